@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/google/nftables"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/netguard"
+)
+
+// main is the entrypoint for the block-direct-access init container
+//
+// It installs nftables rules so the protected ports are only reachable over
+// loopback, reads them back to verify, and exits non-zero on any failure so
+// the pod never starts with the app port exposed.
+//
+// With --validate it runs unprivileged in CNI mode instead, and only checks
+// that the CNI plugin installed the rules before the app starts.
+func main() {
+	klog.InitFlags(nil)
+	var ports, allowCIDRs string
+	var validate bool
+	flag.StringVar(&ports, "ports", "", "comma-separated TCP ports to protect (required unless --validate)")
+	flag.StringVar(&allowCIDRs, "allow-cidrs", "", "comma-separated CIDRs or addresses allowed to reach the ports besides loopback")
+	flag.BoolVar(&validate, "validate", false, "only check that the rules are installed, without NET_ADMIN")
+	flag.Parse()
+
+	if validate {
+		if err := netguard.Check(5 * time.Second); err != nil {
+			klog.ErrorS(err, "direct access is not blocked; the oauth2-proxy CNI plugin did not run for this pod, delete it once the plugin is installed on the node")
+			os.Exit(1)
+		}
+		klog.InfoS("direct access blocked by the CNI plugin")
+		return
+	}
+
+	rules, err := netguard.ParsePorts(ports)
+	if err != nil {
+		klog.ErrorS(err, "invalid arguments")
+		os.Exit(2)
+	}
+	rules.Allowed, err = netguard.ParsePrefixes(allowCIDRs)
+	if err != nil {
+		klog.ErrorS(err, "invalid arguments")
+		os.Exit(2)
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		klog.ErrorS(err, "failed to open netlink connection")
+		os.Exit(1)
+	}
+
+	if err := netguard.Apply(conn, rules); err != nil {
+		klog.ErrorS(err, "failed to apply rules")
+		os.Exit(1)
+	}
+	if err := netguard.Verify(conn, rules); err != nil {
+		klog.ErrorS(err, "failed to verify rules")
+		os.Exit(1)
+	}
+
+	klog.InfoS("direct access blocked", "ports", ports, "allowed", allowCIDRs)
+}
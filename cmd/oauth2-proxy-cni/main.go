@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/version"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/cni"
+)
+
+// main is the entrypoint for the chained CNI plugin and its node installer
+//
+// Invoked by the container runtime it acts as a CNI plugin. Invoked as
+// "oauth2-proxy-cni install" from the DaemonSet it installs itself on the node,
+// keeps the conflist chained, and unchains itself on shutdown.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "install" {
+		runInstaller(os.Args[2:])
+		return
+	}
+
+	plugin := cni.NewPlugin()
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:   plugin.Add,
+		Check: plugin.Check,
+		Del:   plugin.Del,
+	}, version.All, "oauth2-proxy-cni: blocks direct access to oauth2-proxy protected ports")
+}
+
+// runInstaller installs the plugin and re-checks the conflist until SIGTERM
+func runInstaller(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	klog.InitFlags(fs)
+	binDir := fs.String("bin-dir", "/host/opt/cni/bin", "host CNI binary directory as mounted in this container")
+	netDir := fs.String("net-dir", "/host/etc/cni/net.d", "host CNI config directory as mounted in this container")
+	hostNetDir := fs.String("host-net-dir", "/etc/cni/net.d", "CNI config directory path on the host")
+	interval := fs.Duration("interval", time.Minute, "how often to re-check that the plugin is still chained")
+	_ = fs.Parse(args)
+
+	self, err := os.Executable()
+	if err != nil {
+		klog.Fatal("failed to locate own binary: ", err)
+	}
+	installer := &cni.Installer{
+		BinarySource: self,
+		BinDir:       *binDir,
+		NetDir:       *netDir,
+		HostNetDir:   *hostNetDir,
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		// The primary CNI may not have written its config yet, keep retrying
+		if err := installer.Install(); err != nil {
+			klog.ErrorS(err, "install failed")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			klog.Info("uninstalling...")
+			if err := installer.Uninstall(); err != nil {
+				klog.ErrorS(err, "uninstall failed")
+				os.Exit(1)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/nsdefaults"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+	"github.com/spacemule/oauth2-proxy-injector/internal/rules"
+)
+
+// Output formats selected with --output
+const (
+	outputExplain = "explain"
+	outputPatch   = "patch"
+	outputPod     = "pod"
+)
+
+// initImagePlaceholder stands in for an unset --init-image so rendered pods
+// show where the webhook's pinned image would go
+const initImagePlaceholder = "<init-image>"
+
+type cmdConfig struct {
+	podFile          string
+	configMapFiles   string
+	workloadFiles    string
+	rulesFile        string
+	namespaceFile    string
+	namespace        string
+	configNamespace  string
+	defaultConfigMap string
+	initImage        string
+	blockMode        string
+	output           string
+}
+
+// main renders what the webhook would inject into a pod, without a cluster
+//
+// ConfigMaps are read from local manifests, so "why is my cookie-domain wrong"
+// can be answered with --output=explain before anything is deployed.
+func main() {
+	klog.InitFlags(nil)
+	cfg := parseFlags()
+
+	if err := run(cfg, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses command line flags and returns configuration
+func parseFlags() cmdConfig {
+	c := cmdConfig{}
+	flag.StringVar(&c.podFile, "pod", "-", "Pod manifest (YAML or JSON), - for stdin")
+	flag.StringVar(&c.configMapFiles, "configmaps", "", "comma-separated ConfigMap manifests to load instead of the cluster")
+	flag.StringVar(&c.workloadFiles, "workloads", "", "comma-separated owner manifests (ReplicaSet, Deployment, ...) whose annotations pods inherit via ownerReferences")
+	flag.StringVar(&c.rulesFile, "rules", "", "injection rules ConfigMap manifest (optional); its namespace holds rule profiles")
+	flag.StringVar(&c.namespaceFile, "namespace-manifest", "", "the pod's Namespace manifest (optional); its oauth2-proxy annotations apply as defaults")
+	flag.StringVar(&c.namespace, "namespace", "default", "namespace to assume when the Pod manifest has none")
+	flag.StringVar(&c.configNamespace, "config-namespace", "", "namespace of the default ConfigMap")
+	flag.StringVar(&c.defaultConfigMap, "default-config", "", "default configuration ConfigMap (optional)")
+	flag.StringVar(&c.initImage, "init-image", "", "image providing /netguard for the block-direct-access init container")
+	flag.StringVar(&c.blockMode, "block-direct-access-mode", string(mutation.BlockModeInitContainer), "init-container or cni")
+	flag.StringVar(&c.output, "output", outputExplain, "what to print: explain (settings and where they came from), patch (JSON Patch) or pod (mutated Pod)")
+	flag.Parse()
+	if c.initImage == "" {
+		c.initImage = initImagePlaceholder
+	}
+
+	switch c.output {
+	case outputExplain, outputPatch, outputPod:
+	default:
+		klog.Fatalf("invalid --output %q: must be %s, %s or %s", c.output, outputExplain, outputPatch, outputPod)
+	}
+
+	return c
+}
+
+// run builds the same PodMutator as the webhook on top of a fake clientset
+func run(cfg cmdConfig, out io.Writer) error {
+	pod := &corev1.Pod{}
+	podData, err := readManifest(cfg.podFile)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(podData, pod); err != nil {
+		return fmt.Errorf("failed to parse pod %s: %w", cfg.podFile, err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = cfg.namespace
+	}
+
+	client := fake.NewSimpleClientset()
+	for _, f := range strings.Split(cfg.configMapFiles, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if _, err := loadConfigMap(client, f, cfg.namespace); err != nil {
+			return err
+		}
+	}
+
+	scheme := metadatafake.NewTestScheme()
+	if err := metav1.AddMetaToScheme(scheme); err != nil {
+		return err
+	}
+	metadataClient := metadatafake.NewSimpleMetadataClient(scheme)
+	for _, f := range strings.Split(cfg.workloadFiles, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if err := loadWorkload(metadataClient, f, cfg.namespace); err != nil {
+			return err
+		}
+	}
+	owners := owner.NewResolver(metadataClient, 0)
+
+	configNamespace := cfg.configNamespace
+	if configNamespace == "" {
+		configNamespace = cfg.namespace
+	}
+
+	// The webhook reads rules from its config namespace, where profiles live too
+	var ruleMatcher rules.Matcher
+	if cfg.rulesFile != "" {
+		cm, err := loadConfigMap(client, cfg.rulesFile, cfg.namespace)
+		if err != nil {
+			return err
+		}
+		if _, err := rules.Parse(cm.Data[rules.DataKey]); err != nil {
+			return err
+		}
+		ruleMatcher = rules.NewConfigMapMatcher(client, cm.Namespace, cm.Name, 0)
+		if cfg.configNamespace == "" {
+			configNamespace = cm.Namespace
+		}
+	}
+
+	var namespaces nsdefaults.Lister
+	if cfg.namespaceFile != "" {
+		ns := &corev1.Namespace{}
+		data, err := readManifest(cfg.namespaceFile)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(data, ns); err != nil {
+			return fmt.Errorf("failed to parse namespace %s: %w", cfg.namespaceFile, err)
+		}
+		if ns.Name != pod.Namespace {
+			return fmt.Errorf("namespace %s does not match the pod's namespace %s", ns.Name, pod.Namespace)
+		}
+		if err := client.Tracker().Add(ns); err != nil {
+			return err
+		}
+		lister := nsdefaults.NewInformerLister(client, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if err := lister.Start(ctx, time.Minute); err != nil {
+			return err
+		}
+		namespaces = lister
+	}
+
+	blockMode, err := mutation.ParseBlockMode(cfg.blockMode)
+	if err != nil {
+		return err
+	}
+	podMutator := mutation.NewPodMutator(
+		annotation.NewParser(),
+		config.NewLoader(client, configNamespace),
+		mutation.NewSidecarBuilder(),
+		config.NewMerger(),
+		mutation.NewKnativeDetector(),
+		mutation.NewInitContainerBuilder(blockMode, cfg.initImage),
+		blockMode,
+		nil,
+		nil,
+		mutation.NewCookieSecretGenerator(client, owners),
+		owners,
+		true,
+		ruleMatcher,
+		namespaces,
+		cfg.defaultConfigMap,
+		configNamespace,
+	)
+
+	ctx := context.Background()
+	if cfg.output == outputExplain {
+		effectiveCfg, err := podMutator.ResolveConfig(ctx, pod)
+		if err != nil {
+			return err
+		}
+		if effectiveCfg == nil {
+			return fmt.Errorf("injection is not enabled for this pod (set %s: \"true\")", annotation.KeyEnabled)
+		}
+		return writeYAML(out, effectiveCfg.Explain())
+	}
+
+	patches, err := podMutator.Mutate(ctx, pod)
+	if err != nil {
+		return err
+	}
+	patchJSON, err := mutation.MarshalPatches(patches)
+	if err != nil {
+		return err
+	}
+	if cfg.output == outputPatch {
+		_, err = fmt.Fprintln(out, string(patchJSON))
+		return err
+	}
+
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		return err
+	}
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	if err != nil {
+		return err
+	}
+	mutated, err := patch.Apply(podJSON)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch: %w", err)
+	}
+	data, err := yaml.JSONToYAML(mutated)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// loadConfigMap adds a ConfigMap manifest to the fake clientset
+func loadConfigMap(client *fake.Clientset, path, defaultNamespace string) (*corev1.ConfigMap, error) {
+	data, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	cm := &corev1.ConfigMap{}
+	if err := yaml.UnmarshalStrict(data, cm); err != nil {
+		return nil, fmt.Errorf("failed to parse configmap %s: %w", path, err)
+	}
+	if cm.Namespace == "" {
+		cm.Namespace = defaultNamespace
+	}
+	return cm, client.Tracker().Add(cm)
+}
+
+// loadWorkload adds an owner manifest's metadata to the fake metadata client
+func loadWorkload(client *metadatafake.FakeMetadataClient, path, defaultNamespace string) error {
+	data, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	obj := &metav1.PartialObjectMetadata{}
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		return fmt.Errorf("failed to parse workload %s: %w", path, err)
+	}
+	if obj.Namespace == "" {
+		obj.Namespace = defaultNamespace
+	}
+	return client.Tracker().Add(obj)
+}
+
+// readManifest reads a file, or stdin for "-"
+func readManifest(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// writeYAML prints v as YAML
+func writeYAML(out io.Writer, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
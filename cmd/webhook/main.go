@@ -8,29 +8,84 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	"github.com/spacemule/oauth2-proxy-injector/internal/admission"
 	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/audit"
 	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/discovery"
+	"github.com/spacemule/oauth2-proxy-injector/internal/drift"
 	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/nsdefaults"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+	"github.com/spacemule/oauth2-proxy-injector/internal/registration"
+	"github.com/spacemule/oauth2-proxy-injector/internal/rules"
 	"github.com/spacemule/oauth2-proxy-injector/internal/service"
+	"github.com/spacemule/oauth2-proxy-injector/internal/tracing"
 )
 
 type cmdConfig struct {
-	port             int
-	certFile         string
-	keyFile          string
-	configNamespace  string
-	defaultConfigMap string
-	initImage        string
+	port                int
+	certFile            string
+	keyFile             string
+	configNamespace     string
+	defaultConfigMap    string
+	initImage           string
+	blockMode           string
+	mode                string
+	driftInterval       time.Duration
+	driftRestart        bool
+	metricsAddr         string
+	validateRefs        string
+	generateCookies     bool
+	regInterval         time.Duration
+	regTokenFile        string
+	oidcDiscovery       bool
+	oidcDiscoveryTTL    time.Duration
+	workloadAnnotations bool
+	ownerCacheTTL       time.Duration
+	rulesConfigMap      string
+	rulesTTL            time.Duration
+	nsAnnotations       bool
+	auditLog            string
+	auditURL            string
+	otlpEndpoint        string
+	otlpInsecure        bool
+	traceSampleRatio    float64
 }
 
+// Run modes selected with --mode
+const (
+	modeWebhook      = "webhook"
+	modeDrift        = "drift-controller"
+	modeRegistration = "client-registration"
+)
+
+// auditQueueSize is how many audit events wait for --audit-url before being dropped
+const auditQueueSize = 1000
+
+// discoverySyncInterval is how often in-use ConfigMaps are re-validated
+// Discovery documents themselves are cached for --oidc-discovery-ttl.
+const discoverySyncInterval = time.Minute
+
+// namespaceSyncTimeout bounds the namespace informer's initial list at startup
+const namespaceSyncTimeout = 30 * time.Second
+
 // main is the entrypoint for the webhook server
 func main() {
 	klog.InitFlags(nil)
@@ -40,18 +95,94 @@ func main() {
 		klog.Fatal("failed to create kubernetes client: ", err)
 	}
 	parser := annotation.NewParser()
-	loader := config.NewLoader(client, cfg.configNamespace)
+	var loader config.Loader = config.NewLoader(client, cfg.configNamespace)
+	var discoveryLoader *discovery.ValidatingLoader
+	if cfg.oidcDiscovery && cfg.mode == modeWebhook {
+		discoveryLoader = discovery.NewValidatingLoader(loader, discovery.NewValidator(nil, cfg.oidcDiscoveryTTL), createEventRecorder(client))
+		if cfg.defaultConfigMap != "" {
+			discoveryLoader.Track(cfg.defaultConfigMap, cfg.configNamespace)
+		}
+		loader = discoveryLoader
+	}
 	builder := mutation.NewSidecarBuilder()
 	merger := config.NewMerger()
 	knativeDetector := mutation.NewKnativeDetector()
-	initContainerBuilder := mutation.NewIPTablesInitContainerBuilder(cfg.initImage)
-	podMutator := mutation.NewPodMutator(parser, loader, builder, merger, knativeDetector, initContainerBuilder, cfg.defaultConfigMap, cfg.configNamespace)
-	podHandler := admission.NewHandler(podMutator)
+	blockMode, err := mutation.ParseBlockMode(cfg.blockMode)
+	if err != nil {
+		klog.Fatal("invalid --block-direct-access-mode: ", err)
+	}
+	// No default: a floating tag would let the init container drift from the
+	// webhook. Without one only pods with block-direct-access are denied, so an
+	// upgrade that misses the flag doesn't take injection down with it
+	if cfg.initImage == "" {
+		klog.Warning("--init-image is not set; pods with block-direct-access will be denied")
+	}
+	initContainerBuilder := mutation.NewInitContainerBuilder(blockMode, cfg.initImage)
+	// The namespace informer also serves the Pod Security and reference
+	// validation lookups, which otherwise Get the namespace per admission
+	var namespaces nsdefaults.Lister
+	var namespaceLister corelisters.NamespaceLister
+	if cfg.nsAnnotations {
+		lister := nsdefaults.NewInformerLister(client, 0)
+		if err := lister.Start(context.Background(), namespaceSyncTimeout); err != nil {
+			klog.Fatal("failed to start namespace informer: ", err)
+		}
+		namespaces = lister
+		namespaceLister = lister.Namespaces()
+	}
+	podSecurityChecker, err := mutation.NewPodSecurityChecker(client, namespaceLister)
+	if err != nil {
+		klog.Fatal("failed to create pod security checker: ", err)
+	}
+	validateRefs, err := annotation.ParseReferenceValidation(cfg.validateRefs)
+	if err != nil {
+		klog.Fatal("invalid --validate-references: ", err)
+	}
+	dynamicClient, err := createDynamicClient()
+	if err != nil {
+		klog.Fatal("failed to create dynamic client: ", err)
+	}
+	referenceChecker := mutation.NewReferenceChecker(client, namespaceLister, dynamicClient, validateRefs)
+	metadataClient, err := createMetadataClient()
+	if err != nil {
+		klog.Fatal("failed to create metadata client: ", err)
+	}
+	owners := owner.NewResolver(metadataClient, cfg.ownerCacheTTL)
+	var cookieSecretGenerator mutation.CookieSecretGenerator
+	if cfg.generateCookies {
+		cookieSecretGenerator = mutation.NewCookieSecretGenerator(client, owners)
+	}
+	var ruleMatcher rules.Matcher
+	if cfg.rulesConfigMap != "" {
+		ruleMatcher = rules.NewConfigMapMatcher(client, cfg.configNamespace, cfg.rulesConfigMap, cfg.rulesTTL)
+	}
+	podMutator := mutation.NewPodMutator(parser, loader, builder, merger, knativeDetector, initContainerBuilder, blockMode, podSecurityChecker, referenceChecker, cookieSecretGenerator, owners, cfg.workloadAnnotations, ruleMatcher, namespaces, cfg.defaultConfigMap, cfg.configNamespace)
 
-	serviceMutator := service.NewServiceMutator()
+	switch cfg.mode {
+	case modeDrift:
+		controller := drift.NewController(client, podMutator, owners, cfg.driftRestart)
+		runController(cfg, func(ctx context.Context) { controller.Run(ctx, cfg.driftInterval) })
+		return
+	case modeRegistration:
+		controller := registration.NewController(client, podMutator, registration.NewClient(nil, readTokenFile(cfg.regTokenFile)))
+		runController(cfg, func(ctx context.Context) { controller.Run(ctx, cfg.regInterval) })
+		return
+	}
+
+	stopTracing := setupTracing(cfg)
+	auditSink, stopAudit := createAuditSink(cfg)
+	podHandler := admission.NewHandler(podMutator, auditSink)
+
+	serviceMutator := service.NewServiceMutator(client)
 	serviceHandler := service.NewHandler(serviceMutator)
 
-	server, err := setupServer(podHandler, serviceHandler, client, cfg.certFile, cfg.keyFile, cfg.port)
+	var ready func() error
+	if discoveryLoader != nil {
+		go discoveryLoader.Run(context.Background(), discoverySyncInterval)
+		ready = func() error { return discoveryLoader.Ready(cfg.defaultConfigMap, cfg.configNamespace) }
+	}
+
+	server, err := setupServer(podHandler, serviceHandler, client, ready, cfg.certFile, cfg.keyFile, cfg.port)
 	if err != nil {
 		klog.Fatal("failed to create server: ", err)
 	}
@@ -65,6 +196,63 @@ func main() {
 	}()
 
 	gracefulShutdown(server)
+	stopAudit()
+	stopTracing()
+}
+
+// setupTracing exports spans to --otlp-endpoint, if set, and returns a
+// function flushing them on shutdown
+func setupTracing(cfg cmdConfig) func() {
+	if cfg.otlpEndpoint == "" {
+		return func() {}
+	}
+	shutdown, err := tracing.Setup(context.Background(), tracing.Options{
+		Endpoint:    cfg.otlpEndpoint,
+		Insecure:    cfg.otlpInsecure,
+		SampleRatio: cfg.traceSampleRatio,
+	})
+	if err != nil {
+		klog.Fatal("failed to set up tracing: ", err)
+	}
+	klog.InfoS("exporting traces", "endpoint", cfg.otlpEndpoint)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			klog.ErrorS(err, "failed to flush traces")
+		}
+	}
+}
+
+// createAuditSink returns the sink for --audit-log and --audit-url, nil if
+// neither is set, and a function flushing it on shutdown
+func createAuditSink(cfg cmdConfig) (audit.Sink, func()) {
+	var sinks audit.MultiSink
+	stop := func() {}
+	if cfg.auditLog != "" {
+		sink, err := audit.OpenFileSink(cfg.auditLog)
+		if err != nil {
+			klog.Fatal("invalid --audit-log: ", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.auditURL != "" {
+		sink := audit.NewHTTPSink(cfg.auditURL, 10*time.Second, auditQueueSize)
+		ctx, cancel := context.WithCancel(context.Background())
+		go sink.Run(ctx)
+		stop = func() {
+			cancel()
+			<-sink.Done()
+		}
+		sinks = append(sinks, sink)
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, stop
+	case 1:
+		return sinks[0], stop
+	}
+	return sinks, stop
 }
 
 // parseFlags parses command line flags and returns configuration
@@ -75,17 +263,87 @@ func parseFlags() cmdConfig {
 	flag.StringVar(&c.keyFile, "key-file", "", "path to TLS private key")
 	flag.StringVar(&c.configNamespace, "config-namespace", "", "namespace for ConfigMaps")
 	flag.StringVar(&c.defaultConfigMap, "default-config", "", "default configuration ConfigMap (optional)")
-	flag.StringVar(&c.initImage, "init-image", "ghcr.io/kube-vip/kube-vip-iptables:v1.0.1", "iptables init container image")
+	flag.StringVar(&c.initImage, "init-image", "", "image providing /netguard for the block-direct-access init container, or the validation container in CNI mode, pinned to a tag or digest (required for block-direct-access)")
+
+	flag.StringVar(&c.blockMode, "block-direct-access-mode", string(mutation.BlockModeInitContainer), "how block-direct-access rules are installed: init-container or cni (requires the oauth2-proxy CNI plugin on every node)")
+
+	flag.StringVar(&c.validateRefs, "validate-references", string(annotation.ReferenceValidationOff), "check referenced Secrets, keys and SecretProviderClasses at admission: off, warn or deny (overridable per namespace and pod)")
+	flag.BoolVar(&c.generateCookies, "generate-cookie-secrets", false, "create a per-workload cookie Secret for pods with cookie-secret-ref: generate (requires create on Secrets)")
+	flag.BoolVar(&c.oidcDiscovery, "validate-oidc-discovery", false, "check in-use ConfigMaps against their issuer's /.well-known/openid-configuration in the background; failures are reported as metrics and Events, and fail /readyz for the default ConfigMap")
+	flag.DurationVar(&c.oidcDiscoveryTTL, "oidc-discovery-ttl", 10*time.Minute, "how long fetched discovery documents are cached")
+	flag.BoolVar(&c.workloadAnnotations, "workload-annotations", false, "apply oauth2-proxy annotations set on a pod's Deployment, StatefulSet, DaemonSet, Job or Knative Service beneath the pod's own (requires get on those resources)")
+	flag.DurationVar(&c.ownerCacheTTL, "owner-cache-ttl", 30*time.Second, "how long pod owners are cached; annotation changes on a workload are seen after at most this long")
+	flag.StringVar(&c.rulesConfigMap, "rules-configmap", "", "ConfigMap in --config-namespace holding label-selector injection rules (optional)")
+	flag.DurationVar(&c.rulesTTL, "rules-ttl", 30*time.Second, "how long injection rules and namespace labels are cached")
+	flag.BoolVar(&c.nsAnnotations, "namespace-annotations", false, "apply oauth2-proxy annotations set on a pod's Namespace beneath rules and the workload's and pod's own; also serves Pod Security and reference validation namespace reads from the informer (requires list and watch on namespaces)")
+	flag.StringVar(&c.mode, "mode", modeWebhook, "run mode: webhook, drift-controller or client-registration")
+	flag.DurationVar(&c.driftInterval, "drift-interval", 5*time.Minute, "how often the drift controller checks injected pods")
+	flag.BoolVar(&c.driftRestart, "drift-restart", false, "rollout restart Deployments and StatefulSets whose sidecars have drifted")
+	flag.StringVar(&c.metricsAddr, "metrics-addr", ":9090", "address controller modes serve /metrics on")
+	flag.DurationVar(&c.regInterval, "registration-interval", time.Minute, "how often the client-registration controller looks for unregistered workloads")
+	flag.StringVar(&c.regTokenFile, "registration-token-file", "", "file holding an initial access token for the issuer's registration endpoint (optional)")
+	flag.StringVar(&c.auditLog, "audit-log", "", "file to append admission decisions to as JSON lines, \"-\" for stdout (optional)")
+	flag.StringVar(&c.auditURL, "audit-url", "", "URL admission decisions are POSTed to as JSON lines in the background (optional)")
+	flag.StringVar(&c.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector host:port to export admission traces to, e.g. localhost:4318 (tracing is disabled if empty)")
+	flag.BoolVar(&c.otlpInsecure, "otlp-insecure", true, "export traces over plain HTTP instead of HTTPS")
+	flag.Float64Var(&c.traceSampleRatio, "trace-sample-ratio", 1, "fraction of admissions traced when the apiserver didn't sample the request itself")
 
 	flag.Parse()
 
-	if c.certFile == "" || c.keyFile == "" {
-		klog.Fatal("--cert-file and --key-file are required")
+	switch c.mode {
+	case modeWebhook:
+		if c.certFile == "" || c.keyFile == "" {
+			klog.Fatal("--cert-file and --key-file are required")
+		}
+	case modeDrift, modeRegistration:
+	default:
+		klog.Fatalf("invalid --mode %q: must be %s, %s or %s", c.mode, modeWebhook, modeDrift, modeRegistration)
 	}
 
 	return c
 }
 
+// runController serves metrics and runs a controller loop until SIGTERM/SIGINT
+func runController(cfg cmdConfig, run func(ctx context.Context)) {
+	m := http.NewServeMux()
+	m.Handle("/metrics", promhttp.Handler())
+	m.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{
+		Addr:         cfg.metricsAddr,
+		Handler:      m,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		klog.InfoS("starting metrics server", "addr", cfg.metricsAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			klog.ErrorS(err, "metrics server error")
+			os.Exit(1)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go run(ctx)
+
+	gracefulShutdown(server)
+}
+
+// readTokenFile returns the trimmed contents of path, or "" if path is empty
+func readTokenFile(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		klog.Fatal("failed to read token file: ", err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
 // createKubernetesClient creates an in-cluster Kubernetes clientset
 func createKubernetesClient() (kubernetes.Interface, error) {
 	cfg, err := rest.InClusterConfig()
@@ -100,10 +358,38 @@ func createKubernetesClient() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
+// createDynamicClient creates an in-cluster dynamic client for CRDs like SecretProviderClass
+func createDynamicClient() (dynamic.Interface, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(cfg)
+}
+
+// createMetadataClient creates a metadata-only client for reading pod owners
+func createMetadataClient() (metadata.Interface, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata.NewForConfig(cfg)
+}
+
+// createEventRecorder creates an EventRecorder that writes Events through client
+func createEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "oauth2-proxy-injector"})
+}
+
 // setupServer creates and configures the HTTPS server
+// ready may be nil; otherwise /readyz also fails while it returns an error.
 //
 // TODO: Update signature to accept both handlers
-func setupServer(podHandler *admission.Handler, serviceHandler *service.Handler, client kubernetes.Interface, certFile, keyFile string, port int) (*http.Server, error) {
+func setupServer(podHandler *admission.Handler, serviceHandler *service.Handler, client kubernetes.Interface, ready func() error, certFile, keyFile string, port int) (*http.Server, error) {
 	m := http.NewServeMux()
 
 	m.HandleFunc("/mutate", podHandler.HandleAdmission)
@@ -120,6 +406,12 @@ func setupServer(podHandler *admission.Handler, serviceHandler *service.Handler,
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
+		if ready != nil {
+			if err := ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 	})
 
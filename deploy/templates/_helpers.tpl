@@ -67,3 +67,48 @@ Create the certificate secret name
 {{- define "oauth2-proxy-injector.certificateSecretName" -}}
 {{- printf "%s-tls" (include "oauth2-proxy-injector.fullname" .) }}
 {{- end }}
+
+{{/*
+CNI DaemonSet selector labels
+Distinct name so the webhook Service never selects CNI installer pods
+*/}}
+{{- define "oauth2-proxy-injector.cniSelectorLabels" -}}
+app.kubernetes.io/name: {{ include "oauth2-proxy-injector.name" . }}-cni
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+
+{{/*
+Drift controller selector labels
+Distinct name so the webhook Service never selects drift controller pods
+*/}}
+{{- define "oauth2-proxy-injector.driftSelectorLabels" -}}
+app.kubernetes.io/name: {{ include "oauth2-proxy-injector.name" . }}-drift
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+
+{{/*
+Client registration controller selector labels
+*/}}
+{{- define "oauth2-proxy-injector.clientRegistrationSelectorLabels" -}}
+app.kubernetes.io/name: {{ include "oauth2-proxy-injector.name" . }}-client-registration
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+
+{{/*
+Init container image: initContainer.image, else this chart's image at its tag
+Fails the render rather than the pods: the webhook has no default, and a
+floating tag would let /netguard drift from the webhook
+*/}}
+{{- define "oauth2-proxy-injector.initImage" -}}
+{{- $image := .Values.initContainer.image | default (printf "%s:%s" .Values.image.repository (.Values.image.tag | default .Chart.AppVersion)) -}}
+{{- if or (hasPrefix ":" $image) (hasPrefix "@" $image) -}}
+{{- fail "image.repository or initContainer.image must be set" -}}
+{{- end -}}
+{{- if not (or (contains "@" $image) (regexMatch ":[^/:]+$" $image)) -}}
+{{- fail (printf "init container image %q must be pinned to a tag or digest" $image) -}}
+{{- end -}}
+{{- if hasSuffix ":latest" $image -}}
+{{- fail (printf "init container image %q must be pinned to a tag other than latest" $image) -}}
+{{- end -}}
+{{- $image -}}
+{{- end }}
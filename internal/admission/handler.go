@@ -6,14 +6,19 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 
+	"github.com/spacemule/oauth2-proxy-injector/internal/audit"
 	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/tracing"
 )
 
 // ContentTypeJSON is the expected Content-Type for admission reviews
@@ -22,12 +27,15 @@ const ContentTypeJSON = "application/json"
 // Handler handles Kubernetes admission webhook requests
 type Handler struct {
 	mutator mutation.Mutator
+	audit   audit.Sink
 }
 
 // NewHandler creates a new admission Handler
-func NewHandler(mutator mutation.Mutator) *Handler {
+// auditSink records every decision and may be nil
+func NewHandler(mutator mutation.Mutator, auditSink audit.Sink) *Handler {
 	return &Handler{
 		mutator: mutator,
+		audit:   auditSink,
 	}
 }
 
@@ -62,19 +70,37 @@ func (h *Handler) HandleAdmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := h.handleAdmissionRequest(r.Context(), review.Request)
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "HandleAdmission")
+	defer span.End()
+	resp := h.handleAdmissionRequest(ctx, review.Request)
 	review.Response = resp
 	writeAdmissionReview(w, &review)
 }
 
 // handleAdmissionRequest processes a single admission request
-func (h *Handler) handleAdmissionRequest(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+func (h *Handler) handleAdmissionRequest(ctx context.Context, request *admissionv1.AdmissionRequest) (resp *admissionv1.AdmissionResponse) {
 	pod := &corev1.Pod{}
 
 	if request.UID == "" {
 		return denied("", "UID not set")
 	}
 
+	start := time.Now()
+	review := &mutation.Review{DryRun: request.DryRun != nil && *request.DryRun}
+	var patchOps int
+	mutated := false
+	defer func() {
+		result := outcome(resp, mutated, patchOps)
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("admission.uid", string(request.UID)),
+			attribute.String("admission.namespace", request.Namespace),
+			attribute.String("admission.generate_name", pod.GenerateName),
+			attribute.String("admission.outcome", result),
+			attribute.Int("admission.patch_ops", patchOps),
+		)
+		h.record(request, pod, review, resp, result, patchOps, time.Since(start))
+	}()
+
 	if request.Kind.Group != "" || request.Kind.Version != "v1" || request.Kind.Kind != "Pod" {
 		return allowed(string(request.UID))
 	}
@@ -87,18 +113,28 @@ func (h *Handler) handleAdmissionRequest(ctx context.Context, request *admission
 		return allowed(string(request.UID))
 	}
 
+	// Namespace is often unset on CREATE (generateName, namespace from the request)
+	if pod.Namespace == "" {
+		pod.Namespace = request.Namespace
+	}
+
 	klog.InfoS("processing admission request",
+		"uid", request.UID,
 		"pod", pod.Name,
+		"generateName", pod.GenerateName,
 		"namespace", request.Namespace,
 		"operation", request.Operation,
 	)
 
-	patches, err := h.mutator.Mutate(ctx, pod)
+	mutated = true
+	patches, err := h.mutator.Mutate(mutation.WithReview(ctx, review), pod)
 	if err != nil {
+		klog.InfoS("denied admission request", "uid", request.UID, "reason", err.Error())
 		return denied(string(request.UID), err.Error())
 	}
+	patchOps = len(patches)
 	if len(patches) == 0 {
-		return allowed(string(request.UID))
+		return withWarnings(allowed(string(request.UID)), review.Warnings)
 	}
 
 	jsonPatches, err := json.Marshal(patches)
@@ -106,8 +142,52 @@ func (h *Handler) handleAdmissionRequest(ctx context.Context, request *admission
 		return denied(string(request.UID), err.Error())
 	}
 
-	return patchResponse(string(request.UID), jsonPatches)
+	return withWarnings(patchResponse(string(request.UID), jsonPatches), review.Warnings)
+
+}
+
+// outcome classifies a response as an audit.Outcome* value
+// mutated is false for requests returned before the mutator ran
+func outcome(resp *admissionv1.AdmissionResponse, mutated bool, patchOps int) string {
+	switch {
+	case !resp.Allowed:
+		return audit.OutcomeDenied
+	case !mutated:
+		return audit.OutcomeSkipped
+	case patchOps > 0:
+		return audit.OutcomePatched
+	}
+	return audit.OutcomeAllowed
+}
 
+// record sends the decision to the audit sink, if one is set
+func (h *Handler) record(request *admissionv1.AdmissionRequest, pod *corev1.Pod, review *mutation.Review, resp *admissionv1.AdmissionResponse, result string, patchOps int, latency time.Duration) {
+	if h.audit == nil {
+		return
+	}
+	event := audit.Event{
+		Time:         time.Now().UTC(),
+		UID:          string(request.UID),
+		Kind:         request.Kind.Kind,
+		Operation:    string(request.Operation),
+		Namespace:    request.Namespace,
+		Name:         pod.Name,
+		GenerateName: pod.GenerateName,
+		DryRun:       review.DryRun,
+		ConfigMap:    review.ConfigMap,
+		Annotations:  audit.Redact(review.Annotations),
+		Outcome:      result,
+		PatchOps:     patchOps,
+		Warnings:     review.Warnings,
+		LatencyMS:    float64(latency.Microseconds()) / 1000,
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		event.Owner = owner.Kind + "/" + owner.Name
+	}
+	if !resp.Allowed && resp.Result != nil {
+		event.Reason = resp.Result.Message
+	}
+	h.audit.Record(event)
 }
 
 // allowed returns an AdmissionResponse allowing the request
@@ -140,6 +220,12 @@ func patchResponse(uid string, patch []byte) *admissionv1.AdmissionResponse {
 	}
 }
 
+// withWarnings attaches warnings to be shown to the API client (e.g. kubectl)
+func withWarnings(resp *admissionv1.AdmissionResponse, warnings []string) *admissionv1.AdmissionResponse {
+	resp.Warnings = warnings
+	return resp
+}
+
 // writeAdmissionReview writes an AdmissionReview response
 func writeAdmissionReview(w http.ResponseWriter, review *admissionv1.AdmissionReview) {
 	body, err := json.Marshal(review)
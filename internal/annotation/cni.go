@@ -0,0 +1,34 @@
+package annotation
+
+// Annotations shared between the webhook, the chained oauth2-proxy CNI plugin
+// and the drift controller in CNI block mode. They are written by the webhook
+// and the plugin, never by users, so they aren't part of ConfigOverrides.
+const (
+	// CNIBlockedPortsAnnotation lists the ports the oauth2-proxy CNI plugin must block
+	// Set by the webhook instead of adding an init container when running in CNI mode
+	// Value: comma-separated ports, e.g. "8080"
+	CNIBlockedPortsAnnotation = AnnotationPrefix + "cni-blocked-ports"
+
+	// CNIAllowedCIDRsAnnotation lists extra source CIDRs the CNI plugin lets through
+	// Value: comma-separated CIDRs, e.g. "10.42.0.0/16"
+	CNIAllowedCIDRsAnnotation = AnnotationPrefix + "cni-allowed-cidrs"
+
+	// CNIAllowNodeAnnotation tells the CNI plugin to let the node's InternalIPs through
+	// Value: "true"
+	CNIAllowNodeAnnotation = AnnotationPrefix + "cni-allow-node"
+
+	// CNIGuardedPortsAnnotation is stamped by the CNI plugin once the rules are
+	// installed and verified in the pod's netns, so the drift controller can
+	// spot pods whose sandbox was set up without the plugin in the chain
+	// Value: the CNIBlockedPortsAnnotation value the rules were built from
+	CNIGuardedPortsAnnotation = AnnotationPrefix + "cni-guarded-ports"
+)
+
+// CNIAnnotations lists every CNI mode annotation, so the webhook can drop
+// values a pod inherits from its template that its config doesn't call for
+var CNIAnnotations = []string{
+	CNIBlockedPortsAnnotation,
+	CNIAllowedCIDRsAnnotation,
+	CNIAllowNodeAnnotation,
+	CNIGuardedPortsAnnotation,
+}
@@ -2,8 +2,12 @@ package annotation
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 // Annotation key constants - all under the spacemule.net domain
@@ -17,6 +21,9 @@ import (
 // - Header Overrides: Per-service token passing
 // - Behavior Overrides: Per-service UX settings
 const (
+	// SourceAnnotation is the provenance recorded for settings read from pod annotations
+	SourceAnnotation = "annotation"
+
 	// AnnotationPrefix is the base prefix for all oauth2-proxy annotations
 	AnnotationPrefix = "spacemule.net/oauth2-proxy."
 
@@ -31,6 +38,12 @@ const (
 	// If not set, uses the default ConfigMap configured in the webhook
 	KeyConfig = AnnotationPrefix + "config"
 
+	// KeySpec sets any of the other annotations in a single JSON or YAML document
+	// Value: object keyed by annotation name without the prefix, e.g.
+	//   {"enabled": true, "protected-port": "http", "allowed-groups": ["ops", "dev"]}
+	// Individual annotations on the same object win over the spec's fields
+	KeySpec = AnnotationPrefix + "spec"
+
 	// KeyInjected is set by the webhook after injection to prevent double-injection
 	// Value: "true" (set automatically, do not set manually)
 	KeyInjected = AnnotationPrefix + "injected"
@@ -41,6 +54,37 @@ const (
 	// Value: "true" or "false" (default)
 	KeyBlockDirectAccess = AnnotationPrefix + "block-direct-access"
 
+	// KeyBlockAllowKubelet lets the node IP (status.hostIP, or the node's InternalIPs
+	// in CNI mode) reach the protected port directly
+	// Kubelet probes only come from that address on CNIs that route node traffic
+	// into the pod network; bridge/overlay CNIs may use the gateway IP instead.
+	// Value: "true" or "false" (default)
+	KeyBlockAllowKubelet = AnnotationPrefix + "block-direct-access-allow-kubelet"
+
+	// KeyBlockDirectProbes leaves probes pointing at the app instead of rerouting
+	// them through oauth2-proxy, so their paths don't need to be added to ignore-paths
+	// Only safe when the probe source is allowlisted, so it requires allow-kubelet
+	// or allow-cidrs. Istio's pilot-agent probes are still rerouted.
+	// Value: "true" or "false" (default)
+	KeyBlockDirectProbes = AnnotationPrefix + "block-direct-access-direct-probes"
+
+	// KeyBlockAllowCIDRs lists extra source ranges allowed to reach the protected port
+	// Value: comma-separated CIDRs (e.g., "10.42.0.0/16,fd00::/64")
+	// Use case: letting a Prometheus scraper hit /metrics without skip-auth routes
+	KeyBlockAllowCIDRs = AnnotationPrefix + "block-direct-access-allow-cidrs"
+
+	// KeyClientRegistration selects how the OAuth client is provisioned
+	// Value: "static" (default, client-id/client-secret-ref as configured) or
+	// "dynamic" (the client-registration controller registers a client per
+	// workload via RFC 7591 and the sidecar reads it from a generated Secret)
+	KeyClientRegistration = AnnotationPrefix + "client-registration"
+
+	// KeyValidateReferences checks that referenced Secrets, Secret keys and the
+	// SecretProviderClass exist at admission time
+	// Value: "off", "warn" (admission warning) or "deny" (reject the pod)
+	// Default: the namespace's annotation of the same name, then --validate-references
+	KeyValidateReferences = AnnotationPrefix + "validate-references"
+
 	// ===== Port/Routing Annotations (annotation-only) =====
 
 	// KeyProtectedPort specifies which container port should be protected
@@ -68,6 +112,22 @@ const (
 	// Value: "http" (default), "https", or "https-insecure"
 	KeyUpstreamTLS = AnnotationPrefix + "upstream-tls"
 
+	// KeyIPFamily overrides the IP family used for the localhost upstream
+	// Value: "auto" (default, upstream is localhost, which resolves to both
+	// 127.0.0.1 and ::1), "ipv4" (127.0.0.1) or "ipv6" ([::1])
+	// Use case: pinning one family when the app's TLS certificate or a mesh needs it
+	KeyIPFamily = AnnotationPrefix + "ip-family"
+
+	// KeyProxyPort overrides the port oauth2-proxy listens on
+	// Value: port number (default "4180")
+	// Use case: apps that already use 4180, or Knative's USER_PORT
+	KeyProxyPort = AnnotationPrefix + "proxy-port"
+
+	// KeyMesh selects how block-direct-access coexists with a service mesh sidecar
+	// Value: "auto" (default, detect Istio or Linkerd), "istio", "linkerd" or "none"
+	// Use case: forcing the mode when the mesh injects its sidecar after this webhook
+	KeyMesh = AnnotationPrefix + "mesh"
+
 	// ===== Identity Overrides (override ConfigMap values) =====
 
 	// KeyClientID overrides the OAuth2 client ID from ConfigMap
@@ -181,6 +241,83 @@ const (
 	// Supports: "fromEnv" to read from OAUTH2_PROXY_PROMPT environment variable
 	KeyPrompt = AnnotationPrefix + "prompt"
 
+	// KeyProviders selects a named provider block from the ConfigMap's providers key
+	// Value: the provider ID; oauth2-proxy supports one provider per pod
+	// Default: the ConfigMap's only block
+	KeyProviders = AnnotationPrefix + "providers"
+
+	// ===== Sign-in Page Overrides =====
+
+	// KeyCustomTemplatesConfigMap names a ConfigMap in the pod's namespace whose
+	// keys (sign_in.html, error.html, logos) are mounted as --custom-templates-dir
+	// Plain value, no "fromEnv": the volume is created at injection time
+	KeyCustomTemplatesConfigMap = AnnotationPrefix + "custom-templates-configmap"
+
+	// KeyBanner sets the sign-in page banner (HTML allowed, "-" hides it)
+	// Supports: "fromEnv" to read from OAUTH2_PROXY_BANNER environment variable
+	KeyBanner = AnnotationPrefix + "banner"
+
+	// KeyFooter sets the sign-in page footer (HTML allowed, "-" hides it)
+	// Supports: "fromEnv" to read from OAUTH2_PROXY_FOOTER environment variable
+	KeyFooter = AnnotationPrefix + "footer"
+
+	// KeyCustomSignInLogo sets the sign-in page logo
+	// Value: an https:// URL, a key of the custom templates ConfigMap, an
+	// absolute path in the sidecar, or "-" to hide the logo
+	// Supports: "fromEnv" to read from OAUTH2_PROXY_CUSTOM_SIGN_IN_LOGO environment variable
+	KeyCustomSignInLogo = AnnotationPrefix + "custom-sign-in-logo"
+
+	// ===== Provider-Specific Overrides =====
+	// Only valid with the matching provider; see config.providerSettingKeys
+
+	// KeyGitHubOrg restricts logins to members of a GitHub organisation
+	// Value: organisation name
+	KeyGitHubOrg = AnnotationPrefix + "github-org"
+
+	// KeyGitHubTeams restricts logins to members of GitHub teams
+	// Value: comma-separated team slugs, or "org:team" without github-org
+	KeyGitHubTeams = AnnotationPrefix + "github-team"
+
+	// KeyGitHubRepo restricts logins to collaborators of a GitHub repository
+	// Value: "owner/repo"
+	KeyGitHubRepo = AnnotationPrefix + "github-repo"
+
+	// KeyGitHubUsers allows specific GitHub users
+	// Value: comma-separated usernames
+	KeyGitHubUsers = AnnotationPrefix + "github-user"
+
+	// KeyGitLabGroups restricts logins to members of GitLab groups
+	// Value: comma-separated group paths
+	KeyGitLabGroups = AnnotationPrefix + "gitlab-group"
+
+	// KeyGitLabProjects restricts logins to members of GitLab projects
+	// Value: comma-separated "group/project" or "group/project=accesslevel"
+	KeyGitLabProjects = AnnotationPrefix + "gitlab-project"
+
+	// KeyGoogleGroups restricts logins to members of Google groups
+	// Value: comma-separated group emails
+	// Requires google-admin-email and a service account (or application default credentials)
+	KeyGoogleGroups = AnnotationPrefix + "google-group"
+
+	// KeyGoogleAdminEmail is the Google admin to impersonate for group lookups
+	KeyGoogleAdminEmail = AnnotationPrefix + "google-admin-email"
+
+	// KeyGoogleServiceAccountJSON is the path to the service account JSON key in the sidecar
+	// Value: file path, e.g. under the secret-provider-class mount
+	KeyGoogleServiceAccountJSON = AnnotationPrefix + "google-service-account-json"
+
+	// KeyGoogleUseApplicationDefaultCredentials uses workload identity instead of a key file
+	// Value: "true" or "false"
+	KeyGoogleUseApplicationDefaultCredentials = AnnotationPrefix + "google-use-application-default-credentials"
+
+	// KeyAzureTenant is the Azure AD tenant for the azure provider
+	// Value: tenant ID or domain (oauth2-proxy default: "common")
+	KeyAzureTenant = AnnotationPrefix + "azure-tenant"
+
+	// KeyKeycloakGroups restricts logins to members of Keycloak groups
+	// Value: comma-separated group paths (e.g., "/admins")
+	KeyKeycloakGroups = AnnotationPrefix + "keycloak-group"
+
 	// ===== Cookie Overrides =====
 
 	// KeyCookieSecure overrides the cookie secure flag from ConfigMap
@@ -195,6 +332,35 @@ const (
 	// Use case: Testing new versions, using custom builds
 	KeyProxyImage = AnnotationPrefix + "proxy-image"
 
+	// KeyProxyCPURequest overrides the sidecar's CPU request
+	// Value: Kubernetes quantity (e.g., "10m")
+	// Bounded by the ConfigMap's proxy-max-cpu
+	KeyProxyCPURequest = AnnotationPrefix + "proxy-cpu-request"
+
+	// KeyProxyCPULimit overrides the sidecar's CPU limit
+	// Value: Kubernetes quantity (e.g., "100m")
+	// Bounded by the ConfigMap's proxy-max-cpu
+	KeyProxyCPULimit = AnnotationPrefix + "proxy-cpu-limit"
+
+	// KeyProxyMemoryRequest overrides the sidecar's memory request
+	// Value: Kubernetes quantity (e.g., "32Mi")
+	// Bounded by the ConfigMap's proxy-max-memory
+	KeyProxyMemoryRequest = AnnotationPrefix + "proxy-memory-request"
+
+	// KeyProxyMemoryLimit overrides the sidecar's memory limit
+	// Value: Kubernetes quantity (e.g., "128Mi")
+	// Bounded by the ConfigMap's proxy-max-memory
+	KeyProxyMemoryLimit = AnnotationPrefix + "proxy-memory-limit"
+
+	// KeyProxyImagePullPolicy overrides the sidecar's imagePullPolicy
+	// Value: "Always", "IfNotPresent", or "Never"
+	KeyProxyImagePullPolicy = AnnotationPrefix + "proxy-image-pull-policy"
+
+	// KeyProxyImagePullSecrets overrides the Secrets used to pull the proxy image
+	// Value: comma-separated Secret names in the pod's namespace
+	// Added to the pod's imagePullSecrets (pull secrets are pod-wide in Kubernetes)
+	KeyProxyImagePullSecrets = AnnotationPrefix + "proxy-image-pull-secrets"
+
 	// KeyPingPath overrides the oauth2-proxy ping/healthz endpoint path
 	// Value: path (e.g., "/oauth2/ping")
 	// Default: "/ping" (oauth2-proxy default)
@@ -303,6 +469,156 @@ const (
 	UpstreamNoTLS UpstreamTLSMode = "http"
 )
 
+// ParseQuantity parses a Kubernetes resource quantity (e.g., "100m", "64Mi")
+func ParseQuantity(value string) (resource.Quantity, error) {
+	q, err := resource.ParseQuantity(strings.TrimSpace(value))
+	if err != nil {
+		return q, fmt.Errorf("invalid quantity %q: %w", value, err)
+	}
+	if q.Sign() < 0 {
+		return q, fmt.Errorf("invalid quantity %q: must not be negative", value)
+	}
+	return q, nil
+}
+
+// ParsePullPolicy validates an imagePullPolicy string
+func ParsePullPolicy(value string) (corev1.PullPolicy, error) {
+	switch p := corev1.PullPolicy(strings.TrimSpace(value)); p {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid image pull policy %q (must be %s, %s, or %s)", value, corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever)
+	}
+}
+
+// Mesh identifies the service mesh whose sidecar shares the pod
+type Mesh string
+
+const (
+	// MeshAuto detects the mesh from the pod's containers and annotations (default)
+	MeshAuto Mesh = "auto"
+
+	// MeshIstio adapts to istio-proxy and istio-init
+	MeshIstio Mesh = "istio"
+
+	// MeshLinkerd adapts to linkerd-proxy and linkerd-init
+	MeshLinkerd Mesh = "linkerd"
+
+	// MeshNone disables mesh handling
+	MeshNone Mesh = "none"
+)
+
+// ParseMesh validates a mesh string
+func ParseMesh(value string) (Mesh, error) {
+	switch m := Mesh(strings.ToLower(strings.TrimSpace(value))); m {
+	case MeshAuto, MeshIstio, MeshLinkerd, MeshNone:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid mesh value: %q (must be %s, %s, %s or %s)", value, MeshAuto, MeshIstio, MeshLinkerd, MeshNone)
+	}
+}
+
+// ParsePort validates a port number string
+func ParsePort(value string) (int32, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q (must be 1-65535)", value)
+	}
+	return int32(port), nil
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs
+// Returns the CIDRs in canonical form (e.g., "10.1.2.3/8" -> "10.0.0.0/8")
+func ParseCIDRs(value string) ([]string, error) {
+	ret := []string{}
+	for _, c := range strings.Split(value, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", c, err)
+		}
+		ret = append(ret, ipNet.String())
+	}
+	return ret, nil
+}
+
+// ClientRegistration selects how the OAuth client is provisioned
+type ClientRegistration string
+
+const (
+	// ClientRegistrationStatic uses the configured client-id and client secret
+	ClientRegistrationStatic ClientRegistration = "static"
+
+	// ClientRegistrationDynamic registers a client per workload at the issuer
+	ClientRegistrationDynamic ClientRegistration = "dynamic"
+)
+
+// ParseClientRegistration validates a client registration mode string
+func ParseClientRegistration(value string) (ClientRegistration, error) {
+	switch m := ClientRegistration(strings.ToLower(strings.TrimSpace(value))); m {
+	case ClientRegistrationStatic, ClientRegistrationDynamic:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid client-registration value: %q (must be %s or %s)", value, ClientRegistrationStatic, ClientRegistrationDynamic)
+	}
+}
+
+// ReferenceValidation controls what happens when referenced Secrets are missing
+type ReferenceValidation string
+
+const (
+	// ReferenceValidationOff skips reference checks
+	ReferenceValidationOff ReferenceValidation = "off"
+
+	// ReferenceValidationWarn admits the pod with an admission warning
+	ReferenceValidationWarn ReferenceValidation = "warn"
+
+	// ReferenceValidationDeny rejects the pod
+	ReferenceValidationDeny ReferenceValidation = "deny"
+)
+
+// ParseReferenceValidation validates a reference validation mode string
+func ParseReferenceValidation(value string) (ReferenceValidation, error) {
+	switch m := ReferenceValidation(strings.ToLower(strings.TrimSpace(value))); m {
+	case ReferenceValidationOff, ReferenceValidationWarn, ReferenceValidationDeny:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid validate-references value: %q (must be %s, %s, or %s)", value, ReferenceValidationOff, ReferenceValidationWarn, ReferenceValidationDeny)
+	}
+}
+
+// IPFamily represents the IP family oauth2-proxy uses to reach the app over loopback
+type IPFamily string
+
+const (
+	// IPFamilyAuto uses localhost for the upstream (default), so oauth2-proxy
+	// reaches apps bound to either loopback address on single and dual-stack pods
+	IPFamilyAuto IPFamily = "auto"
+
+	// IPFamilyIPv4 uses 127.0.0.1 for the upstream
+	IPFamilyIPv4 IPFamily = "ipv4"
+
+	// IPFamilyIPv6 uses ::1 for the upstream
+	IPFamilyIPv6 IPFamily = "ipv6"
+)
+
+// ParseIPFamily validates an IP family string
+func ParseIPFamily(value string) (IPFamily, error) {
+	switch IPFamily(strings.ToLower(strings.TrimSpace(value))) {
+	case IPFamilyAuto:
+		return IPFamilyAuto, nil
+	case IPFamilyIPv4:
+		return IPFamilyIPv4, nil
+	case IPFamilyIPv6:
+		return IPFamilyIPv6, nil
+	default:
+		return "", fmt.Errorf("invalid ip-family value: %q (must be %s, %s or %s)", value, IPFamilyAuto, IPFamilyIPv4, IPFamilyIPv6)
+	}
+}
+
 // ValueSourceType represents how a configuration value should be resolved
 type ValueSourceType string
 
@@ -531,6 +847,13 @@ type Config struct {
 	// UpstreamTLS is the TLS mode for upstream connections
 	UpstreamTLS UpstreamTLSMode
 
+	// ClientRegistration is "dynamic" when the client comes from RFC 7591 registration
+	ClientRegistration ClientRegistration
+
+	// ValidateReferences overrides the namespace/webhook reference validation mode
+	// Empty means not set on the pod
+	ValidateReferences ReferenceValidation
+
 	// PingPath is the path for oauth2-proxy's ping/healthz endpoint
 	PingPath string
 
@@ -543,6 +866,11 @@ type Config struct {
 
 	// Overrides contains all the fields that can override ConfigMap values
 	Overrides ConfigOverrides
+
+	// Sources maps each setting present in the annotations (key without
+	// AnnotationPrefix, e.g. "cookie-domains") to where it was set
+	// Used for provenance in the effective-config annotation
+	Sources map[string]string
 }
 
 // ConfigOverrides holds annotation values that override ConfigMap settings
@@ -572,6 +900,25 @@ type ConfigOverrides struct {
 	// ValidateURL overrides the validate-url
 	ValidateURL ValueSource
 
+	// Providers selects provider blocks by ID, nil when unset
+	// Does not support fromEnv
+	Providers []string
+
+	// ===== Provider-Specific Overrides =====
+
+	GitHubOrg                              ValueSource
+	GitHubTeams                            StringSliceValueSource
+	GitHubRepo                             ValueSource
+	GitHubUsers                            StringSliceValueSource
+	GitLabGroups                           StringSliceValueSource
+	GitLabProjects                         StringSliceValueSource
+	GoogleGroups                           StringSliceValueSource
+	GoogleAdminEmail                       ValueSource
+	GoogleServiceAccountJSON               ValueSource
+	GoogleUseApplicationDefaultCredentials BoolValueSource
+	AzureTenant                            ValueSource
+	KeycloakGroups                         StringSliceValueSource
+
 	// ===== Identity Overrides =====
 
 	// ClientID overrides the OAuth2 client ID
@@ -654,12 +1001,61 @@ type ConfigOverrides struct {
 	// When set, approval-prompt is ignored by oauth2-proxy
 	Prompt ValueSource
 
+	// ===== Sign-in Page Overrides =====
+
+	// CustomTemplatesConfigMap overrides custom-templates-configmap. nil means not set
+	CustomTemplatesConfigMap *string
+
+	// Banner, Footer and CustomSignInLogo override the sign-in page branding
+	Banner           ValueSource
+	Footer           ValueSource
+	CustomSignInLogo ValueSource
+
 	// ===== Container Overrides =====
 
 	// ProxyImage overrides the oauth2-proxy container image
 	// This is a plain *string (not ValueSource) because it's used at pod creation
 	// time by the webhook, not by oauth2-proxy at runtime. "fromEnv" makes no sense here.
 	ProxyImage *string
+
+	// ProxyCPURequest, ProxyCPULimit, ProxyMemoryRequest and ProxyMemoryLimit
+	// override the sidecar's resources. nil means not set
+	ProxyCPURequest    *resource.Quantity
+	ProxyCPULimit      *resource.Quantity
+	ProxyMemoryRequest *resource.Quantity
+	ProxyMemoryLimit   *resource.Quantity
+
+	// ProxyImagePullPolicy overrides the sidecar's imagePullPolicy
+	ProxyImagePullPolicy *corev1.PullPolicy
+
+	// ProxyImagePullSecrets overrides the Secrets used to pull the proxy image
+	// nil means not set
+	ProxyImagePullSecrets []string
+
+	// IPFamily overrides the IP family of the localhost upstream
+	// Used by the webhook at pod creation time, so "fromEnv" is not supported
+	IPFamily *IPFamily
+
+	// ProxyPort overrides the port oauth2-proxy listens on
+	// Used by the webhook at pod creation time, so "fromEnv" is not supported
+	ProxyPort *int32
+
+	// Mesh overrides the service mesh handling
+	// Used by the webhook at pod creation time, so "fromEnv" is not supported
+	Mesh *Mesh
+
+	// ===== Block Direct Access Overrides =====
+	// Used by the webhook to generate firewall rules, so "fromEnv" is not supported
+
+	// BlockAllowKubelet overrides whether the node may reach the protected port
+	BlockAllowKubelet *bool
+
+	// BlockDirectProbes overrides whether probes are left pointing at the app
+	BlockDirectProbes *bool
+
+	// BlockAllowCIDRs overrides the extra source ranges allowed to reach the protected port
+	// nil means not set
+	BlockAllowCIDRs []string
 }
 
 // Parser defines the interface for parsing pod annotations
@@ -676,7 +1072,13 @@ func NewParser() *AnnotationParser {
 }
 
 // Parse extracts oauth2-proxy configuration from pod annotations
+// A KeySpec document is expanded first, see ExpandSpec
 func (p *AnnotationParser) Parse(annotations map[string]string) (*Config, error) {
+	annotations, err := ExpandSpec(annotations)
+	if err != nil {
+		return nil, err
+	}
+
 	var (
 		cfg *Config = &Config{
 			IgnorePaths:         []string{},
@@ -691,6 +1093,13 @@ func (p *AnnotationParser) Parse(annotations map[string]string) (*Config, error)
 	}
 	cfg.Enabled = true
 
+	cfg.Sources = make(map[string]string)
+	for k := range annotations {
+		if strings.HasPrefix(k, AnnotationPrefix) {
+			cfg.Sources[strings.TrimPrefix(k, AnnotationPrefix)] = SourceAnnotation
+		}
+	}
+
 	// ConfigMapName is optional - if not set, mutator will use webhook's default
 	if v, ok := annotations[KeyConfig]; ok {
 		cfg.ConfigMapName = v
@@ -718,6 +1127,33 @@ func (p *AnnotationParser) Parse(annotations map[string]string) (*Config, error)
 		cfg.Overrides.ProxyImage = &s
 	}
 
+	for key, dst := range map[string]**resource.Quantity{
+		KeyProxyCPURequest:    &cfg.Overrides.ProxyCPURequest,
+		KeyProxyCPULimit:      &cfg.Overrides.ProxyCPULimit,
+		KeyProxyMemoryRequest: &cfg.Overrides.ProxyMemoryRequest,
+		KeyProxyMemoryLimit:   &cfg.Overrides.ProxyMemoryLimit,
+	} {
+		if v, ok := annotations[key]; ok {
+			q, err := ParseQuantity(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value: %w", key, err)
+			}
+			*dst = &q
+		}
+	}
+
+	if v, ok := annotations[KeyProxyImagePullPolicy]; ok {
+		policy, err := ParsePullPolicy(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %w", KeyProxyImagePullPolicy, err)
+		}
+		cfg.Overrides.ProxyImagePullPolicy = &policy
+	}
+
+	if v, ok := annotations[KeyProxyImagePullSecrets]; ok {
+		cfg.Overrides.ProxyImagePullSecrets = parsePaths(v)
+	}
+
 	if v, ok := annotations[KeyPingPath]; ok {
 		cfg.PingPath = strings.TrimSpace(v)
 	}
@@ -785,6 +1221,71 @@ func (p *AnnotationParser) Parse(annotations map[string]string) (*Config, error)
 		cfg.UpstreamTLS = UpstreamTLSMode(v)
 	}
 
+	cfg.ClientRegistration = ClientRegistrationStatic
+	if v, ok := annotations[KeyClientRegistration]; ok {
+		mode, err := ParseClientRegistration(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientRegistration = mode
+	}
+
+	if v, ok := annotations[KeyValidateReferences]; ok {
+		mode, err := ParseReferenceValidation(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ValidateReferences = mode
+	}
+
+	if v, ok := annotations[KeyIPFamily]; ok {
+		family, err := ParseIPFamily(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Overrides.IPFamily = &family
+	}
+
+	if v, ok := annotations[KeyProxyPort]; ok {
+		port, err := ParsePort(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %w", KeyProxyPort, err)
+		}
+		cfg.Overrides.ProxyPort = &port
+	}
+
+	if v, ok := annotations[KeyMesh]; ok {
+		mesh, err := ParseMesh(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Overrides.Mesh = &mesh
+	}
+
+	if v, ok := annotations[KeyBlockAllowKubelet]; ok {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %q (must be true or false)", KeyBlockAllowKubelet, v)
+		}
+		cfg.Overrides.BlockAllowKubelet = &b
+	}
+
+	if v, ok := annotations[KeyBlockDirectProbes]; ok {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %q (must be true or false)", KeyBlockDirectProbes, v)
+		}
+		cfg.Overrides.BlockDirectProbes = &b
+	}
+
+	if v, ok := annotations[KeyBlockAllowCIDRs]; ok {
+		cidrs, err := ParseCIDRs(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %w", KeyBlockAllowCIDRs, err)
+		}
+		cfg.Overrides.BlockAllowCIDRs = cidrs
+	}
+
 	if v, ok := annotations[KeyClientID]; ok {
 		cfg.Overrides.ClientID = ParseValueSource(v)
 	}
@@ -886,6 +1387,63 @@ func (p *AnnotationParser) Parse(annotations map[string]string) (*Config, error)
 		cfg.Overrides.Prompt = ParseValueSource(v)
 	}
 
+	if v, ok := annotations[KeyCustomTemplatesConfigMap]; ok {
+		s := strings.TrimSpace(v)
+		cfg.Overrides.CustomTemplatesConfigMap = &s
+	}
+	if v, ok := annotations[KeyBanner]; ok {
+		cfg.Overrides.Banner = ParseValueSource(v)
+	}
+	if v, ok := annotations[KeyFooter]; ok {
+		cfg.Overrides.Footer = ParseValueSource(v)
+	}
+	if v, ok := annotations[KeyCustomSignInLogo]; ok {
+		cfg.Overrides.CustomSignInLogo = ParseValueSource(strings.TrimSpace(v))
+	}
+
+	if v, ok := annotations[KeyProviders]; ok {
+		// Non-nil even when empty, so an empty selection is reported rather than ignored
+		cfg.Overrides.Providers = []string{}
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				cfg.Overrides.Providers = append(cfg.Overrides.Providers, id)
+			}
+		}
+	}
+
+	for key, dst := range map[string]*ValueSource{
+		KeyGitHubOrg:                &cfg.Overrides.GitHubOrg,
+		KeyGitHubRepo:               &cfg.Overrides.GitHubRepo,
+		KeyGoogleAdminEmail:         &cfg.Overrides.GoogleAdminEmail,
+		KeyGoogleServiceAccountJSON: &cfg.Overrides.GoogleServiceAccountJSON,
+		KeyAzureTenant:              &cfg.Overrides.AzureTenant,
+	} {
+		if v, ok := annotations[key]; ok {
+			*dst = ParseValueSource(strings.TrimSpace(v))
+		}
+	}
+
+	for key, dst := range map[string]*StringSliceValueSource{
+		KeyGitHubTeams:    &cfg.Overrides.GitHubTeams,
+		KeyGitHubUsers:    &cfg.Overrides.GitHubUsers,
+		KeyGitLabGroups:   &cfg.Overrides.GitLabGroups,
+		KeyGitLabProjects: &cfg.Overrides.GitLabProjects,
+		KeyGoogleGroups:   &cfg.Overrides.GoogleGroups,
+		KeyKeycloakGroups: &cfg.Overrides.KeycloakGroups,
+	} {
+		if v, ok := annotations[key]; ok {
+			*dst = ParseStringSliceValueSource(v)
+		}
+	}
+
+	if v, ok := annotations[KeyGoogleUseApplicationDefaultCredentials]; ok {
+		b, err := ParseBoolValueSource(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Overrides.GoogleUseApplicationDefaultCredentials = b
+	}
+
 	return cfg, nil
 }
 
@@ -917,6 +1475,22 @@ func parsePaths(pathsStr string) []string {
 	return result
 }
 
+// Inherit layers annotations over the oauth2-proxy annotations of inherited
+// Keys without AnnotationPrefix in inherited are dropped; annotations win on
+// conflicts. Used to apply annotations set on a pod's workload.
+func Inherit(inherited, annotations map[string]string) map[string]string {
+	ret := make(map[string]string, len(annotations))
+	for k, v := range inherited {
+		if strings.HasPrefix(k, AnnotationPrefix) {
+			ret[k] = v
+		}
+	}
+	for k, v := range annotations {
+		ret[k] = v
+	}
+	return ret
+}
+
 // IsNamedPort returns true if the protected port is specified by name (e.g., "http")
 // rather than by number (e.g., "8080").
 //
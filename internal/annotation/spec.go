@@ -0,0 +1,165 @@
+package annotation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// specKeys are the annotations a spec may set
+var specKeys = map[string]bool{
+	KeyEnabled:                  true,
+	KeyConfig:                   true,
+	KeyBlockDirectAccess:        true,
+	KeyBlockAllowKubelet:        true,
+	KeyBlockDirectProbes:        true,
+	KeyBlockAllowCIDRs:          true,
+	KeyClientRegistration:       true,
+	KeyValidateReferences:       true,
+	KeyProtectedPort:            true,
+	KeyIgnorePaths:              true,
+	KeyAPIPaths:                 true,
+	KeySkipJWTBearerTokens:      true,
+	KeyUpstreamTLS:              true,
+	KeyMesh:                     true,
+	KeyProxyPort:                true,
+	KeyIPFamily:                 true,
+	KeyClientID:                 true,
+	KeyClientSecretRef:          true,
+	KeyCookieSecretRef:          true,
+	KeyScope:                    true,
+	KeyValidateURL:              true,
+	KeyPKCEEnabled:              true,
+	KeyCodeChallengeMethod:      true,
+	KeyEmailDomains:             true,
+	KeyAllowedGroups:            true,
+	KeyWhitelistDomains:         true,
+	KeyCookieName:               true,
+	KeyCookieDomains:            true,
+	KeyRedirectURL:              true,
+	KeyExtraJWTIssuers:          true,
+	KeyPassAccessToken:          true,
+	KeySetXAuthRequest:          true,
+	KeyPassAuthorizationHeader:  true,
+	KeySkipProviderButton:       true,
+	KeyProvider:                 true,
+	KeyOIDCIssuerURL:            true,
+	KeyOIDCGroupsClaim:          true,
+	KeyPrompt:                   true,
+	KeyProviders:                true,
+	KeyCustomTemplatesConfigMap: true,
+	KeyBanner:                   true,
+	KeyFooter:                   true,
+	KeyCustomSignInLogo:         true,
+	KeyGitHubOrg:                true,
+	KeyGitHubTeams:              true,
+	KeyGitHubRepo:               true,
+	KeyGitHubUsers:              true,
+	KeyGitLabGroups:             true,
+	KeyGitLabProjects:           true,
+	KeyGoogleGroups:             true,
+	KeyGoogleAdminEmail:         true,
+	KeyGoogleServiceAccountJSON: true,
+	KeyGoogleUseApplicationDefaultCredentials: true,
+	KeyAzureTenant:           true,
+	KeyKeycloakGroups:        true,
+	KeyCookieSecure:          true,
+	KeyProxyImage:            true,
+	KeyProxyCPURequest:       true,
+	KeyProxyCPULimit:         true,
+	KeyProxyMemoryRequest:    true,
+	KeyProxyMemoryLimit:      true,
+	KeyProxyImagePullPolicy:  true,
+	KeyProxyImagePullSecrets: true,
+	KeyPingPath:              true,
+	KeyReadyPath:             true,
+	KeyUpstream:              true,
+	KeySecretProviderClass:   true,
+	KeyEnvSecret:             true,
+	KeyExtraEnv:              true,
+	KeyEnvFile:               true,
+}
+
+// ExpandSpec returns annotations with the KeySpec document replaced by the
+// individual annotations it sets
+//
+// The spec is decoded strictly: unknown or duplicate fields are rejected.
+// Strings are used verbatim, so "fromEnv" and "file:..." keep their meaning;
+// booleans and numbers become their string form and lists of strings are
+// joined with commas (spaces for scope). Annotations set individually on
+// the same object win over the spec's fields. Returns annotations itself
+// when there is no spec.
+func ExpandSpec(annotations map[string]string) (map[string]string, error) {
+	doc, ok := annotations[KeySpec]
+	if !ok {
+		return annotations, nil
+	}
+
+	data, err := yaml.YAMLToJSONStrict([]byte(doc))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", KeySpec, err)
+	}
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("invalid %s: must be an object: %w", KeySpec, err)
+	}
+
+	ret := make(map[string]string, len(annotations)+len(fields))
+	for k, v := range annotations {
+		if k != KeySpec {
+			ret[k] = v
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := AnnotationPrefix + name
+		if !specKeys[key] {
+			return nil, fmt.Errorf("invalid %s: unknown field %q", KeySpec, name)
+		}
+		sep := ","
+		if key == KeyScope {
+			sep = " "
+		}
+		value, err := specValue(fields[name], sep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: field %q: %w", KeySpec, name, err)
+		}
+		if _, ok := ret[key]; !ok {
+			ret[key] = value
+		}
+	}
+	return ret, nil
+}
+
+// specValue converts a decoded spec field to its annotation value
+func specValue(v interface{}, sep string) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, json.Number:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list items must be strings")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, sep), nil
+	default:
+		return "", fmt.Errorf("must be a string, boolean, number or list of strings")
+	}
+}
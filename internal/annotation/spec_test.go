@@ -0,0 +1,84 @@
+package annotation
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestExpandSpec tests decoding, value conversion and precedence
+func TestExpandSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+		wantErr     string
+	}{
+		{
+			name: "yaml with lists and scalars",
+			annotations: map[string]string{KeySpec: `
+enabled: true
+protected-port: 8080
+allowed-groups: [ops, dev]
+scope: [openid, email]
+client-id: fromEnv`},
+			want: map[string]string{
+				KeyEnabled:       "true",
+				KeyProtectedPort: "8080",
+				KeyAllowedGroups: "ops,dev",
+				KeyScope:         "openid email",
+				KeyClientID:      "fromEnv",
+			},
+		},
+		{
+			name: "individual annotation wins",
+			annotations: map[string]string{
+				KeySpec:          `{"enabled": true, "allowed-groups": "ops"}`,
+				KeyAllowedGroups: "dev",
+			},
+			want: map[string]string{KeyEnabled: "true", KeyAllowedGroups: "dev"},
+		},
+		{
+			name:        "unknown field",
+			annotations: map[string]string{KeySpec: `{"enabeld": true}`},
+			wantErr:     `unknown field "enabeld"`,
+		},
+		{
+			name:        "duplicate field",
+			annotations: map[string]string{KeySpec: "enabled: true\nenabled: false"},
+			wantErr:     "invalid " + KeySpec,
+		},
+		{
+			name:        "nested object",
+			annotations: map[string]string{KeySpec: `{"upstream": {"host": "x"}}`},
+			wantErr:     `field "upstream"`,
+		},
+		{
+			name:        "not an object",
+			annotations: map[string]string{KeySpec: `[enabled]`},
+			wantErr:     "must be an object",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandSpec(tt.annotations)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ExpandSpec() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandSpec() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("ExpandSpec() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("ExpandSpec()[%s] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// Outcomes recorded in Event.Outcome
+const (
+	// OutcomeSkipped means the request wasn't a Pod CREATE the webhook handles
+	OutcomeSkipped = "skipped"
+
+	// OutcomeAllowed means the pod was admitted unchanged
+	OutcomeAllowed = "allowed"
+
+	// OutcomePatched means the pod was admitted with a patch
+	OutcomePatched = "patched"
+
+	// OutcomeDenied means the pod was rejected
+	OutcomeDenied = "denied"
+)
+
+// redacted replaces credentials in recorded annotation values
+const redacted = "<redacted>"
+
+// Event is one admission decision, written as a single JSON line
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// UID is the AdmissionRequest UID; also logged by the webhook so the
+	// audit record of a request can be found from its log lines
+	UID string `json:"uid"`
+
+	Kind      string `json:"kind"`
+	Operation string `json:"operation"`
+	Namespace string `json:"namespace"`
+
+	// Name is often empty for pods created by controllers, GenerateName isn't
+	Name         string `json:"name,omitempty"`
+	GenerateName string `json:"generateName,omitempty"`
+
+	// Owner is the controlling owner as "Kind/name", e.g. "ReplicaSet/web-5d4f"
+	Owner string `json:"owner,omitempty"`
+
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// ConfigMap is the "namespace/name" of the ConfigMap the pod's config was loaded from
+	ConfigMap string `json:"configMap,omitempty"`
+
+	// Annotations are the oauth2-proxy annotations after layering, see Redact
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Outcome is one of OutcomeSkipped, OutcomeAllowed, OutcomePatched or OutcomeDenied
+	Outcome string `json:"outcome"`
+
+	// Reason is the denial message
+	Reason string `json:"reason,omitempty"`
+
+	PatchOps int      `json:"patchOps"`
+	Warnings []string `json:"warnings,omitempty"`
+
+	// LatencyMS is the time spent handling the request in milliseconds
+	LatencyMS float64 `json:"latencyMs"`
+}
+
+// Sink records admission decisions
+//
+// Record must not block admission for long; sinks that do I/O over the
+// network queue events and drop them when the queue is full.
+type Sink interface {
+	Record(event Event)
+}
+
+// Redact returns the oauth2-proxy annotations safe to record
+//
+// Only prefixed keys are kept, since other webhooks' annotations may carry
+// credentials, and the spec annotation is left out as it is already expanded.
+// URLs lose their userinfo, e.g. a password embedded in upstream.
+func Redact(annotations map[string]string) map[string]string {
+	var ret map[string]string
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, annotation.AnnotationPrefix) || k == annotation.KeySpec {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[string]string)
+		}
+		ret[k] = redactURLs(v)
+	}
+	return ret
+}
+
+// redactURLs hides the userinfo of URLs in a comma-separated value
+func redactURLs(value string) string {
+	if !strings.Contains(value, "@") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, p := range parts {
+		u, err := url.Parse(strings.TrimSpace(p))
+		if err != nil || u.User == nil || u.Host == "" {
+			continue
+		}
+		u.User = nil
+		parts[i] = u.Scheme + "://" + redacted + "@" + strings.TrimPrefix(u.String(), u.Scheme+"://")
+	}
+	return strings.Join(parts, ",")
+}
+
+// WriterSink writes events as JSON lines to an io.Writer
+type WriterSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewWriterSink creates a Sink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{enc: json.NewEncoder(w)}
+}
+
+// OpenFileSink creates a Sink appending to the file at path, or writing to
+// stdout if path is "-"
+func OpenFileSink(path string) (*WriterSink, error) {
+	if path == "-" {
+		return NewWriterSink(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewWriterSink(f), nil
+}
+
+// Record implements Sink
+func (s *WriterSink) Record(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(event); err != nil {
+		klog.ErrorS(err, "failed to write audit event", "uid", event.UID)
+	}
+}
+
+// HTTPSink POSTs batches of events as JSON lines (application/x-ndjson)
+//
+// Events are queued and sent by a background goroutine so a slow receiver
+// doesn't slow down admission. When the queue is full events are dropped
+// and logged.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+	queue  chan Event
+	done   chan struct{}
+}
+
+// httpSinkBatch is the most events sent in one request
+const httpSinkBatch = 100
+
+// NewHTTPSink creates a Sink sending to url; call Run to start sending
+func NewHTTPSink(url string, timeout time.Duration, queueSize int) *HTTPSink {
+	return &HTTPSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// Record implements Sink
+func (s *HTTPSink) Record(event Event) {
+	select {
+	case s.queue <- event:
+	default:
+		klog.InfoS("audit queue full, dropping event", "uid", event.UID)
+	}
+}
+
+// Run sends queued events until ctx is done, then sends what is left
+func (s *HTTPSink) Run(ctx context.Context) {
+	defer close(s.done)
+	for {
+		select {
+		case event := <-s.queue:
+			s.send(s.batch(event))
+		case <-ctx.Done():
+			for len(s.queue) > 0 {
+				s.send(s.batch(<-s.queue))
+			}
+			return
+		}
+	}
+}
+
+// Done is closed once Run has returned
+func (s *HTTPSink) Done() <-chan struct{} {
+	return s.done
+}
+
+// batch collects first and whatever else is queued, up to httpSinkBatch events
+func (s *HTTPSink) batch(first Event) []Event {
+	ret := []Event{first}
+	for len(ret) < httpSinkBatch {
+		select {
+		case event := <-s.queue:
+			ret = append(ret, event)
+		default:
+			return ret
+		}
+	}
+	return ret
+}
+
+// send POSTs events; failures are logged, not retried
+func (s *HTTPSink) send(events []Event) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			klog.ErrorS(err, "failed to encode audit event", "uid", e.UID)
+		}
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", &body)
+	if err != nil {
+		klog.ErrorS(err, "failed to send audit events", "count", len(events))
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		klog.ErrorS(fmt.Errorf("status %s", resp.Status), "audit sink rejected events", "count", len(events))
+	}
+}
+
+// MultiSink records every event to each of its sinks
+type MultiSink []Sink
+
+// Record implements Sink
+func (m MultiSink) Record(event Event) {
+	for _, s := range m {
+		s.Record(event)
+	}
+}
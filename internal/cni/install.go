@@ -0,0 +1,235 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+)
+
+// serviceAccountDir is where the installer's own service account credentials are mounted
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubeconfigName is the file written next to the CNI network configuration
+const KubeconfigName = PluginType + ".kubeconfig"
+
+// Installer places the plugin on a node and chains it into the CNI config
+//
+// It runs in a DaemonSet with the host's CNI directories mounted, the same
+// way Istio CNI and Multus install themselves.
+type Installer struct {
+	// BinarySource is the plugin binary to copy, usually os.Executable()
+	BinarySource string
+
+	// BinDir is the host CNI binary directory as mounted in the installer
+	// Default: /host/opt/cni/bin
+	BinDir string
+
+	// NetDir is the host CNI config directory as mounted in the installer
+	// Default: /host/etc/cni/net.d
+	NetDir string
+
+	// HostNetDir is NetDir as seen from the host, used in the plugin config
+	// since the plugin itself runs in the host mount namespace
+	// Default: /etc/cni/net.d
+	HostNetDir string
+}
+
+// Install copies the binary, writes the kubeconfig and chains the plugin
+//
+// Safe to call repeatedly: the conflist is only rewritten when the plugin is
+// missing, e.g. after the primary CNI regenerated its config.
+func (i *Installer) Install() error {
+	if err := i.installBinary(); err != nil {
+		return err
+	}
+	if err := i.writeKubeconfig(); err != nil {
+		return err
+	}
+
+	path, err := i.findConfList()
+	if err != nil {
+		return err
+	}
+	return i.updateConfList(path, true)
+}
+
+// Uninstall removes the plugin from the conflist and deletes the kubeconfig
+//
+// The binary is left in place so pods being set up concurrently don't fail.
+func (i *Installer) Uninstall() error {
+	path, err := i.findConfList()
+	if err != nil {
+		return err
+	}
+	if err := i.updateConfList(path, false); err != nil {
+		return err
+	}
+
+	err = os.Remove(filepath.Join(i.NetDir, KubeconfigName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// installBinary copies the plugin into BinDir atomically
+func (i *Installer) installBinary() error {
+	src, err := os.Open(i.BinarySource)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeFileAtomic(filepath.Join(i.BinDir, PluginType), 0o755, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// writeKubeconfig builds a kubeconfig from the installer's service account
+func (i *Installer) writeKubeconfig() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return err
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return err
+	}
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["local"] = &clientcmdapi.Cluster{
+		Server:                   "https://" + net.JoinHostPort(host, port),
+		CertificateAuthorityData: ca,
+	}
+	kubeconfig.AuthInfos[PluginType] = &clientcmdapi.AuthInfo{Token: strings.TrimSpace(string(token))}
+	kubeconfig.Contexts[PluginType] = &clientcmdapi.Context{Cluster: "local", AuthInfo: PluginType}
+	kubeconfig.CurrentContext = PluginType
+
+	data, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(i.NetDir, KubeconfigName), 0o600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// findConfList returns the conflist the runtime uses, i.e. the first by name
+//
+// Plain .conf files hold a single plugin and can't be chained, so they are
+// reported as an error rather than silently converted.
+func (i *Installer) findConfList() (string, error) {
+	entries, err := os.ReadDir(i.NetDir)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.Type().IsRegular() && (ext == ".conflist" || ext == ".conf" || ext == ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no CNI network configuration found in %s", i.NetDir)
+	}
+	sort.Strings(names)
+
+	if filepath.Ext(names[0]) != ".conflist" {
+		return "", fmt.Errorf("primary CNI config %s is not a .conflist, cannot chain %s", names[0], PluginType)
+	}
+	return filepath.Join(i.NetDir, names[0]), nil
+}
+
+// updateConfList adds or removes the plugin entry, preserving all other fields
+func (i *Installer) updateConfList(path string, present bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var conflist map[string]interface{}
+	if err := json.Unmarshal(data, &conflist); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	plugins, ok := conflist["plugins"].([]interface{})
+	if !ok {
+		return fmt.Errorf("%s has no plugins list", path)
+	}
+
+	var kept []interface{}
+	found := false
+	for _, p := range plugins {
+		if m, ok := p.(map[string]interface{}); ok && m["type"] == PluginType {
+			found = true
+			continue
+		}
+		kept = append(kept, p)
+	}
+	if found == present {
+		return nil
+	}
+
+	if present {
+		kept = append(kept, map[string]interface{}{
+			"type":       PluginType,
+			"kubeconfig": filepath.Join(i.HostNetDir, KubeconfigName),
+		})
+		klog.InfoS("chaining plugin into CNI config", "path", path)
+	} else {
+		klog.InfoS("removing plugin from CNI config", "path", path)
+	}
+	conflist["plugins"] = kept
+
+	out, err := json.MarshalIndent(conflist, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, 0o644, func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
+
+// writeFileAtomic writes via a hidden temp file in the same directory and renames
+//
+// The temp name never ends in .conf/.conflist so the runtime can't pick up a
+// partial network config.
+func writeFileAtomic(path string, mode os.FileMode, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
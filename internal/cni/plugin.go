@@ -0,0 +1,277 @@
+// Package cni implements a chained CNI plugin that installs the
+// block-direct-access nftables rules at pod network setup.
+//
+// It is the alternative to the netguard init container for namespaces where
+// Pod Security Admission rejects root and NET_ADMIN: the webhook only adds
+// annotation.CNIBlockedPortsAnnotation, and this plugin (running with the
+// container runtime's privileges) programs the rules in the pod's netns.
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/netguard"
+)
+
+// PluginType is the plugin "type" in the CNI conflist and the binary name
+const PluginType = "oauth2-proxy-cni"
+
+// podLookupTimeout bounds the API server call made during ADD
+const podLookupTimeout = 10 * time.Second
+
+// PluginConf is the network configuration passed to the plugin on stdin
+type PluginConf struct {
+	types.NetConf
+
+	// Kubeconfig is the host path of the kubeconfig used to look up pods
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+// K8sArgs are the CNI_ARGS set by the kubelet for each pod
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+}
+
+// Plugin implements the CNI commands
+//
+// The API client and the netns operations are fields so tests can run the
+// commands without a kubeconfig or a network namespace.
+type Plugin struct {
+	// newClient builds the API client from the configured kubeconfig path
+	newClient func(kubeconfig string) (kubernetes.Interface, error)
+
+	// apply installs and verifies the rules in the netns at the given path
+	apply func(netns string, rules netguard.Rules) error
+
+	// verify checks the rules installed in the netns at the given path
+	verify func(netns string, rules netguard.Rules) error
+}
+
+// NewPlugin creates a Plugin that talks to the API server and the pod's netns
+func NewPlugin() *Plugin {
+	return &Plugin{
+		newClient: clientFromKubeconfig,
+		apply:     applyInNetNS,
+		verify:    verifyInNetNS,
+	}
+}
+
+// Add installs the rules for the pod if it carries CNIBlockedPortsAnnotation
+//
+// Any failure is returned to the runtime, which fails the sandbox: a pod that
+// asked for block-direct-access never starts with its app port exposed.
+func (p *Plugin) Add(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.PrevResult == nil {
+		return fmt.Errorf("%s must be used as a chained plugin", PluginType)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), podLookupTimeout)
+	defer cancel()
+	client, pod, rules, ok, err := p.lookupRules(ctx, conf, args.Args)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := p.apply(args.Netns, rules); err != nil {
+			return err
+		}
+		// The rules are in place, so a failed stamp only shows up as drift
+		if err := stampGuarded(ctx, client, pod); err != nil {
+			klog.ErrorS(err, "failed to stamp guarded ports", "pod", klog.KObj(pod))
+		}
+	}
+
+	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+}
+
+// Check verifies the rules are still installed for annotated pods
+func (p *Plugin) Check(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), podLookupTimeout)
+	defer cancel()
+	_, _, rules, ok, err := p.lookupRules(ctx, conf, args.Args)
+	if err != nil || !ok {
+		return err
+	}
+
+	return p.verify(args.Netns, rules)
+}
+
+// Del is a no-op: the rules live in the pod's netns and go away with it
+func (p *Plugin) Del(_ *skel.CmdArgs) error {
+	return nil
+}
+
+// parseConfig decodes the plugin configuration and the previous plugin's result
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf := &PluginConf{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %w", err)
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %w", err)
+	}
+
+	return conf, nil
+}
+
+// lookupRules fetches the pod and parses its CNIBlockedPortsAnnotation
+//
+// Returns ok=false for non-Kubernetes sandboxes and pods without the annotation.
+func (p *Plugin) lookupRules(ctx context.Context, conf *PluginConf, cniArgs string) (kubernetes.Interface, *corev1.Pod, netguard.Rules, bool, error) {
+	var rules netguard.Rules
+
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(cniArgs, &k8sArgs); err != nil {
+		return nil, nil, rules, false, fmt.Errorf("failed to parse CNI_ARGS: %w", err)
+	}
+	namespace, name := string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME)
+	if namespace == "" || name == "" {
+		return nil, nil, rules, false, nil
+	}
+
+	client, err := p.newClient(conf.Kubeconfig)
+	if err != nil {
+		return nil, nil, rules, false, err
+	}
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, rules, false, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+
+	ports, ok := pod.Annotations[annotation.CNIBlockedPortsAnnotation]
+	if !ok {
+		return client, pod, rules, false, nil
+	}
+	rules, err = netguard.ParsePorts(ports)
+	if err != nil {
+		return nil, nil, rules, false, fmt.Errorf("pod %s/%s: invalid %s: %w", namespace, name, annotation.CNIBlockedPortsAnnotation, err)
+	}
+	rules.Allowed, err = netguard.ParsePrefixes(pod.Annotations[annotation.CNIAllowedCIDRsAnnotation])
+	if err != nil {
+		return nil, nil, rules, false, fmt.Errorf("pod %s/%s: invalid %s: %w", namespace, name, annotation.CNIAllowedCIDRsAnnotation, err)
+	}
+	if pod.Annotations[annotation.CNIAllowNodeAnnotation] == "true" {
+		nodeIPs, err := lookupNodeIPs(ctx, client, pod.Spec.NodeName)
+		if err != nil {
+			return nil, nil, rules, false, err
+		}
+		rules.Allowed = append(rules.Allowed, nodeIPs...)
+	}
+
+	klog.InfoS("blocking direct access", "pod", klog.KRef(namespace, name), "ports", ports)
+	return client, pod, rules, true, nil
+}
+
+// stampGuarded records on the pod which blocked ports the rules were installed for
+func stampGuarded(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				annotation.CNIGuardedPortsAnnotation: pod.Annotations[annotation.CNIBlockedPortsAnnotation],
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// clientFromKubeconfig builds an API client from the kubeconfig the installer wrote
+func clientFromKubeconfig(kubeconfig string) (kubernetes.Interface, error) {
+	restCfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: %w", kubeconfig, err)
+	}
+	return kubernetes.NewForConfig(restCfg)
+}
+
+// lookupNodeIPs returns the node's internal addresses as single-host prefixes
+//
+// pod.Status.HostIP isn't reliably set yet during sandbox creation, so the
+// Node object is the source of truth for where kubelet probes come from.
+func lookupNodeIPs(ctx context.Context, client kubernetes.Interface, nodeName string) ([]netip.Prefix, error) {
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %w", nodeName, err)
+	}
+
+	var ret []netip.Prefix
+	for _, a := range node.Status.Addresses {
+		if a.Type != corev1.NodeInternalIP {
+			continue
+		}
+		addr, err := netip.ParseAddr(a.Address)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: invalid address %q", nodeName, a.Address)
+		}
+		ret = append(ret, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("node %s has no InternalIP address", nodeName)
+	}
+
+	return ret, nil
+}
+
+// applyInNetNS installs and verifies the rules inside the pod's network namespace
+func applyInNetNS(netns string, rules netguard.Rules) error {
+	return withNetNSConn(netns, func(conn *nftables.Conn) error {
+		if err := netguard.Apply(conn, rules); err != nil {
+			return err
+		}
+		return netguard.Verify(conn, rules)
+	})
+}
+
+// verifyInNetNS checks the rules inside the pod's network namespace
+func verifyInNetNS(netns string, rules netguard.Rules) error {
+	return withNetNSConn(netns, func(conn *nftables.Conn) error {
+		return netguard.Verify(conn, rules)
+	})
+}
+
+// withNetNSConn opens a netlink connection bound to the given netns path
+func withNetNSConn(netns string, fn func(conn *nftables.Conn) error) error {
+	f, err := os.Open(netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %s: %w", netns, err)
+	}
+	defer f.Close()
+
+	conn, err := nftables.New(nftables.WithNetNSFd(int(f.Fd())))
+	if err != nil {
+		return fmt.Errorf("failed to open netlink connection in %s: %w", netns, err)
+	}
+
+	return fn(conn)
+}
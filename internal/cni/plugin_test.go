@@ -0,0 +1,332 @@
+package cni
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/netguard"
+)
+
+const (
+	testNetNS = "/var/run/netns/cni-test"
+
+	chainedConf = `{"cniVersion":"1.0.0","name":"k8s-pod-network","type":"oauth2-proxy-cni",` +
+		`"kubeconfig":"/etc/cni/net.d/oauth2-proxy-cni.kubeconfig",` +
+		`"prevResult":{"cniVersion":"1.0.0","interfaces":[{"name":"eth0"}],"ips":[{"address":"10.42.0.7/24","interface":0}]}}`
+	unchainedConf = `{"cniVersion":"1.0.0","name":"k8s-pod-network","type":"oauth2-proxy-cni"}`
+)
+
+// fakeNetNS records the rules the plugin installs or verifies
+type fakeNetNS struct {
+	applied  []netguard.Rules
+	verified []netguard.Rules
+	err      error
+}
+
+func (f *fakeNetNS) apply(netns string, rules netguard.Rules) error {
+	if netns != testNetNS {
+		return fmt.Errorf("unexpected netns %s", netns)
+	}
+	f.applied = append(f.applied, rules)
+	return f.err
+}
+
+func (f *fakeNetNS) verify(netns string, rules netguard.Rules) error {
+	if netns != testNetNS {
+		return fmt.Errorf("unexpected netns %s", netns)
+	}
+	f.verified = append(f.verified, rules)
+	return f.err
+}
+
+// newTestPlugin returns a Plugin backed by a fake clientset holding the objects
+func newTestPlugin(t *testing.T, objects ...runtime.Object) (*Plugin, *fake.Clientset, *fakeNetNS) {
+	t.Helper()
+
+	// Add prints the CNI result to stdout, keep it out of the test output
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devnull
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		devnull.Close()
+	})
+
+	client := fake.NewSimpleClientset(objects...)
+	netns := &fakeNetNS{}
+	return &Plugin{
+		newClient: func(string) (kubernetes.Interface, error) { return client, nil },
+		apply:     netns.apply,
+		verify:    netns.verify,
+	}, client, netns
+}
+
+func testPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: annotations},
+		Spec:       corev1.PodSpec{NodeName: "node-a"},
+	}
+}
+
+func testNode() *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeHostName, Address: "node-a"},
+			{Type: corev1.NodeInternalIP, Address: "192.168.1.10"},
+			{Type: corev1.NodeInternalIP, Address: "fd00::10"},
+		}},
+	}
+}
+
+func cmdArgs(conf string) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: "abc123",
+		Netns:       testNetNS,
+		IfName:      "eth0",
+		Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=app",
+		StdinData:   []byte(conf),
+	}
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var ret []string
+	for _, p := range prefixes {
+		ret = append(ret, p.String())
+	}
+	return ret
+}
+
+// TestPluginAdd tests rule installation and the guarded-ports stamp
+func TestPluginAdd(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantPorts   []uint16
+		wantAllowed []string
+		wantErr     string
+	}{
+		{
+			name:        "unannotated pod",
+			annotations: nil,
+		},
+		{
+			name:        "blocked ports",
+			annotations: map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"},
+			wantPorts:   []uint16{8080},
+		},
+		{
+			name: "allowed cidrs and node",
+			annotations: map[string]string{
+				annotation.CNIBlockedPortsAnnotation: "8080",
+				annotation.CNIAllowedCIDRsAnnotation: "10.42.0.0/16",
+				annotation.CNIAllowNodeAnnotation:    "true",
+			},
+			wantPorts:   []uint16{8080},
+			wantAllowed: []string{"10.42.0.0/16", "192.168.1.10/32", "fd00::10/128"},
+		},
+		{
+			name:        "invalid ports",
+			annotations: map[string]string{annotation.CNIBlockedPortsAnnotation: "http"},
+			wantErr:     "invalid " + annotation.CNIBlockedPortsAnnotation,
+		},
+		{
+			name: "invalid cidrs",
+			annotations: map[string]string{
+				annotation.CNIBlockedPortsAnnotation: "8080",
+				annotation.CNIAllowedCIDRsAnnotation: "10.42.0.0/33",
+			},
+			wantErr: "invalid " + annotation.CNIAllowedCIDRsAnnotation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plugin, client, netns := newTestPlugin(t, testPod(tt.annotations), testNode())
+
+			err := plugin.Add(cmdArgs(chainedConf))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Add() error = %v, want %q", err, tt.wantErr)
+				}
+				if len(netns.applied) != 0 {
+					t.Errorf("applied %v after an error", netns.applied)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+
+			pod, err := client.CoreV1().Pods("default").Get(context.Background(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			guarded, stamped := pod.Annotations[annotation.CNIGuardedPortsAnnotation]
+			if tt.wantPorts == nil {
+				if len(netns.applied) != 0 || stamped {
+					t.Errorf("applied = %v, guarded = %q, want nothing for an unannotated pod", netns.applied, guarded)
+				}
+				return
+			}
+			if len(netns.applied) != 1 {
+				t.Fatalf("applied %d times, want once", len(netns.applied))
+			}
+			got := netns.applied[0]
+			if !slices.Equal(got.Ports, tt.wantPorts) || !slices.Equal(prefixStrings(got.Allowed), tt.wantAllowed) {
+				t.Errorf("applied ports = %v, allowed = %v, want %v, %v", got.Ports, prefixStrings(got.Allowed), tt.wantPorts, tt.wantAllowed)
+			}
+			if guarded != tt.annotations[annotation.CNIBlockedPortsAnnotation] {
+				t.Errorf("guarded ports = %q, want %q", guarded, tt.annotations[annotation.CNIBlockedPortsAnnotation])
+			}
+		})
+	}
+}
+
+// TestPluginAdd_Failures tests that setup fails closed and leaves the pod unstamped
+func TestPluginAdd_Failures(t *testing.T) {
+	blocked := map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"}
+
+	t.Run("not chained", func(t *testing.T) {
+		plugin, _, netns := newTestPlugin(t, testPod(blocked))
+		if err := plugin.Add(cmdArgs(unchainedConf)); err == nil || !strings.Contains(err.Error(), "chained plugin") {
+			t.Fatalf("Add() error = %v, want chained plugin error", err)
+		}
+		if len(netns.applied) != 0 {
+			t.Errorf("applied %v without a prevResult", netns.applied)
+		}
+	})
+
+	t.Run("apply fails", func(t *testing.T) {
+		plugin, client, netns := newTestPlugin(t, testPod(blocked))
+		netns.err = fmt.Errorf("nf_tables not loaded")
+		if err := plugin.Add(cmdArgs(chainedConf)); err == nil {
+			t.Fatal("Add() succeeded, want the apply error")
+		}
+		pod, _ := client.CoreV1().Pods("default").Get(context.Background(), "app", metav1.GetOptions{})
+		if _, ok := pod.Annotations[annotation.CNIGuardedPortsAnnotation]; ok {
+			t.Error("pod stamped as guarded after a failed apply")
+		}
+	})
+
+	t.Run("pod lookup fails", func(t *testing.T) {
+		plugin, client, netns := newTestPlugin(t)
+		client.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("connection refused")
+		})
+		if err := plugin.Add(cmdArgs(chainedConf)); err == nil || !strings.Contains(err.Error(), "failed to get pod") {
+			t.Fatalf("Add() error = %v, want pod lookup error", err)
+		}
+		if len(netns.applied) != 0 {
+			t.Errorf("applied %v without the pod", netns.applied)
+		}
+	})
+
+	t.Run("node has no InternalIP", func(t *testing.T) {
+		node := testNode()
+		node.Status.Addresses = node.Status.Addresses[:1]
+		plugin, _, _ := newTestPlugin(t, testPod(map[string]string{
+			annotation.CNIBlockedPortsAnnotation: "8080",
+			annotation.CNIAllowNodeAnnotation:    "true",
+		}), node)
+		if err := plugin.Add(cmdArgs(chainedConf)); err == nil || !strings.Contains(err.Error(), "no InternalIP") {
+			t.Fatalf("Add() error = %v, want missing InternalIP error", err)
+		}
+	})
+
+	t.Run("stamp fails", func(t *testing.T) {
+		plugin, client, netns := newTestPlugin(t, testPod(blocked))
+		client.PrependReactor("patch", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("forbidden")
+		})
+		// The rules are installed, so the pod may start; drift reports the missing stamp
+		if err := plugin.Add(cmdArgs(chainedConf)); err != nil {
+			t.Fatalf("Add() error = %v, want success once the rules are applied", err)
+		}
+		if len(netns.applied) != 1 {
+			t.Errorf("applied %d times, want once", len(netns.applied))
+		}
+	})
+}
+
+// TestPluginAdd_NonKubernetes tests that sandboxes without pod CNI_ARGS are passed through
+func TestPluginAdd_NonKubernetes(t *testing.T) {
+	plugin, _, netns := newTestPlugin(t)
+	plugin.newClient = func(string) (kubernetes.Interface, error) {
+		t.Fatal("client created for a non-Kubernetes sandbox")
+		return nil, nil
+	}
+	args := cmdArgs(chainedConf)
+	args.Args = ""
+	if err := plugin.Add(args); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if len(netns.applied) != 0 {
+		t.Errorf("applied %v", netns.applied)
+	}
+}
+
+// TestPluginCheck tests that CHECK verifies annotated pods only
+func TestPluginCheck(t *testing.T) {
+	t.Run("annotated", func(t *testing.T) {
+		plugin, _, netns := newTestPlugin(t, testPod(map[string]string{annotation.CNIBlockedPortsAnnotation: "8080,9090"}))
+		if err := plugin.Check(cmdArgs(chainedConf)); err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		if len(netns.verified) != 1 || !slices.Equal(netns.verified[0].Ports, []uint16{8080, 9090}) {
+			t.Errorf("verified = %v, want ports 8080,9090", netns.verified)
+		}
+		if len(netns.applied) != 0 {
+			t.Errorf("Check() applied rules: %v", netns.applied)
+		}
+	})
+
+	t.Run("rules missing", func(t *testing.T) {
+		plugin, _, netns := newTestPlugin(t, testPod(map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"}))
+		netns.err = fmt.Errorf("chain oauth2_proxy_guard/input not found")
+		if err := plugin.Check(cmdArgs(chainedConf)); err == nil {
+			t.Fatal("Check() succeeded, want the verify error")
+		}
+	})
+
+	t.Run("unannotated", func(t *testing.T) {
+		plugin, _, netns := newTestPlugin(t, testPod(nil))
+		if err := plugin.Check(cmdArgs(chainedConf)); err != nil {
+			t.Fatalf("Check() error = %v", err)
+		}
+		if len(netns.verified) != 0 {
+			t.Errorf("verified %v for an unannotated pod", netns.verified)
+		}
+	})
+}
+
+// TestPluginDel tests that DEL never touches the API server or the netns
+func TestPluginDel(t *testing.T) {
+	plugin, _, netns := newTestPlugin(t)
+	plugin.newClient = func(string) (kubernetes.Interface, error) {
+		t.Fatal("client created on DEL")
+		return nil, nil
+	}
+	if err := plugin.Del(cmdArgs(chainedConf)); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if len(netns.applied)+len(netns.verified) != 0 {
+		t.Errorf("DEL touched the netns: applied %v, verified %v", netns.applied, netns.verified)
+	}
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// hashVersion prefixes every hash and is bumped whenever hashedConfig changes,
+// so pods stamped with the previous layout are reported as drifted once
+// instead of being compared against a different set of fields
+const hashVersion = "v1"
+
+// hashedConfig is the subset of EffectiveConfig that shapes the injected pod
+//
+// Fields are listed explicitly with fixed JSON names: adding a field to
+// EffectiveConfig or renaming one doesn't change existing hashes until it is
+// added here along with a hashVersion bump. Where the config came from
+// (ConfigMap name, provenance) is left out, since moving identical settings
+// between layers doesn't change the sidecar.
+type hashedConfig struct {
+	Provider        SourcedValue    `json:"provider"`
+	OIDCIssuerURL   SourcedValue    `json:"oidc-issuer-url"`
+	OIDCGroupsClaim SourcedValue    `json:"oidc-groups-claim"`
+	Scope           SourcedValue    `json:"scope"`
+	ValidateURL     SourcedValue    `json:"validate-url"`
+	Providers       []ProviderBlock `json:"providers"`
+
+	GitHubOrg                              SourcedValue       `json:"github-org"`
+	GitHubTeams                            SourcedStringSlice `json:"github-teams"`
+	GitHubRepo                             SourcedValue       `json:"github-repo"`
+	GitHubUsers                            SourcedStringSlice `json:"github-users"`
+	GitLabGroups                           SourcedStringSlice `json:"gitlab-groups"`
+	GitLabProjects                         SourcedStringSlice `json:"gitlab-projects"`
+	GoogleGroups                           SourcedStringSlice `json:"google-groups"`
+	GoogleAdminEmail                       SourcedValue       `json:"google-admin-email"`
+	GoogleServiceAccountJSON               SourcedValue       `json:"google-service-account-json"`
+	GoogleUseApplicationDefaultCredentials SourcedBool        `json:"google-use-application-default-credentials"`
+	AzureTenant                            SourcedValue       `json:"azure-tenant"`
+	KeycloakGroups                         SourcedStringSlice `json:"keycloak-groups"`
+
+	ClientID            SourcedValue     `json:"client-id"`
+	ClientSecret        SourcedSecretRef `json:"client-secret"`
+	PKCEEnabled         bool             `json:"pkce-enabled"`
+	CodeChallengeMethod SourcedValue     `json:"code-challenge-method"`
+
+	CookieSecret  SourcedSecretRef   `json:"cookie-secret"`
+	CookieDomains SourcedStringSlice `json:"cookie-domains"`
+	CookieSecure  SourcedBool        `json:"cookie-secure"`
+	CookieName    SourcedValue       `json:"cookie-name"`
+
+	EmailDomains     SourcedStringSlice `json:"email-domains"`
+	AllowedGroups    SourcedStringSlice `json:"allowed-groups"`
+	WhitelistDomains SourcedStringSlice `json:"whitelist-domains"`
+
+	RedirectURL     SourcedValue       `json:"redirect-url"`
+	ExtraJWTIssuers SourcedStringSlice `json:"extra-jwt-issuers"`
+
+	PassAccessToken         SourcedBool `json:"pass-access-token"`
+	SetXAuthRequest         SourcedBool `json:"set-xauthrequest"`
+	PassAuthorizationHeader SourcedBool `json:"pass-authorization-header"`
+
+	SkipProviderButton  SourcedBool  `json:"skip-provider-button"`
+	SkipJWTBearerTokens SourcedBool  `json:"skip-jwt-bearer-tokens"`
+	Prompt              SourcedValue `json:"prompt"`
+
+	CustomTemplatesConfigMap string       `json:"custom-templates-configmap"`
+	Banner                   SourcedValue `json:"banner"`
+	Footer                   SourcedValue `json:"footer"`
+	CustomSignInLogo         SourcedValue `json:"custom-sign-in-logo"`
+
+	ProxyImage            string                       `json:"proxy-image"`
+	ExtraArgs             []string                     `json:"extra-args"`
+	ProxyResources        *corev1.ResourceRequirements `json:"proxy-resources"`
+	ProxySecurityContext  *corev1.SecurityContext      `json:"proxy-security-context"`
+	ProxyImagePullPolicy  corev1.PullPolicy            `json:"proxy-image-pull-policy"`
+	ProxyImagePullSecrets []string                     `json:"proxy-image-pull-secrets"`
+
+	BlockDirectAccess bool                       `json:"block-direct-access"`
+	BlockAllowKubelet bool                       `json:"block-direct-access-allow-kubelet"`
+	BlockDirectProbes bool                       `json:"block-direct-access-direct-probes"`
+	BlockAllowCIDRs   []string                   `json:"block-direct-access-allow-cidrs"`
+	Mesh              annotation.Mesh            `json:"mesh"`
+	ProtectedPort     string                     `json:"protected-port"`
+	Upstream          SourcedValue               `json:"upstream"`
+	UpstreamTLS       annotation.UpstreamTLSMode `json:"upstream-tls"`
+	IPFamily          annotation.IPFamily        `json:"ip-family"`
+	ProxyPort         int32                      `json:"proxy-port"`
+	IgnorePaths       []string                   `json:"ignore-paths"`
+	APIPaths          []string                   `json:"api-paths"`
+	PingPath          string                     `json:"ping-path"`
+	ReadyPath         string                     `json:"ready-path"`
+
+	SecretProviderClass       string            `json:"secret-provider-class"`
+	EnvSecret                 string            `json:"env-secret"`
+	ExtraEnv                  map[string]string `json:"extra-env"`
+	DynamicClientRegistration bool              `json:"dynamic-client-registration"`
+	EnvFile                   string            `json:"env-file"`
+}
+
+// Hash returns a versioned SHA-256 of the settings that shape the injected pod
+// Two pods injected from identical settings get the same hash, e.g. "v1:3f2a..."
+func (cfg *EffectiveConfig) Hash() (string, error) {
+	data, err := json.Marshal(hashedConfig{
+		Provider:        cfg.Provider,
+		OIDCIssuerURL:   cfg.OIDCIssuerURL,
+		OIDCGroupsClaim: cfg.OIDCGroupsClaim,
+		Scope:           cfg.Scope,
+		ValidateURL:     cfg.ValidateURL,
+		Providers:       cfg.Providers,
+
+		GitHubOrg:                              cfg.GitHubOrg,
+		GitHubTeams:                            cfg.GitHubTeams,
+		GitHubRepo:                             cfg.GitHubRepo,
+		GitHubUsers:                            cfg.GitHubUsers,
+		GitLabGroups:                           cfg.GitLabGroups,
+		GitLabProjects:                         cfg.GitLabProjects,
+		GoogleGroups:                           cfg.GoogleGroups,
+		GoogleAdminEmail:                       cfg.GoogleAdminEmail,
+		GoogleServiceAccountJSON:               cfg.GoogleServiceAccountJSON,
+		GoogleUseApplicationDefaultCredentials: cfg.GoogleUseApplicationDefaultCredentials,
+		AzureTenant:                            cfg.AzureTenant,
+		KeycloakGroups:                         cfg.KeycloakGroups,
+
+		ClientID:            cfg.ClientID,
+		ClientSecret:        cfg.ClientSecret,
+		PKCEEnabled:         cfg.PKCEEnabled,
+		CodeChallengeMethod: cfg.CodeChallengeMethod,
+
+		CookieSecret:  cfg.CookieSecret,
+		CookieDomains: cfg.CookieDomains,
+		CookieSecure:  cfg.CookieSecure,
+		CookieName:    cfg.CookieName,
+
+		EmailDomains:     cfg.EmailDomains,
+		AllowedGroups:    cfg.AllowedGroups,
+		WhitelistDomains: cfg.WhitelistDomains,
+
+		RedirectURL:     cfg.RedirectURL,
+		ExtraJWTIssuers: cfg.ExtraJWTIssuers,
+
+		PassAccessToken:         cfg.PassAccessToken,
+		SetXAuthRequest:         cfg.SetXAuthRequest,
+		PassAuthorizationHeader: cfg.PassAuthorizationHeader,
+
+		SkipProviderButton:  cfg.SkipProviderButton,
+		SkipJWTBearerTokens: cfg.SkipJWTBearerTokens,
+		Prompt:              cfg.Prompt,
+
+		CustomTemplatesConfigMap: cfg.CustomTemplatesConfigMap,
+		Banner:                   cfg.Banner,
+		Footer:                   cfg.Footer,
+		CustomSignInLogo:         cfg.CustomSignInLogo,
+
+		ProxyImage:            cfg.ProxyImage,
+		ExtraArgs:             cfg.ExtraArgs,
+		ProxyResources:        cfg.ProxyResources,
+		ProxySecurityContext:  cfg.ProxySecurityContext,
+		ProxyImagePullPolicy:  cfg.ProxyImagePullPolicy,
+		ProxyImagePullSecrets: cfg.ProxyImagePullSecrets,
+
+		BlockDirectAccess: cfg.BlockDirectAccess,
+		BlockAllowKubelet: cfg.BlockAllowKubelet,
+		BlockDirectProbes: cfg.BlockDirectProbes,
+		BlockAllowCIDRs:   cfg.BlockAllowCIDRs,
+		Mesh:              cfg.Mesh,
+		ProtectedPort:     cfg.ProtectedPort,
+		Upstream:          cfg.Upstream,
+		UpstreamTLS:       cfg.UpstreamTLS,
+		IPFamily:          cfg.IPFamily,
+		ProxyPort:         cfg.ProxyPort,
+		IgnorePaths:       cfg.IgnorePaths,
+		APIPaths:          cfg.APIPaths,
+		PingPath:          cfg.PingPath,
+		ReadyPath:         cfg.ReadyPath,
+
+		SecretProviderClass:       cfg.SecretProviderClass,
+		EnvSecret:                 cfg.EnvSecret,
+		ExtraEnv:                  cfg.ExtraEnv,
+		DynamicClientRegistration: cfg.DynamicClientRegistration,
+		EnvFile:                   cfg.EnvFile,
+	})
+	if err != nil {
+		return "", fmt.Errorf("hashing effective config: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hashVersion + ":" + hex.EncodeToString(sum[:]), nil
+}
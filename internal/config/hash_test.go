@@ -0,0 +1,54 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestHash tests that the hash covers pod-shaping settings but not where they came from
+func TestHash(t *testing.T) {
+	base := func() *EffectiveConfig {
+		return &EffectiveConfig{
+			ConfigMapName:      "oauth2-proxy",
+			ConfigMapNamespace: "default",
+			Provenance:         map[string]string{"provider": SourceDefault},
+			Provider:           SourcedValue{Value: "oidc"},
+			ProtectedPort:      "8080",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(cfg *EffectiveConfig)
+		same   bool
+	}{
+		{name: "identical", mutate: func(*EffectiveConfig) {}, same: true},
+		{name: "configmap name", mutate: func(cfg *EffectiveConfig) { cfg.ConfigMapName = "other" }, same: true},
+		{name: "configmap namespace", mutate: func(cfg *EffectiveConfig) { cfg.ConfigMapNamespace = "other" }, same: true},
+		{name: "provenance", mutate: func(cfg *EffectiveConfig) { cfg.Provenance["provider"] = "annotation" }, same: true},
+		{name: "provider", mutate: func(cfg *EffectiveConfig) { cfg.Provider.Value = "github" }, same: false},
+		{name: "protected port", mutate: func(cfg *EffectiveConfig) { cfg.ProtectedPort = "9090" }, same: false},
+		{name: "proxy image", mutate: func(cfg *EffectiveConfig) { cfg.ProxyImage = "oauth2-proxy:v7.8.1" }, same: false},
+		{name: "extra env", mutate: func(cfg *EffectiveConfig) { cfg.ExtraEnv = map[string]string{"A": "b"} }, same: false},
+	}
+	want, err := base().Hash()
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	if !strings.HasPrefix(want, hashVersion+":") {
+		t.Errorf("Hash() = %q, want %q prefix", want, hashVersion+":")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base()
+			tt.mutate(cfg)
+			got, err := cfg.Hash()
+			if err != nil {
+				t.Fatalf("Hash() error = %v", err)
+			}
+			if (got == want) != tt.same {
+				t.Errorf("Hash() = %q, base %q, want same = %v", got, want, tt.same)
+			}
+		})
+	}
+}
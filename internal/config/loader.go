@@ -4,9 +4,17 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/tracing"
 )
 
 // Loader defines the interface for loading oauth2-proxy configuration
@@ -41,12 +49,20 @@ func NewLoader(client kubernetes.Interface, defaultNamespace string) *ConfigMapL
 // Pro: Fail fast with clear error
 // Con: Additional API calls, might not have permission
 // Suggestion: Add optional validation, default off
-func (l *ConfigMapLoader) Load(ctx context.Context, name, namespace string) (*ProxyConfig, error) {
+func (l *ConfigMapLoader) Load(ctx context.Context, name, namespace string) (_ *ProxyConfig, err error) {
 	n := namespace
 	if namespace == "" {
 		n = l.defaultNamespace
 	}
+	ctx, span := tracing.Start(ctx, "ConfigMapLoader.Load",
+		attribute.String("configmap.name", name),
+		attribute.String("configmap.namespace", n),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
 	cm, err := l.client.CoreV1().ConfigMaps(n).Get(ctx, name, metav1.GetOptions{})
+	span.SetAttributes(attribute.Float64("k8s.api.latency_ms", float64(time.Since(start).Microseconds())/1000))
 	if err != nil {
 		return nil, err
 	}
@@ -64,12 +80,25 @@ func parseConfigMap(data map[string]string, name, namespace string) (*ProxyConfi
 	cfg := &ProxyConfig{
 		Name:      name,
 		Namespace: namespace,
+		Keys:      make(map[string]bool, len(data)),
+	}
+	for k := range data {
+		cfg.Keys[k] = true
 	}
 	var err error
 
+	// With named provider blocks the single provider keys become optional
+	if v, ok := data[CMKeyProviders]; ok {
+		cfg.Providers, err = parseProviderBlocks(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	multiProvider := len(cfg.Providers) > 0
+
 	if v, ok := data[CMKeyProvider]; ok {
 		cfg.Provider = strings.TrimSpace(v)
-	} else {
+	} else if !multiProvider {
 		return nil, fmt.Errorf("configmap missing required key %s", CMKeyProvider)
 	}
 
@@ -81,7 +110,7 @@ func parseConfigMap(data map[string]string, name, namespace string) (*ProxyConfi
 
 	if v, ok := data[CMKeyClientID]; ok {
 		cfg.ClientID = strings.TrimSpace(v)
-	} else {
+	} else if !multiProvider {
 		return nil, fmt.Errorf("configmap missing required key %s", CMKeyClientID)
 	}
 
@@ -107,13 +136,15 @@ func parseConfigMap(data map[string]string, name, namespace string) (*ProxyConfi
 		if err != nil {
 			return nil, err
 		}
-	} else if !cfg.PKCEEnabled {
+	} else if !cfg.PKCEEnabled && !multiProvider {
 		return nil, fmt.Errorf("configmap missing key %s when %s is false", CMKeyClientSecretRef, CMKeyPKCEEnabled)
 	}
 
 	// CookieSecretRef is optional in ConfigMap - can be overridden via annotation
 	// Validation that it's set happens after merging in the mutator
-	if v, ok := data[CMKeyCookieSecretRef]; ok {
+	if v, ok := data[CMKeyCookieSecretRef]; ok && strings.TrimSpace(v) == GenerateSecretRef {
+		cfg.GenerateCookieSecret = true
+	} else if ok {
 		cfg.CookieSecretRef, err = parseSecretRef(v, "cookie-secret")
 		if err != nil {
 			return nil, err
@@ -160,6 +191,31 @@ func parseConfigMap(data map[string]string, name, namespace string) (*ProxyConfi
 
 	if v, ok := data[CMKeyProxyImage]; ok {
 		cfg.ProxyImage = strings.TrimSpace(v)
+	} else {
+		cfg.ProxyImage = DefaultProxyImage
+	}
+
+	if err := parseProxyResources(data, cfg); err != nil {
+		return nil, err
+	}
+
+	if v, ok := data[CMKeyProxyImagePullPolicy]; ok {
+		cfg.ProxyImagePullPolicy, err = annotation.ParsePullPolicy(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CMKeyProxyImagePullPolicy, err)
+		}
+	}
+
+	if v, ok := data[CMKeyProxyImagePullSecrets]; ok {
+		cfg.ProxyImagePullSecrets = splitAndTrim(v, ",")
+	}
+
+	if v, ok := data[CMKeyProxySecurityContext]; ok {
+		sc := &corev1.SecurityContext{}
+		if err := yaml.UnmarshalStrict([]byte(v), sc); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CMKeyProxySecurityContext, err)
+		}
+		cfg.ProxySecurityContext = sc
 	}
 
 	if v, ok := data[CMKeyOIDCGroupsClaim]; ok {
@@ -172,6 +228,10 @@ func parseConfigMap(data map[string]string, name, namespace string) (*ProxyConfi
 		cfg.Scope = strings.TrimSpace(v)
 	}
 
+	if err := parseProviderSettings(data, cfg); err != nil {
+		return nil, err
+	}
+
 	if v, ok := data[CMKeyCookieName]; ok {
 		cfg.CookieName = strings.TrimSpace(v)
 	}
@@ -217,9 +277,134 @@ func parseConfigMap(data map[string]string, name, namespace string) (*ProxyConfi
 		cfg.Prompt = strings.TrimSpace(v)
 	}
 
+	if v, ok := data[CMKeyCustomTemplatesConfigMap]; ok {
+		cfg.CustomTemplatesConfigMap = strings.TrimSpace(v)
+	}
+	if v, ok := data[CMKeyBanner]; ok {
+		cfg.Banner = v
+	}
+	if v, ok := data[CMKeyFooter]; ok {
+		cfg.Footer = v
+	}
+	if v, ok := data[CMKeyCustomSignInLogo]; ok {
+		cfg.CustomSignInLogo = strings.TrimSpace(v)
+	}
+
+	if v, ok := data[CMKeyIPFamily]; ok {
+		cfg.IPFamily, err = annotation.ParseIPFamily(v)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cfg.IPFamily = annotation.IPFamilyAuto
+	}
+
+	if v, ok := data[CMKeyProxyPort]; ok {
+		cfg.ProxyPort, err = annotation.ParsePort(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CMKeyProxyPort, err)
+		}
+	} else {
+		cfg.ProxyPort = DefaultProxyPort
+	}
+
+	if v, ok := data[CMKeyMesh]; ok {
+		cfg.Mesh, err = annotation.ParseMesh(v)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cfg.Mesh = annotation.MeshAuto
+	}
+
+	if v, ok := data[CMKeyBlockAllowKubelet]; ok {
+		cfg.BlockAllowKubelet, err = parseBool(v, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := data[CMKeyBlockDirectProbes]; ok {
+		cfg.BlockDirectProbes, err = parseBool(v, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := data[CMKeyBlockAllowCIDRs]; ok {
+		cfg.BlockAllowCIDRs, err = annotation.ParseCIDRs(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CMKeyBlockAllowCIDRs, err)
+		}
+	}
+
 	return cfg, nil
 }
 
+// parseProxyResources parses the sidecar resource keys and policy maximums
+// ProxyResources is left nil when no resource keys are set
+func parseProxyResources(data map[string]string, cfg *ProxyConfig) error {
+	keys := []struct {
+		key  string
+		name corev1.ResourceName
+		list func(r *corev1.ResourceRequirements) *corev1.ResourceList
+	}{
+		{CMKeyProxyCPURequest, corev1.ResourceCPU, requestsOf},
+		{CMKeyProxyCPULimit, corev1.ResourceCPU, limitsOf},
+		{CMKeyProxyMemoryRequest, corev1.ResourceMemory, requestsOf},
+		{CMKeyProxyMemoryLimit, corev1.ResourceMemory, limitsOf},
+	}
+	for _, k := range keys {
+		v, ok := data[k.key]
+		if !ok {
+			continue
+		}
+		q, err := annotation.ParseQuantity(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", k.key, err)
+		}
+		if cfg.ProxyResources == nil {
+			cfg.ProxyResources = &corev1.ResourceRequirements{}
+		}
+		setResource(k.list(cfg.ProxyResources), k.name, q)
+	}
+
+	if v, ok := data[CMKeyProxyMaxCPU]; ok {
+		q, err := annotation.ParseQuantity(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", CMKeyProxyMaxCPU, err)
+		}
+		cfg.ProxyMaxCPU = &q
+	}
+	if v, ok := data[CMKeyProxyMaxMemory]; ok {
+		q, err := annotation.ParseQuantity(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", CMKeyProxyMaxMemory, err)
+		}
+		cfg.ProxyMaxMemory = &q
+	}
+
+	return nil
+}
+
+// requestsOf returns a pointer to the Requests list
+func requestsOf(r *corev1.ResourceRequirements) *corev1.ResourceList {
+	return &r.Requests
+}
+
+// limitsOf returns a pointer to the Limits list
+func limitsOf(r *corev1.ResourceRequirements) *corev1.ResourceList {
+	return &r.Limits
+}
+
+// setResource sets a quantity in a ResourceList, allocating it if needed
+func setResource(list *corev1.ResourceList, name corev1.ResourceName, q resource.Quantity) {
+	if *list == nil {
+		*list = corev1.ResourceList{}
+	}
+	(*list)[name] = q
+}
+
 // parseSecretRef parses a secret reference string
 // Formats:
 //   - "secret-name" -> SecretRef{Name: "secret-name", Key: defaultKey}
@@ -0,0 +1,30 @@
+package config
+
+import "testing"
+
+// TestParseConfigMap_ProxyImage tests that a ConfigMap without proxy-image gets the documented default
+func TestParseConfigMap_ProxyImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		want  string
+	}{
+		{name: "unset", image: "", want: DefaultProxyImage},
+		{name: "set", image: " oauth2-proxy:v7.8.1 ", want: "oauth2-proxy:v7.8.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{CMKeyProvider: "github", CMKeyClientID: "app", CMKeyPKCEEnabled: "true"}
+			if tt.image != "" {
+				data[CMKeyProxyImage] = tt.image
+			}
+			cfg, err := parseConfigMap(data, "oauth2-proxy", "default")
+			if err != nil {
+				t.Fatalf("parseConfigMap() error = %v", err)
+			}
+			if cfg.ProxyImage != tt.want {
+				t.Errorf("ProxyImage = %q, want %q", cfg.ProxyImage, tt.want)
+			}
+		})
+	}
+}
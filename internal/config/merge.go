@@ -3,7 +3,11 @@ package config
 import (
 	"fmt"
 	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"net/url"
+	"sort"
 	"strings"
 )
 
@@ -35,10 +39,10 @@ func NewMerger() *ConfigMerger {
 //   - If annotation is not set, use ConfigMap value with ValueSourceLiteral
 func (m *ConfigMerger) Merge(base *ProxyConfig, overrides *annotation.Config) (*EffectiveConfig, error) {
 	cfg := &EffectiveConfig{
-		ConfigMapName:      base.Name,
-		ConfigMapNamespace: base.Namespace,
-		ProxyResources:     base.ProxyResources,
-		ExtraArgs:          base.ExtraArgs,
+		ConfigMapName:        base.Name,
+		ConfigMapNamespace:   base.Namespace,
+		ProxySecurityContext: base.ProxySecurityContext,
+		ExtraArgs:            base.ExtraArgs,
 	}
 
 	// Provider settings with SourcedValue support
@@ -47,6 +51,12 @@ func (m *ConfigMerger) Merge(base *ProxyConfig, overrides *annotation.Config) (*
 	cfg.OIDCGroupsClaim = mergeSourcedValue(base.OIDCGroupsClaim, overrides.Overrides.OIDCGroupsClaim)
 	cfg.Scope = mergeSourcedValue(base.Scope, overrides.Overrides.Scope)
 	cfg.ValidateURL = mergeSourcedValue(base.ValidateURL, overrides.Overrides.ValidateURL)
+	mergeProviderSettings(cfg, base, overrides.Overrides)
+	if v, err := selectProviders(base.Providers, overrides.Overrides.Providers); err != nil {
+		return nil, err
+	} else {
+		cfg.Providers = v
+	}
 
 	// Identity settings
 	cfg.ClientID = mergeSourcedValue(base.ClientID, overrides.Overrides.ClientID)
@@ -65,8 +75,8 @@ func (m *ConfigMerger) Merge(base *ProxyConfig, overrides *annotation.Config) (*
 		cfg.ClientSecret = v
 	}
 
-	// Cookie secret with SourcedSecretRef
-	if v, err := mergeSourcedSecretRef(base.CookieSecretRef, overrides.Overrides.CookieSecretRef, "cookie-secret"); err != nil {
+	// Cookie secret with SourcedSecretRef, or a generated per-workload Secret
+	if v, err := mergeCookieSecretRef(base, overrides.Overrides.CookieSecretRef); err != nil {
 		return nil, err
 	} else {
 		cfg.CookieSecret = v
@@ -79,6 +89,41 @@ func (m *ConfigMerger) Merge(base *ProxyConfig, overrides *annotation.Config) (*
 
 	// Container settings
 	cfg.ProxyImage = mergeString(base.ProxyImage, overrides.Overrides.ProxyImage)
+	cfg.IPFamily = base.IPFamily
+	if overrides.Overrides.IPFamily != nil {
+		cfg.IPFamily = *overrides.Overrides.IPFamily
+	}
+	if cfg.IPFamily == "" {
+		cfg.IPFamily = annotation.IPFamilyAuto
+	}
+	cfg.ProxyPort = base.ProxyPort
+	if overrides.Overrides.ProxyPort != nil {
+		cfg.ProxyPort = *overrides.Overrides.ProxyPort
+	}
+	if cfg.ProxyPort == 0 {
+		cfg.ProxyPort = DefaultProxyPort
+	}
+	cfg.Mesh = base.Mesh
+	if overrides.Overrides.Mesh != nil {
+		cfg.Mesh = *overrides.Overrides.Mesh
+	}
+	if cfg.Mesh == "" {
+		cfg.Mesh = annotation.MeshAuto
+	}
+
+	if v, err := mergeProxyResources(base, overrides.Overrides); err != nil {
+		return nil, err
+	} else {
+		cfg.ProxyResources = v
+	}
+	cfg.ProxyImagePullPolicy = base.ProxyImagePullPolicy
+	if overrides.Overrides.ProxyImagePullPolicy != nil {
+		cfg.ProxyImagePullPolicy = *overrides.Overrides.ProxyImagePullPolicy
+	}
+	cfg.ProxyImagePullSecrets = base.ProxyImagePullSecrets
+	if overrides.Overrides.ProxyImagePullSecrets != nil {
+		cfg.ProxyImagePullSecrets = overrides.Overrides.ProxyImagePullSecrets
+	}
 
 	// Routing settings with SourcedValue support
 	cfg.RedirectURL = mergeSourcedValue(base.RedirectURL, overrides.Overrides.RedirectURL)
@@ -90,11 +135,31 @@ func (m *ConfigMerger) Merge(base *ProxyConfig, overrides *annotation.Config) (*
 	cfg.PassAuthorizationHeader = mergeSourcedBool(base.PassAuthorizationHeader, overrides.Overrides.PassAuthorizationHeader)
 	cfg.SkipProviderButton = mergeSourcedBool(base.SkipProviderButton, overrides.Overrides.SkipProviderButton)
 	cfg.Prompt = mergeSourcedValue(base.Prompt, overrides.Overrides.Prompt)
+
+	// Sign-in page settings
+	cfg.CustomTemplatesConfigMap = mergeString(base.CustomTemplatesConfigMap, overrides.Overrides.CustomTemplatesConfigMap)
+	cfg.Banner = mergeSourcedValue(base.Banner, overrides.Overrides.Banner)
+	cfg.Footer = mergeSourcedValue(base.Footer, overrides.Overrides.Footer)
+	cfg.CustomSignInLogo = mergeSourcedValue(base.CustomSignInLogo, overrides.Overrides.CustomSignInLogo)
 	cfg.WhitelistDomains = mergeSourcedStringSlice(base.WhitelistDomains, overrides.Overrides.WhitelistDomains)
 	cfg.EmailDomains = mergeSourcedStringSlice(base.EmailDomains, overrides.Overrides.EmailDomains)
 	cfg.AllowedGroups = mergeSourcedStringSlice(base.AllowedGroups, overrides.Overrides.AllowedGroups)
 	cfg.ExtraJWTIssuers = mergeSourcedStringSlice(base.ExtraJWTIssuers, overrides.Overrides.ExtraJWTIssuers)
 
+	// Block-direct-access firewall settings
+	cfg.BlockAllowKubelet = base.BlockAllowKubelet
+	if overrides.Overrides.BlockAllowKubelet != nil {
+		cfg.BlockAllowKubelet = *overrides.Overrides.BlockAllowKubelet
+	}
+	cfg.BlockDirectProbes = base.BlockDirectProbes
+	if overrides.Overrides.BlockDirectProbes != nil {
+		cfg.BlockDirectProbes = *overrides.Overrides.BlockDirectProbes
+	}
+	cfg.BlockAllowCIDRs = base.BlockAllowCIDRs
+	if overrides.Overrides.BlockAllowCIDRs != nil {
+		cfg.BlockAllowCIDRs = overrides.Overrides.BlockAllowCIDRs
+	}
+
 	// Annotation-only settings
 	cfg.BlockDirectAccess = overrides.BlockDirectAccess
 	cfg.ProtectedPort = overrides.ProtectedPort
@@ -109,6 +174,18 @@ func (m *ConfigMerger) Merge(base *ProxyConfig, overrides *annotation.Config) (*
 	cfg.ExtraEnv = overrides.ExtraEnv
 	cfg.EnvFile = overrides.EnvFile
 
+	// Dynamically registered clients are read from the registration Secret via fromEnv
+	if overrides.ClientRegistration == annotation.ClientRegistrationDynamic {
+		if cfg.EnvSecret != "" {
+			return nil, fmt.Errorf("\nclient-registration: dynamic cannot be combined with env-secret")
+		}
+		cfg.DynamicClientRegistration = true
+		cfg.ClientID = SourcedValue{Source: annotation.ValueSourceEnv}
+		cfg.ClientSecret = SourcedSecretRef{Source: annotation.ValueSourceEnv}
+	}
+
+	recordProvenance(cfg, base, overrides)
+
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
@@ -124,6 +201,82 @@ func mergeString(base string, override *string) string {
 	return base
 }
 
+// mergeProxyResources applies per-resource annotation overrides to the
+// ConfigMap's sidecar resources and enforces the ConfigMap's maximums
+//
+// Returns nil when neither the ConfigMap nor the annotations set anything.
+func mergeProxyResources(base *ProxyConfig, overrides annotation.ConfigOverrides) (*corev1.ResourceRequirements, error) {
+	resourceOverrides := []struct {
+		q    *resource.Quantity
+		name corev1.ResourceName
+		list func(r *corev1.ResourceRequirements) *corev1.ResourceList
+	}{
+		{overrides.ProxyCPURequest, corev1.ResourceCPU, requestsOf},
+		{overrides.ProxyCPULimit, corev1.ResourceCPU, limitsOf},
+		{overrides.ProxyMemoryRequest, corev1.ResourceMemory, requestsOf},
+		{overrides.ProxyMemoryLimit, corev1.ResourceMemory, limitsOf},
+	}
+
+	overridden := false
+	for _, o := range resourceOverrides {
+		overridden = overridden || o.q != nil
+	}
+	if base.ProxyResources == nil && !overridden {
+		return nil, nil
+	}
+
+	ret := &corev1.ResourceRequirements{}
+	if base.ProxyResources != nil {
+		ret = base.ProxyResources.DeepCopy()
+	}
+	for _, o := range resourceOverrides {
+		if o.q != nil {
+			setResource(o.list(ret), o.name, *o.q)
+		}
+	}
+
+	if err := checkProxyResources(ret, base); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// checkProxyResources rejects sidecar resources above the ConfigMap's maximums
+// or with a request above its limit
+// Resources are checked in a fixed order so the same config always reports the same error.
+func checkProxyResources(r *corev1.ResourceRequirements, base *ProxyConfig) error {
+	for _, m := range []struct {
+		name corev1.ResourceName
+		max  *resource.Quantity
+	}{
+		{corev1.ResourceCPU, base.ProxyMaxCPU},
+		{corev1.ResourceMemory, base.ProxyMaxMemory},
+	} {
+		if m.max == nil {
+			continue
+		}
+		if q, ok := r.Requests[m.name]; ok && q.Cmp(*m.max) > 0 {
+			return fmt.Errorf("\nproxy %s request %s exceeds maximum %s", m.name, q.String(), m.max.String())
+		}
+		if q, ok := r.Limits[m.name]; ok && q.Cmp(*m.max) > 0 {
+			return fmt.Errorf("\nproxy %s limit %s exceeds maximum %s", m.name, q.String(), m.max.String())
+		}
+	}
+
+	names := make([]corev1.ResourceName, 0, len(r.Requests))
+	for name := range r.Requests {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, name := range names {
+		req := r.Requests[name]
+		if limit, ok := r.Limits[name]; ok && req.Cmp(limit) > 0 {
+			return fmt.Errorf("\nproxy %s request %s exceeds limit %s", name, req.String(), limit.String())
+		}
+	}
+	return nil
+}
+
 // mergeSourcedValue merges a base string value with a ValueSource override
 //
 // Returns a SourcedValue with the resolved value and source type:
@@ -183,6 +336,21 @@ func mergeSourcedSecretRef(base *SecretRef, override annotation.ValueSource, def
 	}
 }
 
+// mergeCookieSecretRef is mergeSourcedSecretRef plus the "generate" value
+//
+// An annotation (any value) wins over the ConfigMap, so a pod can opt in to
+// generation under a shared ConfigMap secret, or pin a Secret when the
+// ConfigMap generates.
+func mergeCookieSecretRef(base *ProxyConfig, override annotation.ValueSource) (SourcedSecretRef, error) {
+	if override.IsSet() && override.Type == annotation.ValueSourceLiteral && strings.TrimSpace(override.Value) == GenerateSecretRef {
+		return SourcedSecretRef{Source: annotation.ValueSourceLiteral, Generate: true}, nil
+	}
+	if !override.IsSet() && base.GenerateCookieSecret {
+		return SourcedSecretRef{Source: annotation.ValueSourceLiteral, Generate: true}, nil
+	}
+	return mergeSourcedSecretRef(base.CookieSecretRef, override, "cookie-secret")
+}
+
 // mergeSourcedBool merges a base bool value with a BoolValueSource override
 //
 // Returns a SourcedBool with the resolved value and source type:
@@ -237,16 +405,26 @@ func mergeSourcedStringSlice(base []string, override annotation.StringSliceValue
 // 5. For redirect-url: only validate URL format if source is literal and value is set
 // 6. For upstream: only check if ProtectedPort is also empty AND source is not fromEnv
 func (cfg *EffectiveConfig) Validate() error {
+	if len(cfg.Providers) > 0 {
+		if err := cfg.validateProviderBlock(); err != nil {
+			return err
+		}
+		return cfg.validateCommon()
+	}
+
 	// Provider validation - skip if coming from env
 	if cfg.Provider.IsLiteral() && cfg.Provider.Value == "" {
 		return fmt.Errorf("\nprovider unset")
 	}
-	// OIDC issuer validation - only check if provider is literal "oidc" and issuer source is literal
-	if cfg.Provider.IsLiteral() && cfg.Provider.Value == "oidc" {
+	// OIDC issuer validation - only check if provider is literal "oidc"/"keycloak-oidc" and issuer source is literal
+	if cfg.Provider.IsLiteral() && (cfg.Provider.Value == "oidc" || cfg.Provider.Value == "keycloak-oidc") {
 		if cfg.OIDCIssuerURL.IsLiteral() && cfg.OIDCIssuerURL.Value == "" {
-			return fmt.Errorf("\nprovider type oidc requires oidc-issuer-url")
+			return fmt.Errorf("\nprovider type %s requires oidc-issuer-url", cfg.Provider.Value)
 		}
 	}
+	if err := cfg.validateProviderSettings(); err != nil {
+		return err
+	}
 	// Client ID validation - skip if coming from env
 	if cfg.ClientID.IsLiteral() && cfg.ClientID.Value == "" {
 		return fmt.Errorf("\nclient-id unset")
@@ -258,11 +436,16 @@ func (cfg *EffectiveConfig) Validate() error {
 		if !cfg.PKCEEnabled && cfg.ClientSecret.Ref == nil && cfg.ClientSecret.IsLiteral() {
 			return fmt.Errorf("\npkce must be enabled or client-secret-ref provided")
 		}
+	}
 
-		// Cookie secret: required unless source is file/env
-		if cfg.CookieSecret.Ref == nil && cfg.CookieSecret.IsLiteral() {
-			return fmt.Errorf("\ncookie-secret-ref unset")
-		}
+	return cfg.validateCommon()
+}
+
+// validateCommon checks the settings shared by single-provider and provider block configs
+func (cfg *EffectiveConfig) validateCommon() error {
+	// Cookie secret: required unless source is file/env or secrets come from CSI
+	if cfg.SecretProviderClass == "" && cfg.CookieSecret.Ref == nil && !cfg.CookieSecret.Generate && cfg.CookieSecret.IsLiteral() {
+		return fmt.Errorf("\ncookie-secret-ref unset")
 	}
 
 	// URL validation - only validate if literal and non-empty
@@ -291,9 +474,41 @@ func (cfg *EffectiveConfig) Validate() error {
 		return fmt.Errorf("\nupstream-tls invalid")
 	}
 
+	if cfg.IPFamily != annotation.IPFamilyAuto && cfg.IPFamily != annotation.IPFamilyIPv4 && cfg.IPFamily != annotation.IPFamilyIPv6 {
+		return fmt.Errorf("\nip-family invalid")
+	}
+
+	// Probes left on a blocked port only pass if their source is allowlisted
+	if cfg.BlockDirectAccess && cfg.BlockDirectProbes && !cfg.BlockAllowKubelet && len(cfg.BlockAllowCIDRs) == 0 {
+		return fmt.Errorf("\nblock-direct-access-direct-probes requires block-direct-access-allow-kubelet or block-direct-access-allow-cidrs")
+	}
+
+	if cfg.CustomTemplatesConfigMap != "" {
+		if errs := validation.IsDNS1123Subdomain(cfg.CustomTemplatesConfigMap); len(errs) > 0 {
+			return fmt.Errorf("\ncustom-templates-configmap %q invalid: %s", cfg.CustomTemplatesConfigMap, strings.Join(errs, ", "))
+		}
+	}
+	if cfg.CustomSignInLogo.IsLiteral() && IsTemplatesKey(cfg.CustomSignInLogo.Value) {
+		if cfg.CustomTemplatesConfigMap == "" {
+			return fmt.Errorf("\ncustom-sign-in-logo %q is not a URL or absolute path and custom-templates-configmap is unset", cfg.CustomSignInLogo.Value)
+		}
+		if errs := validation.IsConfigMapKey(cfg.CustomSignInLogo.Value); len(errs) > 0 {
+			return fmt.Errorf("\ncustom-sign-in-logo %q invalid: %s", cfg.CustomSignInLogo.Value, strings.Join(errs, ", "))
+		}
+	}
+
 	return nil
 }
 
+// IsTemplatesKey reports whether a custom-sign-in-logo value names a key of
+// the custom templates ConfigMap rather than a URL, an absolute path or "-"
+func IsTemplatesKey(logo string) bool {
+	if logo == "" || logo == "-" || strings.HasPrefix(logo, "/") {
+		return false
+	}
+	return !strings.HasPrefix(logo, "http://") && !strings.HasPrefix(logo, "https://")
+}
+
 // String returns a human-readable summary of the config for logging
 func (cfg *EffectiveConfig) String() string {
 	var builder strings.Builder
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// TestMergeProxyResources tests resource overrides, maximums and request/limit ordering
+func TestMergeProxyResources(t *testing.T) {
+	q := func(s string) *resource.Quantity {
+		v := resource.MustParse(s)
+		return &v
+	}
+	cmResources := func() *corev1.ResourceRequirements {
+		return &corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m"), corev1.ResourceMemory: resource.MustParse("32Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		base      ProxyConfig
+		overrides annotation.ConfigOverrides
+		want      *corev1.ResourceRequirements
+		wantErr   string
+	}{
+		{name: "nothing set", want: nil},
+		{name: "configmap only", base: ProxyConfig{ProxyResources: cmResources()}, want: cmResources()},
+		{
+			name:      "annotation only",
+			overrides: annotation.ConfigOverrides{ProxyMemoryLimit: q("128Mi")},
+			want:      &corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}},
+		},
+		{
+			name:      "annotation overrides one resource",
+			base:      ProxyConfig{ProxyResources: cmResources()},
+			overrides: annotation.ConfigOverrides{ProxyCPULimit: q("200m"), ProxyCPURequest: q("50m")},
+			want: &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("50m"), corev1.ResourceMemory: resource.MustParse("32Mi")},
+				Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+			},
+		},
+		{
+			name:      "request above limit",
+			base:      ProxyConfig{ProxyResources: cmResources()},
+			overrides: annotation.ConfigOverrides{ProxyCPURequest: q("500m")},
+			wantErr:   "cpu request 500m exceeds limit 100m",
+		},
+		{
+			name:      "several requests above limits reports cpu",
+			base:      ProxyConfig{ProxyResources: cmResources()},
+			overrides: annotation.ConfigOverrides{ProxyCPURequest: q("500m"), ProxyMemoryRequest: q("1Gi")},
+			wantErr:   "cpu request 500m exceeds limit 100m",
+		},
+		{
+			name:      "request at limit",
+			overrides: annotation.ConfigOverrides{ProxyMemoryRequest: q("64Mi"), ProxyMemoryLimit: q("64Mi")},
+			want: &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+				Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+			},
+		},
+		{
+			name:      "limit above maximum",
+			base:      ProxyConfig{ProxyResources: cmResources(), ProxyMaxMemory: q("256Mi")},
+			overrides: annotation.ConfigOverrides{ProxyMemoryLimit: q("512Mi")},
+			wantErr:   "memory limit 512Mi exceeds maximum 256Mi",
+		},
+		{
+			name:      "request above maximum",
+			base:      ProxyConfig{ProxyMaxCPU: q("200m")},
+			overrides: annotation.ConfigOverrides{ProxyCPURequest: q("300m")},
+			wantErr:   "cpu request 300m exceeds maximum 200m",
+		},
+		{
+			name:      "both above maximum reports cpu",
+			base:      ProxyConfig{ProxyMaxCPU: q("200m"), ProxyMaxMemory: q("256Mi")},
+			overrides: annotation.ConfigOverrides{ProxyCPULimit: q("1"), ProxyMemoryLimit: q("1Gi")},
+			wantErr:   "cpu limit 1 exceeds maximum 200m",
+		},
+		{
+			name:      "at maximum",
+			base:      ProxyConfig{ProxyMaxCPU: q("200m")},
+			overrides: annotation.ConfigOverrides{ProxyCPULimit: q("200m")},
+			want:      &corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeProxyResources(&tt.base, tt.overrides)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("mergeProxyResources() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeProxyResources() error = %v", err)
+			}
+			if !equalResources(got, tt.want) {
+				t.Errorf("mergeProxyResources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMergeProxyResources_CopiesConfigMap tests that overrides don't leak into the shared ConfigMap config
+func TestMergeProxyResources_CopiesConfigMap(t *testing.T) {
+	base := ProxyConfig{ProxyResources: &corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+	}}
+	cpu := resource.MustParse("50m")
+	if _, err := mergeProxyResources(&base, annotation.ConfigOverrides{ProxyCPULimit: &cpu}); err != nil {
+		t.Fatal(err)
+	}
+	if got := base.ProxyResources.Limits[corev1.ResourceCPU]; got.String() != "100m" {
+		t.Errorf("ConfigMap cpu limit = %s, want 100m", got.String())
+	}
+}
+
+func equalResources(a, b *corev1.ResourceRequirements) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return equalResourceList(a.Requests, b.Requests) && equalResourceList(a.Limits, b.Limits)
+}
+
+func equalResourceList(a, b corev1.ResourceList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, q := range a {
+		other, ok := b[name]
+		if !ok || q.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,289 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// Provenance sources recorded in EffectiveConfig.Provenance
+// ConfigMap sources are "configmap:<namespace>/<name>", see SourceConfigMap;
+// rule, Namespace and workload sources are "rule:<name>", "namespace:<name>"
+// and "workload:<kind>/<name>".
+const (
+	// SourceDefault means neither the ConfigMap nor an annotation set the value
+	SourceDefault = "default"
+
+	// sourceRulePrefix prefixes the rule name in SourceRule
+	sourceRulePrefix = "rule:"
+
+	// redacted replaces values that may contain credentials
+	redacted = "<redacted>"
+)
+
+// SourceRule returns the provenance string for a value set by an injection rule
+func SourceRule(name string) string {
+	return sourceRulePrefix + name
+}
+
+// IsRuleSource reports whether a provenance string came from SourceRule
+func IsRuleSource(source string) bool {
+	return strings.HasPrefix(source, sourceRulePrefix)
+}
+
+// SourceNamespace returns the provenance string for a value set by a Namespace annotation
+func SourceNamespace(name string) string {
+	return "namespace:" + name
+}
+
+// SourceWorkload returns the provenance string for a value inherited from the
+// annotations of the pod's workload, e.g. "workload:Deployment/web"
+func SourceWorkload(kind, name string) string {
+	return "workload:" + kind + "/" + name
+}
+
+// SourceConfigMap returns the provenance string for a value read from a ConfigMap
+func SourceConfigMap(namespace, name string) string {
+	return "configmap:" + namespace + "/" + name
+}
+
+// ExplainedValue is one setting in the effective-config annotation
+type ExplainedValue struct {
+	// Value is the effective value, "fromEnv"/"file" for runtime sources
+	Value interface{} `json:"value,omitempty"`
+
+	// Source is where the value came from, see EffectiveConfig.Provenance
+	Source string `json:"source"`
+}
+
+// setting pairs a setting name with its effective, redacted value
+type setting struct {
+	key   string
+	value interface{}
+}
+
+// Explain returns the effective settings with their provenance
+// Keys are annotation/ConfigMap key names, e.g. "cookie-domains". Settings
+// left at an empty default are omitted to keep the annotation small.
+//
+// Values that may carry credentials (extra-args values, upstream userinfo)
+// are redacted so the result is safe to store on the pod.
+func (cfg *EffectiveConfig) Explain() map[string]ExplainedValue {
+	ret := make(map[string]ExplainedValue)
+	for _, s := range cfg.settings() {
+		source := cfg.Provenance[s.key]
+		if source == SourceDefault && isEmpty(s.value) {
+			continue
+		}
+		ret[s.key] = ExplainedValue{Value: s.value, Source: source}
+	}
+	return ret
+}
+
+// ExplainJSON returns Explain as compact JSON for the effective-config annotation
+func (cfg *EffectiveConfig) ExplainJSON() (string, error) {
+	data, err := json.Marshal(cfg.Explain())
+	if err != nil {
+		return "", fmt.Errorf("encoding effective config: %w", err)
+	}
+	return string(data), nil
+}
+
+// settings lists every setting reported by Explain and tracked in Provenance
+func (cfg *EffectiveConfig) settings() []setting {
+	return []setting{
+		{CMKeyProvider, sourcedValue(cfg.Provider)},
+		{CMKeyOIDCIssuerURL, sourcedValue(cfg.OIDCIssuerURL)},
+		{CMKeyOIDCGroupsClaim, sourcedValue(cfg.OIDCGroupsClaim)},
+		{CMKeyScope, sourcedValue(cfg.Scope)},
+		{CMKeyValidateURL, sourcedValue(cfg.ValidateURL)},
+		{CMKeyProviders, cfg.ProviderIDs()},
+		{CMKeyGitHubOrg, sourcedValue(cfg.GitHubOrg)},
+		{CMKeyGitHubTeams, sourcedStringSlice(cfg.GitHubTeams)},
+		{CMKeyGitHubRepo, sourcedValue(cfg.GitHubRepo)},
+		{CMKeyGitHubUsers, sourcedStringSlice(cfg.GitHubUsers)},
+		{CMKeyGitLabGroups, sourcedStringSlice(cfg.GitLabGroups)},
+		{CMKeyGitLabProjects, sourcedStringSlice(cfg.GitLabProjects)},
+		{CMKeyGoogleGroups, sourcedStringSlice(cfg.GoogleGroups)},
+		{CMKeyGoogleAdminEmail, sourcedValue(cfg.GoogleAdminEmail)},
+		{CMKeyGoogleServiceAccountJSON, sourcedValue(cfg.GoogleServiceAccountJSON)},
+		{CMKeyGoogleUseApplicationDefaultCredentials, sourcedBool(cfg.GoogleUseApplicationDefaultCredentials)},
+		{CMKeyAzureTenant, sourcedValue(cfg.AzureTenant)},
+		{CMKeyKeycloakGroups, sourcedStringSlice(cfg.KeycloakGroups)},
+		{CMKeyClientID, sourcedValue(cfg.ClientID)},
+		{CMKeyClientSecretRef, sourcedSecretRef(cfg.ClientSecret)},
+		{CMKeyPKCEEnabled, cfg.PKCEEnabled},
+		{CMKeyCodeChallengeMethod, sourcedValue(cfg.CodeChallengeMethod)},
+		{CMKeyCookieSecretRef, sourcedSecretRef(cfg.CookieSecret)},
+		{CMKeyCookieDomains, sourcedStringSlice(cfg.CookieDomains)},
+		{CMKeyCookieSecure, sourcedBool(cfg.CookieSecure)},
+		{CMKeyCookieName, sourcedValue(cfg.CookieName)},
+		{CMKeyEmailDomains, sourcedStringSlice(cfg.EmailDomains)},
+		{CMKeyAllowedGroups, sourcedStringSlice(cfg.AllowedGroups)},
+		{CMKeyWhitelistDomains, sourcedStringSlice(cfg.WhitelistDomains)},
+		{CMKeyRedirectURL, sourcedValue(cfg.RedirectURL)},
+		{CMKeyExtraJWTIssuers, sourcedStringSlice(cfg.ExtraJWTIssuers)},
+		{CMKeyPassAccessToken, sourcedBool(cfg.PassAccessToken)},
+		{CMKeySetXAuthRequest, sourcedBool(cfg.SetXAuthRequest)},
+		{CMKeyPassAuthorizationHeader, sourcedBool(cfg.PassAuthorizationHeader)},
+		{CMKeySkipProviderButton, sourcedBool(cfg.SkipProviderButton)},
+		{CMKeyPrompt, sourcedValue(cfg.Prompt)},
+		{CMKeyCustomTemplatesConfigMap, cfg.CustomTemplatesConfigMap},
+		{CMKeyBanner, sourcedValue(cfg.Banner)},
+		{CMKeyFooter, sourcedValue(cfg.Footer)},
+		{CMKeyCustomSignInLogo, sourcedValue(cfg.CustomSignInLogo)},
+		{CMKeyProxyImage, cfg.ProxyImage},
+		{CMKeyExtraArgs, redactArgs(cfg.ExtraArgs)},
+		{CMKeyProxyImagePullPolicy, cfg.ProxyImagePullPolicy},
+		{CMKeyProxyImagePullSecrets, cfg.ProxyImagePullSecrets},
+		{CMKeyProxySecurityContext, cfg.ProxySecurityContext},
+		{CMKeyIPFamily, cfg.IPFamily},
+		{CMKeyProxyPort, cfg.ProxyPort},
+		{CMKeyBlockAllowKubelet, cfg.BlockAllowKubelet},
+		{CMKeyBlockDirectProbes, cfg.BlockDirectProbes},
+		{CMKeyBlockAllowCIDRs, cfg.BlockAllowCIDRs},
+		{CMKeyMesh, cfg.Mesh},
+		{"proxy-resources", cfg.ProxyResources},
+		{shortKey(annotation.KeySkipJWTBearerTokens), sourcedBool(cfg.SkipJWTBearerTokens)},
+		{shortKey(annotation.KeyBlockDirectAccess), cfg.BlockDirectAccess},
+		{shortKey(annotation.KeyProtectedPort), cfg.ProtectedPort},
+		{shortKey(annotation.KeyUpstream), redactUpstream(cfg.Upstream)},
+		{shortKey(annotation.KeyUpstreamTLS), cfg.UpstreamTLS},
+		{shortKey(annotation.KeyIgnorePaths), cfg.IgnorePaths},
+		{shortKey(annotation.KeyAPIPaths), cfg.APIPaths},
+		{shortKey(annotation.KeyPingPath), cfg.PingPath},
+		{shortKey(annotation.KeyReadyPath), cfg.ReadyPath},
+		{shortKey(annotation.KeySecretProviderClass), cfg.SecretProviderClass},
+		{shortKey(annotation.KeyEnvSecret), cfg.EnvSecret},
+		{shortKey(annotation.KeyExtraEnv), cfg.ExtraEnv},
+		{shortKey(annotation.KeyEnvFile), cfg.EnvFile},
+		{shortKey(annotation.KeyClientRegistration), cfg.DynamicClientRegistration},
+	}
+}
+
+// recordProvenance fills cfg.Provenance once all fields are merged
+//
+// A setting comes from whichever layer last set it: an annotation (or any
+// other source the parser recorded), the ConfigMap, or the built-in default.
+// Resources have one entry per annotation but are reported together, so any
+// resource annotation marks them as overridden.
+func recordProvenance(cfg *EffectiveConfig, base *ProxyConfig, overrides *annotation.Config) {
+	cfg.Provenance = make(map[string]string)
+	for _, s := range cfg.settings() {
+		keys := []string{s.key}
+		if s.key == "proxy-resources" {
+			keys = []string{CMKeyProxyCPURequest, CMKeyProxyCPULimit, CMKeyProxyMemoryRequest, CMKeyProxyMemoryLimit}
+		}
+
+		cfg.Provenance[s.key] = SourceDefault
+		for _, k := range keys {
+			if src, ok := overrides.Sources[k]; ok {
+				cfg.Provenance[s.key] = src
+				break
+			}
+			if base.Keys[k] {
+				cfg.Provenance[s.key] = SourceConfigMap(base.Namespace, base.Name)
+			}
+		}
+	}
+
+	// Registered clients replace whatever client-id/secret were configured
+	if cfg.DynamicClientRegistration {
+		src := cfg.Provenance[shortKey(annotation.KeyClientRegistration)]
+		cfg.Provenance[CMKeyClientID] = src
+		cfg.Provenance[CMKeyClientSecretRef] = src
+	}
+}
+
+// isEmpty reports nil, zero and zero-length values
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map:
+		return rv.Len() == 0
+	}
+	return rv.IsZero()
+}
+
+// shortKey strips the annotation prefix, e.g. "spacemule.net/oauth2-proxy.upstream" -> "upstream"
+func shortKey(key string) string {
+	return strings.TrimPrefix(key, annotation.AnnotationPrefix)
+}
+
+// sourcedValue reports runtime-resolved values by source rather than value
+func sourcedValue(sv SourcedValue) interface{} {
+	switch {
+	case sv.IsFromEnv():
+		return string(annotation.ValueSourceEnv)
+	case sv.IsFromFile():
+		return string(annotation.ValueSourceFile)
+	}
+	return sv.Value
+}
+
+func sourcedBool(sb SourcedBool) interface{} {
+	if sb.IsFromEnv() {
+		return string(annotation.ValueSourceEnv)
+	}
+	return sb.Value
+}
+
+func sourcedStringSlice(ss SourcedStringSlice) interface{} {
+	if ss.IsFromEnv() {
+		return string(annotation.ValueSourceEnv)
+	}
+	return ss.Values
+}
+
+// sourcedSecretRef reports the Secret name:key, never its contents
+func sourcedSecretRef(ssr SourcedSecretRef) interface{} {
+	switch {
+	case ssr.IsFromEnv():
+		return string(annotation.ValueSourceEnv)
+	case ssr.IsFromFile():
+		return string(annotation.ValueSourceFile)
+	case ssr.Ref != nil:
+		return ssr.Ref.Name + ":" + ssr.Ref.Key
+	case ssr.Generate:
+		return GenerateSecretRef
+	}
+	return nil
+}
+
+// redactArgs keeps flag names but drops their values
+func redactArgs(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	ret := make([]string, len(args))
+	for i, a := range args {
+		if idx := strings.IndexAny(a, "= "); idx >= 0 {
+			ret[i] = a[:idx+1] + redacted
+		} else {
+			ret[i] = a
+		}
+	}
+	return ret
+}
+
+// redactUpstream hides credentials embedded in the upstream URL
+func redactUpstream(sv SourcedValue) interface{} {
+	v := sourcedValue(sv)
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		authority, _, _ := strings.Cut(rest, "/")
+		if at := strings.LastIndex(authority, "@"); at >= 0 {
+			return scheme + "://" + redacted + "@" + rest[at+1:]
+		}
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// TestExplain_Redaction tests that credentials never reach the effective-config annotation
+func TestExplain_Redaction(t *testing.T) {
+	const password = "hunter2"
+	cfg := &EffectiveConfig{
+		Provenance:   map[string]string{},
+		ClientSecret: SourcedSecretRef{Ref: &SecretRef{Name: "oauth2", Key: "client-secret"}},
+		CookieSecret: SourcedSecretRef{Source: annotation.ValueSourceFile, FilePath: "/mnt/secrets/cookie"},
+		ExtraArgs:    []string{"--client-secret=" + password, "--basic-auth-password " + password, "--skip-auth-preflight"},
+		Upstream:     SourcedValue{Value: "http://admin:" + password + "@localhost:8080/api"},
+	}
+
+	explained := cfg.Explain()
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{key: CMKeyClientSecretRef, want: "oauth2:client-secret"},
+		{key: CMKeyCookieSecretRef, want: string(annotation.ValueSourceFile)},
+		{key: CMKeyExtraArgs, want: []string{"--client-secret=" + redacted, "--basic-auth-password " + redacted, "--skip-auth-preflight"}},
+		{key: shortKey(annotation.KeyUpstream), want: "http://" + redacted + "@localhost:8080/api"},
+	}
+	for _, tt := range tests {
+		got := explained[tt.key].Value
+		if want, ok := tt.want.([]string); ok {
+			if args, _ := got.([]string); !slices.Equal(args, want) {
+				t.Errorf("Explain()[%s] = %v, want %v", tt.key, got, want)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Explain()[%s] = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	data, err := cfg.ExplainJSON()
+	if err != nil {
+		t.Fatalf("ExplainJSON() error = %v", err)
+	}
+	if strings.Contains(data, password) {
+		t.Errorf("ExplainJSON() leaks a credential: %s", data)
+	}
+}
+
+// TestRedactUpstream tests that only URL userinfo is hidden
+func TestRedactUpstream(t *testing.T) {
+	tests := []struct {
+		name string
+		in   SourcedValue
+		want interface{}
+	}{
+		{name: "no credentials", in: SourcedValue{Value: "http://localhost:8080"}, want: "http://localhost:8080"},
+		{name: "user and password", in: SourcedValue{Value: "https://u:p@app.svc:8443/x"}, want: "https://" + redacted + "@app.svc:8443/x"},
+		{name: "at sign in path", in: SourcedValue{Value: "http://localhost:8080/users/@me"}, want: "http://localhost:8080/users/@me"},
+		{name: "file URL", in: SourcedValue{Value: "file:///var/www"}, want: "file:///var/www"},
+		{name: "fromEnv", in: SourcedValue{Source: annotation.ValueSourceEnv}, want: string(annotation.ValueSourceEnv)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactUpstream(tt.in); got != tt.want {
+				t.Errorf("redactUpstream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
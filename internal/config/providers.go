@@ -0,0 +1,349 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// providerSettingKeys maps each provider type to the provider-specific
+// settings it accepts. oauth2-proxy silently ignores settings meant for
+// another provider, so Validate rejects them instead.
+var providerSettingKeys = map[string][]string{
+	"github":        {CMKeyGitHubOrg, CMKeyGitHubTeams, CMKeyGitHubRepo, CMKeyGitHubUsers},
+	"gitlab":        {CMKeyGitLabGroups, CMKeyGitLabProjects},
+	"google":        {CMKeyGoogleGroups, CMKeyGoogleAdminEmail, CMKeyGoogleServiceAccountJSON, CMKeyGoogleUseApplicationDefaultCredentials},
+	"azure":         {CMKeyAzureTenant},
+	"keycloak":      {CMKeyKeycloakGroups},
+	"keycloak-oidc": {CMKeyKeycloakGroups},
+}
+
+// parseProviderSettings reads the provider-specific keys from ConfigMap data
+func parseProviderSettings(data map[string]string, cfg *ProxyConfig) error {
+	for key, dst := range map[string]*string{
+		CMKeyGitHubOrg:                &cfg.GitHubOrg,
+		CMKeyGitHubRepo:               &cfg.GitHubRepo,
+		CMKeyGoogleAdminEmail:         &cfg.GoogleAdminEmail,
+		CMKeyGoogleServiceAccountJSON: &cfg.GoogleServiceAccountJSON,
+		CMKeyAzureTenant:              &cfg.AzureTenant,
+	} {
+		if v, ok := data[key]; ok {
+			*dst = strings.TrimSpace(v)
+		}
+	}
+
+	for key, dst := range map[string]*[]string{
+		CMKeyGitHubTeams:    &cfg.GitHubTeams,
+		CMKeyGitHubUsers:    &cfg.GitHubUsers,
+		CMKeyGitLabGroups:   &cfg.GitLabGroups,
+		CMKeyGitLabProjects: &cfg.GitLabProjects,
+		CMKeyGoogleGroups:   &cfg.GoogleGroups,
+		CMKeyKeycloakGroups: &cfg.KeycloakGroups,
+	} {
+		if v, ok := data[key]; ok {
+			*dst = splitAndTrim(v, ",")
+		}
+	}
+
+	if v, ok := data[CMKeyGoogleUseApplicationDefaultCredentials]; ok {
+		b, err := parseBool(v, false)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", CMKeyGoogleUseApplicationDefaultCredentials, err)
+		}
+		cfg.GoogleUseApplicationDefaultCredentials = b
+	}
+
+	return nil
+}
+
+// mergeProviderSettings applies annotation overrides to the provider-specific settings
+func mergeProviderSettings(cfg *EffectiveConfig, base *ProxyConfig, overrides annotation.ConfigOverrides) {
+	cfg.GitHubOrg = mergeSourcedValue(base.GitHubOrg, overrides.GitHubOrg)
+	cfg.GitHubTeams = mergeSourcedStringSlice(base.GitHubTeams, overrides.GitHubTeams)
+	cfg.GitHubRepo = mergeSourcedValue(base.GitHubRepo, overrides.GitHubRepo)
+	cfg.GitHubUsers = mergeSourcedStringSlice(base.GitHubUsers, overrides.GitHubUsers)
+	cfg.GitLabGroups = mergeSourcedStringSlice(base.GitLabGroups, overrides.GitLabGroups)
+	cfg.GitLabProjects = mergeSourcedStringSlice(base.GitLabProjects, overrides.GitLabProjects)
+	cfg.GoogleGroups = mergeSourcedStringSlice(base.GoogleGroups, overrides.GoogleGroups)
+	cfg.GoogleAdminEmail = mergeSourcedValue(base.GoogleAdminEmail, overrides.GoogleAdminEmail)
+	cfg.GoogleServiceAccountJSON = mergeSourcedValue(base.GoogleServiceAccountJSON, overrides.GoogleServiceAccountJSON)
+	cfg.GoogleUseApplicationDefaultCredentials = mergeSourcedBool(base.GoogleUseApplicationDefaultCredentials, overrides.GoogleUseApplicationDefaultCredentials)
+	cfg.AzureTenant = mergeSourcedValue(base.AzureTenant, overrides.AzureTenant)
+	cfg.KeycloakGroups = mergeSourcedStringSlice(base.KeycloakGroups, overrides.KeycloakGroups)
+}
+
+// providerSettingsSet returns which provider-specific settings are in use
+// A fromEnv setting counts as set since the sidecar will read it.
+func (cfg *EffectiveConfig) providerSettingsSet() map[string]bool {
+	value := func(v SourcedValue) bool { return v.IsFromEnv() || v.Value != "" }
+	slice := func(v SourcedStringSlice) bool { return v.IsFromEnv() || len(v.Values) > 0 }
+	boolean := func(v SourcedBool) bool { return v.IsFromEnv() || v.Value }
+
+	return map[string]bool{
+		CMKeyGitHubOrg:                              value(cfg.GitHubOrg),
+		CMKeyGitHubTeams:                            slice(cfg.GitHubTeams),
+		CMKeyGitHubRepo:                             value(cfg.GitHubRepo),
+		CMKeyGitHubUsers:                            slice(cfg.GitHubUsers),
+		CMKeyGitLabGroups:                           slice(cfg.GitLabGroups),
+		CMKeyGitLabProjects:                         slice(cfg.GitLabProjects),
+		CMKeyGoogleGroups:                           slice(cfg.GoogleGroups),
+		CMKeyGoogleAdminEmail:                       value(cfg.GoogleAdminEmail),
+		CMKeyGoogleServiceAccountJSON:               value(cfg.GoogleServiceAccountJSON),
+		CMKeyGoogleUseApplicationDefaultCredentials: boolean(cfg.GoogleUseApplicationDefaultCredentials),
+		CMKeyAzureTenant:                            value(cfg.AzureTenant),
+		CMKeyKeycloakGroups:                         slice(cfg.KeycloakGroups),
+	}
+}
+
+// validateProviderSettings checks that provider-specific settings match the
+// provider and that each provider's required combinations are present
+//
+// When the provider itself comes from env or a file it is unknown here, so
+// only the format checks run.
+func (cfg *EffectiveConfig) validateProviderSettings() error {
+	set := cfg.providerSettingsSet()
+
+	if cfg.Provider.IsLiteral() {
+		allowed := map[string]bool{}
+		for _, key := range providerSettingKeys[cfg.Provider.Value] {
+			allowed[key] = true
+		}
+		var wrong []string
+		for key, ok := range set {
+			if ok && !allowed[key] {
+				wrong = append(wrong, key)
+			}
+		}
+		if len(wrong) > 0 {
+			sort.Strings(wrong)
+			return fmt.Errorf("\n%s not supported by provider %q", strings.Join(wrong, ", "), cfg.Provider.Value)
+		}
+	}
+
+	if cfg.GitHubRepo.IsLiteral() && cfg.GitHubRepo.Value != "" {
+		if parts := strings.Split(cfg.GitHubRepo.Value, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("\ngithub-repo %q must be owner/repo", cfg.GitHubRepo.Value)
+		}
+	}
+
+	if cfg.GitLabProjects.IsLiteral() {
+		for _, p := range cfg.GitLabProjects.Values {
+			project, level, hasLevel := strings.Cut(p, "=")
+			if !strings.Contains(project, "/") {
+				return fmt.Errorf("\ngitlab-project %q must be group/project", p)
+			}
+			if _, err := strconv.Atoi(level); hasLevel && err != nil {
+				return fmt.Errorf("\ngitlab-project %q access level must be a number", p)
+			}
+		}
+	}
+
+	// oauth2-proxy requires all of google-group, google-admin-email and
+	// credentials as soon as any one of them is set
+	if set[CMKeyGoogleGroups] || set[CMKeyGoogleAdminEmail] || set[CMKeyGoogleServiceAccountJSON] {
+		if !set[CMKeyGoogleGroups] {
+			return fmt.Errorf("\ngoogle-admin-email and google-service-account-json require google-group")
+		}
+		if !set[CMKeyGoogleAdminEmail] {
+			return fmt.Errorf("\ngoogle-group requires google-admin-email")
+		}
+		if !set[CMKeyGoogleServiceAccountJSON] && !set[CMKeyGoogleUseApplicationDefaultCredentials] {
+			return fmt.Errorf("\ngoogle-group requires google-service-account-json or google-use-application-default-credentials")
+		}
+	}
+
+	return nil
+}
+
+// ProviderBlock is one named login provider from the ConfigMap's providers key
+// The selected block is rendered as an oauth2-proxy alpha-config provider, so
+// one ConfigMap can hold the logins of several services.
+type ProviderBlock struct {
+	// ID names the block; annotations select blocks by ID
+	// Must be a DNS label, it is used in file paths
+	ID string `json:"id"`
+
+	// Provider is the oauth2-proxy provider type
+	Provider string `json:"provider"`
+
+	// Name is the label on the sign-in button, defaults to the provider's own
+	Name string `json:"name,omitempty"`
+
+	OIDCIssuerURL       string   `json:"oidc-issuer-url,omitempty"`
+	OIDCGroupsClaim     string   `json:"oidc-groups-claim,omitempty"`
+	ClientID            string   `json:"client-id"`
+	ClientSecretRef     string   `json:"client-secret-ref,omitempty"`
+	Scope               string   `json:"scope,omitempty"`
+	CodeChallengeMethod string   `json:"code-challenge-method,omitempty"`
+	AllowedGroups       []string `json:"allowed-groups,omitempty"`
+
+	GitHubOrg                              string   `json:"github-org,omitempty"`
+	GitHubTeams                            []string `json:"github-team,omitempty"`
+	GitHubRepo                             string   `json:"github-repo,omitempty"`
+	GitHubUsers                            []string `json:"github-user,omitempty"`
+	GitLabGroups                           []string `json:"gitlab-group,omitempty"`
+	GitLabProjects                         []string `json:"gitlab-project,omitempty"`
+	GoogleGroups                           []string `json:"google-group,omitempty"`
+	GoogleAdminEmail                       string   `json:"google-admin-email,omitempty"`
+	GoogleServiceAccountJSON               string   `json:"google-service-account-json,omitempty"`
+	GoogleUseApplicationDefaultCredentials bool     `json:"google-use-application-default-credentials,omitempty"`
+	AzureTenant                            string   `json:"azure-tenant,omitempty"`
+	KeycloakGroups                         []string `json:"keycloak-group,omitempty"`
+
+	// ClientSecret is ClientSecretRef parsed, nil with PKCE and no secret
+	ClientSecret *SecretRef `json:"-"`
+}
+
+// parseProviderBlocks parses and validates the providers key
+func parseProviderBlocks(value string) ([]ProviderBlock, error) {
+	var blocks []ProviderBlock
+	if err := yaml.UnmarshalStrict([]byte(value), &blocks); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", CMKeyProviders, err)
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("invalid %s: no providers listed", CMKeyProviders)
+	}
+
+	seen := make(map[string]bool, len(blocks))
+	for i := range blocks {
+		b := &blocks[i]
+		if errs := validation.IsDNS1123Label(b.ID); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid %s: id %q: %s", CMKeyProviders, b.ID, strings.Join(errs, ", "))
+		}
+		if seen[b.ID] {
+			return nil, fmt.Errorf("invalid %s: duplicate id %q", CMKeyProviders, b.ID)
+		}
+		seen[b.ID] = true
+
+		if b.ClientSecretRef != "" {
+			ref, err := parseSecretRef(b.ClientSecretRef, "client-secret")
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: provider %s: %w", CMKeyProviders, b.ID, err)
+			}
+			b.ClientSecret = ref
+		}
+		if err := b.validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s: provider %s: %w", CMKeyProviders, b.ID, err)
+		}
+	}
+
+	return blocks, nil
+}
+
+// validate applies the single-provider rules to a block
+func (b ProviderBlock) validate() error {
+	if b.Provider == "" {
+		return fmt.Errorf("provider unset")
+	}
+	if b.ClientID == "" {
+		return fmt.Errorf("client-id unset")
+	}
+	if b.ClientSecret == nil && b.CodeChallengeMethod == "" {
+		return fmt.Errorf("code-challenge-method or client-secret-ref required")
+	}
+	if b.CodeChallengeMethod != "" && b.CodeChallengeMethod != "S256" && b.CodeChallengeMethod != "plain" {
+		return fmt.Errorf("code-challenge-method %q must be S256 or plain", b.CodeChallengeMethod)
+	}
+	if (b.Provider == "oidc" || b.Provider == "keycloak-oidc") && b.OIDCIssuerURL == "" {
+		return fmt.Errorf("provider type %s requires oidc-issuer-url", b.Provider)
+	}
+
+	// Reuse the top-level provider-specific checks on a literal-only view of the block
+	view := &EffectiveConfig{
+		Provider:                               literal(b.Provider),
+		GitHubOrg:                              literal(b.GitHubOrg),
+		GitHubTeams:                            literalSlice(b.GitHubTeams),
+		GitHubRepo:                             literal(b.GitHubRepo),
+		GitHubUsers:                            literalSlice(b.GitHubUsers),
+		GitLabGroups:                           literalSlice(b.GitLabGroups),
+		GitLabProjects:                         literalSlice(b.GitLabProjects),
+		GoogleGroups:                           literalSlice(b.GoogleGroups),
+		GoogleAdminEmail:                       literal(b.GoogleAdminEmail),
+		GoogleServiceAccountJSON:               literal(b.GoogleServiceAccountJSON),
+		GoogleUseApplicationDefaultCredentials: SourcedBool{Value: b.GoogleUseApplicationDefaultCredentials, Source: annotation.ValueSourceLiteral},
+		AzureTenant:                            literal(b.AzureTenant),
+		KeycloakGroups:                         literalSlice(b.KeycloakGroups),
+	}
+	if err := view.validateProviderSettings(); err != nil {
+		return fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "\n"))
+	}
+	return nil
+}
+
+// selectProviders returns the block named by the providers annotation, or
+// the only block when the annotation is unset
+//
+// oauth2-proxy builds only the first provider of an alpha config and rejects
+// skip-provider-button with more than one, so a pod gets exactly one block;
+// a ConfigMap listing several is a catalogue pods choose from.
+func selectProviders(blocks []ProviderBlock, ids []string) ([]ProviderBlock, error) {
+	if ids == nil {
+		if len(blocks) > 1 {
+			return nil, fmt.Errorf("\nConfigMap %s lists %d providers, select one with the providers annotation", CMKeyProviders, len(blocks))
+		}
+		return blocks, nil
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("\nproviders annotation requires a ConfigMap with a %s key", CMKeyProviders)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("\nproviders annotation selects no providers")
+	}
+	if len(ids) > 1 {
+		return nil, fmt.Errorf("\nproviders annotation selects %d providers, oauth2-proxy supports one per pod", len(ids))
+	}
+
+	for _, b := range blocks {
+		if b.ID == ids[0] {
+			return []ProviderBlock{b}, nil
+		}
+	}
+	return nil, fmt.Errorf("\nprovider %q not defined in ConfigMap %s", ids[0], CMKeyProviders)
+}
+
+// literal wraps a string as a literal SourcedValue
+func literal(v string) SourcedValue {
+	return SourcedValue{Value: v, Source: annotation.ValueSourceLiteral}
+}
+
+// literalSlice wraps a slice as a literal SourcedStringSlice
+func literalSlice(v []string) SourcedStringSlice {
+	return SourcedStringSlice{Values: v, Source: annotation.ValueSourceLiteral, Set: len(v) > 0}
+}
+
+// validateProviderBlock rejects settings that can't be expressed in an alpha
+// config. Upstreams and headers move into the alpha config, so their values
+// must be known at injection time.
+func (cfg *EffectiveConfig) validateProviderBlock() error {
+	if cfg.DynamicClientRegistration {
+		return fmt.Errorf("\nclient-registration: dynamic cannot be combined with %s", CMKeyProviders)
+	}
+	if cfg.Upstream.IsFromEnv() {
+		return fmt.Errorf("\nupstream: fromEnv cannot be combined with %s", CMKeyProviders)
+	}
+	for key, v := range map[string]SourcedBool{
+		CMKeyPassAccessToken:         cfg.PassAccessToken,
+		CMKeySetXAuthRequest:         cfg.SetXAuthRequest,
+		CMKeyPassAuthorizationHeader: cfg.PassAuthorizationHeader,
+	} {
+		if v.IsFromEnv() {
+			return fmt.Errorf("\n%s: fromEnv cannot be combined with %s", key, CMKeyProviders)
+		}
+	}
+	return nil
+}
+
+// ProviderIDs returns the ID of the selected provider block, if any
+func (cfg *EffectiveConfig) ProviderIDs() []string {
+	var ret []string
+	for _, b := range cfg.Providers {
+		ret = append(ret, b.ID)
+	}
+	return ret
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// TestSelectProviders tests that a pod gets exactly one provider block
+func TestSelectProviders(t *testing.T) {
+	corp := ProviderBlock{ID: "corp", Provider: "oidc"}
+	github := ProviderBlock{ID: "github", Provider: "github"}
+
+	tests := []struct {
+		name    string
+		blocks  []ProviderBlock
+		ids     []string
+		want    string
+		wantErr string
+	}{
+		{name: "no blocks", blocks: nil, ids: nil, want: ""},
+		{name: "only block", blocks: []ProviderBlock{corp}, ids: nil, want: "corp"},
+		{name: "selected", blocks: []ProviderBlock{corp, github}, ids: []string{"github"}, want: "github"},
+		{name: "several blocks unselected", blocks: []ProviderBlock{corp, github}, ids: nil, wantErr: "select one"},
+		{name: "several selected", blocks: []ProviderBlock{corp, github}, ids: []string{"corp", "github"}, wantErr: "one per pod"},
+		{name: "empty selection", blocks: []ProviderBlock{corp}, ids: []string{}, wantErr: "selects no providers"},
+		{name: "unknown id", blocks: []ProviderBlock{corp}, ids: []string{"gitlab"}, wantErr: `"gitlab" not defined`},
+		{name: "no providers key", blocks: nil, ids: []string{"corp"}, wantErr: "requires a ConfigMap"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectProviders(tt.blocks, tt.ids)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectProviders() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectProviders() error = %v", err)
+			}
+			if ids := strings.Join((&EffectiveConfig{Providers: got}).ProviderIDs(), ","); ids != tt.want {
+				t.Errorf("selectProviders() = %q, want %q", ids, tt.want)
+			}
+		})
+	}
+}
+
+// TestValidateProviderSettings tests each provider's allowed and required settings
+func TestValidateProviderSettings(t *testing.T) {
+	literal := func(v string) SourcedValue { return SourcedValue{Value: v} }
+	list := func(v ...string) SourcedStringSlice { return SourcedStringSlice{Values: v, Set: true} }
+	fromEnv := SourcedValue{Source: annotation.ValueSourceEnv}
+
+	tests := []struct {
+		name    string
+		cfg     EffectiveConfig
+		wantErr string
+	}{
+		{name: "oidc without extras", cfg: EffectiveConfig{Provider: literal("oidc")}},
+		{
+			name: "github",
+			cfg: EffectiveConfig{
+				Provider:    literal("github"),
+				GitHubOrg:   literal("acme"),
+				GitHubTeams: list("sre", "dev"),
+				GitHubRepo:  literal("acme/app"),
+				GitHubUsers: list("alice"),
+			},
+		},
+		{name: "github repo without owner", cfg: EffectiveConfig{Provider: literal("github"), GitHubRepo: literal("app")}, wantErr: "must be owner/repo"},
+		{name: "github repo from env", cfg: EffectiveConfig{Provider: literal("github"), GitHubRepo: fromEnv}},
+		{name: "gitlab", cfg: EffectiveConfig{Provider: literal("gitlab"), GitLabGroups: list("acme"), GitLabProjects: list("acme/app", "acme/lib=30")}},
+		{name: "gitlab project without group", cfg: EffectiveConfig{Provider: literal("gitlab"), GitLabProjects: list("app")}, wantErr: "must be group/project"},
+		{name: "gitlab project bad level", cfg: EffectiveConfig{Provider: literal("gitlab"), GitLabProjects: list("acme/app=dev")}, wantErr: "access level must be a number"},
+		{
+			name: "google with service account",
+			cfg: EffectiveConfig{
+				Provider:                 literal("google"),
+				GoogleGroups:             list("admins@acme.com"),
+				GoogleAdminEmail:         literal("admin@acme.com"),
+				GoogleServiceAccountJSON: literal("/etc/google/sa.json"),
+			},
+		},
+		{
+			name: "google with application default credentials",
+			cfg: EffectiveConfig{
+				Provider:                               literal("google"),
+				GoogleGroups:                           list("admins@acme.com"),
+				GoogleAdminEmail:                       literal("admin@acme.com"),
+				GoogleUseApplicationDefaultCredentials: SourcedBool{Value: true},
+			},
+		},
+		{
+			name:    "google admin email without group",
+			cfg:     EffectiveConfig{Provider: literal("google"), GoogleAdminEmail: literal("admin@acme.com")},
+			wantErr: "require google-group",
+		},
+		{
+			name:    "google group without admin email",
+			cfg:     EffectiveConfig{Provider: literal("google"), GoogleGroups: list("admins@acme.com")},
+			wantErr: "requires google-admin-email",
+		},
+		{
+			name: "google group without credentials",
+			cfg: EffectiveConfig{
+				Provider:         literal("google"),
+				GoogleGroups:     list("admins@acme.com"),
+				GoogleAdminEmail: literal("admin@acme.com"),
+			},
+			wantErr: "google-service-account-json or google-use-application-default-credentials",
+		},
+		{name: "azure", cfg: EffectiveConfig{Provider: literal("azure"), AzureTenant: literal("contoso")}},
+		{name: "keycloak", cfg: EffectiveConfig{Provider: literal("keycloak"), KeycloakGroups: list("/admins")}},
+		{name: "keycloak-oidc", cfg: EffectiveConfig{Provider: literal("keycloak-oidc"), KeycloakGroups: list("/admins")}},
+		{name: "setting for another provider", cfg: EffectiveConfig{Provider: literal("oidc"), GitHubOrg: literal("acme")}, wantErr: `github-org not supported by provider "oidc"`},
+		{
+			name:    "several wrong settings sorted",
+			cfg:     EffectiveConfig{Provider: literal("azure"), KeycloakGroups: list("/admins"), GitHubOrg: literal("acme")},
+			wantErr: `github-org, keycloak-group not supported`,
+		},
+		{name: "fromEnv setting for another provider", cfg: EffectiveConfig{Provider: literal("gitlab"), AzureTenant: fromEnv}, wantErr: "azure-tenant not supported"},
+		{name: "provider from env skips provider check", cfg: EffectiveConfig{Provider: fromEnv, AzureTenant: literal("contoso")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validateProviderSettings()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("validateProviderSettings() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateProviderSettings() error = %v", err)
+			}
+		})
+	}
+}
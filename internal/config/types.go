@@ -5,6 +5,7 @@ import (
 
 	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 // ProxyConfig holds the oauth2-proxy configuration loaded from a ConfigMap
@@ -17,6 +18,10 @@ type ProxyConfig struct {
 	// Namespace is where the ConfigMap lives
 	Namespace string
 
+	// Keys records which ConfigMap keys were present, for provenance
+	// Fields whose key is absent hold built-in defaults
+	Keys map[string]bool
+
 	// ===== Provider Settings (shared across namespace) =====
 
 	// Provider is the OAuth2 provider (e.g., "oidc", "google", "github")
@@ -37,6 +42,52 @@ type ProxyConfig struct {
 	// ValidateURL specifies the validation URL for opaque tokens
 	ValidateURL string
 
+	// Providers are named provider blocks pods select one of
+	// When set they replace the single provider settings above and the
+	// sidecar is configured with an oauth2-proxy alpha config
+	// Overridable: pods select a subset by ID
+	Providers []ProviderBlock
+
+	// ===== Provider-Specific Settings (overridable per-service) =====
+	// Each is only valid with its provider; see providerSettingKeys
+
+	// GitHubOrg restricts logins to members of a GitHub organisation
+	GitHubOrg string
+
+	// GitHubTeams restricts logins to members of these team slugs
+	GitHubTeams []string
+
+	// GitHubRepo restricts logins to collaborators of "owner/repo"
+	GitHubRepo string
+
+	// GitHubUsers allows these GitHub users regardless of org/team
+	GitHubUsers []string
+
+	// GitLabGroups restricts logins to members of these GitLab groups
+	GitLabGroups []string
+
+	// GitLabProjects restricts logins to members of these "group/project[=accesslevel]"
+	GitLabProjects []string
+
+	// GoogleGroups restricts logins to members of these Google groups
+	// Requires GoogleAdminEmail and a service account or application default credentials
+	GoogleGroups []string
+
+	// GoogleAdminEmail is the Google Workspace admin impersonated for group lookups
+	GoogleAdminEmail string
+
+	// GoogleServiceAccountJSON is the path to the service account key inside the sidecar
+	GoogleServiceAccountJSON string
+
+	// GoogleUseApplicationDefaultCredentials uses workload identity instead of a key file
+	GoogleUseApplicationDefaultCredentials bool
+
+	// AzureTenant is the Azure AD tenant (oauth2-proxy default: "common")
+	AzureTenant string
+
+	// KeycloakGroups restricts logins to members of these Keycloak groups
+	KeycloakGroups []string
+
 	// ===== Identity Settings (overridable per-service) =====
 
 	// ClientID is the OAuth2 client ID
@@ -65,6 +116,10 @@ type ProxyConfig struct {
 	// Overridable: Services may need isolated cookie encryption
 	CookieSecretRef *SecretRef
 
+	// GenerateCookieSecret is set by cookie-secret-ref: generate
+	// Each workload gets its own generated Secret instead of a shared one
+	GenerateCookieSecret bool
+
 	// CookieDomains sets the domain for oauth2-proxy cookies
 	// Leave empty for automatic domain detection
 	// Overridable: Different services may have different domains
@@ -140,6 +195,24 @@ type ProxyConfig struct {
 	// Overridable: Different services may need different prompt behavior
 	Prompt string
 
+	// ===== Sign-in Page Settings =====
+
+	// CustomTemplatesConfigMap is a ConfigMap in the pod's namespace mounted
+	// as oauth2-proxy's --custom-templates-dir
+	// Optional - the stock templates are used if empty
+	// Overridable: each service may have its own branding
+	CustomTemplatesConfigMap string
+
+	// Banner and Footer are shown on the sign-in page. "-" hides them
+	// Overridable: per service
+	Banner string
+	Footer string
+
+	// CustomSignInLogo is a URL, a key of CustomTemplatesConfigMap, an
+	// absolute path, or "-" to hide the logo
+	// Overridable: per service
+	CustomSignInLogo string
+
 	// ===== Container Settings (ConfigMap only) =====
 
 	// ExtraArgs contains any additional oauth2-proxy arguments
@@ -152,8 +225,53 @@ type ProxyConfig struct {
 	ProxyImage string
 
 	// ProxyResources specifies resource requests/limits for the sidecar
-	// Optional - uses oauth2-proxy defaults if not set
+	// Built from the proxy-cpu-*/proxy-memory-* keys; nil if none are set
+	// Overridable: per-resource via proxy-cpu-request etc. annotations
 	ProxyResources *corev1.ResourceRequirements
+
+	// ProxyMaxCPU and ProxyMaxMemory bound every sidecar request and limit,
+	// including annotation overrides. nil means unbounded
+	ProxyMaxCPU    *resource.Quantity
+	ProxyMaxMemory *resource.Quantity
+
+	// ProxyImagePullPolicy is the sidecar's imagePullPolicy
+	// Optional - Kubernetes defaults apply if empty
+	ProxyImagePullPolicy corev1.PullPolicy
+
+	// ProxyImagePullSecrets are Secrets added to the pod's imagePullSecrets
+	// so the proxy image can be pulled from a private registry
+	ProxyImagePullSecrets []string
+
+	// ProxySecurityContext replaces the sidecar's hardened default SecurityContext
+	// Optional - nil uses mutation.DefaultSecurityContext (PSA "restricted" compliant)
+	ProxySecurityContext *corev1.SecurityContext
+
+	// IPFamily selects the loopback address used for the upstream
+	// Default: "auto" (localhost, both families). "ipv4" or "ipv6" pin one.
+	// Overridable: Pods may pin a different family
+	IPFamily annotation.IPFamily
+
+	// ProxyPort is the port oauth2-proxy listens on
+	// Default: DefaultProxyPort. Overridable: Pods may pick a free port
+	ProxyPort int32
+
+	// ===== Block Direct Access Settings (overridable) =====
+
+	// Mesh selects how block-direct-access coexists with a service mesh sidecar
+	// Default: "auto", detected per pod
+	Mesh annotation.Mesh
+
+	// BlockAllowKubelet lets the node IP reach the protected port when
+	// block-direct-access is enabled
+	BlockAllowKubelet bool
+
+	// BlockDirectProbes leaves probes pointing at the app instead of rerouting
+	// them through oauth2-proxy; requires their source to be allowlisted
+	BlockDirectProbes bool
+
+	// BlockAllowCIDRs are extra source ranges allowed to reach the protected port
+	// Example: a Prometheus scraper's pod CIDR
+	BlockAllowCIDRs []string
 }
 
 // SecretRef references a key in a Kubernetes Secret
@@ -193,6 +311,9 @@ func (sv SourcedValue) IsLiteral() bool {
 type SourcedSecretRef struct {
 	Ref    *SecretRef
 	Source annotation.ValueSourceType
+	// Generate asks the webhook to create a per-workload Secret and fill in Ref
+	// Only supported for the cookie secret, set by the value "generate"
+	Generate bool
 	// FilePath is the explicit file path when Source is ValueSourceFile
 	// If empty and Source is ValueSourceFile, uses the default CSI mount path
 	FilePath string
@@ -351,6 +472,63 @@ const (
 	// When set, approval-prompt is ignored by oauth2-proxy
 	CMKeyPrompt = "prompt"
 
+	// CMKeyProviders is a YAML list of named provider blocks (see ProviderBlock)
+	// Replaces provider, client-id and the other provider keys when set
+	CMKeyProviders = "providers"
+
+	// ===== Sign-in Page Settings (overridable) =====
+
+	// CMKeyCustomTemplatesConfigMap names a ConfigMap of sign_in.html, error.html and logos
+	// The ConfigMap is looked up in the pod's namespace
+	CMKeyCustomTemplatesConfigMap = "custom-templates-configmap"
+
+	// CMKeyBanner is the sign-in page banner ("-" hides it)
+	CMKeyBanner = "banner"
+
+	// CMKeyFooter is the sign-in page footer ("-" hides it)
+	CMKeyFooter = "footer"
+
+	// CMKeyCustomSignInLogo is a URL, templates ConfigMap key, absolute path or "-"
+	CMKeyCustomSignInLogo = "custom-sign-in-logo"
+
+	// ===== Provider-Specific Settings (overridable) =====
+
+	// CMKeyGitHubOrg is the GitHub organisation logins are restricted to
+	CMKeyGitHubOrg = "github-org"
+
+	// CMKeyGitHubTeams is comma-separated GitHub team slugs
+	CMKeyGitHubTeams = "github-team"
+
+	// CMKeyGitHubRepo is the "owner/repo" whose collaborators may log in
+	CMKeyGitHubRepo = "github-repo"
+
+	// CMKeyGitHubUsers is comma-separated GitHub usernames
+	CMKeyGitHubUsers = "github-user"
+
+	// CMKeyGitLabGroups is comma-separated GitLab group paths
+	CMKeyGitLabGroups = "gitlab-group"
+
+	// CMKeyGitLabProjects is comma-separated "group/project[=accesslevel]"
+	CMKeyGitLabProjects = "gitlab-project"
+
+	// CMKeyGoogleGroups is comma-separated Google group emails
+	CMKeyGoogleGroups = "google-group"
+
+	// CMKeyGoogleAdminEmail is the admin impersonated for Google group lookups
+	CMKeyGoogleAdminEmail = "google-admin-email"
+
+	// CMKeyGoogleServiceAccountJSON is the service account key path in the sidecar
+	CMKeyGoogleServiceAccountJSON = "google-service-account-json"
+
+	// CMKeyGoogleUseApplicationDefaultCredentials uses workload identity for group lookups
+	CMKeyGoogleUseApplicationDefaultCredentials = "google-use-application-default-credentials"
+
+	// CMKeyAzureTenant is the Azure AD tenant
+	CMKeyAzureTenant = "azure-tenant"
+
+	// CMKeyKeycloakGroups is comma-separated Keycloak group paths
+	CMKeyKeycloakGroups = "keycloak-group"
+
 	// ===== Container Settings (not overridable) =====
 
 	// CMKeyExtraArgs is newline-separated extra arguments
@@ -359,17 +537,74 @@ const (
 
 	// CMKeyProxyImage is the oauth2-proxy container image
 	CMKeyProxyImage = "proxy-image"
+
+	// CMKeyProxyCPURequest is the sidecar's CPU request (e.g., "10m")
+	CMKeyProxyCPURequest = "proxy-cpu-request"
+
+	// CMKeyProxyCPULimit is the sidecar's CPU limit (e.g., "100m")
+	CMKeyProxyCPULimit = "proxy-cpu-limit"
+
+	// CMKeyProxyMemoryRequest is the sidecar's memory request (e.g., "32Mi")
+	CMKeyProxyMemoryRequest = "proxy-memory-request"
+
+	// CMKeyProxyMemoryLimit is the sidecar's memory limit (e.g., "128Mi")
+	CMKeyProxyMemoryLimit = "proxy-memory-limit"
+
+	// CMKeyProxyMaxCPU is the largest CPU request/limit annotations may set
+	CMKeyProxyMaxCPU = "proxy-max-cpu"
+
+	// CMKeyProxyMaxMemory is the largest memory request/limit annotations may set
+	CMKeyProxyMaxMemory = "proxy-max-memory"
+
+	// CMKeyProxyImagePullPolicy is the sidecar's imagePullPolicy
+	CMKeyProxyImagePullPolicy = "proxy-image-pull-policy"
+
+	// CMKeyProxyImagePullSecrets is comma-separated Secret names for pulling the proxy image
+	CMKeyProxyImagePullSecrets = "proxy-image-pull-secrets"
+
+	// CMKeyProxySecurityContext is a YAML/JSON corev1.SecurityContext for the sidecar
+	// Replaces the hardened default entirely, it is not merged field by field
+	CMKeyProxySecurityContext = "proxy-security-context"
+
+	// CMKeyIPFamily is the IP family of the localhost upstream ("auto", "ipv4" or "ipv6")
+	CMKeyIPFamily = "ip-family"
+
+	// CMKeyProxyPort is the port oauth2-proxy listens on
+	CMKeyProxyPort = "proxy-port"
+
+	// ===== Block Direct Access Settings (overridable) =====
+
+	// CMKeyBlockAllowKubelet allows the node IP through the firewall
+	CMKeyBlockAllowKubelet = "block-direct-access-allow-kubelet"
+
+	// CMKeyBlockDirectProbes leaves probes pointing at the app
+	CMKeyBlockDirectProbes = "block-direct-access-direct-probes"
+
+	// CMKeyMesh is the service mesh mode ("auto", "istio", "linkerd" or "none")
+	CMKeyMesh = "mesh"
+
+	// CMKeyBlockAllowCIDRs is comma-separated CIDRs allowed through the firewall
+	CMKeyBlockAllowCIDRs = "block-direct-access-allow-cidrs"
 )
 
+// GenerateSecretRef is the cookie-secret-ref value that requests a generated Secret
+const GenerateSecretRef = "generate"
+
 // DefaultProxyImage is the default oauth2-proxy container image
 const DefaultProxyImage = "quay.io/oauth2-proxy/oauth2-proxy:v7.14.2"
 
+// DefaultProxyPort is the default port oauth2-proxy listens on
+const DefaultProxyPort int32 = 4180
+
 // NewEmptyProxyConfig creates an empty ProxyConfig with sensible defaults
 // Used for annotation-only mode where no ConfigMap is specified
 func NewEmptyProxyConfig() *ProxyConfig {
 	return &ProxyConfig{
 		ProxyImage:   DefaultProxyImage,
 		CookieSecure: true,
+		IPFamily:     annotation.IPFamilyAuto,
+		ProxyPort:    DefaultProxyPort,
+		Mesh:         annotation.MeshAuto,
 	}
 }
 
@@ -390,6 +625,11 @@ type EffectiveConfig struct {
 	ConfigMapName      string
 	ConfigMapNamespace string
 
+	// Provenance maps each setting name (e.g. "cookie-domains") to where its
+	// value came from: SourceDefault, SourceConfigMap(...) or an annotation source.
+	// Excluded from Hash so moving a value between layers isn't drift.
+	Provenance map[string]string `json:"-"`
+
 	// ===== Provider Settings (merged, supports fromEnv) =====
 
 	Provider        SourcedValue
@@ -398,6 +638,26 @@ type EffectiveConfig struct {
 	Scope           SourcedValue
 	ValidateURL     SourcedValue
 
+	// Providers holds the selected provider block, at most one (no fromEnv)
+	// Non-empty means the single provider settings are not rendered and the
+	// sidecar reads an alpha config instead
+	Providers []ProviderBlock
+
+	// ===== Provider-Specific Settings (merged, supports fromEnv) =====
+
+	GitHubOrg                              SourcedValue
+	GitHubTeams                            SourcedStringSlice
+	GitHubRepo                             SourcedValue
+	GitHubUsers                            SourcedStringSlice
+	GitLabGroups                           SourcedStringSlice
+	GitLabProjects                         SourcedStringSlice
+	GoogleGroups                           SourcedStringSlice
+	GoogleAdminEmail                       SourcedValue
+	GoogleServiceAccountJSON               SourcedValue
+	GoogleUseApplicationDefaultCredentials SourcedBool
+	AzureTenant                            SourcedValue
+	KeycloakGroups                         SourcedStringSlice
+
 	// ===== Identity Settings (merged, supports fromEnv) =====
 
 	ClientID            SourcedValue
@@ -438,21 +698,39 @@ type EffectiveConfig struct {
 	// Value: space-delimited list (e.g., "none", "login", "consent", "select_account")
 	Prompt SourcedValue
 
+	// ===== Sign-in Page Settings =====
+
+	// CustomTemplatesConfigMap is mounted as --custom-templates-dir (no fromEnv)
+	CustomTemplatesConfigMap string
+
+	Banner           SourcedValue
+	Footer           SourcedValue
+	CustomSignInLogo SourcedValue
+
 	// ===== Container Settings =====
 
 	// ProxyImage is the oauth2-proxy container image (plain string, no fromEnv)
 	// This is used by the webhook at pod creation time, not by oauth2-proxy at runtime
-	ProxyImage     string
-	ExtraArgs      []string                    // ConfigMap only, no fromEnv
-	ProxyResources *corev1.ResourceRequirements // ConfigMap only
+	ProxyImage            string
+	ExtraArgs             []string                     // ConfigMap only, no fromEnv
+	ProxyResources        *corev1.ResourceRequirements // ConfigMap defaults, per-resource annotation overrides
+	ProxySecurityContext  *corev1.SecurityContext      // ConfigMap only, nil means hardened default
+	ProxyImagePullPolicy  corev1.PullPolicy
+	ProxyImagePullSecrets []string // added to the pod's imagePullSecrets
 
 	// ===== Pod-Specific Settings (annotation-only, NO fromEnv support) =====
 	// These are inherently per-pod and wouldn't make sense from env vars
 
 	BlockDirectAccess bool
+	BlockAllowKubelet bool            // node IP may reach the protected port
+	BlockDirectProbes bool            // probes aren't rerouted, their source must be allowlisted
+	BlockAllowCIDRs   []string        // extra source ranges allowed to reach the protected port
+	Mesh              annotation.Mesh // service mesh handling for block-direct-access
 	ProtectedPort     string
 	Upstream          SourcedValue               // supports fromEnv (not strictly pod-specific)
 	UpstreamTLS       annotation.UpstreamTLSMode // "http", "https", "https-insecure"
+	IPFamily          annotation.IPFamily        // loopback family for the default upstream
+	ProxyPort         int32                      // port oauth2-proxy listens on
 	IgnorePaths       []string                   // pod-specific routing
 	APIPaths          []string                   // pod-specific routing
 	PingPath          string                     // pod-specific probe config
@@ -479,6 +757,11 @@ type EffectiveConfig struct {
 	// Requires EnvSecret to be set
 	ExtraEnv map[string]string
 
+	// DynamicClientRegistration means client-id and client-secret come from the
+	// Secret written by the client-registration controller. The mutator points
+	// EnvSecret at it once the workload is known.
+	DynamicClientRegistration bool
+
 	// EnvFile is the path to a file to source before starting oauth2-proxy
 	// When set, the container command becomes:
 	//   /bin/sh -c "source <path> && exec /bin/oauth2-proxy ..."
@@ -0,0 +1,207 @@
+package discovery
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// Event reasons recorded on ConfigMaps
+const (
+	ReasonDiscoveryFailed      = "OIDCDiscoveryFailed"
+	ReasonDiscoveryValid       = "OIDCDiscoveryValid"
+	ReasonDiscoveryUnavailable = "OIDCDiscoveryUnavailable"
+)
+
+// ValidatingLoader wraps a config.Loader and validates every ConfigMap it
+// has loaded against the issuer's discovery document in the background
+//
+// Admission never waits on the issuer: Load only records which ConfigMaps
+// are in use, and Run re-loads and validates them. Results are exposed as
+// metrics, Events on the ConfigMap and through Ready.
+type ValidatingLoader struct {
+	loader    config.Loader
+	validator *Validator
+
+	// recorder emits Events on ConfigMaps, may be nil
+	recorder record.EventRecorder
+
+	mu sync.Mutex
+	// configs are the ConfigMaps to validate, keyed by namespace/name
+	configs map[string]configKey
+	// results is the last definite validation result per ConfigMap, nil when valid
+	results map[string]error
+	// unavailable is the last fetch error per ConfigMap, cleared once a fetch succeeds
+	unavailable map[string]error
+}
+
+// configKey identifies a ConfigMap
+type configKey struct {
+	name      string
+	namespace string
+}
+
+func (k configKey) String() string {
+	return k.namespace + "/" + k.name
+}
+
+// NewValidatingLoader creates a ValidatingLoader
+// recorder may be nil to skip Events.
+func NewValidatingLoader(loader config.Loader, validator *Validator, recorder record.EventRecorder) *ValidatingLoader {
+	return &ValidatingLoader{
+		loader:      loader,
+		validator:   validator,
+		recorder:    recorder,
+		configs:     make(map[string]configKey),
+		results:     make(map[string]error),
+		unavailable: make(map[string]error),
+	}
+}
+
+// Load delegates to the wrapped loader and tracks the ConfigMap for validation
+func (l *ValidatingLoader) Load(ctx context.Context, name, namespace string) (*config.ProxyConfig, error) {
+	cfg, err := l.loader.Load(ctx, name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	l.Track(cfg.Name, cfg.Namespace)
+	return cfg, nil
+}
+
+// Track adds a ConfigMap to the set validated by Run
+// The default ConfigMap is tracked at startup so it is checked before first use.
+func (l *ValidatingLoader) Track(name, namespace string) {
+	key := configKey{name: name, namespace: namespace}
+	l.mu.Lock()
+	l.configs[key.String()] = key
+	l.mu.Unlock()
+}
+
+// Ready returns the last validation error for a ConfigMap
+// ConfigMaps that haven't been validated yet are reported ready, and one
+// whose issuer or ConfigMap can't be fetched keeps its last result, so an
+// issuer outage doesn't take every webhook replica out of the Service.
+func (l *ValidatingLoader) Ready(name, namespace string) error {
+	key := configKey{name: name, namespace: namespace}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.results[key.String()]
+}
+
+// Run calls Sync every interval until ctx is cancelled
+func (l *ValidatingLoader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		l.Sync(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync re-loads and validates every tracked ConfigMap
+// ConfigMaps that no longer exist stop being tracked.
+func (l *ValidatingLoader) Sync(ctx context.Context) {
+	l.mu.Lock()
+	keys := make([]configKey, 0, len(l.configs))
+	for _, key := range l.configs {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	for _, key := range keys {
+		cfg, err := l.loader.Load(ctx, key.name, key.namespace)
+		if apierrors.IsNotFound(err) {
+			l.forget(key)
+			continue
+		}
+		if err == nil {
+			err = l.validator.Validate(ctx, cfg)
+		}
+		l.record(key, err)
+	}
+}
+
+// forget stops tracking a deleted ConfigMap
+func (l *ValidatingLoader) forget(key configKey) {
+	l.mu.Lock()
+	delete(l.configs, key.String())
+	delete(l.results, key.String())
+	delete(l.unavailable, key.String())
+	l.mu.Unlock()
+	discoveryValid.DeleteLabelValues(key.String())
+}
+
+// record stores a result, updates metrics and emits an Event when the result changes
+// Fetch errors are recorded by recordUnavailable instead.
+func (l *ValidatingLoader) record(key configKey, err error) {
+	if err != nil && !isMismatch(err) {
+		l.recordUnavailable(key, err)
+		return
+	}
+
+	l.mu.Lock()
+	previous, seen := l.results[key.String()]
+	l.results[key.String()] = err
+	delete(l.unavailable, key.String())
+	l.mu.Unlock()
+
+	if err != nil {
+		discoveryValid.WithLabelValues(key.String()).Set(0)
+		discoveryFailures.Inc()
+		klog.ErrorS(err, "OIDC discovery validation failed", "configmap", klog.KRef(key.namespace, key.name))
+	} else {
+		discoveryValid.WithLabelValues(key.String()).Set(1)
+	}
+
+	if l.recorder == nil || (seen && sameResult(previous, err)) {
+		return
+	}
+	ref := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: key.name, Namespace: key.namespace}}
+	switch {
+	case err != nil:
+		l.recorder.Event(ref, corev1.EventTypeWarning, ReasonDiscoveryFailed, err.Error())
+	case seen:
+		l.recorder.Event(ref, corev1.EventTypeNormal, ReasonDiscoveryValid, "oidc-issuer-url matches the discovery document")
+	}
+}
+
+// recordUnavailable counts a fetch error and emits an Event when it changes,
+// keeping the last result
+func (l *ValidatingLoader) recordUnavailable(key configKey, err error) {
+	l.mu.Lock()
+	previous, seen := l.unavailable[key.String()]
+	l.unavailable[key.String()] = err
+	l.mu.Unlock()
+
+	discoveryFetchErrors.Inc()
+	klog.ErrorS(err, "OIDC discovery validation skipped, keeping the last result", "configmap", klog.KRef(key.namespace, key.name))
+	if l.recorder == nil || (seen && sameResult(previous, err)) {
+		return
+	}
+	ref := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: key.name, Namespace: key.namespace}}
+	l.recorder.Event(ref, corev1.EventTypeWarning, ReasonDiscoveryUnavailable, err.Error())
+}
+
+// sameResult reports whether two validation results are equivalent
+func sameResult(a, b error) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Error() == b.Error()
+}
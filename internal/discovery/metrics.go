@@ -0,0 +1,34 @@
+package discovery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "oauth2_proxy_injector"
+
+var (
+	// discoveryValid is 1 when a ConfigMap matches its issuer's discovery document
+	discoveryValid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "oidc_discovery_valid",
+		Help:      "Whether a ConfigMap's OIDC settings match its issuer's discovery document (1) or not (0).",
+	}, []string{"configmap"})
+
+	// discoveryFailures counts validations that found a mismatch
+	discoveryFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oidc_discovery_failures_total",
+		Help:      "Number of OIDC discovery validations that found a mismatch.",
+	})
+
+	// discoveryFetchErrors counts validations that couldn't fetch the document or ConfigMap
+	discoveryFetchErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oidc_discovery_fetch_errors_total",
+		Help:      "Number of OIDC discovery validations that couldn't fetch the discovery document or ConfigMap.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(discoveryValid, discoveryFailures, discoveryFetchErrors)
+}
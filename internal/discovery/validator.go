@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// Document is the subset of an OpenID Provider Metadata document that is checked
+type Document struct {
+	Issuer                        string   `json:"issuer"`
+	ScopesSupported               []string `json:"scopes_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+}
+
+// mismatchError is a setting the discovery document contradicts, as opposed
+// to a document that couldn't be fetched
+type mismatchError struct {
+	msg string
+}
+
+func (e *mismatchError) Error() string {
+	return e.msg
+}
+
+// isMismatch reports whether err is a definite mismatch rather than a fetch error
+func isMismatch(err error) bool {
+	var m *mismatchError
+	return errors.As(err, &m)
+}
+
+// Validator checks a ProxyConfig against its issuer's discovery document
+type Validator struct {
+	httpClient *http.Client
+
+	// ttl is how long a fetched document is reused
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedDocument
+}
+
+// cachedDocument is a fetched document and when it was fetched
+type cachedDocument struct {
+	doc     *Document
+	fetched time.Time
+}
+
+// NewValidator creates a Validator
+// httpClient may be nil to use a client with a 10 second timeout.
+func NewValidator(httpClient *http.Client, ttl time.Duration) *Validator {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Validator{
+		httpClient: httpClient,
+		ttl:        ttl,
+		cache:      make(map[string]cachedDocument),
+	}
+}
+
+// Validate fetches <oidc-issuer-url>/.well-known/openid-configuration and
+// checks that the issuer matches exactly and that the configured scopes and
+// PKCE method are advertised. ConfigMaps without an issuer URL are skipped.
+// Mismatches are reported apart from fetch errors, see isMismatch.
+//
+// scopes_supported and code_challenge_methods_supported are optional in
+// the spec, so they are only checked when the issuer publishes them.
+func (v *Validator) Validate(ctx context.Context, cfg *config.ProxyConfig) error {
+	if cfg.OIDCIssuerURL == "" {
+		return nil
+	}
+
+	doc, err := v.document(ctx, cfg.OIDCIssuerURL)
+	if err != nil {
+		return err
+	}
+
+	// oauth2-proxy verifies the issuer claim byte for byte, trailing slash included
+	if doc.Issuer != cfg.OIDCIssuerURL {
+		return &mismatchError{fmt.Sprintf("oidc-issuer-url %q does not match issuer %q in the discovery document", cfg.OIDCIssuerURL, doc.Issuer)}
+	}
+
+	if len(doc.ScopesSupported) > 0 {
+		for _, scope := range strings.Fields(cfg.Scope) {
+			if !slices.Contains(doc.ScopesSupported, scope) {
+				return &mismatchError{fmt.Sprintf("scope %q is not in scopes_supported %v", scope, doc.ScopesSupported)}
+			}
+		}
+	}
+
+	if cfg.PKCEEnabled || cfg.CodeChallengeMethod != "" {
+		method := cfg.CodeChallengeMethod
+		if method == "" {
+			method = "S256"
+		}
+		if len(doc.CodeChallengeMethodsSupported) > 0 && !slices.Contains(doc.CodeChallengeMethodsSupported, method) {
+			return &mismatchError{fmt.Sprintf("code-challenge-method %q is not in code_challenge_methods_supported %v", method, doc.CodeChallengeMethodsSupported)}
+		}
+	}
+
+	return nil
+}
+
+// document returns the issuer's discovery document, fetching it if the
+// cached copy is missing or older than the TTL
+// Failed fetches aren't cached so a fixed issuer recovers on the next check.
+func (v *Validator) document(ctx context.Context, issuer string) (*Document, error) {
+	v.mu.Lock()
+	cached, ok := v.cache[issuer]
+	v.mu.Unlock()
+	if ok && time.Since(cached.fetched) < v.ttl {
+		return cached.doc, nil
+	}
+
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery request to %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery at %s failed: %s", url, resp.Status)
+	}
+
+	var doc Document
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid discovery document at %s: %w", url, err)
+	}
+
+	v.mu.Lock()
+	v.cache[issuer] = cachedDocument{doc: &doc, fetched: time.Now()}
+	v.mu.Unlock()
+	return &doc, nil
+}
@@ -0,0 +1,242 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// fakeIssuer serves a discovery document and counts fetches
+type fakeIssuer struct {
+	server  *httptest.Server
+	doc     Document
+	fetches int
+	// down makes the issuer answer 503 Service Unavailable
+	down bool
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	f := &fakeIssuer{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		f.fetches++
+		if f.down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(f.doc)
+	}))
+	t.Cleanup(f.server.Close)
+	f.doc = Document{
+		Issuer:                        f.server.URL,
+		ScopesSupported:               []string{"openid", "email", "profile", "groups"},
+		CodeChallengeMethodsSupported: []string{"S256"},
+	}
+	return f
+}
+
+// TestValidate tests issuer, scope and PKCE checks against a stand-in issuer
+func TestValidate(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	tests := []struct {
+		name    string
+		cfg     config.ProxyConfig
+		wantErr string
+	}{
+		{
+			name: "valid",
+			cfg:  config.ProxyConfig{OIDCIssuerURL: issuer.server.URL, Scope: "openid email groups", PKCEEnabled: true},
+		},
+		{
+			name: "no issuer is skipped",
+			cfg:  config.ProxyConfig{Scope: "anything"},
+		},
+		{
+			name:    "trailing slash mismatch",
+			cfg:     config.ProxyConfig{OIDCIssuerURL: issuer.server.URL + "/"},
+			wantErr: "does not match issuer",
+		},
+		{
+			name:    "unsupported scope",
+			cfg:     config.ProxyConfig{OIDCIssuerURL: issuer.server.URL, Scope: "openid offline_access"},
+			wantErr: `scope "offline_access"`,
+		},
+		{
+			name:    "unsupported PKCE method",
+			cfg:     config.ProxyConfig{OIDCIssuerURL: issuer.server.URL, CodeChallengeMethod: "plain"},
+			wantErr: `code-challenge-method "plain"`,
+		},
+		{
+			name:    "unreachable issuer",
+			cfg:     config.ProxyConfig{OIDCIssuerURL: issuer.server.URL + "/typo"},
+			wantErr: "404",
+		},
+	}
+
+	validator := NewValidator(issuer.server.Client(), time.Minute)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.Validate(context.Background(), &tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestValidate_UnadvertisedListsAreNotChecked tests issuers that omit the optional fields
+func TestValidate_UnadvertisedListsAreNotChecked(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	issuer.doc.ScopesSupported = nil
+	issuer.doc.CodeChallengeMethodsSupported = nil
+
+	validator := NewValidator(issuer.server.Client(), time.Minute)
+	cfg := &config.ProxyConfig{OIDCIssuerURL: issuer.server.URL, Scope: "openid custom", PKCEEnabled: true}
+	if err := validator.Validate(context.Background(), cfg); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+}
+
+// TestValidate_CachesDocument tests that documents are reused within the TTL
+func TestValidate_CachesDocument(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	cfg := &config.ProxyConfig{OIDCIssuerURL: issuer.server.URL}
+
+	validator := NewValidator(issuer.server.Client(), time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := validator.Validate(context.Background(), cfg); err != nil {
+			t.Fatalf("Validate() error = %v", err)
+		}
+	}
+	if issuer.fetches != 1 {
+		t.Errorf("fetches = %d, want 1 within the TTL", issuer.fetches)
+	}
+
+	expired := NewValidator(issuer.server.Client(), 0)
+	expired.Validate(context.Background(), cfg)
+	expired.Validate(context.Background(), cfg)
+	if issuer.fetches != 3 {
+		t.Errorf("fetches = %d, want 3 with a zero TTL", issuer.fetches)
+	}
+}
+
+// TestValidatingLoader tests tracking, readiness and Events for a ConfigMap
+// whose issuer is fixed after a failed check
+func TestValidatingLoader(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "oauth2-proxy", Namespace: "system"},
+		Data: map[string]string{
+			config.CMKeyProvider:      "oidc",
+			config.CMKeyOIDCIssuerURL: issuer.server.URL + "/",
+			config.CMKeyClientID:      "client",
+			config.CMKeyPKCEEnabled:   "true",
+		},
+	}
+	client := fake.NewSimpleClientset(cm)
+	recorder := record.NewFakeRecorder(10)
+	loader := NewValidatingLoader(config.NewLoader(client, "system"), NewValidator(issuer.server.Client(), 0), recorder)
+	ctx := context.Background()
+
+	// Nothing is checked until a ConfigMap is loaded or tracked
+	loader.Sync(ctx)
+	if err := loader.Ready("oauth2-proxy", "system"); err != nil {
+		t.Fatalf("Ready() before load = %v, want nil", err)
+	}
+
+	if _, err := loader.Load(ctx, "oauth2-proxy", "system"); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	loader.Sync(ctx)
+	if err := loader.Ready("oauth2-proxy", "system"); err == nil {
+		t.Fatal("Ready() with mismatched issuer = nil, want error")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonDiscoveryFailed) {
+		t.Errorf("event = %q, want %s", event, ReasonDiscoveryFailed)
+	}
+
+	// The same failure isn't reported twice
+	loader.Sync(ctx)
+	if len(recorder.Events) != 0 {
+		t.Errorf("repeated failure emitted %d more events, want 0", len(recorder.Events))
+	}
+
+	cm.Data[config.CMKeyOIDCIssuerURL] = issuer.server.URL
+	if _, err := client.CoreV1().ConfigMaps("system").Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	loader.Sync(ctx)
+	if err := loader.Ready("oauth2-proxy", "system"); err != nil {
+		t.Errorf("Ready() after fix = %v, want nil", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonDiscoveryValid) {
+		t.Errorf("event = %q, want %s", event, ReasonDiscoveryValid)
+	}
+}
+
+// TestValidatingLoader_IssuerUnavailable tests that an unreachable issuer
+// keeps the last result instead of failing readiness
+func TestValidatingLoader_IssuerUnavailable(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "oauth2-proxy", Namespace: "system"},
+		Data: map[string]string{
+			config.CMKeyProvider:      "oidc",
+			config.CMKeyOIDCIssuerURL: issuer.server.URL,
+			config.CMKeyClientID:      "client",
+			config.CMKeyPKCEEnabled:   "true",
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	loader := NewValidatingLoader(config.NewLoader(fake.NewSimpleClientset(cm), "system"), NewValidator(issuer.server.Client(), 0), recorder)
+	loader.Track("oauth2-proxy", "system")
+	ctx := context.Background()
+
+	// Down before the first check: nothing is known, so it stays ready
+	issuer.down = true
+	loader.Sync(ctx)
+	if err := loader.Ready("oauth2-proxy", "system"); err != nil {
+		t.Errorf("Ready() with issuer down before any check = %v, want nil", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonDiscoveryUnavailable) {
+		t.Errorf("event = %q, want %s", event, ReasonDiscoveryUnavailable)
+	}
+
+	// A mismatch found while up isn't cleared by the issuer going down
+	issuer.down = false
+	issuer.doc.Issuer = "https://elsewhere.example.com"
+	loader.Sync(ctx)
+	if err := loader.Ready("oauth2-proxy", "system"); err == nil {
+		t.Fatal("Ready() with mismatched issuer = nil, want error")
+	}
+	<-recorder.Events
+	issuer.down = true
+	loader.Sync(ctx)
+	if err := loader.Ready("oauth2-proxy", "system"); err == nil {
+		t.Error("Ready() after issuer went down = nil, want the last mismatch")
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonDiscoveryUnavailable) {
+		t.Errorf("event = %q, want %s", event, ReasonDiscoveryUnavailable)
+	}
+}
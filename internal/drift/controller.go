@@ -0,0 +1,233 @@
+package drift
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+)
+
+// Drift reasons reported in the reason label
+const (
+	// ReasonImage means the proxy image changed
+	ReasonImage = "image"
+
+	// ReasonConfig means some other part of the EffectiveConfig changed
+	ReasonConfig = "config"
+
+	// ReasonUnstamped means the pod was injected before hashes were recorded
+	ReasonUnstamped = "unstamped"
+
+	// ReasonUnguarded means the pod asked the CNI plugin for block-direct-access
+	// but its network came up without the plugin stamping the guarded ports
+	ReasonUnguarded = "unguarded"
+)
+
+// restartedAtAnnotation is the pod template annotation kubectl rollout restart sets
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// ConfigResolver computes the config that would be injected into a pod now
+// Implemented by mutation.PodMutator
+type ConfigResolver interface {
+	ResolveConfig(ctx context.Context, pod *corev1.Pod) (*config.EffectiveConfig, error)
+}
+
+// Controller periodically compares injected pods against current settings
+type Controller struct {
+	client   kubernetes.Interface
+	resolver ConfigResolver
+	owners   owner.Resolver
+
+	// restart triggers a rollout restart of drifted Deployments and StatefulSets
+	restart bool
+
+	// restarted maps an owner to the config hash it was last restarted towards,
+	// so a rollout in progress isn't restarted again on every sync
+	restarted map[string]string
+}
+
+// NewController creates a drift controller
+func NewController(client kubernetes.Interface, resolver ConfigResolver, owners owner.Resolver, restart bool) *Controller {
+	return &Controller{
+		client:    client,
+		resolver:  resolver,
+		owners:    owners,
+		restart:   restart,
+		restarted: make(map[string]string),
+	}
+}
+
+// Run calls Sync every interval until ctx is cancelled
+func (c *Controller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Sync(ctx); err != nil {
+			syncErrors.Inc()
+			klog.ErrorS(err, "drift sync failed")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync lists injected pods, refreshes the drift metrics and restarts owners if enabled
+func (c *Controller) Sync(ctx context.Context) error {
+	pods, err := c.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: mutation.InjectedLabel + "=true",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list injected pods: %w", err)
+	}
+
+	injected := make(map[string]float64)
+	drifted := make(map[driftKey]float64)
+	targets := make(map[string]restartTarget)
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		injected[pod.Namespace]++
+
+		reason, hash, err := c.check(ctx, pod)
+		if err != nil {
+			syncErrors.Inc()
+			klog.ErrorS(err, "failed to check pod for drift", "pod", klog.KObj(pod))
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+
+		ref, err := c.owners.Resolve(ctx, pod)
+		if err != nil {
+			syncErrors.Inc()
+			klog.ErrorS(err, "failed to resolve pod owner", "pod", klog.KObj(pod))
+			continue
+		}
+		drifted[driftKey{ref: ref, reason: reason}]++
+		targets[ref.String()] = restartTarget{ref: ref, hash: hash}
+	}
+
+	injectedPods.Reset()
+	for ns, n := range injected {
+		injectedPods.WithLabelValues(ns).Set(n)
+	}
+	driftedPods.Reset()
+	for k, n := range drifted {
+		driftedPods.WithLabelValues(k.ref.Namespace, k.ref.Kind, k.ref.Name, k.reason).Set(n)
+	}
+
+	// Owners that converged may drift again towards a previous hash later
+	for key := range c.restarted {
+		if _, ok := targets[key]; !ok {
+			delete(c.restarted, key)
+		}
+	}
+
+	if c.restart {
+		for key, t := range targets {
+			if c.restarted[key] == t.hash {
+				continue
+			}
+			if err := c.restartOwner(ctx, t.ref); err != nil {
+				syncErrors.Inc()
+				klog.ErrorS(err, "failed to restart owner", "owner", key)
+				continue
+			}
+			c.restarted[key] = t.hash
+		}
+	}
+
+	klog.V(2).InfoS("drift sync complete", "pods", len(pods.Items), "driftedOwners", len(targets))
+	return nil
+}
+
+// check compares a pod's stamped hash and image against a fresh resolution
+// Returns the drift reason (empty if none) and the hash the pod should have
+func (c *Controller) check(ctx context.Context, pod *corev1.Pod) (string, string, error) {
+	cfg, err := c.resolver.ResolveConfig(ctx, pod)
+	if err != nil {
+		return "", "", err
+	}
+	if cfg == nil {
+		// Injection was disabled after the pod was created, nothing to compare
+		return "", "", nil
+	}
+	hash, err := cfg.Hash()
+	if err != nil {
+		return "", "", err
+	}
+
+	// The CNI plugin stamps the ports once the rules are in place, which is
+	// before the pod gets an IP; no stamp after that means it never ran
+	if ports, ok := pod.Annotations[annotation.CNIBlockedPortsAnnotation]; ok && pod.Status.PodIP != "" &&
+		pod.Annotations[annotation.CNIGuardedPortsAnnotation] != ports {
+		return ReasonUnguarded, hash, nil
+	}
+
+	stampedHash, ok := pod.Annotations[mutation.ConfigHashAnnotation]
+	switch {
+	case !ok:
+		return ReasonUnstamped, hash, nil
+	case pod.Annotations[mutation.InjectedImageAnnotation] != cfg.ProxyImage:
+		return ReasonImage, hash, nil
+	case stampedHash != hash:
+		return ReasonConfig, hash, nil
+	}
+	return "", hash, nil
+}
+
+// restartOwner bumps the restartedAt template annotation like kubectl rollout restart
+// Only Deployments and StatefulSets are restarted; other owners are only reported.
+func (c *Controller) restartOwner(ctx context.Context, ref owner.Ref) error {
+	patch := []byte(fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+		restartedAtAnnotation, time.Now().Format(time.RFC3339)))
+
+	var err error
+	switch ref.Kind {
+	case "Deployment":
+		_, err = c.client.AppsV1().Deployments(ref.Namespace).Patch(ctx, ref.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = c.client.AppsV1().StatefulSets(ref.Namespace).Patch(ctx, ref.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	default:
+		klog.V(2).InfoS("not restarting unsupported owner kind", "owner", ref.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	restarts.WithLabelValues(ref.Namespace, ref.Kind, ref.Name).Inc()
+	klog.InfoS("triggered rollout restart for sidecar drift", "owner", ref.String())
+	return nil
+}
+
+// driftKey groups drifted pods for the drift gauge
+type driftKey struct {
+	ref    owner.Ref
+	reason string
+}
+
+// restartTarget is an owner and the hash its pods should converge to
+type restartTarget struct {
+	ref  owner.Ref
+	hash string
+}
@@ -0,0 +1,173 @@
+package drift
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+)
+
+// staticResolver resolves every pod to the same config
+type staticResolver struct {
+	cfg *config.EffectiveConfig
+}
+
+func (r staticResolver) ResolveConfig(context.Context, *corev1.Pod) (*config.EffectiveConfig, error) {
+	return r.cfg, nil
+}
+
+// podOwners resolves every pod to a Deployment named after its app label
+type podOwners struct{}
+
+func (podOwners) Resolve(_ context.Context, pod *corev1.Pod) (owner.Ref, error) {
+	return owner.Ref{APIVersion: "apps/v1", Kind: "Deployment", Name: pod.Labels["app"], Namespace: pod.Namespace}, nil
+}
+
+func (podOwners) Annotations(context.Context, *corev1.Pod) (map[string]string, error) {
+	return nil, nil
+}
+
+func testConfig() *config.EffectiveConfig {
+	return &config.EffectiveConfig{
+		ProxyImage:    "quay.io/oauth2-proxy/oauth2-proxy:v7.8.1",
+		ProtectedPort: "8080",
+	}
+}
+
+// injectedPod returns a running pod stamped with cfg's hash and image
+func injectedPod(t *testing.T, name string, cfg *config.EffectiveConfig) *corev1.Pod {
+	t.Helper()
+	hash, err := cfg.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{mutation.InjectedLabel: "true", "app": name},
+			Annotations: map[string]string{
+				mutation.ConfigHashAnnotation:    hash,
+				mutation.InjectedImageAnnotation: cfg.ProxyImage,
+			},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.42.0.7"},
+	}
+}
+
+// TestCheck_Unguarded tests that CNI mode pods without the plugin's stamp are reported
+func TestCheck_Unguarded(t *testing.T) {
+	cfg := testConfig()
+	c := NewController(nil, staticResolver{cfg: cfg}, podOwners{}, false)
+
+	tests := []struct {
+		name   string
+		mutate func(pod *corev1.Pod)
+		want   string
+	}{
+		{name: "init container mode", mutate: func(*corev1.Pod) {}, want: ""},
+		{
+			name: "guarded",
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations[annotation.CNIBlockedPortsAnnotation] = "8080"
+				pod.Annotations[annotation.CNIGuardedPortsAnnotation] = "8080"
+			},
+			want: "",
+		},
+		{
+			name: "never stamped",
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations[annotation.CNIBlockedPortsAnnotation] = "8080"
+			},
+			want: ReasonUnguarded,
+		},
+		{
+			name: "stamped for other ports",
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations[annotation.CNIBlockedPortsAnnotation] = "8080"
+				pod.Annotations[annotation.CNIGuardedPortsAnnotation] = "9090"
+			},
+			want: ReasonUnguarded,
+		},
+		{
+			name: "network not set up yet",
+			mutate: func(pod *corev1.Pod) {
+				pod.Annotations[annotation.CNIBlockedPortsAnnotation] = "8080"
+				pod.Status.PodIP = ""
+			},
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := injectedPod(t, "app", cfg)
+			tt.mutate(pod)
+			got, _, err := c.check(context.Background(), pod)
+			if err != nil {
+				t.Fatalf("check() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSync tests that drifted pods are reported per owner and reason and that
+// each drifted owner is restarted once per target hash
+func TestSync(t *testing.T) {
+	cfg := testConfig()
+	stale := testConfig()
+	stale.ProtectedPort = "9090"
+
+	current := injectedPod(t, "current", cfg)
+	image := injectedPod(t, "image", cfg)
+	image.Annotations[mutation.InjectedImageAnnotation] = "quay.io/oauth2-proxy/oauth2-proxy:v7.6.0"
+	changed := injectedPod(t, "changed", stale)
+	unstamped := injectedPod(t, "unstamped", cfg)
+	delete(unstamped.Annotations, mutation.ConfigHashAnnotation)
+	finished := injectedPod(t, "finished", stale)
+	finished.Status.Phase = corev1.PodSucceeded
+
+	client := fake.NewSimpleClientset(current, image, changed, unstamped, finished,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "changed", Namespace: "default"}})
+	c := NewController(client, staticResolver{cfg: cfg}, podOwners{}, true)
+
+	for i := 0; i < 2; i++ {
+		if err := c.Sync(context.Background()); err != nil {
+			t.Fatalf("Sync() error = %v", err)
+		}
+	}
+
+	if got := testutil.ToFloat64(injectedPods.WithLabelValues("default")); got != 4 {
+		t.Errorf("injected pods = %v, want 4", got)
+	}
+	if got := testutil.CollectAndCount(driftedPods); got != 3 {
+		t.Errorf("drifted series = %d, want 3", got)
+	}
+	for name, reason := range map[string]string{"image": ReasonImage, "changed": ReasonConfig, "unstamped": ReasonUnstamped} {
+		if got := testutil.ToFloat64(driftedPods.WithLabelValues("default", "Deployment", name, reason)); got != 1 {
+			t.Errorf("drifted pods for %s/%s = %v, want 1", name, reason, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(restarts.WithLabelValues("default", "Deployment", "changed")); got != 1 {
+		t.Errorf("restarts = %v, want 1 across two syncs", got)
+	}
+	deploy, err := client.AppsV1().Deployments("default").Get(context.Background(), "changed", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := deploy.Spec.Template.Annotations[restartedAtAnnotation]; !ok {
+		t.Errorf("deployment template annotations = %v, want %s", deploy.Spec.Template.Annotations, restartedAtAnnotation)
+	}
+}
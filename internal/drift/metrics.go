@@ -0,0 +1,41 @@
+package drift
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "oauth2_proxy_injector"
+
+var (
+	// injectedPods counts pods carrying the injected label, by namespace
+	injectedPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "injected_pods",
+		Help:      "Number of pods with an injected oauth2-proxy sidecar.",
+	}, []string{"namespace"})
+
+	// driftedPods counts pods whose sidecar no longer matches what would be injected now
+	driftedPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sidecar_drift_pods",
+		Help:      "Number of injected pods whose sidecar differs from what would be injected now.",
+	}, []string{"namespace", "owner_kind", "owner_name", "reason"})
+
+	// restarts counts rollout restarts triggered by the controller
+	restarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_restarts_total",
+		Help:      "Number of rollout restarts triggered to resolve sidecar drift.",
+	}, []string{"namespace", "owner_kind", "owner_name"})
+
+	// syncErrors counts failed sync passes and per-pod evaluation errors
+	syncErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_sync_errors_total",
+		Help:      "Number of errors encountered while checking pods for drift.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(injectedPods, driftedPods, restarts, syncErrors)
+}
@@ -0,0 +1,368 @@
+package mutation
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// AlphaConfigAnnotation holds the rendered alpha config on pods using a provider block
+// The sidecar reads it back through a downward API volume, so no ConfigMap
+// has to be created per pod.
+const AlphaConfigAnnotation = "spacemule.net/oauth2-proxy.alpha-config"
+
+const (
+	// AlphaConfigVolumeName is the downward API volume exposing AlphaConfigAnnotation
+	AlphaConfigVolumeName = "oauth2-proxy-alpha-config"
+
+	// AlphaConfigMountPath is where the alpha config volume is mounted
+	AlphaConfigMountPath = "/etc/oauth2-proxy/alpha"
+
+	// alphaConfigFile is the file name inside AlphaConfigMountPath
+	alphaConfigFile = "alpha-config.yaml"
+
+	// ProviderSecretsVolumeName is the projected volume holding each provider's client secret
+	ProviderSecretsVolumeName = "oauth2-proxy-provider-secrets"
+
+	// ProviderSecretsMountPath is where provider client secrets are mounted, as <id>/client-secret
+	ProviderSecretsMountPath = "/etc/oauth2-proxy/providers"
+)
+
+// alphaOwnedFlags are legacy flags oauth2-proxy refuses once --alpha-config
+// is given; their settings are rendered into the alpha config instead
+var alphaOwnedFlags = map[string]bool{
+	"provider":                          true,
+	"oidc-issuer-url":                   true,
+	"oidc-groups-claim":                 true,
+	"client-id":                         true,
+	"client-secret-file":                true,
+	"code-challenge-method":             true,
+	"scope":                             true,
+	"validate-url":                      true,
+	"prompt":                            true,
+	"allowed-group":                     true,
+	"http-address":                      true,
+	"upstream":                          true,
+	"ssl-upstream-insecure-skip-verify": true,
+	"pass-access-token":                 true,
+	"set-xauthrequest":                  true,
+	"pass-authorization-header":         true,
+	"github-org":                        true,
+	"github-team":                       true,
+	"github-repo":                       true,
+	"github-user":                       true,
+	"gitlab-group":                      true,
+	"gitlab-project":                    true,
+	"google-group":                      true,
+	"google-admin-email":                true,
+	"google-service-account-json":       true,
+	"google-use-application-default-credentials": true,
+	"azure-tenant":   true,
+	"keycloak-group": true,
+}
+
+// alphaArgs drops the flags the alpha config replaces and points oauth2-proxy at it
+func alphaArgs(args []string) []string {
+	ret := make([]string, 0, len(args)+1)
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if alphaOwnedFlags[name] {
+			continue
+		}
+		ret = append(ret, arg)
+	}
+	return append(ret, "--alpha-config="+AlphaConfigMountPath+"/"+alphaConfigFile)
+}
+
+// The types below mirror the parts of oauth2-proxy's AlphaOptions that are rendered
+
+type alphaOptions struct {
+	UpstreamConfig        alphaUpstreamConfig `json:"upstreamConfig"`
+	InjectRequestHeaders  []alphaHeader       `json:"injectRequestHeaders,omitempty"`
+	InjectResponseHeaders []alphaHeader       `json:"injectResponseHeaders,omitempty"`
+	Server                alphaServer         `json:"server"`
+	Providers             []alphaProvider     `json:"providers"`
+}
+
+type alphaUpstreamConfig struct {
+	Upstreams []alphaUpstream `json:"upstreams"`
+}
+
+type alphaUpstream struct {
+	ID                    string `json:"id"`
+	Path                  string `json:"path"`
+	URI                   string `json:"uri"`
+	InsecureSkipTLSVerify bool   `json:"insecureSkipTLSVerify,omitempty"`
+}
+
+type alphaHeader struct {
+	Name   string             `json:"name"`
+	Values []alphaHeaderValue `json:"values"`
+}
+
+type alphaHeaderValue struct {
+	ClaimSource alphaClaimSource `json:"claimSource"`
+}
+
+type alphaClaimSource struct {
+	Claim  string `json:"claim"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+type alphaServer struct {
+	BindAddress string `json:"bindAddress"`
+}
+
+type alphaProvider struct {
+	ID                  string                `json:"id"`
+	Provider            string                `json:"provider"`
+	Name                string                `json:"name,omitempty"`
+	ClientID            string                `json:"clientID"`
+	ClientSecretFile    string                `json:"clientSecretFile,omitempty"`
+	Scope               string                `json:"scope,omitempty"`
+	CodeChallengeMethod string                `json:"code_challenge_method,omitempty"`
+	AllowedGroups       []string              `json:"allowedGroups,omitempty"`
+	ValidateURL         string                `json:"validateURL,omitempty"`
+	LoginURLParameters  []alphaLoginParameter `json:"loginURLParameters,omitempty"`
+	OIDCConfig          *alphaOIDCConfig      `json:"oidcConfig,omitempty"`
+	GitHubConfig        *alphaGitHubConfig    `json:"githubConfig,omitempty"`
+	GitLabConfig        *alphaGitLabConfig    `json:"gitlabConfig,omitempty"`
+	GoogleConfig        *alphaGoogleConfig    `json:"googleConfig,omitempty"`
+	AzureConfig         *alphaAzureConfig     `json:"azureConfig,omitempty"`
+	KeycloakConfig      *alphaKeycloakConfig  `json:"keycloakConfig,omitempty"`
+}
+
+type alphaLoginParameter struct {
+	Name    string   `json:"name"`
+	Default []string `json:"default"`
+}
+
+type alphaOIDCConfig struct {
+	IssuerURL      string   `json:"issuerURL"`
+	GroupsClaim    string   `json:"groupsClaim,omitempty"`
+	EmailClaim     string   `json:"emailClaim"`
+	UserIDClaim    string   `json:"userIDClaim"`
+	AudienceClaims []string `json:"audienceClaims"`
+}
+
+type alphaGitHubConfig struct {
+	Org   string   `json:"org,omitempty"`
+	Team  string   `json:"team,omitempty"`
+	Repo  string   `json:"repo,omitempty"`
+	Users []string `json:"users,omitempty"`
+}
+
+type alphaGitLabConfig struct {
+	Group    []string `json:"group,omitempty"`
+	Projects []string `json:"projects,omitempty"`
+}
+
+type alphaGoogleConfig struct {
+	Groups                           []string `json:"group,omitempty"`
+	AdminEmail                       string   `json:"adminEmail,omitempty"`
+	ServiceAccountJSON               string   `json:"serviceAccountJson,omitempty"`
+	UseApplicationDefaultCredentials bool     `json:"useApplicationDefaultCredentials,omitempty"`
+}
+
+type alphaAzureConfig struct {
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type alphaKeycloakConfig struct {
+	Groups []string `json:"groups,omitempty"`
+}
+
+// BuildAlphaConfig renders the oauth2-proxy alpha config for a pod using a provider block
+//
+// Besides the provider it carries the upstream, the listen address and the
+// identity headers, which oauth2-proxy no longer takes as flags in this mode.
+// The top-level allowed-groups apply unless the block sets its own; prompt
+// and validate-url always apply.
+//
+// oauth2-proxy only builds the first provider of an alpha config, so exactly
+// one block must be selected.
+func BuildAlphaConfig(cfg *config.EffectiveConfig, portMapping PortMapping) (string, error) {
+	if len(cfg.Providers) != 1 {
+		return "", fmt.Errorf("alpha config needs exactly one provider, got %d", len(cfg.Providers))
+	}
+	uri, insecure := upstreamURL(cfg, portMapping)
+	opts := alphaOptions{
+		UpstreamConfig: alphaUpstreamConfig{
+			Upstreams: []alphaUpstream{{ID: "upstream", Path: "/", URI: uri, InsecureSkipTLSVerify: insecure}},
+		},
+		InjectRequestHeaders:  alphaRequestHeaders(cfg),
+		InjectResponseHeaders: alphaResponseHeaders(cfg),
+		Server:                alphaServer{BindAddress: fmt.Sprintf("0.0.0.0:%d", portMapping.ListenPort)},
+	}
+
+	for _, b := range cfg.Providers {
+		p := alphaProvider{
+			ID:                  b.ID,
+			Provider:            b.Provider,
+			Name:                b.Name,
+			ClientID:            b.ClientID,
+			Scope:               b.Scope,
+			CodeChallengeMethod: b.CodeChallengeMethod,
+			AllowedGroups:       b.AllowedGroups,
+		}
+		if b.ClientSecret != nil {
+			p.ClientSecretFile = providerSecretPath(b.ID)
+		} else {
+			// PKCE without a secret, matching the single-provider /dev/null trick
+			p.ClientSecretFile = "/dev/null"
+		}
+		if len(p.AllowedGroups) == 0 && cfg.AllowedGroups.IsLiteral() {
+			p.AllowedGroups = cfg.AllowedGroups.Values
+		}
+		if cfg.ValidateURL.IsLiteral() {
+			p.ValidateURL = cfg.ValidateURL.Value
+		}
+		if cfg.Prompt.IsLiteral() && cfg.Prompt.Value != "" {
+			p.LoginURLParameters = []alphaLoginParameter{{Name: "prompt", Default: []string{cfg.Prompt.Value}}}
+		}
+		if b.OIDCIssuerURL != "" {
+			groupsClaim := b.OIDCGroupsClaim
+			if groupsClaim == "" {
+				groupsClaim = "groups"
+			}
+			p.OIDCConfig = &alphaOIDCConfig{
+				IssuerURL:      b.OIDCIssuerURL,
+				GroupsClaim:    groupsClaim,
+				EmailClaim:     "email",
+				UserIDClaim:    "email",
+				AudienceClaims: []string{"aud"},
+			}
+		}
+		if b.GitHubOrg != "" || len(b.GitHubTeams) > 0 || b.GitHubRepo != "" || len(b.GitHubUsers) > 0 {
+			p.GitHubConfig = &alphaGitHubConfig{Org: b.GitHubOrg, Team: strings.Join(b.GitHubTeams, ","), Repo: b.GitHubRepo, Users: b.GitHubUsers}
+		}
+		if len(b.GitLabGroups) > 0 || len(b.GitLabProjects) > 0 {
+			p.GitLabConfig = &alphaGitLabConfig{Group: b.GitLabGroups, Projects: b.GitLabProjects}
+		}
+		if len(b.GoogleGroups) > 0 {
+			p.GoogleConfig = &alphaGoogleConfig{
+				Groups:                           b.GoogleGroups,
+				AdminEmail:                       b.GoogleAdminEmail,
+				ServiceAccountJSON:               b.GoogleServiceAccountJSON,
+				UseApplicationDefaultCredentials: b.GoogleUseApplicationDefaultCredentials,
+			}
+		}
+		if b.AzureTenant != "" {
+			p.AzureConfig = &alphaAzureConfig{Tenant: b.AzureTenant}
+		}
+		if len(b.KeycloakGroups) > 0 {
+			p.KeycloakConfig = &alphaKeycloakConfig{Groups: b.KeycloakGroups}
+		}
+		opts.Providers = append(opts.Providers, p)
+	}
+
+	data, err := yaml.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("rendering alpha config: %w", err)
+	}
+	return string(data), nil
+}
+
+// alphaRequestHeaders are the identity headers oauth2-proxy sends upstream by
+// default in legacy mode, plus the ones pass-access-token and
+// pass-authorization-header add
+func alphaRequestHeaders(cfg *config.EffectiveConfig) []alphaHeader {
+	ret := []alphaHeader{
+		claimHeader("X-Forwarded-User", "user", ""),
+		claimHeader("X-Forwarded-Email", "email", ""),
+		claimHeader("X-Forwarded-Preferred-Username", "preferred_username", ""),
+		claimHeader("X-Forwarded-Groups", "groups", ""),
+	}
+	if cfg.PassAccessToken.Value {
+		ret = append(ret, claimHeader("X-Forwarded-Access-Token", "access_token", ""))
+	}
+	if cfg.PassAuthorizationHeader.Value {
+		ret = append(ret, claimHeader("Authorization", "id_token", "Bearer "))
+	}
+	return ret
+}
+
+// alphaResponseHeaders are the X-Auth-Request-* headers set-xauthrequest adds
+func alphaResponseHeaders(cfg *config.EffectiveConfig) []alphaHeader {
+	if !cfg.SetXAuthRequest.Value {
+		return nil
+	}
+	ret := []alphaHeader{
+		claimHeader("X-Auth-Request-User", "user", ""),
+		claimHeader("X-Auth-Request-Email", "email", ""),
+		claimHeader("X-Auth-Request-Preferred-Username", "preferred_username", ""),
+		claimHeader("X-Auth-Request-Groups", "groups", ""),
+	}
+	if cfg.PassAccessToken.Value {
+		ret = append(ret, claimHeader("X-Auth-Request-Access-Token", "access_token", ""))
+	}
+	return ret
+}
+
+// claimHeader builds a header whose value is a session claim
+func claimHeader(name, claim, prefix string) alphaHeader {
+	return alphaHeader{Name: name, Values: []alphaHeaderValue{{ClaimSource: alphaClaimSource{Claim: claim, Prefix: prefix}}}}
+}
+
+// providerSecretPath is where a provider block's client secret is mounted
+func providerSecretPath(id string) string {
+	return ProviderSecretsMountPath + "/" + id + "/client-secret"
+}
+
+// buildAlphaVolumes returns the alpha config and provider secret volumes and mounts
+func buildAlphaVolumes(cfg *config.EffectiveConfig) ([]corev1.Volume, []corev1.VolumeMount) {
+	volumes := []corev1.Volume{{
+		Name: AlphaConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{{
+					Path:     alphaConfigFile,
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", AlphaConfigAnnotation)},
+				}},
+			},
+		},
+	}}
+	mounts := []corev1.VolumeMount{{Name: AlphaConfigVolumeName, MountPath: AlphaConfigMountPath, ReadOnly: true}}
+
+	var sources []corev1.VolumeProjection
+	for _, b := range cfg.Providers {
+		if b.ClientSecret == nil {
+			continue
+		}
+		sources = append(sources, corev1.VolumeProjection{
+			Secret: &corev1.SecretProjection{
+				LocalObjectReference: corev1.LocalObjectReference{Name: b.ClientSecret.Name},
+				Items:                []corev1.KeyToPath{{Key: b.ClientSecret.Key, Path: b.ID + "/client-secret"}},
+			},
+		})
+	}
+	if len(sources) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name:         ProviderSecretsVolumeName,
+			VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: sources}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: ProviderSecretsVolumeName, MountPath: ProviderSecretsMountPath, ReadOnly: true})
+	}
+
+	return volumes, mounts
+}
+
+// upstreamURL returns the upstream oauth2-proxy forwards to and whether TLS
+// verification is skipped
+func upstreamURL(cfg *config.EffectiveConfig, portMapping PortMapping) (string, bool) {
+	insecure := cfg.UpstreamTLS == annotation.UpstreamTLSInsecure
+	if cfg.Upstream.Value != "" {
+		return cfg.Upstream.Value, insecure
+	}
+
+	scheme := "http"
+	if cfg.UpstreamTLS != annotation.UpstreamNoTLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, loopbackHost(cfg.IPFamily), portMapping.ProxyPort), insecure
+}
@@ -0,0 +1,135 @@
+package mutation
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// blockConfig is an effective config using the corp provider block, with the
+// single-provider settings the alpha config replaces also set
+func blockConfig() *config.EffectiveConfig {
+	literal := func(v string) config.SourcedValue {
+		return config.SourcedValue{Value: v, Source: annotation.ValueSourceLiteral}
+	}
+	return &config.EffectiveConfig{
+		Provider:        literal("github"),
+		OIDCIssuerURL:   literal("https://ignored.example.com"),
+		ClientID:        literal("ignored"),
+		Scope:           literal("openid"),
+		ValidateURL:     literal("https://sso.example.com/userinfo"),
+		Prompt:          literal("login"),
+		GitHubOrg:       literal("acme"),
+		AllowedGroups:   config.SourcedStringSlice{Values: []string{"staff"}, Source: annotation.ValueSourceLiteral, Set: true},
+		PassAccessToken: config.SourcedBool{Value: true, Source: annotation.ValueSourceLiteral},
+		SetXAuthRequest: config.SourcedBool{Value: true, Source: annotation.ValueSourceLiteral},
+		UpstreamTLS:     annotation.UpstreamNoTLS,
+		Providers: []config.ProviderBlock{{
+			ID:            "corp",
+			Provider:      "oidc",
+			Name:          "Corporate SSO",
+			OIDCIssuerURL: "https://sso.example.com/realms/corp",
+			ClientID:      "app",
+			ClientSecret:  &config.SecretRef{Name: "corp-oidc", Key: "client-secret"},
+		}},
+	}
+}
+
+// TestBuildAlphaConfig tests the rendered provider, upstream, server and headers
+func TestBuildAlphaConfig(t *testing.T) {
+	data, err := BuildAlphaConfig(blockConfig(), PortMapping{ProxyPort: 8080, ListenPort: 4180})
+	if err != nil {
+		t.Fatalf("BuildAlphaConfig() error = %v", err)
+	}
+	var got alphaOptions
+	if err := yaml.UnmarshalStrict([]byte(data), &got); err != nil {
+		t.Fatalf("rendered alpha config doesn't parse: %v\n%s", err, data)
+	}
+
+	if len(got.Providers) != 1 {
+		t.Fatalf("providers = %+v, want one", got.Providers)
+	}
+	p := got.Providers[0]
+	if p.ID != "corp" || p.Provider != "oidc" || p.ClientID != "app" || p.Name != "Corporate SSO" {
+		t.Errorf("provider = %+v", p)
+	}
+	if p.ClientSecretFile != ProviderSecretsMountPath+"/corp/client-secret" {
+		t.Errorf("clientSecretFile = %q", p.ClientSecretFile)
+	}
+	if p.OIDCConfig == nil || p.OIDCConfig.IssuerURL != "https://sso.example.com/realms/corp" || p.OIDCConfig.GroupsClaim != "groups" {
+		t.Errorf("oidcConfig = %+v", p.OIDCConfig)
+	}
+	if p.GitHubConfig != nil {
+		t.Errorf("githubConfig = %+v, want the top-level github-org ignored", p.GitHubConfig)
+	}
+	if !slices.Equal(p.AllowedGroups, []string{"staff"}) || p.ValidateURL != "https://sso.example.com/userinfo" {
+		t.Errorf("allowedGroups = %v, validateURL = %q, want the top-level settings", p.AllowedGroups, p.ValidateURL)
+	}
+	if len(p.LoginURLParameters) != 1 || p.LoginURLParameters[0].Default[0] != "login" {
+		t.Errorf("loginURLParameters = %+v, want prompt=login", p.LoginURLParameters)
+	}
+
+	if u := got.UpstreamConfig.Upstreams; len(u) != 1 || u[0].URI != "http://localhost:8080" {
+		t.Errorf("upstreams = %+v", u)
+	}
+	if got.Server.BindAddress != "0.0.0.0:4180" {
+		t.Errorf("bindAddress = %q", got.Server.BindAddress)
+	}
+	var request []string
+	for _, h := range got.InjectRequestHeaders {
+		request = append(request, h.Name)
+	}
+	if !slices.Contains(request, "X-Forwarded-Access-Token") || slices.Contains(request, "Authorization") {
+		t.Errorf("request headers = %v, want pass-access-token only", request)
+	}
+	if len(got.InjectResponseHeaders) == 0 {
+		t.Error("response headers empty, want X-Auth-Request-* for set-xauthrequest")
+	}
+}
+
+// TestBuildAlphaConfig_OneProvider tests that oauth2-proxy's one provider limit is enforced
+func TestBuildAlphaConfig_OneProvider(t *testing.T) {
+	cfg := blockConfig()
+	cfg.Providers = append(cfg.Providers, config.ProviderBlock{ID: "github", Provider: "github", ClientID: "gh"})
+	if _, err := BuildAlphaConfig(cfg, PortMapping{ProxyPort: 8080, ListenPort: 4180}); err == nil {
+		t.Error("BuildAlphaConfig() with two providers succeeded, want error")
+	}
+}
+
+// TestAlphaArgs tests that owned flags are dropped and the rest kept in order
+func TestAlphaArgs(t *testing.T) {
+	got := alphaArgs([]string{
+		"--provider=oidc",
+		"--cookie-secure=true",
+		"--allowed-group=a",
+		"--skip-provider-button",
+		"--upstream=http://127.0.0.1:8080",
+		"--http-address=0.0.0.0:4180",
+	})
+	want := []string{"--cookie-secure=true", "--skip-provider-button", "--alpha-config=" + AlphaConfigMountPath + "/" + alphaConfigFile}
+	if !slices.Equal(got, want) {
+		t.Errorf("alphaArgs() = %v, want %v", got, want)
+	}
+}
+
+// TestBuildArgs_ProviderBlock tests that none of the flags oauth2-proxy refuses
+// alongside --alpha-config reach the sidecar
+func TestBuildArgs_ProviderBlock(t *testing.T) {
+	args := buildArgs(blockConfig(), PortMapping{ProxyPort: 8080, ListenPort: 4180})
+	var alpha bool
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if alphaOwnedFlags[name] {
+			t.Errorf("args contain %s, which the alpha config owns", arg)
+		}
+		alpha = alpha || name == "alpha-config"
+	}
+	if !alpha {
+		t.Errorf("args = %v, want --alpha-config", args)
+	}
+}
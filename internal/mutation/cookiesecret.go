@@ -0,0 +1,157 @@
+package mutation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+)
+
+// GeneratedCookieSecretKey is the key holding the cookie secret in generated Secrets
+const GeneratedCookieSecretKey = "cookie-secret"
+
+// GeneratedCookieSecretSuffix is appended to the workload name to name its Secret
+const GeneratedCookieSecretSuffix = "-oauth2-proxy-cookie"
+
+// cookieSecretBytes is the AES-256 key size oauth2-proxy expects
+const cookieSecretBytes = 32
+
+// managedByLabel marks Secrets created by the webhook; an existing Secret with
+// the generated name is only reused if it carries it
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "oauth2-proxy-injector"
+)
+
+// CookieSecretGenerator provides a per-workload cookie secret
+type CookieSecretGenerator interface {
+	// Ensure returns a reference to the workload's cookie Secret, creating it
+	// if needed. With dryRun the reference is returned but nothing is created.
+	Ensure(ctx context.Context, pod *corev1.Pod, dryRun bool) (*config.SecretRef, error)
+}
+
+// KubeCookieSecretGenerator implements CookieSecretGenerator
+//
+// The Secret is named after the pod's top-level owner and owned by it, so all
+// replicas share one secret and it is garbage collected with the workload.
+type KubeCookieSecretGenerator struct {
+	client kubernetes.Interface
+	owners owner.Resolver
+}
+
+// NewCookieSecretGenerator creates a CookieSecretGenerator
+func NewCookieSecretGenerator(client kubernetes.Interface, owners owner.Resolver) *KubeCookieSecretGenerator {
+	return &KubeCookieSecretGenerator{
+		client: client,
+		owners: owners,
+	}
+}
+
+// Ensure creates <workload>-oauth2-proxy-cookie if it doesn't already exist
+//
+// An existing Secret is only reused if the webhook created it and it still
+// holds the cookie-secret key. Otherwise the pod is denied rather than wired
+// to a Secret someone else controls, or one the sidecar can't start from.
+func (g *KubeCookieSecretGenerator) Ensure(ctx context.Context, pod *corev1.Pod, dryRun bool) (*config.SecretRef, error) {
+	ref, err := g.owners.Resolve(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	workload := owner.WorkloadName(ref, pod)
+	if workload == "" {
+		return nil, fmt.Errorf("\ncannot generate cookie secret: pod has no owner or name")
+	}
+	secretRef := &config.SecretRef{
+		Name: workload + GeneratedCookieSecretSuffix,
+		Key:  GeneratedCookieSecretKey,
+	}
+
+	existing, err := g.client.CoreV1().Secrets(pod.Namespace).Get(ctx, secretRef.Name, metav1.GetOptions{})
+	if err == nil {
+		if err := checkGeneratedCookieSecret(existing); err != nil {
+			return nil, err
+		}
+		return secretRef, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", pod.Namespace, secretRef.Name, err)
+	}
+	if dryRun {
+		return secretRef, nil
+	}
+
+	value, err := randomCookieSecret()
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretRef.Name,
+			Namespace: pod.Namespace,
+			Labels: map[string]string{
+				managedByLabel: managedBy,
+			},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{GeneratedCookieSecretKey: value},
+	}
+	if ref.UID != "" {
+		secret.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: ref.APIVersion,
+			Kind:       ref.Kind,
+			Name:       ref.Name,
+			UID:        ref.UID,
+		}}
+	}
+
+	_, err = g.client.CoreV1().Secrets(pod.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// Another replica was admitted concurrently, or someone else created
+		// a Secret of the same name since the Get
+		existing, err := g.client.CoreV1().Secrets(pod.Namespace).Get(ctx, secretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret %s/%s: %w", pod.Namespace, secretRef.Name, err)
+		}
+		if err := checkGeneratedCookieSecret(existing); err != nil {
+			return nil, err
+		}
+		return secretRef, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret %s/%s: %w", pod.Namespace, secretRef.Name, err)
+	}
+
+	klog.InfoS("generated cookie secret", "secret", klog.KRef(pod.Namespace, secretRef.Name), "workload", workload)
+	return secretRef, nil
+}
+
+// checkGeneratedCookieSecret verifies an existing Secret is one Ensure created
+func checkGeneratedCookieSecret(secret *corev1.Secret) error {
+	if secret.Labels[managedByLabel] != managedBy {
+		return fmt.Errorf("\ncannot generate cookie secret: secret %s/%s already exists and is not labelled %s=%s", secret.Namespace, secret.Name, managedByLabel, managedBy)
+	}
+	if _, ok := secret.Data[GeneratedCookieSecretKey]; !ok {
+		return fmt.Errorf("\ncannot generate cookie secret: secret %s/%s has no key %q; delete it to have it regenerated", secret.Namespace, secret.Name, GeneratedCookieSecretKey)
+	}
+	return nil
+}
+
+// randomCookieSecret returns 32 random bytes, base64url encoded
+// oauth2-proxy decodes base64 secrets, so the cipher gets the full 32 bytes.
+func randomCookieSecret() (string, error) {
+	b := make([]byte, cookieSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate cookie secret: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,145 @@
+package mutation
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+)
+
+// staticOwners is an owner.Resolver that resolves every pod to one workload
+type staticOwners owner.Ref
+
+func (o staticOwners) Resolve(context.Context, *corev1.Pod) (owner.Ref, error) {
+	return owner.Ref(o), nil
+}
+
+func (staticOwners) Annotations(context.Context, *corev1.Pod) (map[string]string, error) {
+	return nil, nil
+}
+
+// cookieSecret returns a Secret named for the web Deployment
+func cookieSecret(labels map[string]string, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "web" + GeneratedCookieSecretSuffix, Namespace: "apps", Labels: labels},
+		Data:       data,
+	}
+}
+
+// TestKubeCookieSecretGenerator_Ensure tests creating, reusing and refusing cookie Secrets
+func TestKubeCookieSecretGenerator_Ensure(t *testing.T) {
+	managed := map[string]string{managedByLabel: managedBy}
+	key := map[string][]byte{GeneratedCookieSecretKey: []byte("c2VjcmV0")}
+
+	tests := []struct {
+		name       string
+		existing   *corev1.Secret
+		dryRun     bool
+		wantCreate bool
+		wantErr    bool
+	}{
+		{name: "create", wantCreate: true},
+		{name: "dry run", dryRun: true},
+		{name: "reuse", existing: cookieSecret(managed, key)},
+		{name: "reuse on dry run", existing: cookieSecret(managed, key), dryRun: true},
+		{name: "not managed", existing: cookieSecret(nil, key), wantErr: true},
+		{name: "not managed on dry run", existing: cookieSecret(nil, key), dryRun: true, wantErr: true},
+		{name: "missing key", existing: cookieSecret(managed, map[string][]byte{"other": nil}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if tt.existing != nil {
+				client = fake.NewSimpleClientset(tt.existing)
+			}
+			g := NewCookieSecretGenerator(client, staticOwners{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "uid-1"})
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-abc", Namespace: "apps"}}
+
+			ref, err := g.Ensure(context.Background(), pod, tt.dryRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Ensure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ref == nil || ref.Name != "web-oauth2-proxy-cookie" || ref.Key != GeneratedCookieSecretKey {
+				t.Errorf("Ensure() = %+v, want web-oauth2-proxy-cookie/%s", ref, GeneratedCookieSecretKey)
+			}
+
+			created := 0
+			for _, action := range client.Actions() {
+				if action.Matches("create", "secrets") {
+					created++
+				}
+			}
+			if (tt.wantCreate && created != 1) || (!tt.wantCreate && created != 0) {
+				t.Fatalf("created %d secrets, wantCreate %v", created, tt.wantCreate)
+			}
+			if !tt.wantCreate {
+				return
+			}
+
+			secret, err := client.CoreV1().Secrets("apps").Get(context.Background(), ref.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secret.Labels[managedByLabel] != managedBy {
+				t.Errorf("labels = %v, want %s=%s", secret.Labels, managedByLabel, managedBy)
+			}
+			if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != "uid-1" {
+				t.Errorf("ownerReferences = %+v, want the Deployment", secret.OwnerReferences)
+			}
+			if len(secret.StringData[GeneratedCookieSecretKey]) != 44 {
+				t.Errorf("cookie secret = %q, want 32 bytes base64 encoded", secret.StringData[GeneratedCookieSecretKey])
+			}
+		})
+	}
+}
+
+// TestKubeCookieSecretGenerator_EnsureRace tests that losing the create race
+// to another replica reuses its Secret, but not a Secret someone else created
+func TestKubeCookieSecretGenerator_EnsureRace(t *testing.T) {
+	tests := []struct {
+		name    string
+		winner  *corev1.Secret
+		wantErr bool
+	}{
+		{
+			name:   "other replica",
+			winner: cookieSecret(map[string]string{managedByLabel: managedBy}, map[string][]byte{GeneratedCookieSecretKey: []byte("c2VjcmV0")}),
+		},
+		{
+			name:    "someone else",
+			winner:  cookieSecret(nil, map[string][]byte{GeneratedCookieSecretKey: []byte("c2VjcmV0")}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			// The winner's Secret appears between our Get and Create
+			client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if err := client.Tracker().Add(tt.winner); err != nil {
+					return true, nil, err
+				}
+				return true, nil, apierrors.NewAlreadyExists(corev1.Resource("secrets"), tt.winner.Name)
+			})
+			g := NewCookieSecretGenerator(client, staticOwners{Kind: "Deployment", Name: "web", UID: "uid-1"})
+
+			ref, err := g.Ensure(context.Background(), &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "apps"}}, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Ensure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (ref == nil || ref.Name != tt.winner.Name) {
+				t.Errorf("Ensure() = %+v, want %s", ref, tt.winner.Name)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package mutation
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -9,10 +10,49 @@ import (
 	"github.com/spacemule/oauth2-proxy-injector/internal/config"
 )
 
+// NetguardBinary is the path of the netguard binary inside the init image
+const NetguardBinary = "/netguard"
+
+// InitContainerName is the name used for the injected netguard init container
+const InitContainerName = "oauth2-proxy-iptables-init"
+
+// ValidationContainerName is the name used for the CNI mode validation init container
+const ValidationContainerName = "oauth2-proxy-validation"
+
+// validationUser is the numeric uid the validation container runs as
+// The image's nobody user is named, which runAsNonRoot can't verify
+const validationUser int64 = 65534
+
+// hostIPEnv is the init container env var holding the node IP from the downward API
+const hostIPEnv = "HOST_IP"
+
+// BlockMode selects how block-direct-access rules are installed in the pod
+type BlockMode string
+
+const (
+	// BlockModeInitContainer installs the rules from a privileged init container
+	// Requires root and NET_ADMIN in the pod, which PSA "restricted" rejects
+	BlockModeInitContainer BlockMode = "init-container"
+
+	// BlockModeCNI annotates the pod and leaves rule installation to the
+	// chained oauth2-proxy CNI plugin running on each node
+	BlockModeCNI BlockMode = "cni"
+)
+
+// ParseBlockMode parses a block mode flag value
+func ParseBlockMode(value string) (BlockMode, error) {
+	switch BlockMode(value) {
+	case BlockModeInitContainer, BlockModeCNI:
+		return BlockMode(value), nil
+	default:
+		return "", fmt.Errorf("invalid block mode %q: must be %q or %q", value, BlockModeInitContainer, BlockModeCNI)
+	}
+}
+
 // InitContainerBuilder defines the interface for building init containers
 // that set up network rules to block direct access to protected ports
 type InitContainerBuilder interface {
-	// Build creates an init container that configures iptables rules
+	// Build creates an init container that configures firewall rules
 	// to block direct access to the protected port(s), forcing traffic
 	// through oauth2-proxy on localhost
 	//
@@ -20,10 +60,13 @@ type InitContainerBuilder interface {
 	Build(cfg *config.EffectiveConfig, portMapping PortMapping) *corev1.Container
 }
 
-// IPTablesInitContainerBuilder implements InitContainerBuilder for iptables-based port blocking
+// IPTablesInitContainerBuilder implements InitContainerBuilder for port blocking
+//
+// The init container runs cmd/netguard from this repository, which programs
+// nftables over netlink from typed arguments instead of a generated shell script.
 type IPTablesInitContainerBuilder struct {
-	// initImage is the container image that provides iptables
-	// Default: a minimal Alpine-based image with iptables installed
+	// initImage is the container image that provides the netguard binary
+	// Default: the oauth2-proxy-injector image itself
 	initImage string
 }
 
@@ -34,31 +77,109 @@ func NewIPTablesInitContainerBuilder(initImage string) *IPTablesInitContainerBui
 	}
 }
 
-// Build creates an iptables init container if block-direct-access is enabled
+// Build creates a netguard init container if block-direct-access is enabled
 func (b *IPTablesInitContainerBuilder) Build(cfg *config.EffectiveConfig, portMapping PortMapping) *corev1.Container {
 	if !cfg.BlockDirectAccess {
 		return nil
 	}
-	return &corev1.Container{
-		Name:            "oauth2-proxy-iptables-init",
+	ret := &corev1.Container{
+		Name:            InitContainerName,
 		Image:           b.initImage,
-		Command:         []string{"/bin/sh", "-c", buildIPTablesScript([]int32{portMapping.ProxyPort})},
+		Command:         []string{NetguardBinary},
+		Args:            buildNetguardArgs([]int32{portMapping.ProxyPort}, allowedSources(cfg)),
 		SecurityContext: needsSecurityContext(),
 	}
+	if cfg.BlockAllowKubelet {
+		ret.Env = []corev1.EnvVar{{
+			Name: hostIPEnv,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+			},
+		}}
+	}
+
+	return ret
+}
+
+// CNIValidationContainerBuilder implements InitContainerBuilder for CNI mode
+//
+// The CNI plugin installs the rules, but a pod whose network came up without
+// it (plugin missing from the conflist, DaemonSet not ready or restarting)
+// would start exposed. The validation container runs netguard --validate
+// before the app, unprivileged, and fails the pod's init when the rules are
+// missing, like Istio's istio-validation container.
+type CNIValidationContainerBuilder struct {
+	// initImage is the container image that provides the netguard binary
+	initImage string
 }
 
-// buildIPTablesScript generates the shell script that sets up iptables rules
-func buildIPTablesScript(ports []int32) string {
-	var script strings.Builder
+// NewCNIValidationContainerBuilder creates a new CNIValidationContainerBuilder
+func NewCNIValidationContainerBuilder(initImage string) *CNIValidationContainerBuilder {
+	return &CNIValidationContainerBuilder{
+		initImage: initImage,
+	}
+}
+
+// Build creates the validation init container if block-direct-access is enabled
+func (b *CNIValidationContainerBuilder) Build(cfg *config.EffectiveConfig, _ PortMapping) *corev1.Container {
+	if !cfg.BlockDirectAccess {
+		return nil
+	}
+	securityContext := DefaultSecurityContext()
+	uid := validationUser
+	securityContext.RunAsUser = &uid
+	securityContext.RunAsGroup = &uid
+
+	return &corev1.Container{
+		Name:            ValidationContainerName,
+		Image:           b.initImage,
+		Command:         []string{NetguardBinary},
+		Args:            []string{"--validate"},
+		SecurityContext: securityContext,
+	}
+}
+
+// NewInitContainerBuilder returns the InitContainerBuilder for the block mode
+func NewInitContainerBuilder(mode BlockMode, initImage string) InitContainerBuilder {
+	if mode == BlockModeCNI {
+		return NewCNIValidationContainerBuilder(initImage)
+	}
+	return NewIPTablesInitContainerBuilder(initImage)
+}
+
+// isInjectedInitContainer checks if an init container name is one the webhook adds
+func isInjectedInitContainer(name string) bool {
+	return name == InitContainerName || name == ValidationContainerName
+}
+
+// buildNetguardArgs generates the netguard arguments for the protected ports
+// and any extra allowed sources
+func buildNetguardArgs(ports []int32, allowed []string) []string {
+	ret := []string{"--ports=" + formatPorts(ports)}
+	if len(allowed) > 0 {
+		ret = append(ret, "--allow-cidrs="+strings.Join(allowed, ","))
+	}
+	return ret
+}
+
+// allowedSources returns the sources netguard should let through besides loopback
+// The node IP is passed as $(HOST_IP), which the kubelet expands from the env var
+func allowedSources(cfg *config.EffectiveConfig) []string {
+	var ret []string
+	if cfg.BlockAllowKubelet {
+		ret = append(ret, "$("+hostIPEnv+")")
+	}
+	return append(ret, cfg.BlockAllowCIDRs...)
+}
 
-	script.WriteString("#!/bin/sh\n")
-	script.WriteString("set -e\n")
-	for _, p := range ports {
-		script.WriteString(fmt.Sprintf("iptables -A INPUT -p tcp --dport %d -s 127.0.0.1 -j ACCEPT\n", p))
-		script.WriteString(fmt.Sprintf("iptables -A INPUT -p tcp --dport %d -j DROP\n", p))
+// formatPorts joins ports into the comma-separated form netguard understands
+func formatPorts(ports []int32) string {
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		parts[i] = strconv.Itoa(int(p))
 	}
 
-	return script.String()
+	return strings.Join(parts, ",")
 }
 
 // needsSecurityContext returns a SecurityContext with NET_ADMIN capability
@@ -0,0 +1,108 @@
+package mutation
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	psaapi "k8s.io/pod-security-admission/api"
+	"k8s.io/pod-security-admission/policy"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// TestIPTablesInitContainerBuilder_Build tests the netguard args and the
+// downward API env var the $(HOST_IP) source expands from
+func TestIPTablesInitContainerBuilder_Build(t *testing.T) {
+	b := NewIPTablesInitContainerBuilder("injector:v1")
+	mapping := PortMapping{ProxyPort: 8080, ListenPort: 4180}
+
+	tests := []struct {
+		name     string
+		cfg      config.EffectiveConfig
+		wantArgs []string
+		wantEnv  bool
+	}{
+		{
+			name:     "ports only",
+			cfg:      config.EffectiveConfig{BlockDirectAccess: true},
+			wantArgs: []string{"--ports=8080"},
+		},
+		{
+			name:     "cidrs",
+			cfg:      config.EffectiveConfig{BlockDirectAccess: true, BlockAllowCIDRs: []string{"10.42.0.0/16", "fd00::/64"}},
+			wantArgs: []string{"--ports=8080", "--allow-cidrs=10.42.0.0/16,fd00::/64"},
+		},
+		{
+			name:     "kubelet and cidrs",
+			cfg:      config.EffectiveConfig{BlockDirectAccess: true, BlockAllowKubelet: true, BlockAllowCIDRs: []string{"10.42.0.0/16"}},
+			wantArgs: []string{"--ports=8080", "--allow-cidrs=$(HOST_IP),10.42.0.0/16"},
+			wantEnv:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := b.Build(&tt.cfg, mapping)
+			if c == nil {
+				t.Fatal("Build() = nil, want init container")
+			}
+			if c.Image != "injector:v1" || !slices.Equal(c.Command, []string{NetguardBinary}) {
+				t.Errorf("image = %q, command = %v", c.Image, c.Command)
+			}
+			if !slices.Equal(c.Args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", c.Args, tt.wantArgs)
+			}
+			if !tt.wantEnv {
+				if len(c.Env) != 0 {
+					t.Errorf("env = %+v, want none", c.Env)
+				}
+				return
+			}
+			if len(c.Env) != 1 || c.Env[0].Name != hostIPEnv || c.Env[0].ValueFrom == nil ||
+				c.Env[0].ValueFrom.FieldRef == nil || c.Env[0].ValueFrom.FieldRef.FieldPath != "status.hostIP" {
+				t.Errorf("env = %+v, want %s from status.hostIP", c.Env, hostIPEnv)
+			}
+		})
+	}
+
+	if c := b.Build(&config.EffectiveConfig{BlockAllowKubelet: true}, mapping); c != nil {
+		t.Errorf("Build() without block-direct-access = %+v, want nil", c)
+	}
+}
+
+// TestCNIValidationContainerBuilder_Build tests that the CNI mode init container
+// only validates and passes the restricted Pod Security Standard
+func TestCNIValidationContainerBuilder_Build(t *testing.T) {
+	b := NewInitContainerBuilder(BlockModeCNI, "injector:v1")
+	mapping := PortMapping{ProxyPort: 8080, ListenPort: 4180}
+
+	if c := b.Build(&config.EffectiveConfig{}, mapping); c != nil {
+		t.Errorf("Build() without block-direct-access = %+v, want nil", c)
+	}
+
+	c := b.Build(&config.EffectiveConfig{BlockDirectAccess: true, BlockAllowKubelet: true}, mapping)
+	if c == nil {
+		t.Fatal("Build() = nil, want validation container")
+	}
+	if c.Name != ValidationContainerName || c.Image != "injector:v1" || !slices.Equal(c.Command, []string{NetguardBinary}) {
+		t.Errorf("name = %q, image = %q, command = %v", c.Name, c.Image, c.Command)
+	}
+	if !slices.Equal(c.Args, []string{"--validate"}) {
+		t.Errorf("args = %v, want --validate", c.Args)
+	}
+
+	evaluator, err := policy.NewEvaluator(policy.DefaultChecks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{*c},
+		Containers:     []corev1.Container{{Name: "app", Image: "app", SecurityContext: DefaultSecurityContext()}},
+	}}
+	restricted := psaapi.LevelVersion{Level: psaapi.LevelRestricted, Version: psaapi.LatestVersion()}
+	result := policy.AggregateCheckResults(evaluator.EvaluatePod(restricted, &metav1.ObjectMeta{}, &pod.Spec))
+	if !result.Allowed {
+		t.Errorf("validation container violates restricted: %s", result.ForbiddenDetail())
+	}
+}
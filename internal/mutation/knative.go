@@ -1,7 +1,11 @@
 package mutation
 
 import (
+	"encoding/json"
+	"fmt"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // KnativeQueueProxyContainer is the name of Knative's sidecar
@@ -10,6 +14,10 @@ const KnativeQueueProxyContainer = "queue-proxy"
 // KnativeUserPortEnv is the env var queue-proxy uses to know where to forward traffic
 const KnativeUserPortEnv = "USER_PORT"
 
+// KnativeReadinessProbeEnv holds the user container's readiness probe as JSON
+// queue-proxy runs it itself against USER_PORT instead of the kubelet
+const KnativeReadinessProbeEnv = "SERVING_READINESS_PROBE"
+
 // KnativeDetector detects whether a pod is managed by Knative Serving
 type KnativeDetector interface {
 	// IsKnativePod returns true if the pod is a Knative Serving pod
@@ -54,10 +62,74 @@ func (d *DefaultKnativeDetector) FindQueueProxyIndex(pod *corev1.Pod) (int, bool
 // FindUserPortEnvIndex finds the USER_PORT env var in queue-proxy's env slice
 // Returns the index of the env var, or -1 if not found
 func FindUserPortEnvIndex(pod *corev1.Pod, queueProxyIndex int) int {
-	for i, env := range pod.Spec.Containers[queueProxyIndex].Env {
-		if env.Name == "USER_PORT" {
+	return findEnvIndex(pod, queueProxyIndex, KnativeUserPortEnv)
+}
+
+// findEnvIndex finds the named env var in a container's env slice
+// Returns the index of the env var, or -1 if not found
+func findEnvIndex(pod *corev1.Pod, containerIndex int, name string) int {
+	for i, env := range pod.Spec.Containers[containerIndex].Env {
+		if env.Name == name {
 			return i
 		}
 	}
 	return -1
 }
+
+// rewriteKnativeReadinessProbe points the probes in a SERVING_READINESS_PROBE
+// value that target userPort at proxyPort instead
+//
+// The value is a single probe or, with multi-container probing, a list.
+// Returns the rewritten value and the HTTP paths of the rewritten probes,
+// which have to bypass authentication. Exec and gRPC probes are left alone.
+func rewriteKnativeReadinessProbe(value string, userPort, proxyPort int32) (string, []string, error) {
+	var probes []*corev1.Probe
+	list := len(value) > 0 && value[0] == '['
+	if list {
+		if err := json.Unmarshal([]byte(value), &probes); err != nil {
+			return "", nil, fmt.Errorf("invalid %s: %w", KnativeReadinessProbeEnv, err)
+		}
+	} else {
+		probe := &corev1.Probe{}
+		if err := json.Unmarshal([]byte(value), probe); err != nil {
+			return "", nil, fmt.Errorf("invalid %s: %w", KnativeReadinessProbeEnv, err)
+		}
+		probes = append(probes, probe)
+	}
+
+	var paths []string
+	for _, probe := range probes {
+		if probe == nil {
+			continue
+		}
+		if probe.HTTPGet != nil && targetsPort(probe.HTTPGet.Port, userPort) {
+			probe.HTTPGet.Port = intstr.FromInt32(proxyPort)
+			path := probe.HTTPGet.Path
+			if path == "" {
+				path = "/"
+			}
+			paths = append(paths, path)
+		}
+		if probe.TCPSocket != nil && targetsPort(probe.TCPSocket.Port, userPort) {
+			probe.TCPSocket.Port = intstr.FromInt32(proxyPort)
+		}
+	}
+
+	var data []byte
+	var err error
+	if list {
+		data, err = json.Marshal(probes)
+	} else {
+		data, err = json.Marshal(probes[0])
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data), paths, nil
+}
+
+// targetsPort reports whether a probe port is userPort, or unset which
+// queue-proxy treats as USER_PORT
+func targetsPort(port intstr.IntOrString, userPort int32) bool {
+	return port.Type == intstr.Int && (port.IntVal == userPort || port.IntVal == 0)
+}
@@ -0,0 +1,112 @@
+package mutation
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// TestRewriteKnativeReadinessProbe tests single and multi-container probe values
+func TestRewriteKnativeReadinessProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		want      string
+		wantPaths []string
+	}{
+		{
+			name:      "http probe on user port",
+			value:     `{"httpGet":{"path":"/healthz","port":8080}}`,
+			want:      `{"httpGet":{"path":"/healthz","port":4180}}`,
+			wantPaths: []string{"/healthz"},
+		},
+		{
+			name:  "tcp probe on user port",
+			value: `{"tcpSocket":{"port":8080}}`,
+			want:  `{"tcpSocket":{"port":4180}}`,
+		},
+		{
+			name:      "list with a sidecar probe",
+			value:     `[{"httpGet":{"port":8080}},{"httpGet":{"path":"/ready","port":9000}}]`,
+			want:      `[{"httpGet":{"port":4180}},{"httpGet":{"path":"/ready","port":9000}}]`,
+			wantPaths: []string{"/"},
+		},
+		{
+			name:  "exec probe",
+			value: `{"exec":{"command":["true"]}}`,
+			want:  `{"exec":{"command":["true"]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, paths, err := rewriteKnativeReadinessProbe(tt.value, 8080, 4180)
+			if err != nil {
+				t.Fatalf("rewriteKnativeReadinessProbe() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("rewriteKnativeReadinessProbe() = %s, want %s", got, tt.want)
+			}
+			if !slices.Equal(paths, tt.wantPaths) {
+				t.Errorf("rewriteKnativeReadinessProbe() paths = %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+// knativePod returns a Knative pod whose queue-proxy has the given env
+func knativePod(env ...corev1.EnvVar) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"serving.knative.dev/revision": "app-00001"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "user-container", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}},
+			{Name: KnativeQueueProxyContainer, Env: env},
+		}},
+	}
+}
+
+// TestPatchKnativeQueueProxy tests that USER_PORT and the readiness probe are
+// pointed at oauth2-proxy whether or not queue-proxy already sets USER_PORT
+func TestPatchKnativeQueueProxy(t *testing.T) {
+	probe := corev1.EnvVar{Name: KnativeReadinessProbeEnv, Value: `{"httpGet":{"path":"/healthz","port":8080}}`}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+	}{
+		{name: "user port set", pod: knativePod(corev1.EnvVar{Name: KnativeUserPortEnv, Value: "8080"}, probe)},
+		{name: "user port missing", pod: knativePod(probe)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &PodMutator{knativeDetector: NewKnativeDetector()}
+			cfg := &config.EffectiveConfig{}
+			patchBuilder := NewPatchBuilder(false, true, false, false, false)
+			if err := m.patchKnativeQueueProxy(context.Background(), tt.pod, cfg, PortMapping{ProxyPort: 8080, ListenPort: 4180}, patchBuilder); err != nil {
+				t.Fatalf("patchKnativeQueueProxy() error = %v", err)
+			}
+			got, err := applyPatches(t, tt.pod, patchBuilder.Build())
+			if err != nil {
+				t.Fatalf("applying patches: %v", err)
+			}
+
+			env := map[string]string{}
+			for _, e := range got.Spec.Containers[1].Env {
+				env[e.Name] = e.Value
+			}
+			if env[KnativeUserPortEnv] != "4180" {
+				t.Errorf("%s = %q, want 4180", KnativeUserPortEnv, env[KnativeUserPortEnv])
+			}
+			if want := `{"httpGet":{"path":"/healthz","port":4180}}`; env[KnativeReadinessProbeEnv] != want {
+				t.Errorf("%s = %s, want %s", KnativeReadinessProbeEnv, env[KnativeReadinessProbeEnv], want)
+			}
+			if !slices.Equal(cfg.IgnorePaths, []string{"^/healthz$"}) {
+				t.Errorf("ignore paths = %v, want the probe path", cfg.IgnorePaths)
+			}
+		})
+	}
+}
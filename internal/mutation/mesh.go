@@ -0,0 +1,234 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// Istio sidecar containers, annotations and env vars
+const (
+	istioProxyContainer = "istio-proxy"
+	istioInitContainer  = "istio-init"
+
+	// istioStatusAnnotation is set by Istio's injector on injected pods
+	istioStatusAnnotation = "sidecar.istio.io/status"
+
+	// istioInjectKey requests injection as a pod label or annotation
+	istioInjectKey = "sidecar.istio.io/inject"
+
+	// IstioExcludeInboundPortsAnnotation keeps ports out of the inbound redirect to envoy
+	IstioExcludeInboundPortsAnnotation = "traffic.sidecar.istio.io/excludeInboundPorts"
+
+	// istioExcludeInboundPortsArg is istio-init's flag for the same setting
+	istioExcludeInboundPortsArg = "-d"
+
+	// istioAppProbersEnv holds the app probes Istio rewrote to pilot-agent as JSON
+	istioAppProbersEnv = "ISTIO_KUBE_APP_PROBERS"
+)
+
+// Linkerd sidecar containers and annotations
+const (
+	linkerdProxyContainer = "linkerd-proxy"
+	linkerdInitContainer  = "linkerd-init"
+
+	// linkerdInjectAnnotation requests injection ("enabled" or "ingress")
+	linkerdInjectAnnotation = "linkerd.io/inject"
+
+	// linkerdProxyVersionAnnotation is set by Linkerd's injector on injected pods
+	linkerdProxyVersionAnnotation = "linkerd.io/proxy-version"
+
+	// LinkerdSkipInboundPortsAnnotation keeps ports out of linkerd-proxy's inbound redirect
+	LinkerdSkipInboundPortsAnnotation = "config.linkerd.io/skip-inbound-ports"
+
+	// linkerdSkipInboundPortsArg is linkerd-init's flag for the same setting
+	linkerdSkipInboundPortsArg = "--inbound-ports-to-ignore"
+)
+
+// DetectMesh resolves the configured mesh mode for a pod
+//
+// MeshAuto looks for the mesh's containers and the annotations its injector
+// reads or writes. Meshes injected after this webhook are only seen through
+// their inject annotation, so set the mode explicitly (e.g. on the namespace)
+// when injection is enabled by namespace label alone.
+func DetectMesh(pod *corev1.Pod, configured annotation.Mesh) annotation.Mesh {
+	if configured != annotation.MeshAuto && configured != "" {
+		return configured
+	}
+	switch {
+	case hasContainer(pod, istioProxyContainer) || hasContainer(pod, istioInitContainer),
+		pod.Annotations[istioStatusAnnotation] != "",
+		pod.Annotations[istioInjectKey] == "true" || pod.Labels[istioInjectKey] == "true":
+		return annotation.MeshIstio
+	case hasContainer(pod, linkerdProxyContainer) || hasContainer(pod, linkerdInitContainer),
+		pod.Annotations[linkerdProxyVersionAnnotation] != "",
+		pod.Annotations[linkerdInjectAnnotation] == "enabled" || pod.Annotations[linkerdInjectAnnotation] == "ingress":
+		return annotation.MeshLinkerd
+	}
+	return annotation.MeshNone
+}
+
+// hasContainer reports whether the pod has a container or init container named name
+func hasContainer(pod *corev1.Pod, name string) bool {
+	_, ok := findContainer(pod.Spec.Containers, name)
+	if !ok {
+		_, ok = findContainer(pod.Spec.InitContainers, name)
+	}
+	return ok
+}
+
+// findContainer returns the index of the container named name
+func findContainer(containers []corev1.Container, name string) (int, bool) {
+	for i, c := range containers {
+		if c.Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// meshInitContainer returns the mesh's init container name, and the
+// annotation and init container flag excluding inbound ports from its redirect
+func meshInitContainer(mesh annotation.Mesh) (name, excludeAnnotation, excludeArg string) {
+	switch mesh {
+	case annotation.MeshIstio:
+		return istioInitContainer, IstioExcludeInboundPortsAnnotation, istioExcludeInboundPortsArg
+	case annotation.MeshLinkerd:
+		return linkerdInitContainer, LinkerdSkipInboundPortsAnnotation, linkerdSkipInboundPortsArg
+	}
+	return "", "", ""
+}
+
+// excludeInboundPort keeps the protected port out of the mesh's inbound redirect
+//
+// The mesh proxy forwards inbound traffic to the app over loopback, which
+// netguard lets through, so redirected connections to the protected port
+// would bypass oauth2-proxy. Excluded, they reach netguard unredirected and
+// are dropped. The annotation covers mesh CNI plugins and init containers
+// injected later; an init container already injected gets the flag patched.
+func excludeInboundPort(pod *corev1.Pod, mesh annotation.Mesh, port int32, patchBuilder *JSONPatchBuilder) {
+	initName, excludeAnnotation, excludeArg := meshInitContainer(mesh)
+	if initName == "" {
+		return
+	}
+	patchBuilder.AddAnnotation(excludeAnnotation, appendPort(pod.Annotations[excludeAnnotation], port))
+
+	i, ok := findContainer(pod.Spec.InitContainers, initName)
+	if !ok {
+		return
+	}
+	args := pod.Spec.InitContainers[i].Args
+	for j, arg := range args {
+		if arg == excludeArg && j+1 < len(args) {
+			patchBuilder.ReplaceInitContainerArg(i, j+1, appendPort(args[j+1], port))
+			return
+		}
+		if v, ok := strings.CutPrefix(arg, excludeArg+"="); ok {
+			patchBuilder.ReplaceInitContainerArg(i, j, excludeArg+"="+appendPort(v, port))
+			return
+		}
+	}
+	patchBuilder.AddInitContainerArgs(i, len(args) > 0, excludeArg, strconv.Itoa(int(port)))
+}
+
+// appendPort adds port to a comma-separated port list unless already present
+// A list of "*" already excludes every port and is returned unchanged.
+func appendPort(list string, port int32) string {
+	p := strconv.Itoa(int(port))
+	if list == "*" {
+		return list
+	}
+	if list == "" {
+		return p
+	}
+	if slices.Contains(strings.Split(list, ","), p) {
+		return list
+	}
+	return list + "," + p
+}
+
+// meshInitContainerIndex returns where the netguard init container goes:
+// right after the mesh's init container, or -1 to append
+func meshInitContainerIndex(pod *corev1.Pod, mesh annotation.Mesh) int {
+	initName, _, _ := meshInitContainer(mesh)
+	if i, ok := findContainer(pod.Spec.InitContainers, initName); ok && initName != "" {
+		return i + 1
+	}
+	return -1
+}
+
+// rewriteIstioAppProbers points app probes Istio moved to pilot-agent at oauth2-proxy
+//
+// When Istio's injector ran first, the kubelet probes pilot-agent and the
+// original probes live in istio-proxy's ISTIO_KUBE_APP_PROBERS env as a map
+// of pilot-agent path to probe. pilot-agent doesn't probe over loopback, so
+// probes on the protected port would be dropped by netguard. Returns the
+// rewritten value and the HTTP paths that have to bypass authentication.
+func rewriteIstioAppProbers(value, protectedPortName string, protectedPortNumber, listenPort int32) (string, []string, error) {
+	var probers map[string]*corev1.Probe
+	if err := json.Unmarshal([]byte(value), &probers); err != nil {
+		return "", nil, fmt.Errorf("invalid %s: %w", istioAppProbersEnv, err)
+	}
+
+	matches := func(port intstr.IntOrString) bool {
+		return (port.Type == intstr.String && port.StrVal == protectedPortName) || (port.Type == intstr.Int && port.IntVal == protectedPortNumber)
+	}
+	var paths []string
+	for _, probe := range probers {
+		if probe == nil {
+			continue
+		}
+		if probe.HTTPGet != nil && matches(probe.HTTPGet.Port) {
+			probe.HTTPGet.Port = intstr.FromInt32(listenPort)
+			path := probe.HTTPGet.Path
+			if path == "" {
+				path = "/"
+			}
+			paths = append(paths, path)
+		}
+		if probe.TCPSocket != nil && matches(probe.TCPSocket.Port) {
+			probe.TCPSocket.Port = intstr.FromInt32(listenPort)
+		}
+	}
+	slices.Sort(paths)
+
+	data, err := json.Marshal(probers)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data), paths, nil
+}
+
+// patchIstioAppProbers rewrites istio-proxy's ISTIO_KUBE_APP_PROBERS, if set,
+// and lets its HTTP probe paths through oauth2-proxy unauthenticated
+func patchIstioAppProbers(pod *corev1.Pod, cfg *config.EffectiveConfig, mapping PortMapping, patchBuilder *JSONPatchBuilder) error {
+	i, ok := findContainer(pod.Spec.Containers, istioProxyContainer)
+	if !ok {
+		return nil
+	}
+	j := findEnvIndex(pod, i, istioAppProbersEnv)
+	if j < 0 || pod.Spec.Containers[i].Env[j].Value == "" {
+		return nil
+	}
+
+	value, paths, err := rewriteIstioAppProbers(pod.Spec.Containers[i].Env[j].Value, cfg.ProtectedPort, mapping.ProxyPort, mapping.ListenPort)
+	if err != nil {
+		return err
+	}
+	patchBuilder.ReplaceEnvVarValue(i, j, value)
+	for _, p := range paths {
+		path := fmt.Sprintf("^%s$", p)
+		if !slices.Contains(cfg.IgnorePaths, path) {
+			cfg.IgnorePaths = append(cfg.IgnorePaths, path)
+		}
+	}
+	return nil
+}
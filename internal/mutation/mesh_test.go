@@ -0,0 +1,139 @@
+package mutation
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// TestDetectMesh tests detection from containers, annotations and labels
+func TestDetectMesh(t *testing.T) {
+	tests := []struct {
+		name       string
+		pod        corev1.Pod
+		configured annotation.Mesh
+		want       annotation.Mesh
+	}{
+		{
+			name: "istio sidecar",
+			pod:  corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "istio-proxy"}}}},
+			want: annotation.MeshIstio,
+		},
+		{
+			name: "istio inject label",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"sidecar.istio.io/inject": "true"}}},
+			want: annotation.MeshIstio,
+		},
+		{
+			name: "linkerd inject annotation",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"linkerd.io/inject": "enabled"}}},
+			want: annotation.MeshLinkerd,
+		},
+		{
+			name: "no mesh",
+			pod:  corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}},
+			want: annotation.MeshNone,
+		},
+		{
+			name:       "configured mode wins",
+			pod:        corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "istio-proxy"}}}},
+			configured: annotation.MeshNone,
+			want:       annotation.MeshNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configured := tt.configured
+			if configured == "" {
+				configured = annotation.MeshAuto
+			}
+			if got := DetectMesh(&tt.pod, configured); got != tt.want {
+				t.Errorf("DetectMesh() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestExcludeInboundPort tests the annotation and patching an injected istio-init
+func TestExcludeInboundPort(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{IstioExcludeInboundPortsAnnotation: "9090"}},
+		Spec: corev1.PodSpec{InitContainers: []corev1.Container{
+			{Name: "istio-init", Args: []string{"istio-iptables", "-d", "15090,15021"}},
+		}},
+	}
+	patchBuilder := NewPatchBuilder(true, false, false, true, false)
+	excludeInboundPort(pod, annotation.MeshIstio, 8080, patchBuilder)
+
+	want := map[string]interface{}{
+		"/metadata/annotations/traffic.sidecar.istio.io~1excludeInboundPorts": "9090,8080",
+		"/spec/initContainers/0/args/2":                                         "15090,15021,8080",
+	}
+	ops := patchBuilder.Build()
+	if len(ops) != len(want) {
+		t.Fatalf("excludeInboundPort() = %v, want %d operations", ops, len(want))
+	}
+	for _, op := range ops {
+		if op.Value != want[op.Path] {
+			t.Errorf("%s %s = %v, want %v", op.Op, op.Path, op.Value, want[op.Path])
+		}
+	}
+	if i := meshInitContainerIndex(pod, annotation.MeshIstio); i != 1 {
+		t.Errorf("meshInitContainerIndex() = %d, want 1", i)
+	}
+}
+
+// TestExcludeInboundPort_Wildcard tests that "*" is kept rather than narrowed to the port
+func TestExcludeInboundPort_Wildcard(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{IstioExcludeInboundPortsAnnotation: "*"}},
+		Spec: corev1.PodSpec{InitContainers: []corev1.Container{
+			{Name: "istio-init", Args: []string{"istio-iptables", "-d", "*"}},
+		}},
+	}
+	patchBuilder := NewPatchBuilder(true, false, false, true, false)
+	excludeInboundPort(pod, annotation.MeshIstio, 8080, patchBuilder)
+
+	for _, op := range patchBuilder.Build() {
+		if op.Value != "*" {
+			t.Errorf("%s %s = %v, want *", op.Op, op.Path, op.Value)
+		}
+	}
+
+	tests := []struct {
+		list string
+		want string
+	}{
+		{"", "8080"},
+		{"*", "*"},
+		{"9090", "9090,8080"},
+		{"8080,9090", "8080,9090"},
+	}
+	for _, tt := range tests {
+		if got := appendPort(tt.list, 8080); got != tt.want {
+			t.Errorf("appendPort(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+// TestRewriteIstioAppProbers tests that only probes on the protected port move
+func TestRewriteIstioAppProbers(t *testing.T) {
+	value := `{"/app-health/app/livez":{"httpGet":{"path":"/healthz","port":8080}},"/app-health/app/readyz":{"tcpSocket":{"port":9000}}}`
+	want := `{"/app-health/app/livez":{"httpGet":{"path":"/healthz","port":4180}},"/app-health/app/readyz":{"tcpSocket":{"port":9000}}}`
+
+	got, paths, err := rewriteIstioAppProbers(value, "8080", 8080, 4180)
+	if err != nil {
+		t.Fatalf("rewriteIstioAppProbers() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("rewriteIstioAppProbers() = %s, want %s", got, want)
+	}
+	if !slices.Equal(paths, []string{"/healthz"}) {
+		t.Errorf("rewriteIstioAppProbers() paths = %v, want [/healthz]", paths)
+	}
+}
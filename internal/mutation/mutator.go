@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"slices"
 	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
 
 	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
 	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/nsdefaults"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+	"github.com/spacemule/oauth2-proxy-injector/internal/rules"
+	"github.com/spacemule/oauth2-proxy-injector/internal/tracing"
 )
 
 // SidecarContainerName is the name used for the injected oauth2-proxy container
@@ -20,6 +27,28 @@ const SidecarContainerName = "oauth2-proxy"
 // Used to prevent double-injection and for debugging
 const InjectedAnnotation = "spacemule.net/oauth2-proxy.injected"
 
+// RegisteredClientSecretSuffix is appended to the workload name to name the
+// Secret holding a dynamically registered client's client-id and client-secret
+const RegisteredClientSecretSuffix = "-oauth2-proxy-client"
+
+// InjectedLabel is added to mutated pods so they can be listed by label selector
+const InjectedLabel = "spacemule.net/oauth2-proxy.injected"
+
+// ConfigHashAnnotation records the hash of the EffectiveConfig used at injection
+// Compared against a fresh hash by the drift controller
+const ConfigHashAnnotation = "spacemule.net/oauth2-proxy.config-hash"
+
+// EffectiveConfigAnnotation holds the injected settings and where each came from
+// Compact JSON of config.EffectiveConfig.Explain, with credentials redacted
+const EffectiveConfigAnnotation = "spacemule.net/oauth2-proxy.effective-config"
+
+// InjectedImageAnnotation records the oauth2-proxy image used at injection
+const InjectedImageAnnotation = "spacemule.net/oauth2-proxy.injected-image"
+
+// InjectedProxyPortAnnotation records the port the injected oauth2-proxy listens on
+// Read by the Service webhook to pick the targetPort for the pods it selects
+const InjectedProxyPortAnnotation = "spacemule.net/oauth2-proxy.injected-proxy-port"
+
 // Mutator defines the contract for pod mutation operations
 type Mutator interface {
 	// Mutate takes a pod and returns JSON patch operations to inject oauth2-proxy
@@ -35,6 +64,40 @@ type PodMutator struct {
 	knativeDetector      KnativeDetector
 	initContainerBuilder InitContainerBuilder
 
+	// blockMode selects whether block-direct-access uses an init container
+	// or delegates to the chained CNI plugin via annotation.CNIBlockedPortsAnnotation,
+	// with the init container only validating the plugin's rules
+	blockMode BlockMode
+
+	// podSecurityChecker warns when the injected pod would violate the namespace's
+	// Pod Security Standard. Optional - nil skips the check
+	podSecurityChecker PodSecurityChecker
+
+	// referenceChecker verifies referenced Secrets and SecretProviderClasses exist
+	// Optional - nil skips the check
+	referenceChecker ReferenceChecker
+
+	// cookieSecretGenerator creates per-workload cookie Secrets for
+	// cookie-secret-ref: generate. Optional - nil rejects such pods
+	cookieSecretGenerator CookieSecretGenerator
+
+	// owners resolves a pod's workload, used to find the Secret of a dynamically
+	// registered client. Optional - nil rejects client-registration: dynamic
+	owners owner.Resolver
+
+	// rules inject into pods matched by label selectors, beneath workload and
+	// pod annotations. Optional - nil disables rules
+	rules rules.Matcher
+
+	// namespaces supplies annotations set on the pod's Namespace, beneath
+	// rules, workload and pod annotations. Optional - nil ignores them
+	namespaces nsdefaults.Lister
+
+	// workloadAnnotations applies oauth2-proxy annotations set on the pod's
+	// controllers (Deployment, StatefulSet, Knative Service, ...) beneath the
+	// pod's own. Requires owners
+	workloadAnnotations bool
+
 	// defaultConfigMap is the name of the default ConfigMap in the webhook's namespace
 	// Used when pods don't specify spacemule.net/oauth2-proxy.config annotation
 	defaultConfigMap string
@@ -52,6 +115,15 @@ type PodMutator struct {
 //   - builder: builds the oauth2-proxy sidecar container
 //   - merger: merges ConfigMap settings with annotation overrides
 //   - knativeDetector: detects Knative pods and locates queue-proxy
+//   - initContainerBuilder: builds the block-direct-access init container, see NewInitContainerBuilder
+//   - blockMode: how block-direct-access rules are installed (init-container or cni)
+//   - podSecurityChecker: warns about Pod Security Admission violations (optional, may be nil)
+//   - referenceChecker: validates Secret/SecretProviderClass references (optional, may be nil)
+//   - cookieSecretGenerator: creates generated cookie Secrets (optional, may be nil)
+//   - owners: resolves pod owners for client-registration: dynamic (optional, may be nil)
+//   - workloadAnnotations: inherit oauth2-proxy annotations from the pod's controllers
+//   - rules: matches pods against label-selector injection rules (optional, may be nil)
+//   - namespaces: reads oauth2-proxy annotations from Namespaces (optional, may be nil)
 //   - defaultConfigMap: name of the default ConfigMap (e.g., "oauth2-proxy-config")
 //   - defaultConfigNamespace: namespace of the default ConfigMap (webhook's namespace)
 func NewPodMutator(
@@ -61,6 +133,14 @@ func NewPodMutator(
 	merger config.Merger,
 	knativeDetector KnativeDetector,
 	initContainerBuilder InitContainerBuilder,
+	blockMode BlockMode,
+	podSecurityChecker PodSecurityChecker,
+	referenceChecker ReferenceChecker,
+	cookieSecretGenerator CookieSecretGenerator,
+	owners owner.Resolver,
+	workloadAnnotations bool,
+	rules rules.Matcher,
+	namespaces nsdefaults.Lister,
 	defaultConfigMap string,
 	defaultConfigNamespace string,
 ) *PodMutator {
@@ -71,18 +151,24 @@ func NewPodMutator(
 		configMerger:           merger,
 		knativeDetector:        knativeDetector,
 		initContainerBuilder:   initContainerBuilder,
+		blockMode:              blockMode,
+		podSecurityChecker:     podSecurityChecker,
+		referenceChecker:       referenceChecker,
+		cookieSecretGenerator:  cookieSecretGenerator,
+		owners:                 owners,
+		workloadAnnotations:    workloadAnnotations,
+		rules:                  rules,
+		namespaces:             namespaces,
 		defaultConfigMap:       defaultConfigMap,
 		defaultConfigNamespace: defaultConfigNamespace,
 	}
 }
 
 // Mutate inspects pod annotations and injects oauth2-proxy sidecar if enabled
-func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) ([]PatchOperation, error) {
+func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) (_ []PatchOperation, err error) {
 	var ret []PatchOperation
-	var cm, cmNamespace string
-	var proxyCfg *config.ProxyConfig
 
-	annotationCfg, err := m.annotationParser.Parse(pod.Annotations)
+	annotationCfg, err := m.parseAnnotations(ctx, pod)
 	if err != nil {
 		return nil, err
 	}
@@ -90,43 +176,69 @@ func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) ([]PatchOperat
 		return ret, nil
 	}
 
+	// Reinvoked after another webhook, or created from a copy of an injected
+	// pod: a complete injection is left alone, leftovers of one are replaced
 	if isAlreadyInjected(pod) {
 		return ret, nil
 	}
+	partial := isPartiallyInjected(pod)
 
-	if annotationCfg.ConfigMapName != "" {
-		cm = annotationCfg.ConfigMapName
-		cmNamespace = pod.Namespace
-	} else if m.defaultConfigMap != "" {
-		cm = m.defaultConfigMap
-		cmNamespace = m.defaultConfigNamespace
+	effectiveCfg, err := m.resolveConfig(ctx, pod, annotationCfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if cm != "" {
-		proxyCfg, err = m.configLoader.Load(ctx, cm, cmNamespace)
+	// Hash before the probe rewrites below touch IgnorePaths, so the drift
+	// controller can recompute the same value from annotations alone
+	configHash, err := effectiveCfg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if effectiveCfg.CookieSecret.Generate {
+		if m.cookieSecretGenerator == nil {
+			return nil, fmt.Errorf("\ncookie-secret-ref: generate requires the webhook to run with --generate-cookie-secrets")
+		}
+		ref, err := m.cookieSecretGenerator.Ensure(ctx, pod, ReviewFrom(ctx).DryRun)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		proxyCfg = config.NewEmptyProxyConfig()
+		effectiveCfg.CookieSecret.Ref = ref
 	}
 
-	effectiveCfg, err := m.configMerger.Merge(proxyCfg, annotationCfg)
-	if err != nil {
+	if effectiveCfg.DynamicClientRegistration {
+		if err := m.bindRegisteredClient(ctx, pod, effectiveCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, "BuildPatch")
+	defer func() { tracing.End(span, err) }()
+
+	// Every index-based patch below is computed against the pod as it is
+	// once leftovers are removed, and guarded by test operations
+	patchBuilder := NewPatchBuilder(hasExistingAnnotations(pod), hasExistingLabels(pod), hasExistingVolumes(pod), hasExistingInitContainers(pod), hasExistingImagePullSecrets(pod)).Guard(pod)
+	if partial {
+		pod = stripInjection(pod, patchBuilder)
+		patchBuilder.Guard(pod)
+	}
+
+	if err := checkProxyPortFree(pod, effectiveCfg.ProxyPort); err != nil {
 		return nil, err
 	}
 
-	var mapping PortMapping
+	mapping := PortMapping{ListenPort: effectiveCfg.ProxyPort}
 	if effectiveCfg.ProtectedPort != "" {
 		ports := collectContainerPorts(pod)
 		mapping, err = CalculatePortMapping(ports, effectiveCfg)
 		if err != nil {
+			if partial {
+				return nil, fmt.Errorf("pod carries a partial oauth2-proxy injection: %w", err)
+			}
 			return nil, err
 		}
 	}
 
-	patchBuilder := NewPatchBuilder(hasExistingAnnotations(pod), hasExistingLabels(pod), hasExistingVolumes(pod), hasExistingInitContainers(pod))
-
 	// Remove named ports
 	if annotation.IsNamedPort(effectiveCfg.ProtectedPort) {
 		i, j, remove := findProtectedPort(pod, effectiveCfg.ProtectedPort)
@@ -135,9 +247,21 @@ func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) ([]PatchOperat
 		}
 	}
 
-	// When block-direct-access is enabled, rewrite health checks to go through oauth2-proxy
-	// since direct access to the protected port is blocked by iptables
+	// A mesh sidecar redirects inbound traffic and forwards it over loopback,
+	// so block-direct-access has to keep the protected port out of its redirect
+	mesh := annotation.MeshNone
 	if effectiveCfg.BlockDirectAccess {
+		mesh = DetectMesh(pod, effectiveCfg.Mesh)
+		excludeInboundPort(pod, mesh, mapping.ProxyPort, patchBuilder)
+	}
+
+	// When block-direct-access is enabled, rewrite health checks to go through oauth2-proxy
+	// since direct access to the protected port is blocked by nftables. allow-kubelet
+	// alone isn't enough to skip this: the probe source depends on the CNI, and
+	// bridge/overlay CNIs probe from the gateway IP rather than the node IP. Only
+	// direct-probes, which asserts the source is allowlisted, keeps probe paths out
+	// of ignore-paths, unless Istio's pilot-agent runs the probes from inside the pod.
+	if effectiveCfg.BlockDirectAccess && (!effectiveCfg.BlockDirectProbes || mesh == annotation.MeshIstio) {
 		rewrites, err := rewriteProbesForBlockedAccess(pod, effectiveCfg.ProtectedPort, mapping)
 		if err != nil {
 			return nil, err
@@ -151,6 +275,11 @@ func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) ([]PatchOperat
 				}
 			}
 		}
+		if mesh == annotation.MeshIstio {
+			if err := patchIstioAppProbers(pod, effectiveCfg, mapping, patchBuilder); err != nil {
+				return nil, err
+			}
+		}
 	} else if annotation.IsNamedPort(effectiveCfg.ProtectedPort) {
 		rewrites := rewriteProbePortNames(pod, effectiveCfg.ProtectedPort, mapping.ProxyPort)
 		for _, rw := range rewrites {
@@ -158,11 +287,27 @@ func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) ([]PatchOperat
 		}
 	}
 
+	// Handle Knative: redirect queue-proxy's USER_PORT and readiness probe to
+	// oauth2-proxy. Before the sidecar is built since it may add ignore-paths
+	if err := m.patchKnativeQueueProxy(ctx, pod, effectiveCfg, mapping, patchBuilder); err != nil {
+		return nil, err
+	}
+
+	// The CNI plugin installs the rules at network setup, the init container only checks them
+	patchCNIAnnotations(pod, cniAnnotations(effectiveCfg, m.blockMode, mapping), patchBuilder)
 	initContainer := m.initContainerBuilder.Build(effectiveCfg, mapping)
+	if initContainer != nil && initContainer.Image == "" {
+		return nil, fmt.Errorf("\nblock-direct-access requires the webhook to run with --init-image")
+	}
 	container, volumes := m.sidecarBuilder.Build(effectiveCfg, mapping)
 
 	if initContainer != nil {
-		patchBuilder.AddInitContainer(initContainer)
+		// After the mesh's init container, so its redirect rules are in place first
+		if i := meshInitContainerIndex(pod, mesh); i >= 0 {
+			patchBuilder.InsertInitContainer(i, initContainer)
+		} else {
+			patchBuilder.AddInitContainer(initContainer)
+		}
 	}
 	patchBuilder.AddContainer(container)
 
@@ -170,33 +315,372 @@ func (m *PodMutator) Mutate(ctx context.Context, pod *corev1.Pod) ([]PatchOperat
 		patchBuilder.AddVolume(v)
 	}
 
-	// Handle Knative: redirect queue-proxy's USER_PORT to oauth2-proxy
-	if err := m.patchKnativeQueueProxy(pod, patchBuilder); err != nil {
+	// Pull secrets are pod-wide, only add the ones the pod doesn't already reference
+	for _, name := range effectiveCfg.ProxyImagePullSecrets {
+		if !hasImagePullSecret(pod, name) {
+			patchBuilder.AddImagePullSecret(name)
+		}
+	}
+
+	if err := m.checkReferences(ctx, pod, annotationCfg.ValidateReferences, container, volumes); err != nil {
 		return nil, err
 	}
+	m.checkPodSecurity(ctx, pod, initContainer, container, volumes)
+
+	explained, err := effectiveCfg.ExplainJSON()
+	if err != nil {
+		return nil, err
+	}
+	patchBuilder.AddAnnotation(EffectiveConfigAnnotation, explained)
+	patchBuilder.AddAnnotation(ConfigHashAnnotation, configHash)
+	patchBuilder.AddAnnotation(InjectedImageAnnotation, effectiveCfg.ProxyImage)
+	patchBuilder.AddAnnotation(InjectedProxyPortAnnotation, strconv.Itoa(int(mapping.ListenPort)))
+
+	// The sidecar reads its alpha config back from the pod through the downward API
+	if len(effectiveCfg.Providers) > 0 {
+		alpha, err := BuildAlphaConfig(effectiveCfg, mapping)
+		if err != nil {
+			return nil, err
+		}
+		patchBuilder.AddAnnotation(AlphaConfigAnnotation, alpha)
+	}
+	patchBuilder.AddLabel(InjectedLabel, "true")
 
 	return patchBuilder.AddAnnotation(InjectedAnnotation, "true").Build(), nil
 }
 
+// ResolveConfig computes the EffectiveConfig that would be injected into the pod now
+// Returns nil if injection is not enabled for the pod
+//
+// Used by the drift controller to compare running pods against current settings.
+func (m *PodMutator) ResolveConfig(ctx context.Context, pod *corev1.Pod) (*config.EffectiveConfig, error) {
+	annotationCfg, err := m.parseAnnotations(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	if !annotationCfg.Enabled {
+		return nil, nil
+	}
+
+	return m.resolveConfig(ctx, pod, annotationCfg)
+}
+
+// parseAnnotations parses the pod's annotations layered over those of its
+// workload, its injection rule and its namespace, so charts that can't
+// template pod annotations can be configured on the Deployment, by a platform
+// rule or once for the whole namespace
+//
+// Lookup errors deny admission, since any layer may be what enables
+// injection and admitting the pod without it would skip the proxy.
+// Each layer's spec annotation is expanded before layering, so individual
+// annotations on a nearer layer override single fields of a further spec.
+func (m *PodMutator) parseAnnotations(ctx context.Context, pod *corev1.Pod) (_ *annotation.Config, err error) {
+	ctx, span := tracing.Start(ctx, "ParseAnnotations")
+	defer func() { tracing.End(span, err) }()
+
+	annotations, err := annotation.ExpandSpec(pod.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	var workloadKeys []string
+	var workload owner.Ref
+	if m.workloadAnnotations && m.owners != nil && metav1.GetControllerOf(pod) != nil {
+		inherited, err := m.owners.Annotations(ctx, pod)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workload annotations: %w", err)
+		}
+		for k := range inherited {
+			if _, ok := annotations[k]; !ok && strings.HasPrefix(k, annotation.AnnotationPrefix) {
+				workloadKeys = append(workloadKeys, strings.TrimPrefix(k, annotation.AnnotationPrefix))
+			}
+		}
+		if len(workloadKeys) > 0 {
+			workload, err = m.owners.Resolve(ctx, pod)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve workload: %w", err)
+			}
+		}
+		if len(inherited) > 0 {
+			annotations = annotation.Inherit(inherited, annotations)
+		}
+	}
+
+	var rule *rules.Rule
+	if m.rules != nil {
+		var err error
+		rule, err = m.rules.Match(ctx, pod)
+		if err != nil {
+			return nil, fmt.Errorf("failed to match injection rules: %w", err)
+		}
+	}
+	var ruleKeys []string
+	if rule != nil {
+		ruleAnnotations, err := annotation.ExpandSpec(rule.PodAnnotations())
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		for k := range ruleAnnotations {
+			if _, ok := annotations[k]; !ok {
+				ruleKeys = append(ruleKeys, strings.TrimPrefix(k, annotation.AnnotationPrefix))
+			}
+		}
+		annotations = annotation.Inherit(ruleAnnotations, annotations)
+	}
+
+	var nsKeys []string
+	if m.namespaces != nil {
+		nsAnnotations, err := m.namespaces.Annotations(pod.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read namespace annotations: %w", err)
+		}
+		for k := range nsAnnotations {
+			if _, ok := annotations[k]; !ok {
+				nsKeys = append(nsKeys, strings.TrimPrefix(k, annotation.AnnotationPrefix))
+			}
+		}
+		annotations = annotation.Inherit(nsAnnotations, annotations)
+	}
+
+	ReviewFrom(ctx).Annotations = annotations
+	annotationCfg, err := m.annotationParser.Parse(annotations)
+	if err != nil {
+		return nil, err
+	}
+	// Sources is only populated for enabled pods
+	if annotationCfg.Enabled {
+		for _, k := range workloadKeys {
+			annotationCfg.Sources[k] = config.SourceWorkload(workload.Kind, workload.Name)
+		}
+		for _, k := range ruleKeys {
+			annotationCfg.Sources[k] = config.SourceRule(rule.Name)
+		}
+		for _, k := range nsKeys {
+			annotationCfg.Sources[k] = config.SourceNamespace(pod.Namespace)
+		}
+	}
+	return annotationCfg, nil
+}
+
+// resolveConfig loads the ConfigMap for the pod and merges the annotation overrides
+func (m *PodMutator) resolveConfig(ctx context.Context, pod *corev1.Pod, annotationCfg *annotation.Config) (*config.EffectiveConfig, error) {
+	var cm, cmNamespace string
+	var proxyCfg *config.ProxyConfig
+	var err error
+
+	if annotationCfg.ConfigMapName != "" {
+		cm = annotationCfg.ConfigMapName
+		cmNamespace = pod.Namespace
+		// Rule profiles are platform config and live beside the default ConfigMap
+		if config.IsRuleSource(annotationCfg.Sources[strings.TrimPrefix(annotation.KeyConfig, annotation.AnnotationPrefix)]) {
+			cmNamespace = m.defaultConfigNamespace
+		}
+	} else if m.defaultConfigMap != "" {
+		cm = m.defaultConfigMap
+		cmNamespace = m.defaultConfigNamespace
+	}
+
+	if cm != "" {
+		ReviewFrom(ctx).ConfigMap = cmNamespace + "/" + cm
+		proxyCfg, err = m.configLoader.Load(ctx, cm, cmNamespace)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		proxyCfg = config.NewEmptyProxyConfig()
+	}
+
+	_, span := tracing.Start(ctx, "Merge")
+	effectiveCfg, err := m.configMerger.Merge(proxyCfg, annotationCfg)
+	tracing.End(span, err)
+	return effectiveCfg, err
+}
+
 // patchKnativeQueueProxy patches queue-proxy's USER_PORT env var to point to oauth2-proxy
 // This is a no-op for non-Knative pods
-func (m *PodMutator) patchKnativeQueueProxy(pod *corev1.Pod, patchBuilder *JSONPatchBuilder) error {
+//
+// USER_PORT is added if queue-proxy doesn't set it. queue-proxy also runs the
+// user container's readiness probe from SERVING_READINESS_PROBE against the
+// user port; those probes are pointed at oauth2-proxy too and their HTTP
+// paths added to ignore-paths. oauth2-proxy can't match queue-proxy's probe
+// User-Agent, so the path is all that identifies a probe.
+func (m *PodMutator) patchKnativeQueueProxy(ctx context.Context, pod *corev1.Pod, cfg *config.EffectiveConfig, mapping PortMapping, patchBuilder *JSONPatchBuilder) (err error) {
 	if !m.knativeDetector.IsKnativePod(pod) {
 		return nil
 	}
+	ctx, span := tracing.Start(ctx, "PatchKnativeQueueProxy")
+	defer func() { tracing.End(span, err) }()
+
 	c, b := m.knativeDetector.FindQueueProxyIndex(pod)
 	if !b {
 		return fmt.Errorf("unexpected state: queue-proxy pod not found")
 	}
+	proxyPort := strconv.Itoa(int(mapping.ListenPort))
+	queueProxy := pod.Spec.Containers[c]
+
+	// Without USER_PORT the probes target the app port oauth2-proxy forwards to
+	userPort := mapping.ProxyPort
 	i := FindUserPortEnvIndex(pod, c)
 	if i == -1 {
-		return fmt.Errorf("unexpected state: USER_PORT env not found")
+		patchBuilder.AddEnvVar(c, len(queueProxy.Env) > 0, KnativeUserPortEnv, proxyPort)
+	} else {
+		userPort, err = annotation.ParsePort(queueProxy.Env[i].Value)
+		if err != nil {
+			return fmt.Errorf("\nqueue-proxy %s: %w", KnativeUserPortEnv, err)
+		}
+		patchBuilder.ReplaceEnvVarValue(c, i, proxyPort)
 	}
-	patchBuilder.ReplaceEnvVarValue(c, i, "4180")
 
+	j := findEnvIndex(pod, c, KnativeReadinessProbeEnv)
+	if j == -1 || queueProxy.Env[j].Value == "" {
+		return nil
+	}
+	probe, paths, err := rewriteKnativeReadinessProbe(queueProxy.Env[j].Value, userPort, mapping.ListenPort)
+	if err != nil {
+		return err
+	}
+	patchBuilder.ReplaceEnvVarValue(c, j, probe)
+	for _, p := range paths {
+		if p == "/" {
+			ReviewFrom(ctx).AddWarning("Knative readiness probe path / is now reachable without authentication; probe a dedicated path instead")
+		}
+		path := fmt.Sprintf("^%s$", p)
+		if !slices.Contains(cfg.IgnorePaths, path) {
+			cfg.IgnorePaths = append(cfg.IgnorePaths, path)
+		}
+	}
+
+	return nil
+}
+
+// checkProxyPortFree rejects pods that already use the oauth2-proxy port
+func checkProxyPortFree(pod *corev1.Pod, port int32) error {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.ContainerPort == port {
+				return fmt.Errorf("\nproxy-port: %d is already used by container %q, set %s to a free port", port, c.Name, annotation.KeyProxyPort)
+			}
+		}
+	}
+	return nil
+}
+
+// bindRegisteredClient points EnvSecret at the workload's registration Secret
+//
+// The Secret is written asynchronously by the client-registration controller;
+// until it exists the kubelet keeps retrying the sidecar's env.
+func (m *PodMutator) bindRegisteredClient(ctx context.Context, pod *corev1.Pod, cfg *config.EffectiveConfig) error {
+	if m.owners == nil {
+		return fmt.Errorf("\nclient-registration: dynamic requires the webhook to resolve pod owners")
+	}
+	ref, err := m.owners.Resolve(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if ref.Kind != "Deployment" && ref.Kind != "StatefulSet" {
+		ReviewFrom(ctx).AddWarning("client-registration: dynamic only registers clients for Deployments and StatefulSets, %s %q will wait for a Secret nothing creates", ref.Kind, ref.Name)
+	}
+
+	cfg.EnvSecret = owner.WorkloadName(ref, pod) + RegisteredClientSecretSuffix
 	return nil
 }
 
+// checkReferences reports Secrets, keys and SecretProviderClasses the sidecar
+// needs but that don't exist, as a denial or warnings depending on the mode
+//
+// Lookup errors (e.g. RBAC) are logged rather than failing admission.
+func (m *PodMutator) checkReferences(ctx context.Context, pod *corev1.Pod, podMode annotation.ReferenceValidation, container *corev1.Container, volumes []corev1.Volume) error {
+	if m.referenceChecker == nil || pod.Namespace == "" {
+		return nil
+	}
+
+	mode := m.referenceChecker.Mode(ctx, pod.Namespace, podMode)
+	if mode == annotation.ReferenceValidationOff {
+		return nil
+	}
+
+	problems, err := m.referenceChecker.Check(ctx, pod.Namespace, container, volumes)
+	if err != nil {
+		klog.ErrorS(err, "reference validation failed", "namespace", pod.Namespace)
+		return nil
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if mode == annotation.ReferenceValidationDeny {
+		return fmt.Errorf("\nmissing references: %s", strings.Join(problems, "; "))
+	}
+	review := ReviewFrom(ctx)
+	for _, p := range problems {
+		review.AddWarning("%s", p)
+	}
+	return nil
+}
+
+// checkPodSecurity warns when the pod with the injected containers would be
+// rejected by Pod Security Admission in its namespace
+//
+// Only warns: PSA itself enforces after mutation, this just explains why.
+func (m *PodMutator) checkPodSecurity(ctx context.Context, pod *corev1.Pod, initContainer, container *corev1.Container, volumes []corev1.Volume) {
+	if m.podSecurityChecker == nil || pod.Namespace == "" {
+		return
+	}
+
+	injected := pod.DeepCopy()
+	if initContainer != nil {
+		injected.Spec.InitContainers = append(injected.Spec.InitContainers, *initContainer)
+	}
+	injected.Spec.Containers = append(injected.Spec.Containers, *container)
+	injected.Spec.Volumes = append(injected.Spec.Volumes, volumes...)
+
+	violations, err := m.podSecurityChecker.Check(ctx, pod.Namespace, injected)
+	if err != nil {
+		klog.ErrorS(err, "pod security check failed", "namespace", pod.Namespace)
+		return
+	}
+	review := ReviewFrom(ctx)
+	for _, v := range violations {
+		review.AddWarning("%s", v)
+	}
+	if m.blockMode == BlockModeInitContainer && initContainer != nil && len(violations) > 0 {
+		review.AddWarning("the block-direct-access init container needs root and NET_ADMIN; use --block-direct-access-mode=cni in restricted namespaces")
+	}
+}
+
+// cniAnnotations returns the CNI mode annotations the pod should carry
+// Empty unless block-direct-access is enabled in CNI mode
+func cniAnnotations(cfg *config.EffectiveConfig, mode BlockMode, mapping PortMapping) map[string]string {
+	ret := map[string]string{}
+	if !cfg.BlockDirectAccess || mode != BlockModeCNI {
+		return ret
+	}
+	ret[annotation.CNIBlockedPortsAnnotation] = formatPorts([]int32{mapping.ProxyPort})
+	if cfg.BlockAllowKubelet {
+		ret[annotation.CNIAllowNodeAnnotation] = "true"
+	}
+	if len(cfg.BlockAllowCIDRs) > 0 {
+		ret[annotation.CNIAllowedCIDRsAnnotation] = strings.Join(cfg.BlockAllowCIDRs, ",")
+	}
+	return ret
+}
+
+// patchCNIAnnotations sets the wanted CNI annotations and removes the others
+//
+// The plugin trusts whatever CNI annotations the pod carries, so values a pod
+// copied from its template must not survive: a stale allow-list would be
+// honoured, and a guarded-ports stamp would hide a missing plugin from the
+// drift controller.
+func patchCNIAnnotations(pod *corev1.Pod, want map[string]string, patchBuilder PatchBuilder) {
+	for _, key := range annotation.CNIAnnotations {
+		if value, ok := want[key]; ok {
+			patchBuilder.AddAnnotation(key, value)
+		} else if _, ok := pod.Annotations[key]; ok {
+			patchBuilder.RemoveAnnotation(key)
+		}
+	}
+}
+
 // collectContainerPorts gathers all ports from all containers in the pod
 func collectContainerPorts(pod *corev1.Pod) []corev1.ContainerPort {
 	var ret []corev1.ContainerPort
@@ -294,6 +778,69 @@ func isAlreadyInjected(pod *corev1.Pod) bool {
 	return false
 }
 
+// isPartiallyInjected checks if the pod has any container, volume or marker
+// this webhook adds without being fully injected
+func isPartiallyInjected(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[InjectedAnnotation]; ok {
+		return true
+	}
+	if _, ok := pod.Labels[InjectedLabel]; ok {
+		return true
+	}
+	if _, ok := findContainer(pod.Spec.Containers, SidecarContainerName); ok {
+		return true
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if isInjectedInitContainer(c.Name) {
+			return true
+		}
+	}
+	for _, v := range pod.Spec.Volumes {
+		if isInjectedVolume(v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInjectedVolume checks if a volume name is one the sidecar adds
+func isInjectedVolume(name string) bool {
+	switch name {
+	case SecretProviderVolumeName, CustomTemplatesVolumeName, AlphaConfigVolumeName, ProviderSecretsVolumeName:
+		return true
+	}
+	return false
+}
+
+// stripInjection removes the sidecar, init container and volumes left from
+// an earlier injection, and returns a copy of the pod without them
+//
+// Elements are removed from the highest index down so the indices of the
+// ones still to remove don't shift. Markers are overwritten by the new
+// injection and ports and probes it rewrote are left as they are.
+func stripInjection(pod *corev1.Pod, patchBuilder *JSONPatchBuilder) *corev1.Pod {
+	ret := pod.DeepCopy()
+	for i := len(ret.Spec.Containers) - 1; i >= 0; i-- {
+		if ret.Spec.Containers[i].Name == SidecarContainerName {
+			patchBuilder.RemoveContainer(i)
+			ret.Spec.Containers = slices.Delete(ret.Spec.Containers, i, i+1)
+		}
+	}
+	for i := len(ret.Spec.InitContainers) - 1; i >= 0; i-- {
+		if isInjectedInitContainer(ret.Spec.InitContainers[i].Name) {
+			patchBuilder.RemoveInitContainer(i)
+			ret.Spec.InitContainers = slices.Delete(ret.Spec.InitContainers, i, i+1)
+		}
+	}
+	for i := len(ret.Spec.Volumes) - 1; i >= 0; i-- {
+		if isInjectedVolume(ret.Spec.Volumes[i].Name) {
+			patchBuilder.RemoveVolume(i)
+			ret.Spec.Volumes = slices.Delete(ret.Spec.Volumes, i, i+1)
+		}
+	}
+	return ret
+}
+
 // hasExistingAnnotations checks if the pod has any annotations
 func hasExistingAnnotations(pod *corev1.Pod) bool {
 	return len(pod.Annotations) > 0
@@ -314,6 +861,21 @@ func hasExistingInitContainers(pod *corev1.Pod) bool {
 	return len(pod.Spec.InitContainers) > 0
 }
 
+// hasExistingImagePullSecrets checks if the pod has any imagePullSecrets
+func hasExistingImagePullSecrets(pod *corev1.Pod) bool {
+	return len(pod.Spec.ImagePullSecrets) > 0
+}
+
+// hasImagePullSecret checks if the pod already references the named pull secret
+func hasImagePullSecret(pod *corev1.Pod, name string) bool {
+	for _, s := range pod.Spec.ImagePullSecrets {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // rewriteProbesForBlockedAccess finds all probes that target the protected port
 // and returns rewrite descriptors to redirect them through oauth2-proxy.
 //
@@ -334,13 +896,13 @@ func rewriteProbesForBlockedAccess(pod *corev1.Pod, protectedPort string, mappin
 		}
 	}
 	for i, c := range pod.Spec.Containers {
-		if rw := checkProbeForBlockedAccess(c.LivenessProbe, "livenessProbe", i, protectedPort, int32(port), 4180); rw != nil {
+		if rw := checkProbeForBlockedAccess(c.LivenessProbe, "livenessProbe", i, protectedPort, int32(port), mapping.ListenPort); rw != nil {
 			ret = append(ret, *rw)
 		}
-		if rw := checkProbeForBlockedAccess(c.ReadinessProbe, "readinessProbe", i, protectedPort, int32(port), 4180); rw != nil {
+		if rw := checkProbeForBlockedAccess(c.ReadinessProbe, "readinessProbe", i, protectedPort, int32(port), mapping.ListenPort); rw != nil {
 			ret = append(ret, *rw)
 		}
-		if rw := checkProbeForBlockedAccess(c.StartupProbe, "startupProbe", i, protectedPort, int32(port), 4180); rw != nil {
+		if rw := checkProbeForBlockedAccess(c.StartupProbe, "startupProbe", i, protectedPort, int32(port), mapping.ListenPort); rw != nil {
 			ret = append(ret, *rw)
 		}
 	}
@@ -0,0 +1,409 @@
+package mutation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/owner"
+	"github.com/spacemule/oauth2-proxy-injector/internal/rules"
+)
+
+// failingOwners is an owner.Resolver whose API calls fail
+type failingOwners struct{}
+
+func (failingOwners) Resolve(context.Context, *corev1.Pod) (owner.Ref, error) {
+	return owner.Ref{}, errors.New("connection refused")
+}
+
+func (failingOwners) Annotations(context.Context, *corev1.Pod) (map[string]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+// failingRules is a rules.Matcher whose API calls fail
+type failingRules struct{}
+
+func (failingRules) Match(context.Context, *corev1.Pod) (*rules.Rule, error) {
+	return nil, errors.New("connection refused")
+}
+
+// failingNamespaces is an nsdefaults.Lister that can't read namespaces
+type failingNamespaces struct{}
+
+func (failingNamespaces) Annotations(string) (map[string]string, error) {
+	return nil, errors.New("invalid spec")
+}
+
+// controlledPod is a pod without oauth2-proxy annotations of its own, created by a ReplicaSet
+func controlledPod() *corev1.Pod {
+	controller := true
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "default",
+		GenerateName:    "web-5d4f-",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d4f", Controller: &controller}},
+	}}
+}
+
+// TestParseAnnotations_WorkloadError tests that a pod isn't admitted as not
+// enabled when its workload's annotations can't be read
+func TestParseAnnotations_WorkloadError(t *testing.T) {
+	m := &PodMutator{annotationParser: annotation.NewParser(), owners: failingOwners{}, workloadAnnotations: true}
+	if cfg, err := m.parseAnnotations(context.Background(), controlledPod()); err == nil {
+		t.Errorf("parseAnnotations() = %+v, want error", cfg)
+	}
+}
+
+// workloadOwners is an owner.Resolver for pods of one annotated workload
+type workloadOwners struct {
+	ref         owner.Ref
+	annotations map[string]string
+}
+
+func (o workloadOwners) Resolve(context.Context, *corev1.Pod) (owner.Ref, error) {
+	return o.ref, nil
+}
+
+func (o workloadOwners) Annotations(context.Context, *corev1.Pod) (map[string]string, error) {
+	return o.annotations, nil
+}
+
+// TestParseAnnotations_WorkloadSources tests that values inherited from the
+// workload are attributed to it rather than to the pod's annotations
+func TestParseAnnotations_WorkloadSources(t *testing.T) {
+	owners := workloadOwners{
+		ref: owner.Ref{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", Namespace: "default"},
+		annotations: map[string]string{
+			annotation.KeyEnabled:       "true",
+			annotation.KeyProtectedPort: "http",
+			annotation.KeyCookieDomains: ".acme.com",
+			"app.kubernetes.io/name":    "web",
+		},
+	}
+	m := &PodMutator{annotationParser: annotation.NewParser(), owners: owners, workloadAnnotations: true}
+	pod := controlledPod()
+	pod.Annotations = map[string]string{annotation.KeyCookieDomains: ".example.com"}
+
+	cfg, err := m.parseAnnotations(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"enabled":        "workload:Deployment/web",
+		"protected-port": "workload:Deployment/web",
+		"cookie-domains": annotation.SourceAnnotation,
+	}
+	for k, source := range want {
+		if cfg.Sources[k] != source {
+			t.Errorf("Sources[%s] = %q, want %q", k, cfg.Sources[k], source)
+		}
+	}
+	if len(cfg.Sources) != len(want) {
+		t.Errorf("Sources = %v, want %v", cfg.Sources, want)
+	}
+}
+
+// applyPatches applies patch operations to a pod as the apiserver would
+func applyPatches(t *testing.T, pod *corev1.Pod, ops []PatchOperation) (*corev1.Pod, error) {
+	t.Helper()
+	doc, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := MarshalPatches(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := jsonpatch.DecodePatch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(doc)
+	if err != nil {
+		return nil, err
+	}
+	ret := &corev1.Pod{}
+	if err := json.Unmarshal(patched, ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret, nil
+}
+
+func containerNames(containers []corev1.Container) []string {
+	var ret []string
+	for _, c := range containers {
+		ret = append(ret, c.Name)
+	}
+	return ret
+}
+
+// TestStripInjection tests removing leftovers and guarding patches computed after it
+func TestStripInjection(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: InitContainerName}, {Name: "vault-agent-init"}},
+		Containers: []corev1.Container{
+			{Name: "vault-agent"},
+			{Name: SidecarContainerName},
+			{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+		},
+		Volumes: []corev1.Volume{{Name: "vault"}, {Name: CustomTemplatesVolumeName}},
+	}}
+	if !isPartiallyInjected(pod) {
+		t.Fatal("isPartiallyInjected() = false, want true")
+	}
+
+	patchBuilder := NewPatchBuilder(false, false, true, true, false).Guard(pod)
+	stripped := stripInjection(pod, patchBuilder)
+	patchBuilder.Guard(stripped)
+	if i, j, ok := findProtectedPort(stripped, "http"); ok {
+		patchBuilder.RemovePort(i, j)
+	}
+	patchBuilder.AddContainer(&corev1.Container{Name: SidecarContainerName})
+	ops := patchBuilder.Build()
+
+	got, err := applyPatches(t, pod, ops)
+	if err != nil {
+		t.Fatalf("apply error = %v", err)
+	}
+	if names := containerNames(got.Spec.Containers); !slices.Equal(names, []string{"vault-agent", "app", SidecarContainerName}) {
+		t.Errorf("containers = %v", names)
+	}
+	if names := containerNames(got.Spec.InitContainers); !slices.Equal(names, []string{"vault-agent-init"}) {
+		t.Errorf("init containers = %v", names)
+	}
+	if len(got.Spec.Volumes) != 1 || got.Spec.Volumes[0].Name != "vault" {
+		t.Errorf("volumes = %v", got.Spec.Volumes)
+	}
+	if len(got.Spec.Containers[1].Ports) != 0 {
+		t.Errorf("app ports = %v, want none", got.Spec.Containers[1].Ports)
+	}
+
+	// Another webhook moved the app container: the test operations reject the patch
+	reordered := pod.DeepCopy()
+	reordered.Spec.Containers[0], reordered.Spec.Containers[2] = reordered.Spec.Containers[2], reordered.Spec.Containers[0]
+	if _, err := applyPatches(t, reordered, ops); err == nil {
+		t.Error("apply to reordered pod succeeded, want test operation failure")
+	}
+}
+
+// TestParseAnnotations_RuleError tests that a pod isn't admitted as not
+// enabled when the injection rules can't be matched
+func TestParseAnnotations_RuleError(t *testing.T) {
+	m := &PodMutator{annotationParser: annotation.NewParser(), rules: failingRules{}}
+	if cfg, err := m.parseAnnotations(context.Background(), controlledPod()); err == nil {
+		t.Errorf("parseAnnotations() = %+v, want error", cfg)
+	}
+}
+
+// TestParseAnnotations_NamespaceError tests that a pod isn't admitted as not
+// enabled when its namespace's annotations can't be read
+func TestParseAnnotations_NamespaceError(t *testing.T) {
+	m := &PodMutator{annotationParser: annotation.NewParser(), namespaces: failingNamespaces{}}
+	if cfg, err := m.parseAnnotations(context.Background(), controlledPod()); err == nil {
+		t.Errorf("parseAnnotations() = %+v, want error", cfg)
+	}
+}
+
+// testMutator returns a PodMutator reading its default ConfigMap from a fake client
+// Extra objects, e.g. Secrets, are added to the same client.
+func testMutator(mode BlockMode, objects ...runtime.Object) *PodMutator {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "oauth2-proxy-config", Namespace: "oauth2-proxy"},
+		Data: map[string]string{
+			"provider":          "oidc",
+			"oidc-issuer-url":   "https://id.example.com",
+			"client-id":         "app",
+			"client-secret-ref": "oauth2:client-secret",
+			"cookie-secret-ref": "oauth2:cookie-secret",
+		},
+	}
+	client := fake.NewSimpleClientset(append(objects, cm)...)
+	return NewPodMutator(
+		annotation.NewParser(),
+		config.NewLoader(client, "oauth2-proxy"),
+		NewSidecarBuilder(),
+		config.NewMerger(),
+		NewKnativeDetector(),
+		NewInitContainerBuilder(mode, "injector:v1"),
+		mode,
+		nil,
+		nil,
+		nil,
+		nil,
+		false,
+		nil,
+		nil,
+		"oauth2-proxy-config",
+		"oauth2-proxy",
+	)
+}
+
+// protectedPod is a pod opting into injection with block-direct-access on port 8080
+func protectedPod(annotations map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotation.KeyEnabled:           "true",
+				annotation.KeyProtectedPort:     "8080",
+				annotation.KeyBlockDirectAccess: "true",
+			},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Image: "app",
+			Ports: []corev1.ContainerPort{{ContainerPort: 8080}},
+		}}},
+	}
+	for k, v := range annotations {
+		pod.Annotations[k] = v
+	}
+	return pod
+}
+
+// TestMutate_CNIAnnotations tests that CNI annotations copied from a pod
+// template are replaced by the effective config's or removed
+func TestMutate_CNIAnnotations(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     BlockMode
+		template map[string]string
+		want     map[string]string
+	}{
+		{
+			name: "cni mode",
+			mode: BlockModeCNI,
+			want: map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"},
+		},
+		{
+			name: "stale blocked ports",
+			mode: BlockModeCNI,
+			template: map[string]string{
+				annotation.CNIBlockedPortsAnnotation: "9090",
+			},
+			want: map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"},
+		},
+		{
+			name: "stale allowed cidrs",
+			mode: BlockModeCNI,
+			template: map[string]string{
+				annotation.CNIAllowedCIDRsAnnotation: "0.0.0.0/0",
+			},
+			want: map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"},
+		},
+		{
+			name: "stale allow node",
+			mode: BlockModeCNI,
+			template: map[string]string{
+				annotation.CNIAllowNodeAnnotation: "true",
+			},
+			want: map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"},
+		},
+		{
+			name: "copied guarded ports",
+			mode: BlockModeCNI,
+			template: map[string]string{
+				annotation.CNIGuardedPortsAnnotation: "8080",
+			},
+			want: map[string]string{annotation.CNIBlockedPortsAnnotation: "8080"},
+		},
+		{
+			name: "allow-lists from the config replace the template's",
+			mode: BlockModeCNI,
+			template: map[string]string{
+				annotation.KeyBlockAllowKubelet:      "true",
+				annotation.KeyBlockAllowCIDRs:        "10.42.0.0/16",
+				annotation.CNIAllowedCIDRsAnnotation: "0.0.0.0/0",
+				annotation.CNIAllowNodeAnnotation:    "false",
+			},
+			want: map[string]string{
+				annotation.CNIBlockedPortsAnnotation: "8080",
+				annotation.CNIAllowNodeAnnotation:    "true",
+				annotation.CNIAllowedCIDRsAnnotation: "10.42.0.0/16",
+			},
+		},
+		{
+			name: "init container mode",
+			mode: BlockModeInitContainer,
+			template: map[string]string{
+				annotation.CNIBlockedPortsAnnotation: "8080",
+				annotation.CNIGuardedPortsAnnotation: "8080",
+			},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := protectedPod(tt.template)
+			ops, err := testMutator(tt.mode).Mutate(context.Background(), pod)
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			got, err := applyPatches(t, pod, ops)
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			for _, key := range annotation.CNIAnnotations {
+				value, ok := got.Annotations[key]
+				want, wantOK := tt.want[key]
+				if ok != wantOK || value != want {
+					t.Errorf("%s = %q (set %v), want %q (set %v)", key, value, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+// TestMutate_CNIValidationContainer tests that CNI mode adds the unprivileged
+// validation container instead of the netguard init container
+func TestMutate_CNIValidationContainer(t *testing.T) {
+	for mode, want := range map[BlockMode]string{
+		BlockModeCNI:           ValidationContainerName,
+		BlockModeInitContainer: InitContainerName,
+	} {
+		t.Run(string(mode), func(t *testing.T) {
+			pod := protectedPod(nil)
+			ops, err := testMutator(mode).Mutate(context.Background(), pod)
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			got, err := applyPatches(t, pod, ops)
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			if names := containerNames(got.Spec.InitContainers); !slices.Equal(names, []string{want}) {
+				t.Errorf("init containers = %v, want [%s]", names, want)
+			}
+		})
+	}
+}
+
+// TestMutate_NoInitImage tests that without --init-image only pods needing
+// the netguard or validation container are denied
+func TestMutate_NoInitImage(t *testing.T) {
+	for _, mode := range []BlockMode{BlockModeInitContainer, BlockModeCNI} {
+		t.Run(string(mode), func(t *testing.T) {
+			m := testMutator(mode)
+			m.initContainerBuilder = NewInitContainerBuilder(mode, "")
+
+			if ops, err := m.Mutate(context.Background(), protectedPod(nil)); err == nil {
+				t.Errorf("Mutate() = %v, want error for block-direct-access", ops)
+			}
+
+			pod := protectedPod(map[string]string{annotation.KeyBlockDirectAccess: "false"})
+			if _, err := m.Mutate(context.Background(), pod); err != nil {
+				t.Errorf("Mutate() without block-direct-access error = %v", err)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+
+	corev1 "k8s.io/api/core/v1"
 )
 
 // PatchOperation represents a single JSON Patch operation (RFC 6902)
@@ -16,9 +18,25 @@ type PatchOperation struct {
 	// Example: "/spec/containers/-" (append to containers array)
 	Path string `json:"path"`
 
-	// Value is the value for add/replace operations
-	// Omitted for remove operations
-	Value interface{} `json:"value,omitempty"`
+	// Value is the value for add, replace and test operations
+	// Omitted for remove operations, see MarshalJSON
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON writes value for every operation except remove
+//
+// RFC 6902 requires value on add, replace and test even when it is empty, so
+// omitempty can't be used: a test for an empty argument would lose its value
+// and the apiserver would reject the whole patch.
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation PatchOperation // without MarshalJSON
+	return json.Marshal(operation(op))
 }
 
 // PatchBuilder provides a fluent interface for building JSON patch operations
@@ -30,6 +48,17 @@ type PatchBuilder interface {
 	// AddInitContainer appends an init container
 	AddInitContainer(container interface{}) PatchBuilder
 
+	// InsertInitContainer inserts an init container before the one at index
+	// Used to run after an existing init container, e.g. a service mesh's
+	InsertInitContainer(index int, container interface{}) PatchBuilder
+
+	// ReplaceInitContainerArg replaces an argument of an init container
+	ReplaceInitContainerArg(containerIndex, argIndex int, value string) PatchBuilder
+
+	// AddInitContainerArgs appends arguments to an init container
+	// hasArgs must be false if the container has no args list yet
+	AddInitContainerArgs(containerIndex int, hasArgs bool, args ...string) PatchBuilder
+
 	// AddVolume appends a volume to the pod's volumes list
 	AddVolume(volume interface{}) PatchBuilder
 
@@ -39,9 +68,15 @@ type PatchBuilder interface {
 	// AddAnnotation adds or updates an annotation
 	AddAnnotation(key, value string) PatchBuilder
 
+	// RemoveAnnotation removes an annotation the pod has
+	RemoveAnnotation(key string) PatchBuilder
+
 	// AddLabel adds or updates a label
 	AddLabel(key, value string) PatchBuilder
 
+	// AddImagePullSecret appends a Secret reference to the pod's imagePullSecrets
+	AddImagePullSecret(name string) PatchBuilder
+
 	// RemovePort removes a port from a container
 	RemovePort(containerIndex, portIndex int) PatchBuilder
 
@@ -54,6 +89,22 @@ type PatchBuilder interface {
 	// Used for Knative support to redirect queue-proxy's USER_PORT
 	ReplaceEnvVarValue(containerIndex, envIndex int, newValue string) PatchBuilder
 
+	// AddEnvVar appends an environment variable to a container
+	// hasEnv must be false if the container has no env list yet
+	AddEnvVar(containerIndex int, hasEnv bool, name, value string) PatchBuilder
+
+	// RemoveContainer removes a container by index
+	RemoveContainer(index int) PatchBuilder
+
+	// RemoveInitContainer removes an init container by index
+	RemoveInitContainer(index int) PatchBuilder
+
+	// RemoveVolume removes a volume by index
+	RemoveVolume(index int) PatchBuilder
+
+	// Test fails the whole patch unless the value at path equals value
+	Test(path string, value interface{}) PatchBuilder
+
 	// Build returns the accumulated patch operations
 	Build() []PatchOperation
 }
@@ -70,17 +121,63 @@ type JSONPatchBuilder struct {
 	hasVolumes bool
 	// hasInitContainers tracks if the pod already has initContainers
 	hasInitContainers bool
+	// hasImagePullSecrets tracks if the pod already has imagePullSecrets
+	hasImagePullSecrets bool
+	// guard is the pod index-based operations are computed against, see Guard
+	guard *corev1.Pod
+	// tested tracks the paths already guarded by a test operation
+	tested map[string]bool
 }
 
-func NewPatchBuilder(hasAnnotations, hasLabels, hasVolumes, hasInitContainers bool) *JSONPatchBuilder {
+func NewPatchBuilder(hasAnnotations, hasLabels, hasVolumes, hasInitContainers, hasImagePullSecrets bool) *JSONPatchBuilder {
 	return &JSONPatchBuilder{
-		hasAnnotations:    hasAnnotations,
-		hasLabels:         hasLabels,
-		hasVolumes:        hasVolumes,
-		hasInitContainers: hasInitContainers,
+		hasAnnotations:      hasAnnotations,
+		hasLabels:           hasLabels,
+		hasVolumes:          hasVolumes,
+		hasInitContainers:   hasInitContainers,
+		hasImagePullSecrets: hasImagePullSecrets,
 	}
 }
 
+// Guard makes operations addressing a container, init container, port, env
+// var or arg by index first test that the element is the one it was in pod
+//
+// Indices come from the object the webhook was sent. If the patch is applied
+// to anything else, e.g. after another webhook reordered containers, the
+// apiserver rejects it rather than patching the wrong element. Operations
+// removing elements test against the pod before any removal; call Guard
+// again with the pod as it is after them before adding further operations.
+func (b *JSONPatchBuilder) Guard(pod *corev1.Pod) *JSONPatchBuilder {
+	b.guard = pod
+	b.tested = map[string]bool{}
+	return b
+}
+
+// testOnce adds a test operation unless the path was already tested
+func (b *JSONPatchBuilder) testOnce(path string, value interface{}) {
+	if b.tested[path] {
+		return
+	}
+	b.tested[path] = true
+	b.Test(path, value)
+}
+
+// guardContainer tests the name of the container at index
+func (b *JSONPatchBuilder) guardContainer(index int) {
+	if b.guard == nil || index >= len(b.guard.Spec.Containers) {
+		return
+	}
+	b.testOnce(fmt.Sprintf("/spec/containers/%d/name", index), b.guard.Spec.Containers[index].Name)
+}
+
+// guardInitContainer tests the name of the init container at index
+func (b *JSONPatchBuilder) guardInitContainer(index int) {
+	if b.guard == nil || index >= len(b.guard.Spec.InitContainers) {
+		return
+	}
+	b.testOnce(fmt.Sprintf("/spec/initContainers/%d/name", index), b.guard.Spec.InitContainers[index].Name)
+}
+
 func (b *JSONPatchBuilder) AddContainer(container interface{}) PatchBuilder {
 	b.operations = append(b.operations, PatchOperation{
 		Op:    "add",
@@ -107,6 +204,51 @@ func (b *JSONPatchBuilder) AddInitContainer(container interface{}) PatchBuilder
 	return b
 }
 
+// InsertInitContainer inserts at /spec/initContainers/<index>
+func (b *JSONPatchBuilder) InsertInitContainer(index int, container interface{}) PatchBuilder {
+	b.guardInitContainer(index - 1)
+	b.operations = append(b.operations, PatchOperation{
+		Op:    "add",
+		Path:  fmt.Sprintf("/spec/initContainers/%d", index),
+		Value: container,
+	})
+	return b
+}
+
+// ReplaceInitContainerArg replaces an argument of an init container
+func (b *JSONPatchBuilder) ReplaceInitContainerArg(containerIndex, argIndex int, value string) PatchBuilder {
+	b.guardInitContainer(containerIndex)
+	if b.guard != nil && containerIndex < len(b.guard.Spec.InitContainers) && argIndex < len(b.guard.Spec.InitContainers[containerIndex].Args) {
+		b.testOnce(fmt.Sprintf("/spec/initContainers/%d/args/%d", containerIndex, argIndex), b.guard.Spec.InitContainers[containerIndex].Args[argIndex])
+	}
+	b.operations = append(b.operations, PatchOperation{
+		Op:    "replace",
+		Path:  fmt.Sprintf("/spec/initContainers/%d/args/%d", containerIndex, argIndex),
+		Value: value,
+	})
+	return b
+}
+
+// AddInitContainerArgs appends arguments to an init container
+func (b *JSONPatchBuilder) AddInitContainerArgs(containerIndex int, hasArgs bool, args ...string) PatchBuilder {
+	b.guardInitContainer(containerIndex)
+	if !hasArgs {
+		b.operations = append(b.operations, PatchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/initContainers/%d/args", containerIndex),
+			Value: []interface{}{},
+		})
+	}
+	for _, arg := range args {
+		b.operations = append(b.operations, PatchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/initContainers/%d/args/-", containerIndex),
+			Value: arg,
+		})
+	}
+	return b
+}
+
 // AddVolume appends to /spec/volumes/-
 func (b *JSONPatchBuilder) AddVolume(volume interface{}) PatchBuilder {
 	if !b.hasVolumes {
@@ -128,6 +270,7 @@ func (b *JSONPatchBuilder) AddVolume(volume interface{}) PatchBuilder {
 }
 
 func (b *JSONPatchBuilder) AddVolumeMountsArray(containerIndex int) PatchBuilder {
+	b.guardContainer(containerIndex)
 	b.operations = append(b.operations, PatchOperation{
 		Op:    "add",
 		Path:  fmt.Sprintf("/spec/containers/%d/volumeMounts", containerIndex),
@@ -137,6 +280,7 @@ func (b *JSONPatchBuilder) AddVolumeMountsArray(containerIndex int) PatchBuilder
 }
 
 func (b *JSONPatchBuilder) AddVolumeMount(containerIndex int, mount interface{}) PatchBuilder {
+	b.guardContainer(containerIndex)
 	b.operations = append(b.operations, PatchOperation{
 		Op:    "add",
 		Path:  fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIndex),
@@ -165,6 +309,16 @@ func (b *JSONPatchBuilder) AddAnnotation(key, value string) PatchBuilder {
 	return b
 }
 
+// RemoveAnnotation removes an annotation
+// The annotation must exist, removing a missing key fails the whole patch
+func (b *JSONPatchBuilder) RemoveAnnotation(key string) PatchBuilder {
+	b.operations = append(b.operations, PatchOperation{
+		Op:   "remove",
+		Path: "/metadata/annotations/" + escapeJSONPointer(key),
+	})
+	return b
+}
+
 // AddLabel adds or updates a label
 func (b *JSONPatchBuilder) AddLabel(key, value string) PatchBuilder {
 	if !b.hasLabels {
@@ -185,7 +339,30 @@ func (b *JSONPatchBuilder) AddLabel(key, value string) PatchBuilder {
 	return b
 }
 
+// AddImagePullSecret appends to /spec/imagePullSecrets/-
+func (b *JSONPatchBuilder) AddImagePullSecret(name string) PatchBuilder {
+	if !b.hasImagePullSecrets {
+		b.operations = append(b.operations, PatchOperation{
+			Op:    "add",
+			Path:  "/spec/imagePullSecrets",
+			Value: []interface{}{},
+		})
+		b.hasImagePullSecrets = true
+	}
+	b.operations = append(b.operations, PatchOperation{
+		Op:    "add",
+		Path:  "/spec/imagePullSecrets/-",
+		Value: map[string]string{"name": name},
+	})
+
+	return b
+}
+
 func (b *JSONPatchBuilder) RemovePort(containerIndex, portIndex int) PatchBuilder {
+	b.guardContainer(containerIndex)
+	if b.guard != nil && containerIndex < len(b.guard.Spec.Containers) && portIndex < len(b.guard.Spec.Containers[containerIndex].Ports) {
+		b.testOnce(fmt.Sprintf("/spec/containers/%d/ports/%d/containerPort", containerIndex, portIndex), b.guard.Spec.Containers[containerIndex].Ports[portIndex].ContainerPort)
+	}
 	b.operations = append(b.operations, PatchOperation{
 		Op:   "remove",
 		Path: fmt.Sprintf("/spec/containers/%d/ports/%d", containerIndex, portIndex),
@@ -196,6 +373,7 @@ func (b *JSONPatchBuilder) RemovePort(containerIndex, portIndex int) PatchBuilde
 
 // ReplaceProbePort replaces a probe's port from a name to a number
 func (b *JSONPatchBuilder) ReplaceProbePort(containerIndex int, probeType, handlerType string, port int32) PatchBuilder {
+	b.guardContainer(containerIndex)
 	b.operations = append(b.operations, PatchOperation{
 		Op:    "replace",
 		Path:  fmt.Sprintf("/spec/containers/%d/%s/%s/port", containerIndex, probeType, handlerType),
@@ -207,6 +385,10 @@ func (b *JSONPatchBuilder) ReplaceProbePort(containerIndex int, probeType, handl
 
 // ReplaceEnvVarValue replaces an environment variable's value in a container
 func (b *JSONPatchBuilder) ReplaceEnvVarValue(containerIndex, envIndex int, newValue string) PatchBuilder {
+	b.guardContainer(containerIndex)
+	if b.guard != nil && containerIndex < len(b.guard.Spec.Containers) && envIndex < len(b.guard.Spec.Containers[containerIndex].Env) {
+		b.testOnce(fmt.Sprintf("/spec/containers/%d/env/%d/name", containerIndex, envIndex), b.guard.Spec.Containers[containerIndex].Env[envIndex].Name)
+	}
 	b.operations = append(b.operations, PatchOperation{
 		Op:    "replace",
 		Path:  fmt.Sprintf("/spec/containers/%d/env/%d/value", containerIndex, envIndex),
@@ -216,6 +398,67 @@ func (b *JSONPatchBuilder) ReplaceEnvVarValue(containerIndex, envIndex int, newV
 	return b
 }
 
+// AddEnvVar appends an environment variable to a container
+func (b *JSONPatchBuilder) AddEnvVar(containerIndex int, hasEnv bool, name, value string) PatchBuilder {
+	b.guardContainer(containerIndex)
+	if !hasEnv {
+		b.operations = append(b.operations, PatchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/containers/%d/env", containerIndex),
+			Value: []interface{}{},
+		})
+	}
+	b.operations = append(b.operations, PatchOperation{
+		Op:    "add",
+		Path:  fmt.Sprintf("/spec/containers/%d/env/-", containerIndex),
+		Value: map[string]string{"name": name, "value": value},
+	})
+
+	return b
+}
+
+// RemoveContainer removes /spec/containers/<index>
+func (b *JSONPatchBuilder) RemoveContainer(index int) PatchBuilder {
+	b.guardContainer(index)
+	b.operations = append(b.operations, PatchOperation{
+		Op:   "remove",
+		Path: fmt.Sprintf("/spec/containers/%d", index),
+	})
+	return b
+}
+
+// RemoveInitContainer removes /spec/initContainers/<index>
+func (b *JSONPatchBuilder) RemoveInitContainer(index int) PatchBuilder {
+	b.guardInitContainer(index)
+	b.operations = append(b.operations, PatchOperation{
+		Op:   "remove",
+		Path: fmt.Sprintf("/spec/initContainers/%d", index),
+	})
+	return b
+}
+
+// RemoveVolume removes /spec/volumes/<index>
+func (b *JSONPatchBuilder) RemoveVolume(index int) PatchBuilder {
+	if b.guard != nil && index < len(b.guard.Spec.Volumes) {
+		b.testOnce(fmt.Sprintf("/spec/volumes/%d/name", index), b.guard.Spec.Volumes[index].Name)
+	}
+	b.operations = append(b.operations, PatchOperation{
+		Op:   "remove",
+		Path: fmt.Sprintf("/spec/volumes/%d", index),
+	})
+	return b
+}
+
+// Test adds a test operation
+func (b *JSONPatchBuilder) Test(path string, value interface{}) PatchBuilder {
+	b.operations = append(b.operations, PatchOperation{
+		Op:    "test",
+		Path:  path,
+		Value: value,
+	})
+	return b
+}
+
 // Build returns the accumulated patch operations
 func (b *JSONPatchBuilder) Build() []PatchOperation {
 	ret := make([]PatchOperation, len(b.operations))
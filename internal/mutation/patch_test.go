@@ -0,0 +1,68 @@
+package mutation
+
+import (
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestMarshalPatches tests that value is written for every operation but remove
+func TestMarshalPatches(t *testing.T) {
+	tests := []struct {
+		name string
+		op   PatchOperation
+		want string
+	}{
+		{name: "test empty string", op: PatchOperation{Op: "test", Path: "/a", Value: ""}, want: `{"op":"test","path":"/a","value":""}`},
+		{name: "replace empty string", op: PatchOperation{Op: "replace", Path: "/a", Value: ""}, want: `{"op":"replace","path":"/a","value":""}`},
+		{name: "add zero", op: PatchOperation{Op: "add", Path: "/a", Value: 0}, want: `{"op":"add","path":"/a","value":0}`},
+		{name: "add null", op: PatchOperation{Op: "add", Path: "/a"}, want: `{"op":"add","path":"/a","value":null}`},
+		{name: "remove", op: PatchOperation{Op: "remove", Path: "/a", Value: "ignored"}, want: `{"op":"remove","path":"/a"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalPatches([]PatchOperation{tt.op})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "["+tt.want+"]" {
+				t.Errorf("MarshalPatches() = %s, want [%s]", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReplaceInitContainerArg_EmptyGuard tests that an empty argument guarded
+// by a test operation still produces a patch that applies
+func TestReplaceInitContainerArg_EmptyGuard(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{InitContainers: []corev1.Container{{
+		Name: "istio-init",
+		Args: []string{"istio-iptables", "--exclude-inbound-ports", ""},
+	}}}}
+	ops := NewPatchBuilder(false, false, false, true, false).Guard(pod).
+		ReplaceInitContainerArg(0, 2, "8080").
+		Build()
+
+	raw, err := MarshalPatches(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range decoded {
+		if _, ok := op["value"]; !ok {
+			t.Errorf("operation %v has no value", op)
+		}
+	}
+
+	got, err := applyPatches(t, pod, ops)
+	if err != nil {
+		t.Fatalf("patch does not apply: %v", err)
+	}
+	if arg := got.Spec.InitContainers[0].Args[2]; arg != "8080" {
+		t.Errorf("arg = %q, want 8080", arg)
+	}
+}
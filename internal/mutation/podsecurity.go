@@ -0,0 +1,103 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	psaapi "k8s.io/pod-security-admission/api"
+	"k8s.io/pod-security-admission/policy"
+)
+
+// PodSecurityChecker checks a mutated pod against its namespace's Pod Security Standard
+type PodSecurityChecker interface {
+	// Check returns human-readable violations of the namespace's enforce level
+	// An empty result means the pod would be admitted by Pod Security Admission
+	Check(ctx context.Context, namespace string, pod *corev1.Pod) ([]string, error)
+}
+
+// NamespacePodSecurityChecker implements PodSecurityChecker using the
+// pod-security.kubernetes.io/enforce labels on the pod's namespace
+type NamespacePodSecurityChecker struct {
+	client     kubernetes.Interface
+	namespaces corelisters.NamespaceLister
+	evaluator  policy.Evaluator
+}
+
+// NewPodSecurityChecker creates a NamespacePodSecurityChecker with the upstream PSA checks
+//
+// Namespaces are read from the namespaces lister if it isn't nil, otherwise
+// from the API on every check.
+func NewPodSecurityChecker(client kubernetes.Interface, namespaces corelisters.NamespaceLister) (*NamespacePodSecurityChecker, error) {
+	evaluator, err := policy.NewEvaluator(policy.DefaultChecks())
+	if err != nil {
+		return nil, err
+	}
+	return &NamespacePodSecurityChecker{
+		client:     client,
+		namespaces: namespaces,
+		evaluator:  evaluator,
+	}, nil
+}
+
+// getNamespace reads a namespace from the lister if there is one, otherwise
+// from the API; a namespace the informer hasn't seen yet is read from the API
+func getNamespace(ctx context.Context, client kubernetes.Interface, lister corelisters.NamespaceLister, name string) (*corev1.Namespace, error) {
+	if lister != nil {
+		ns, err := lister.Get(name)
+		if !apierrors.IsNotFound(err) {
+			return ns, err
+		}
+	}
+	return client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+// Check evaluates the pod against the namespace's enforce level and version
+func (c *NamespacePodSecurityChecker) Check(ctx context.Context, namespace string, pod *corev1.Pod) ([]string, error) {
+	ns, err := getNamespace(ctx, c.client, c.namespaces, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := psaapi.Policy{
+		Enforce: psaapi.LevelVersion{Level: psaapi.LevelPrivileged, Version: psaapi.LatestVersion()},
+	}
+	pol, errs := psaapi.PolicyToEvaluate(ns.Labels, defaults)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("namespace %s has invalid pod security labels: %v", namespace, errs.ToAggregate())
+	}
+	if pol.Enforce.Level == psaapi.LevelPrivileged {
+		return nil, nil
+	}
+
+	result := policy.AggregateCheckResults(c.evaluator.EvaluatePod(pol.Enforce, &pod.ObjectMeta, &pod.Spec))
+	if result.Allowed {
+		return nil, nil
+	}
+
+	return []string{fmt.Sprintf("injected pod would violate PodSecurity %q: %s", pol.Enforce.String(), result.ForbiddenDetail())}, nil
+}
+
+// DefaultSecurityContext returns the hardened SecurityContext for the oauth2-proxy sidecar
+//
+// Satisfies the Pod Security Standards "restricted" profile. The upstream
+// oauth2-proxy image runs as a numeric non-root user and needs no writable root
+// filesystem or capabilities.
+func DefaultSecurityContext() *corev1.SecurityContext {
+	t, f := true, false
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &t,
+		ReadOnlyRootFilesystem:   &t,
+		AllowPrivilegeEscalation: &f,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
@@ -0,0 +1,218 @@
+package mutation
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// hardenedPod returns a pod whose only container runs with DefaultSecurityContext
+func hardenedPod() *corev1.Pod {
+	return &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "app", Image: "app", SecurityContext: DefaultSecurityContext()}},
+	}}
+}
+
+// netAdminPod returns a hardened pod with an init container adding NET_ADMIN
+func netAdminPod() *corev1.Pod {
+	pod := hardenedPod()
+	pod.Spec.InitContainers = []corev1.Container{{
+		Name:  InitContainerName,
+		Image: "injector",
+		SecurityContext: &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}},
+		},
+	}}
+	return pod
+}
+
+// namespace returns a namespace with the given labels
+func namespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+// TestDefaultSecurityContext tests that the sidecar default passes the restricted level
+func TestDefaultSecurityContext(t *testing.T) {
+	client := fake.NewSimpleClientset(namespace("apps", map[string]string{"pod-security.kubernetes.io/enforce": "restricted"}))
+	checker, err := NewPodSecurityChecker(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container, _ := NewSidecarBuilder().Build(&config.EffectiveConfig{ProxyImage: "oauth2-proxy"}, PortMapping{ProxyPort: 8080, ListenPort: 4180})
+	pod := hardenedPod()
+	pod.Spec.Containers = append(pod.Spec.Containers, *container)
+
+	violations, err := checker.Check(context.Background(), "apps", pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) > 0 {
+		t.Errorf("Check() = %v, want no violations", violations)
+	}
+}
+
+// TestSidecarBuilder_ProxySecurityContext tests that proxy-security-context
+// replaces the default and is copied rather than shared with the config
+func TestSidecarBuilder_ProxySecurityContext(t *testing.T) {
+	uid := int64(1000)
+	override := &corev1.SecurityContext{RunAsUser: &uid}
+
+	tests := []struct {
+		name     string
+		override *corev1.SecurityContext
+		wantUser *int64
+		wantDrop bool
+	}{
+		{name: "default", override: nil, wantUser: nil, wantDrop: true},
+		{name: "override", override: override, wantUser: &uid, wantDrop: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.EffectiveConfig{ProxyImage: "oauth2-proxy", ProxySecurityContext: tt.override}
+			container, _ := NewSidecarBuilder().Build(cfg, PortMapping{ProxyPort: 8080, ListenPort: 4180})
+
+			sc := container.SecurityContext
+			if sc == nil {
+				t.Fatal("SecurityContext = nil")
+			}
+			if (sc.RunAsUser == nil) != (tt.wantUser == nil) || (sc.RunAsUser != nil && *sc.RunAsUser != *tt.wantUser) {
+				t.Errorf("RunAsUser = %v, want %v", sc.RunAsUser, tt.wantUser)
+			}
+			if dropped := sc.Capabilities != nil && len(sc.Capabilities.Drop) > 0; dropped != tt.wantDrop {
+				t.Errorf("drops capabilities = %v, want %v", dropped, tt.wantDrop)
+			}
+			if tt.override != nil && sc == tt.override {
+				t.Error("SecurityContext shares the config's pointer, want a copy")
+			}
+		})
+	}
+}
+
+// TestNamespacePodSecurityChecker_Check tests the namespace's enforce label
+// decides the level, read from the API or from the namespace informer
+func TestNamespacePodSecurityChecker_Check(t *testing.T) {
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		pod            *corev1.Pod
+		wantViolations bool
+		wantErr        bool
+	}{
+		{
+			name:   "unlabelled namespace is privileged",
+			labels: nil,
+			pod:    netAdminPod(),
+		},
+		{
+			name:   "hardened pod passes restricted",
+			labels: map[string]string{"pod-security.kubernetes.io/enforce": "restricted"},
+			pod:    hardenedPod(),
+		},
+		{
+			name:           "NET_ADMIN violates baseline",
+			labels:         map[string]string{"pod-security.kubernetes.io/enforce": "baseline"},
+			pod:            netAdminPod(),
+			wantViolations: true,
+		},
+		{
+			name: "NET_ADMIN violates pinned restricted version",
+			labels: map[string]string{
+				"pod-security.kubernetes.io/enforce":         "restricted",
+				"pod-security.kubernetes.io/enforce-version": "v1.29",
+			},
+			pod:            netAdminPod(),
+			wantViolations: true,
+		},
+		{
+			name:   "warn level is not enforced",
+			labels: map[string]string{"pod-security.kubernetes.io/warn": "restricted"},
+			pod:    netAdminPod(),
+		},
+		{
+			name:   "audit level is not enforced",
+			labels: map[string]string{"pod-security.kubernetes.io/audit": "restricted"},
+			pod:    netAdminPod(),
+		},
+		{
+			name: "warn stricter than enforce",
+			labels: map[string]string{
+				"pod-security.kubernetes.io/enforce": "privileged",
+				"pod-security.kubernetes.io/warn":    "restricted",
+			},
+			pod: netAdminPod(),
+		},
+		{
+			name:    "invalid level",
+			labels:  map[string]string{"pod-security.kubernetes.io/enforce": "strict"},
+			pod:     hardenedPod(),
+			wantErr: true,
+		},
+	}
+
+	for _, informer := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if informer {
+				name = "informer/" + name
+			}
+			t.Run(name, func(t *testing.T) {
+				// With an informer the namespace is only in its cache, so a
+				// passing check shows the API wasn't consulted
+				ns := namespace("apps", tt.labels)
+				client := fake.NewSimpleClientset(ns)
+				var lister corelisters.NamespaceLister
+				if informer {
+					client = fake.NewSimpleClientset()
+					indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+					if err := indexer.Add(ns); err != nil {
+						t.Fatal(err)
+					}
+					lister = corelisters.NewNamespaceLister(indexer)
+				}
+				checker, err := NewPodSecurityChecker(client, lister)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				violations, err := checker.Check(context.Background(), "apps", tt.pod)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if (len(violations) > 0) != tt.wantViolations {
+					t.Errorf("Check() = %v, wantViolations %v", violations, tt.wantViolations)
+				}
+			})
+		}
+	}
+}
+
+// TestNamespacePodSecurityChecker_InformerFallback tests that a namespace the
+// informer hasn't seen yet is read from the API, and that a missing one errors
+func TestNamespacePodSecurityChecker_InformerFallback(t *testing.T) {
+	client := fake.NewSimpleClientset(namespace("new", map[string]string{"pod-security.kubernetes.io/enforce": "baseline"}))
+	lister := corelisters.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	checker, err := NewPodSecurityChecker(client, lister)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := checker.Check(context.Background(), "new", netAdminPod())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 {
+		t.Errorf("Check() = %v, want one violation", violations)
+	}
+
+	if _, err := checker.Check(context.Background(), "missing", hardenedPod()); err == nil {
+		t.Error("Check() on a missing namespace = nil error, want not found")
+	}
+}
@@ -0,0 +1,176 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// SecretProviderClassGVR is the Secrets Store CSI driver's SecretProviderClass resource
+var SecretProviderClassGVR = schema.GroupVersionResource{
+	Group:    "secrets-store.csi.x-k8s.io",
+	Version:  "v1",
+	Resource: "secretproviderclasses",
+}
+
+// ReferenceChecker verifies that objects referenced by the sidecar exist
+//
+// Without it a typo in client-secret-ref only surfaces as the pod being stuck
+// in CreateContainerConfigError.
+type ReferenceChecker interface {
+	// Mode returns the validation mode for a pod in namespace
+	// podMode is the pod's own annotation, empty if unset
+	Mode(ctx context.Context, namespace string, podMode annotation.ReferenceValidation) annotation.ReferenceValidation
+
+	// Check returns one message per missing Secret, Secret key, ConfigMap or SecretProviderClass
+	// referenced by the sidecar container and its volumes
+	Check(ctx context.Context, namespace string, container *corev1.Container, volumes []corev1.Volume) ([]string, error)
+}
+
+// KubeReferenceChecker implements ReferenceChecker against the Kubernetes API
+type KubeReferenceChecker struct {
+	client      kubernetes.Interface
+	namespaces  corelisters.NamespaceLister
+	dynamic     dynamic.Interface
+	defaultMode annotation.ReferenceValidation
+}
+
+// NewReferenceChecker creates a ReferenceChecker
+//
+// Parameters:
+//   - client: used to read Secrets, and Namespace annotations if namespaces is nil
+//   - namespaces: used to read Namespace annotations without a Get per admission (may be nil)
+//   - dynamicClient: used to read SecretProviderClasses (may be nil to skip them)
+//   - defaultMode: applies when neither the pod nor its namespace set a mode
+func NewReferenceChecker(client kubernetes.Interface, namespaces corelisters.NamespaceLister, dynamicClient dynamic.Interface, defaultMode annotation.ReferenceValidation) *KubeReferenceChecker {
+	return &KubeReferenceChecker{
+		client:      client,
+		namespaces:  namespaces,
+		dynamic:     dynamicClient,
+		defaultMode: defaultMode,
+	}
+}
+
+// Mode resolves pod annotation > namespace annotation > webhook default
+func (c *KubeReferenceChecker) Mode(ctx context.Context, namespace string, podMode annotation.ReferenceValidation) annotation.ReferenceValidation {
+	if podMode != "" {
+		return podMode
+	}
+
+	ns, err := getNamespace(ctx, c.client, c.namespaces, namespace)
+	if err != nil {
+		klog.ErrorS(err, "failed to read namespace for reference validation mode", "namespace", namespace)
+		return c.defaultMode
+	}
+	if v, ok := ns.Annotations[annotation.KeyValidateReferences]; ok {
+		mode, err := annotation.ParseReferenceValidation(v)
+		if err != nil {
+			klog.ErrorS(err, "ignoring invalid namespace annotation", "namespace", namespace)
+			return c.defaultMode
+		}
+		return mode
+	}
+
+	return c.defaultMode
+}
+
+// Check looks up every secretKeyRef in the container's env, every Secret
+// projected into a volume, every ConfigMap volume and every
+// SecretProviderClass named by a CSI volume
+func (c *KubeReferenceChecker) Check(ctx context.Context, namespace string, container *corev1.Container, volumes []corev1.Volume) ([]string, error) {
+	var problems []string
+	secrets := make(map[string]*corev1.Secret)
+
+	checkKey := func(name, key, neededFor string) error {
+		secret, seen := secrets[name]
+		if !seen {
+			var err error
+			secret, err = c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				secret = nil
+			} else if err != nil {
+				return fmt.Errorf("failed to get secret %s/%s: %w", namespace, name, err)
+			}
+			secrets[name] = secret
+			if secret == nil {
+				problems = append(problems, fmt.Sprintf("secret %s/%s not found (needed for %s)", namespace, name, neededFor))
+			}
+		}
+		if secret == nil {
+			return nil
+		}
+
+		if _, ok := secret.Data[key]; !ok {
+			problems = append(problems, fmt.Sprintf("secret %s/%s has no key %q (needed for %s)", namespace, name, key, neededFor))
+		}
+		return nil
+	}
+
+	for _, env := range container.Env {
+		if env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil {
+			continue
+		}
+		ref := env.ValueFrom.SecretKeyRef
+		if ref.Optional != nil && *ref.Optional {
+			continue
+		}
+		if err := checkKey(ref.Name, ref.Key, env.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range volumes {
+		if v.ConfigMap != nil && (v.ConfigMap.Optional == nil || !*v.ConfigMap.Optional) {
+			_, err := c.client.CoreV1().ConfigMaps(namespace).Get(ctx, v.ConfigMap.Name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				problems = append(problems, fmt.Sprintf("configmap %s/%s not found (needed for %s)", namespace, v.ConfigMap.Name, v.Name))
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to get configmap %s/%s: %w", namespace, v.ConfigMap.Name, err)
+			}
+		}
+		if v.Projected == nil {
+			continue
+		}
+		for _, src := range v.Projected.Sources {
+			if src.Secret == nil || (src.Secret.Optional != nil && *src.Secret.Optional) {
+				continue
+			}
+			for _, item := range src.Secret.Items {
+				if err := checkKey(src.Secret.Name, item.Key, item.Path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if c.dynamic == nil {
+		return problems, nil
+	}
+	for _, v := range volumes {
+		if v.CSI == nil {
+			continue
+		}
+		name := v.CSI.VolumeAttributes["secretProviderClass"]
+		if name == "" {
+			continue
+		}
+		_, err := c.dynamic.Resource(SecretProviderClassGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			problems = append(problems, fmt.Sprintf("SecretProviderClass %s/%s not found", namespace, name))
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get SecretProviderClass %s/%s: %w", namespace, name, err)
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,187 @@
+package mutation
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// TestKubeReferenceChecker_Mode tests pod annotation > namespace annotation > default
+func TestKubeReferenceChecker_Mode(t *testing.T) {
+	tests := []struct {
+		name        string
+		nsAnnotated string
+		podMode     annotation.ReferenceValidation
+		want        annotation.ReferenceValidation
+	}{
+		{name: "default", want: annotation.ReferenceValidationWarn},
+		{name: "namespace", nsAnnotated: "deny", want: annotation.ReferenceValidationDeny},
+		{name: "namespace off", nsAnnotated: "off", want: annotation.ReferenceValidationOff},
+		{name: "pod over namespace", nsAnnotated: "deny", podMode: annotation.ReferenceValidationOff, want: annotation.ReferenceValidationOff},
+		{name: "invalid namespace annotation", nsAnnotated: "strict", want: annotation.ReferenceValidationWarn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}}
+			if tt.nsAnnotated != "" {
+				ns.Annotations = map[string]string{annotation.KeyValidateReferences: tt.nsAnnotated}
+			}
+			c := NewReferenceChecker(fake.NewSimpleClientset(ns), nil, nil, annotation.ReferenceValidationWarn)
+			if got := c.Mode(context.Background(), "apps", tt.podMode); got != tt.want {
+				t.Errorf("Mode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestKubeReferenceChecker_Check tests that each missing reference is reported once
+func TestKubeReferenceChecker_Check(t *testing.T) {
+	optional := true
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "oauth2", Namespace: "apps"},
+		Data:       map[string][]byte{"client-secret": []byte("s")},
+	}
+	templates := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "templates", Namespace: "apps"}}
+	secretEnv := func(name, secret, key string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: secret}, Key: key},
+		}}
+	}
+	configMapVolume := func(name string) corev1.Volume {
+		return corev1.Volume{Name: "custom-templates", VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		env     []corev1.EnvVar
+		volumes []corev1.Volume
+		want    []string
+	}{
+		{
+			name: "present",
+			env:  []corev1.EnvVar{secretEnv("OAUTH2_PROXY_CLIENT_SECRET", "oauth2", "client-secret")},
+		},
+		{
+			name: "missing secret reported once",
+			env: []corev1.EnvVar{
+				secretEnv("OAUTH2_PROXY_CLIENT_SECRET", "missing", "client-secret"),
+				secretEnv("OAUTH2_PROXY_COOKIE_SECRET", "missing", "cookie-secret"),
+			},
+			want: []string{"secret apps/missing not found (needed for OAUTH2_PROXY_CLIENT_SECRET)"},
+		},
+		{
+			name: "missing key",
+			env:  []corev1.EnvVar{secretEnv("OAUTH2_PROXY_COOKIE_SECRET", "oauth2", "cookie-secret")},
+			want: []string{`secret apps/oauth2 has no key "cookie-secret" (needed for OAUTH2_PROXY_COOKIE_SECRET)`},
+		},
+		{
+			name: "optional secret skipped",
+			env: []corev1.EnvVar{{Name: "OAUTH2_PROXY_COOKIE_SECRET", ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "k", Optional: &optional},
+			}}},
+		},
+		{
+			name:    "projected secret key",
+			volumes: []corev1.Volume{{Name: "secrets", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "oauth2"}, Items: []corev1.KeyToPath{{Key: "cookie-secret", Path: "cookie-secret"}}}}}}}}},
+			want:    []string{`secret apps/oauth2 has no key "cookie-secret" (needed for cookie-secret)`},
+		},
+		{
+			name:    "configmap present",
+			volumes: []corev1.Volume{configMapVolume("templates")},
+		},
+		{
+			name:    "configmap missing",
+			volumes: []corev1.Volume{configMapVolume("typo")},
+			want:    []string{"configmap apps/typo not found (needed for custom-templates)"},
+		},
+		{
+			name:    "secret provider class missing",
+			volumes: []corev1.Volume{BuildCSIVolume("vault")},
+			want:    []string{"SecretProviderClass apps/vault not found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{SecretProviderClassGVR: "SecretProviderClassList"})
+			c := NewReferenceChecker(fake.NewSimpleClientset(secret, templates), nil, dynamicClient, annotation.ReferenceValidationDeny)
+
+			got, err := c.Check(context.Background(), "apps", &corev1.Container{Env: tt.env}, tt.volumes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestKubeReferenceChecker_SecretProviderClass tests that an existing
+// SecretProviderClass passes and that a nil dynamic client skips the lookup
+func TestKubeReferenceChecker_SecretProviderClass(t *testing.T) {
+	spc := &unstructured.Unstructured{}
+	spc.SetAPIVersion("secrets-store.csi.x-k8s.io/v1")
+	spc.SetKind("SecretProviderClass")
+	spc.SetNamespace("apps")
+	spc.SetName("vault")
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{SecretProviderClassGVR: "SecretProviderClassList"}, spc)
+	volumes := []corev1.Volume{BuildCSIVolume("vault")}
+
+	for name, c := range map[string]*KubeReferenceChecker{
+		"present":    NewReferenceChecker(fake.NewSimpleClientset(), nil, dynamicClient, annotation.ReferenceValidationDeny),
+		"no dynamic": NewReferenceChecker(fake.NewSimpleClientset(), nil, nil, annotation.ReferenceValidationDeny),
+	} {
+		got, err := c.Check(context.Background(), "apps", &corev1.Container{}, volumes)
+		if err != nil || len(got) > 0 {
+			t.Errorf("%s: Check() = %q, %v, want no problems", name, got, err)
+		}
+	}
+}
+
+// TestKubeReferenceChecker_RBACDisabled tests that without get on Secrets,
+// ConfigMaps or Namespaces the checker errors or falls back to the default
+// instead of reporting the references as missing
+func TestKubeReferenceChecker_RBACDisabled(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "apps",
+		Annotations: map[string]string{annotation.KeyValidateReferences: "deny"},
+	}})
+	client.PrependReactor("get", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", nil)
+	})
+	c := NewReferenceChecker(client, nil, nil, annotation.ReferenceValidationWarn)
+
+	if got := c.Mode(context.Background(), "apps", ""); got != annotation.ReferenceValidationWarn {
+		t.Errorf("Mode() = %q, want default %q", got, annotation.ReferenceValidationWarn)
+	}
+
+	container := &corev1.Container{Env: []corev1.EnvVar{{Name: "OAUTH2_PROXY_CLIENT_SECRET", ValueFrom: &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "oauth2"}, Key: "client-secret"},
+	}}}}
+	if got, err := c.Check(context.Background(), "apps", container, nil); !apierrors.IsForbidden(err) || got != nil {
+		t.Errorf("Check() secret = %q, %v, want forbidden error", got, err)
+	}
+
+	volumes := []corev1.Volume{{Name: "custom-templates", VolumeSource: corev1.VolumeSource{
+		ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "templates"}},
+	}}}
+	if got, err := c.Check(context.Background(), "apps", &corev1.Container{}, volumes); !apierrors.IsForbidden(err) || got != nil {
+		t.Errorf("Check() configmap = %q, %v, want forbidden error", got, err)
+	}
+}
@@ -0,0 +1,47 @@
+package mutation
+
+import (
+	"context"
+	"fmt"
+)
+
+// Review carries per-request state between the admission handler and the mutator
+//
+// The handler creates one per AdmissionRequest and stores it in the context
+// passed to Mutate, so the Mutator interface stays a plain pod -> patches call.
+type Review struct {
+	// Warnings are returned to the API client in AdmissionResponse.Warnings
+	Warnings []string
+
+	// DryRun is set for dry-run requests; the mutator must not create objects
+	DryRun bool
+
+	// Annotations are the pod's annotations layered with its workload's, rule's
+	// and namespace's, with spec annotations expanded; recorded for auditing
+	Annotations map[string]string
+
+	// ConfigMap is the "namespace/name" of the ConfigMap the config was loaded from
+	ConfigMap string
+}
+
+// reviewKey is the context key for the request's Review
+type reviewKey struct{}
+
+// WithReview returns a context carrying the given Review
+func WithReview(ctx context.Context, r *Review) context.Context {
+	return context.WithValue(ctx, reviewKey{}, r)
+}
+
+// ReviewFrom returns the Review stored in ctx
+// Returns a detached Review if none is set, so callers never need a nil check
+func ReviewFrom(ctx context.Context) *Review {
+	if r, ok := ctx.Value(reviewKey{}).(*Review); ok && r != nil {
+		return r
+	}
+	return &Review{}
+}
+
+// AddWarning appends a formatted warning for the API client
+func (r *Review) AddWarning(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
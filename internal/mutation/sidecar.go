@@ -17,6 +17,9 @@ type PortMapping struct {
 	// ProxyPort is the port oauth2-proxy forwards to (the app's original port)
 	ProxyPort int32
 
+	// ListenPort is the port oauth2-proxy listens on, the proxy-port setting
+	ListenPort int32
+
 	// TLSMode sets if the upstream is http, https, or https without TLS validation
 	TLSMode annotation.UpstreamTLSMode
 }
@@ -42,6 +45,9 @@ func NewSidecarBuilder() *OAuth2ProxySidecarBuilder {
 //   - Adds volume mount to the container
 //   - File-based secrets are handled by buildArgs via IsFromFile() checks
 //   - Env vars for secrets are skipped by buildEnvVars via IsFromFile() checks
+//
+// When cfg.CustomTemplatesConfigMap is set, the ConfigMap is mounted at
+// CustomTemplatesMountPath for --custom-templates-dir.
 func (b *OAuth2ProxySidecarBuilder) Build(cfg *config.EffectiveConfig, portMapping PortMapping) (*corev1.Container, []corev1.Volume) {
 	portName := cfg.ProtectedPort
 	if !annotation.IsNamedPort(portName) {
@@ -60,18 +66,19 @@ func (b *OAuth2ProxySidecarBuilder) Build(cfg *config.EffectiveConfig, portMappi
 	args := buildArgs(cfg, portMapping)
 
 	container := &corev1.Container{
-		Name:  "oauth2-proxy",
-		Image: cfg.ProxyImage,
-		Env:   buildEnvVars(cfg),
+		Name:            "oauth2-proxy",
+		Image:           cfg.ProxyImage,
+		ImagePullPolicy: cfg.ProxyImagePullPolicy,
+		Env:             buildEnvVars(cfg),
 		Ports: []corev1.ContainerPort{
 			{
 				Name:          portName,
-				ContainerPort: 4180,
+				ContainerPort: portMapping.ListenPort,
 				Protocol:      corev1.ProtocolTCP,
 			},
 		},
-		LivenessProbe:  buildProbe(4180, ping),
-		ReadinessProbe: buildProbe(4180, ready),
+		LivenessProbe:  buildProbe(portMapping.ListenPort, ping),
+		ReadinessProbe: buildProbe(portMapping.ListenPort, ready),
 	}
 
 	// When EnvFile is set, use shell wrapper to source env vars before starting
@@ -95,6 +102,12 @@ func (b *OAuth2ProxySidecarBuilder) Build(cfg *config.EffectiveConfig, portMappi
 		container.Resources = *cfg.ProxyResources
 	}
 
+	if cfg.ProxySecurityContext != nil {
+		container.SecurityContext = cfg.ProxySecurityContext.DeepCopy()
+	} else {
+		container.SecurityContext = DefaultSecurityContext()
+	}
+
 	volumes := []corev1.Volume{}
 
 	// Add CSI volume and mount when SecretProviderClass is configured
@@ -103,6 +116,19 @@ func (b *OAuth2ProxySidecarBuilder) Build(cfg *config.EffectiveConfig, portMappi
 		container.VolumeMounts = append(container.VolumeMounts, BuildCSIVolumeMount())
 	}
 
+	// Add the custom sign-in page templates
+	if cfg.CustomTemplatesConfigMap != "" {
+		volumes = append(volumes, BuildTemplatesVolume(cfg.CustomTemplatesConfigMap))
+		container.VolumeMounts = append(container.VolumeMounts, BuildTemplatesVolumeMount())
+	}
+
+	// Add the alpha config and provider secret volumes for a provider block
+	if len(cfg.Providers) > 0 {
+		alphaVolumes, alphaMounts := buildAlphaVolumes(cfg)
+		volumes = append(volumes, alphaVolumes...)
+		container.VolumeMounts = append(container.VolumeMounts, alphaMounts...)
+	}
+
 	return container, volumes
 }
 
@@ -133,25 +159,14 @@ func buildArgs(cfg *config.EffectiveConfig, portMapping PortMapping) []string {
 		ret = append(ret, "--client-id="+cfg.ClientID.Value)
 	}
 
-	ret = append(ret, "--http-address=0.0.0.0:4180")
+	ret = append(ret, fmt.Sprintf("--http-address=0.0.0.0:%d", portMapping.ListenPort))
 
 	// Upstream - skip entirely if fromEnv (oauth2-proxy reads OAUTH2_PROXY_UPSTREAM)
 	if !cfg.Upstream.IsFromEnv() {
-		if cfg.Upstream.Value == "" {
-			switch cfg.UpstreamTLS {
-			case annotation.UpstreamNoTLS:
-				ret = append(ret, fmt.Sprintf("--upstream=http://127.0.0.1:%d", portMapping.ProxyPort))
-			case annotation.UpstreamTLSSecure:
-				ret = append(ret, fmt.Sprintf("--upstream=https://127.0.0.1:%d", portMapping.ProxyPort))
-			case annotation.UpstreamTLSInsecure:
-				ret = append(ret, fmt.Sprintf("--upstream=https://127.0.0.1:%d", portMapping.ProxyPort))
-				ret = append(ret, "--ssl-upstream-insecure-skip-verify=true")
-			}
-		} else {
-			ret = append(ret, fmt.Sprintf("--upstream=%s", cfg.Upstream.Value))
-			if cfg.UpstreamTLS == annotation.UpstreamTLSInsecure {
-				ret = append(ret, "--ssl-upstream-insecure-skip-verify=true")
-			}
+		uri, insecure := upstreamURL(cfg, portMapping)
+		ret = append(ret, "--upstream="+uri)
+		if insecure {
+			ret = append(ret, "--ssl-upstream-insecure-skip-verify=true")
 		}
 	}
 
@@ -231,6 +246,7 @@ func buildArgs(cfg *config.EffectiveConfig, portMapping PortMapping) []string {
 	if !cfg.OIDCGroupsClaim.IsFromEnv() && cfg.OIDCGroupsClaim.Value != "" {
 		ret = append(ret, "--oidc-groups-claim="+cfg.OIDCGroupsClaim.Value)
 	}
+	ret = append(ret, buildProviderArgs(cfg)...)
 	// Redirect URL - skip if fromEnv
 	if !cfg.RedirectURL.IsFromEnv() && cfg.RedirectURL.Value != "" {
 		ret = append(ret, "--redirect-url="+cfg.RedirectURL.Value)
@@ -243,6 +259,7 @@ func buildArgs(cfg *config.EffectiveConfig, portMapping PortMapping) []string {
 	if !cfg.Prompt.IsFromEnv() && cfg.Prompt.Value != "" {
 		ret = append(ret, "--prompt="+cfg.Prompt.Value)
 	}
+	ret = append(ret, buildSignInPageArgs(cfg)...)
 	if cfg.PingPath != "" {
 		ret = append(ret, "--ping-path="+cfg.PingPath)
 	}
@@ -286,6 +303,11 @@ func buildArgs(cfg *config.EffectiveConfig, portMapping PortMapping) []string {
 			ret = append(ret, "--whitelist-domain="+p)
 		}
 	}
+	// Provider blocks are only supported through the alpha config
+	if len(cfg.Providers) > 0 {
+		ret = alphaArgs(ret)
+	}
+
 	for _, arg := range cfg.ExtraArgs {
 		ret = append(ret, arg)
 	}
@@ -293,6 +315,66 @@ func buildArgs(cfg *config.EffectiveConfig, portMapping PortMapping) []string {
 	return ret
 }
 
+// buildProviderArgs returns flags for the provider-specific settings
+// Validate has already checked they match the provider. fromEnv settings are skipped.
+func buildProviderArgs(cfg *config.EffectiveConfig) []string {
+	var ret []string
+
+	value := func(flag string, v config.SourcedValue) {
+		if !v.IsFromEnv() && v.Value != "" {
+			ret = append(ret, "--"+flag+"="+v.Value)
+		}
+	}
+	// GitHub team/user flags take one comma-separated value
+	joined := func(flag string, v config.SourcedStringSlice) {
+		if !v.IsFromEnv() && len(v.Values) > 0 {
+			ret = append(ret, "--"+flag+"="+strings.Join(v.Values, ","))
+		}
+	}
+	// The group/project flags are repeated once per value
+	repeated := func(flag string, v config.SourcedStringSlice) {
+		if !v.IsFromEnv() {
+			for _, s := range v.Values {
+				ret = append(ret, "--"+flag+"="+s)
+			}
+		}
+	}
+
+	value("github-org", cfg.GitHubOrg)
+	joined("github-team", cfg.GitHubTeams)
+	value("github-repo", cfg.GitHubRepo)
+	joined("github-user", cfg.GitHubUsers)
+	repeated("gitlab-group", cfg.GitLabGroups)
+	repeated("gitlab-project", cfg.GitLabProjects)
+	repeated("google-group", cfg.GoogleGroups)
+	value("google-admin-email", cfg.GoogleAdminEmail)
+	value("google-service-account-json", cfg.GoogleServiceAccountJSON)
+	if !cfg.GoogleUseApplicationDefaultCredentials.IsFromEnv() && cfg.GoogleUseApplicationDefaultCredentials.Value {
+		ret = append(ret, "--google-use-application-default-credentials=true")
+	}
+	value("azure-tenant", cfg.AzureTenant)
+	repeated("keycloak-group", cfg.KeycloakGroups)
+
+	return ret
+}
+
+// loopbackHost returns the loopback address for the given IP family,
+// bracketed for IPv6 so it can be used directly in a URL
+//
+// The default is localhost: the pod's /etc/hosts maps it to both 127.0.0.1
+// and ::1, and oauth2-proxy's dialer falls back between them, so apps bound
+// to either family are reached without knowing the pod's IP families.
+func loopbackHost(family annotation.IPFamily) string {
+	switch family {
+	case annotation.IPFamilyIPv4:
+		return "127.0.0.1"
+	case annotation.IPFamilyIPv6:
+		return "[::1]"
+	default:
+		return "localhost"
+	}
+}
+
 // buildEnvVars creates environment variable definitions for secrets and fromEnv fields
 //
 // SourcedSecretRef handling:
@@ -327,7 +409,8 @@ func buildEnvVars(cfg *config.EffectiveConfig) []corev1.EnvVar {
 	}
 
 	// Client secret - only add env var if source is literal and ref is set
-	if cfg.ClientSecret.IsLiteral() && cfg.ClientSecret.Ref != nil {
+	// With a provider block its secret is mounted for the alpha config instead
+	if cfg.ClientSecret.IsLiteral() && cfg.ClientSecret.Ref != nil && len(cfg.Providers) == 0 {
 		ret = append(ret, corev1.EnvVar{
 			Name: "OAUTH2_PROXY_CLIENT_SECRET",
 			ValueFrom: &corev1.EnvVarSource{
@@ -388,6 +471,44 @@ func buildEnvVarsFromSecret(cfg *config.EffectiveConfig) []corev1.EnvVar {
 		addEnvVar("OAUTH2_PROXY_VALIDATE_URL", "validate-url")
 	}
 
+	// Provider-specific settings
+	if cfg.GitHubOrg.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GITHUB_ORG", "github-org")
+	}
+	if cfg.GitHubTeams.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GITHUB_TEAM", "github-team")
+	}
+	if cfg.GitHubRepo.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GITHUB_REPO", "github-repo")
+	}
+	if cfg.GitHubUsers.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GITHUB_USERS", "github-user")
+	}
+	if cfg.GitLabGroups.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GITLAB_GROUPS", "gitlab-group")
+	}
+	if cfg.GitLabProjects.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GITLAB_PROJECTS", "gitlab-project")
+	}
+	if cfg.GoogleGroups.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GOOGLE_GROUPS", "google-group")
+	}
+	if cfg.GoogleAdminEmail.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GOOGLE_ADMIN_EMAIL", "google-admin-email")
+	}
+	if cfg.GoogleServiceAccountJSON.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GOOGLE_SERVICE_ACCOUNT_JSON", "google-service-account-json")
+	}
+	if cfg.GoogleUseApplicationDefaultCredentials.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_GOOGLE_USE_APPLICATION_DEFAULT_CREDENTIALS", "google-use-application-default-credentials")
+	}
+	if cfg.AzureTenant.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_AZURE_TENANT", "azure-tenant")
+	}
+	if cfg.KeycloakGroups.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_KEYCLOAK_GROUPS", "keycloak-group")
+	}
+
 	// Identity settings
 	if cfg.ClientID.IsFromEnv() {
 		addEnvVar("OAUTH2_PROXY_CLIENT_ID", "client-id")
@@ -459,6 +580,17 @@ func buildEnvVarsFromSecret(cfg *config.EffectiveConfig) []corev1.EnvVar {
 		addEnvVar("OAUTH2_PROXY_PROMPT", "prompt")
 	}
 
+	// Sign-in page settings
+	if cfg.Banner.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_BANNER", "banner")
+	}
+	if cfg.Footer.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_FOOTER", "footer")
+	}
+	if cfg.CustomSignInLogo.IsFromEnv() {
+		addEnvVar("OAUTH2_PROXY_CUSTOM_SIGN_IN_LOGO", "custom-sign-in-logo")
+	}
+
 	// Extra env vars (arbitrary user-defined mappings)
 	for secretKey, envVarName := range cfg.ExtraEnv {
 		addEnvVar(envVarName, secretKey)
@@ -504,8 +636,9 @@ func CalculatePortMapping(
 		for _, p := range containerPorts {
 			if p.Name == cfg.ProtectedPort {
 				return PortMapping{
-					ProxyPort: p.ContainerPort,
-					TLSMode:   cfg.UpstreamTLS,
+					ProxyPort:  p.ContainerPort,
+					ListenPort: cfg.ProxyPort,
+					TLSMode:    cfg.UpstreamTLS,
 				}, nil
 			}
 		}
@@ -517,8 +650,9 @@ func CalculatePortMapping(
 		for _, p := range containerPorts {
 			if p.ContainerPort == int32(portNum) {
 				return PortMapping{
-					ProxyPort: p.ContainerPort,
-					TLSMode:   cfg.UpstreamTLS,
+					ProxyPort:  p.ContainerPort,
+					ListenPort: cfg.ProxyPort,
+					TLSMode:    cfg.UpstreamTLS,
 				}, nil
 			}
 		}
@@ -0,0 +1,152 @@
+package mutation
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// TestBuildArgs_Upstream tests that the default upstream follows ip-family
+func TestBuildArgs_Upstream(t *testing.T) {
+	tests := []struct {
+		family annotation.IPFamily
+		want   string
+	}{
+		{family: annotation.IPFamilyAuto, want: "--upstream=http://localhost:8080"},
+		{family: annotation.IPFamilyIPv4, want: "--upstream=http://127.0.0.1:8080"},
+		{family: annotation.IPFamilyIPv6, want: "--upstream=http://[::1]:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.family), func(t *testing.T) {
+			cfg := &config.EffectiveConfig{IPFamily: tt.family, UpstreamTLS: annotation.UpstreamNoTLS}
+			args := buildArgs(cfg, PortMapping{ProxyPort: 8080, ListenPort: 4180})
+			if !slices.Contains(args, tt.want) {
+				t.Errorf("buildArgs() = %v, want %s", args, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildProviderArgs tests each provider's flags and that fromEnv settings get no flag
+func TestBuildProviderArgs(t *testing.T) {
+	literal := func(v string) config.SourcedValue { return config.SourcedValue{Value: v} }
+	list := func(v ...string) config.SourcedStringSlice { return config.SourcedStringSlice{Values: v, Set: true} }
+
+	tests := []struct {
+		name string
+		cfg  config.EffectiveConfig
+		want []string
+	}{
+		{name: "none", cfg: config.EffectiveConfig{}, want: nil},
+		{
+			name: "github",
+			cfg: config.EffectiveConfig{
+				GitHubOrg:   literal("acme"),
+				GitHubTeams: list("sre", "dev"),
+				GitHubRepo:  literal("acme/app"),
+				GitHubUsers: list("alice", "bob"),
+			},
+			want: []string{"--github-org=acme", "--github-team=sre,dev", "--github-repo=acme/app", "--github-user=alice,bob"},
+		},
+		{
+			name: "gitlab",
+			cfg:  config.EffectiveConfig{GitLabGroups: list("acme", "ops"), GitLabProjects: list("acme/app=30")},
+			want: []string{"--gitlab-group=acme", "--gitlab-group=ops", "--gitlab-project=acme/app=30"},
+		},
+		{
+			name: "google",
+			cfg: config.EffectiveConfig{
+				GoogleGroups:                           list("admins@acme.com"),
+				GoogleAdminEmail:                       literal("admin@acme.com"),
+				GoogleServiceAccountJSON:               literal("/etc/google/sa.json"),
+				GoogleUseApplicationDefaultCredentials: config.SourcedBool{Value: true},
+			},
+			want: []string{
+				"--google-group=admins@acme.com",
+				"--google-admin-email=admin@acme.com",
+				"--google-service-account-json=/etc/google/sa.json",
+				"--google-use-application-default-credentials=true",
+			},
+		},
+		{name: "azure", cfg: config.EffectiveConfig{AzureTenant: literal("contoso")}, want: []string{"--azure-tenant=contoso"}},
+		{name: "keycloak", cfg: config.EffectiveConfig{KeycloakGroups: list("/admins", "/ops")}, want: []string{"--keycloak-group=/admins", "--keycloak-group=/ops"}},
+		{
+			name: "fromEnv",
+			cfg: config.EffectiveConfig{
+				GitHubOrg:                              config.SourcedValue{Source: annotation.ValueSourceEnv},
+				GitHubTeams:                            config.SourcedStringSlice{Source: annotation.ValueSourceEnv},
+				GitLabGroups:                           config.SourcedStringSlice{Source: annotation.ValueSourceEnv},
+				GoogleUseApplicationDefaultCredentials: config.SourcedBool{Source: annotation.ValueSourceEnv},
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildProviderArgs(&tt.cfg); !slices.Equal(got, tt.want) {
+				t.Errorf("buildProviderArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildEnvVarsFromSecret_Provider tests that fromEnv provider settings are
+// read from the env secret under oauth2-proxy's variable names
+func TestBuildEnvVarsFromSecret_Provider(t *testing.T) {
+	fromEnv := config.SourcedValue{Source: annotation.ValueSourceEnv}
+	listFromEnv := config.SourcedStringSlice{Source: annotation.ValueSourceEnv}
+
+	cfg := &config.EffectiveConfig{
+		EnvSecret:                              "oauth2-env",
+		GitHubOrg:                              fromEnv,
+		GitHubTeams:                            listFromEnv,
+		GitHubRepo:                             fromEnv,
+		GitHubUsers:                            listFromEnv,
+		GitLabGroups:                           listFromEnv,
+		GitLabProjects:                         listFromEnv,
+		GoogleGroups:                           listFromEnv,
+		GoogleAdminEmail:                       fromEnv,
+		GoogleServiceAccountJSON:               fromEnv,
+		GoogleUseApplicationDefaultCredentials: config.SourcedBool{Source: annotation.ValueSourceEnv},
+		AzureTenant:                            fromEnv,
+		KeycloakGroups:                         listFromEnv,
+	}
+	want := map[string]string{
+		"OAUTH2_PROXY_GITHUB_ORG":                                 "github-org",
+		"OAUTH2_PROXY_GITHUB_TEAM":                                "github-team",
+		"OAUTH2_PROXY_GITHUB_REPO":                                "github-repo",
+		"OAUTH2_PROXY_GITHUB_USERS":                               "github-user",
+		"OAUTH2_PROXY_GITLAB_GROUPS":                              "gitlab-group",
+		"OAUTH2_PROXY_GITLAB_PROJECTS":                            "gitlab-project",
+		"OAUTH2_PROXY_GOOGLE_GROUPS":                              "google-group",
+		"OAUTH2_PROXY_GOOGLE_ADMIN_EMAIL":                         "google-admin-email",
+		"OAUTH2_PROXY_GOOGLE_SERVICE_ACCOUNT_JSON":                "google-service-account-json",
+		"OAUTH2_PROXY_GOOGLE_USE_APPLICATION_DEFAULT_CREDENTIALS": "google-use-application-default-credentials",
+		"OAUTH2_PROXY_AZURE_TENANT":                               "azure-tenant",
+		"OAUTH2_PROXY_KEYCLOAK_GROUPS":                            "keycloak-group",
+	}
+
+	got := map[string]*corev1.SecretKeySelector{}
+	for _, env := range buildEnvVarsFromSecret(cfg) {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			got[env.Name] = env.ValueFrom.SecretKeyRef
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("buildEnvVarsFromSecret() returned %d secret env vars, want %d", len(got), len(want))
+	}
+	for name, key := range want {
+		ref, ok := got[name]
+		if !ok {
+			t.Errorf("missing env var %s", name)
+			continue
+		}
+		if ref.Name != "oauth2-env" || ref.Key != key {
+			t.Errorf("%s from %s/%s, want oauth2-env/%s", name, ref.Name, ref.Key, key)
+		}
+	}
+}
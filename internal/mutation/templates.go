@@ -0,0 +1,59 @@
+package mutation
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// CustomTemplatesMountPath is where the custom templates ConfigMap is mounted
+// and what --custom-templates-dir points at
+const CustomTemplatesMountPath = "/etc/oauth2-proxy/templates"
+
+// CustomTemplatesVolumeName is the volume holding the custom templates ConfigMap
+const CustomTemplatesVolumeName = "oauth2-proxy-templates"
+
+// BuildTemplatesVolume creates the volume for the custom templates ConfigMap
+func BuildTemplatesVolume(configMapName string) corev1.Volume {
+	return corev1.Volume{
+		Name: CustomTemplatesVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+			},
+		},
+	}
+}
+
+// BuildTemplatesVolumeMount creates the volume mount for the oauth2-proxy container
+func BuildTemplatesVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      CustomTemplatesVolumeName,
+		MountPath: CustomTemplatesMountPath,
+		ReadOnly:  true,
+	}
+}
+
+// buildSignInPageArgs returns the flags for the sign-in page templates and branding
+// fromEnv settings are skipped
+func buildSignInPageArgs(cfg *config.EffectiveConfig) []string {
+	var ret []string
+	if cfg.CustomTemplatesConfigMap != "" {
+		ret = append(ret, "--custom-templates-dir="+CustomTemplatesMountPath)
+	}
+	if !cfg.Banner.IsFromEnv() && cfg.Banner.Value != "" {
+		ret = append(ret, "--banner="+cfg.Banner.Value)
+	}
+	if !cfg.Footer.IsFromEnv() && cfg.Footer.Value != "" {
+		ret = append(ret, "--footer="+cfg.Footer.Value)
+	}
+	if !cfg.CustomSignInLogo.IsFromEnv() && cfg.CustomSignInLogo.Value != "" {
+		logo := cfg.CustomSignInLogo.Value
+		// Validate has checked a bare key comes with the templates ConfigMap
+		if config.IsTemplatesKey(logo) {
+			logo = CustomTemplatesMountPath + "/" + logo
+		}
+		ret = append(ret, "--custom-sign-in-logo="+logo)
+	}
+	return ret
+}
@@ -0,0 +1,129 @@
+package mutation
+
+import (
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// TestBuildSignInPageArgs tests the templates dir, banner, footer and logo flags
+func TestBuildSignInPageArgs(t *testing.T) {
+	literal := func(v string) config.SourcedValue { return config.SourcedValue{Value: v} }
+	fromEnv := config.SourcedValue{Source: annotation.ValueSourceEnv}
+
+	tests := []struct {
+		name string
+		cfg  config.EffectiveConfig
+		want []string
+	}{
+		{name: "none", cfg: config.EffectiveConfig{}, want: nil},
+		{
+			name: "templates",
+			cfg:  config.EffectiveConfig{CustomTemplatesConfigMap: "sign-in"},
+			want: []string{"--custom-templates-dir=/etc/oauth2-proxy/templates"},
+		},
+		{
+			name: "banner and footer",
+			cfg:  config.EffectiveConfig{Banner: literal("<b>Acme</b>"), Footer: literal("-")},
+			want: []string{"--banner=<b>Acme</b>", "--footer=-"},
+		},
+		{
+			name: "logo in templates configmap",
+			cfg:  config.EffectiveConfig{CustomTemplatesConfigMap: "sign-in", CustomSignInLogo: literal("logo.svg")},
+			want: []string{"--custom-templates-dir=/etc/oauth2-proxy/templates", "--custom-sign-in-logo=/etc/oauth2-proxy/templates/logo.svg"},
+		},
+		{
+			name: "logo path",
+			cfg:  config.EffectiveConfig{CustomSignInLogo: literal("/var/run/logo.png")},
+			want: []string{"--custom-sign-in-logo=/var/run/logo.png"},
+		},
+		{
+			name: "logo url",
+			cfg:  config.EffectiveConfig{CustomSignInLogo: literal("https://acme.com/logo.png")},
+			want: []string{"--custom-sign-in-logo=https://acme.com/logo.png"},
+		},
+		{
+			name: "logo disabled",
+			cfg:  config.EffectiveConfig{CustomSignInLogo: literal("-")},
+			want: []string{"--custom-sign-in-logo=-"},
+		},
+		{
+			name: "fromEnv",
+			cfg:  config.EffectiveConfig{Banner: fromEnv, Footer: fromEnv, CustomSignInLogo: fromEnv},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildSignInPageArgs(&tt.cfg); !slices.Equal(got, tt.want) {
+				t.Errorf("buildSignInPageArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildEnvVarsFromSecret_SignInPage tests that fromEnv sign-in page
+// settings are read from the env secret
+func TestBuildEnvVarsFromSecret_SignInPage(t *testing.T) {
+	fromEnv := config.SourcedValue{Source: annotation.ValueSourceEnv}
+	cfg := &config.EffectiveConfig{EnvSecret: "oauth2-env", Banner: fromEnv, Footer: fromEnv, CustomSignInLogo: fromEnv}
+	want := map[string]string{
+		"OAUTH2_PROXY_BANNER":              "banner",
+		"OAUTH2_PROXY_FOOTER":              "footer",
+		"OAUTH2_PROXY_CUSTOM_SIGN_IN_LOGO": "custom-sign-in-logo",
+	}
+
+	got := map[string]string{}
+	for _, env := range buildEnvVarsFromSecret(cfg) {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == "oauth2-env" {
+			got[env.Name] = env.ValueFrom.SecretKeyRef.Key
+		}
+	}
+	for name, key := range want {
+		if got[name] != key {
+			t.Errorf("%s = %q, want key %q", name, got[name], key)
+		}
+	}
+}
+
+// TestSidecarBuilder_Templates tests that the templates ConfigMap is mounted
+// read-only where --custom-templates-dir points
+func TestSidecarBuilder_Templates(t *testing.T) {
+	tests := []struct {
+		name      string
+		configMap string
+		wantMount bool
+	}{
+		{name: "without templates", configMap: "", wantMount: false},
+		{name: "with templates", configMap: "sign-in", wantMount: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.EffectiveConfig{ProxyImage: "oauth2-proxy", CustomTemplatesConfigMap: tt.configMap}
+			container, volumes := NewSidecarBuilder().Build(cfg, PortMapping{ProxyPort: 8080, ListenPort: 4180})
+
+			i := slices.IndexFunc(volumes, func(v corev1.Volume) bool { return v.Name == CustomTemplatesVolumeName })
+			j := slices.IndexFunc(container.VolumeMounts, func(m corev1.VolumeMount) bool { return m.Name == CustomTemplatesVolumeName })
+			if (i >= 0) != tt.wantMount || (j >= 0) != tt.wantMount {
+				t.Fatalf("volume index = %d, mount index = %d, wantMount %v", i, j, tt.wantMount)
+			}
+			if !tt.wantMount {
+				return
+			}
+
+			if cm := volumes[i].ConfigMap; cm == nil || cm.Name != tt.configMap {
+				t.Errorf("volume = %+v, want ConfigMap %s", volumes[i].VolumeSource, tt.configMap)
+			}
+			if m := container.VolumeMounts[j]; m.MountPath != CustomTemplatesMountPath || !m.ReadOnly {
+				t.Errorf("mount = %+v, want read-only at %s", m, CustomTemplatesMountPath)
+			}
+			if !slices.Contains(container.Args, "--custom-templates-dir="+CustomTemplatesMountPath) {
+				t.Errorf("args = %v, want --custom-templates-dir=%s", container.Args, CustomTemplatesMountPath)
+			}
+		})
+	}
+}
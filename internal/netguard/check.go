@@ -0,0 +1,33 @@
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Check reports whether the table is installed in the current network
+// namespace, without NET_ADMIN
+//
+// It listens on ValidationAddr and connects to itself. The validation rule
+// resets that connection, so a refused connection means the rules are in
+// place and an accepted one means they are missing.
+func Check(timeout time.Duration) error {
+	ln, err := net.Listen("tcp4", ValidationAddr.String())
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", ValidationAddr, err)
+	}
+	defer ln.Close()
+
+	conn, err := net.DialTimeout("tcp4", ValidationAddr.String(), timeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("table %s is not installed: connection to %s was accepted", TableName, ValidationAddr)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return fmt.Errorf("connecting to %s: %w", ValidationAddr, err)
+}
@@ -0,0 +1,15 @@
+package netguard
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheck_NotInstalled tests that Check fails when nothing resets the validation connection
+func TestCheck_NotInstalled(t *testing.T) {
+	err := Check(time.Second)
+	if err == nil || !strings.Contains(err.Error(), "is not installed") {
+		t.Fatalf("Check() error = %v, want table not installed", err)
+	}
+}
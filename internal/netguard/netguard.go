@@ -0,0 +1,353 @@
+// Package netguard installs nftables rules that block direct access to
+// protected ports, so only loopback traffic (oauth2-proxy) can reach them.
+//
+// Rules live in a dedicated inet table so they cover IPv4 and IPv6 and never
+// touch rules owned by other tools (CNI plugins, service meshes, kube-proxy).
+package netguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// TableName is the nftables table owned by netguard
+const TableName = "oauth2_proxy_guard"
+
+// ChainName is the base chain hooked into input
+const ChainName = "input"
+
+// ValidationAddr is where the validation rule rejects TCP connections
+//
+// Nothing else uses it: Check listens there and connects to itself, and only
+// the installed table turns that connection into a reset. This lets an
+// unprivileged container tell whether the rules are in place, which reading
+// them over netlink can't do without NET_ADMIN.
+var ValidationAddr = netip.MustParseAddrPort("127.0.0.254:4179")
+
+// loopbackPrefixes are always allowed to reach the protected ports
+var loopbackPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.1/32"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// Rules describes the ports to protect
+type Rules struct {
+	// Ports are the TCP ports only reachable over loopback
+	Ports []uint16
+
+	// Allowed are extra source prefixes that may reach the ports directly,
+	// e.g. the node IP for kubelet probes or a metrics scraper range
+	Allowed []netip.Prefix
+}
+
+// Validate checks that the rules are usable
+func (r Rules) Validate() error {
+	if len(r.Ports) == 0 {
+		return fmt.Errorf("no ports to protect")
+	}
+	for _, p := range r.Ports {
+		if p == 0 {
+			return fmt.Errorf("invalid port 0")
+		}
+	}
+	for _, p := range r.Allowed {
+		if !p.IsValid() {
+			return fmt.Errorf("invalid allowed prefix %s", p)
+		}
+	}
+	return nil
+}
+
+// ParsePorts parses a comma-separated list of TCP ports into Rules
+// Value: e.g. "8080" or "8080,9090"
+func ParsePorts(ports string) (Rules, error) {
+	var rules Rules
+
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || port == 0 {
+			return rules, fmt.Errorf("invalid port %q", p)
+		}
+		rules.Ports = append(rules.Ports, uint16(port))
+	}
+
+	return rules, rules.Validate()
+}
+
+// ParsePrefixes parses a comma-separated list of CIDRs or bare addresses
+// Bare addresses become single-host prefixes (/32 or /128)
+// Value: e.g. "10.0.0.5,10.42.0.0/16,fd00::/64"
+func ParsePrefixes(prefixes string) ([]netip.Prefix, error) {
+	var ret []netip.Prefix
+
+	for _, p := range strings.Split(prefixes, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", p)
+			}
+			ret = append(ret, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q", p)
+		}
+		ret = append(ret, prefix.Masked())
+	}
+
+	return ret, nil
+}
+
+// Apply installs the rules in a single nftables transaction
+//
+// The table is deleted and recreated in the same batch, so running Apply
+// repeatedly (e.g. on init container restart) always leaves exactly one copy
+// of the rules in place.
+func Apply(conn *nftables.Conn, rules Rules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+	// AddTable is a no-op if the table exists, so the delete below never fails
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	chain := conn.AddChain(baseChain(table))
+
+	for _, r := range buildRules(rules) {
+		conn.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    chain,
+			Exprs:    r.exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, r.comment),
+		})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("applying nftables rules: %w", err)
+	}
+	return nil
+}
+
+// Verify reads back the installed chain and rules and checks they match exactly
+func Verify(conn *nftables.Conn, rules Rules) error {
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return fmt.Errorf("reading nftables chains: %w", err)
+	}
+	var chain *nftables.Chain
+	for _, c := range chains {
+		if c.Table != nil && c.Table.Name == TableName && c.Name == ChainName {
+			chain = c
+			break
+		}
+	}
+	if chain == nil {
+		return fmt.Errorf("chain %s/%s not found", TableName, ChainName)
+	}
+
+	installed, err := conn.GetRules(table, chain)
+	if err != nil {
+		return fmt.Errorf("reading nftables rules: %w", err)
+	}
+
+	return compare(chain, installed, rules)
+}
+
+// baseChain is the input chain Apply installs and Verify expects
+func baseChain(table *nftables.Table) *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return &nftables.Chain{
+		Name:     ChainName,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}
+}
+
+// compare checks the chain's hook, priority and policy and that the installed
+// rules carry the expected expressions in the expected order
+//
+// Comments alone aren't enough: a rule edited in place or reordered keeps its
+// comment but changes what it matches.
+func compare(chain *nftables.Chain, installed []*nftables.Rule, rules Rules) error {
+	want := baseChain(chain.Table)
+	if chain.Type != want.Type {
+		return fmt.Errorf("chain %s/%s has type %q, want %q", TableName, ChainName, chain.Type, want.Type)
+	}
+	if chain.Hooknum == nil || *chain.Hooknum != *want.Hooknum {
+		return fmt.Errorf("chain %s/%s is not hooked into input", TableName, ChainName)
+	}
+	if chain.Priority == nil || *chain.Priority != *want.Priority {
+		return fmt.Errorf("chain %s/%s does not have filter priority", TableName, ChainName)
+	}
+	if chain.Policy == nil || *chain.Policy != *want.Policy {
+		return fmt.Errorf("chain %s/%s does not have accept policy", TableName, ChainName)
+	}
+
+	expected := buildRules(rules)
+	if len(installed) != len(expected) {
+		return fmt.Errorf("%d rules installed in %s/%s, want %d", len(installed), TableName, ChainName, len(expected))
+	}
+	for i, r := range installed {
+		comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+		if comment != expected[i].comment {
+			return fmt.Errorf("rule %d is %q, want %q", i, comment, expected[i].comment)
+		}
+		if !equalExprs(r.Exprs, expected[i].exprs) {
+			return fmt.Errorf("rule %d (%s) does not match its expected expressions", i, comment)
+		}
+	}
+	return nil
+}
+
+// equalExprs compares expressions by their netlink encoding, which is what
+// the kernel evaluates and is stable across a read back
+func equalExprs(got, want []expr.Any) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	family := byte(nftables.TableFamilyINet)
+	for i := range got {
+		g, err := expr.Marshal(family, got[i])
+		if err != nil {
+			return false
+		}
+		w, err := expr.Marshal(family, want[i])
+		if err != nil {
+			return false
+		}
+		if !bytes.Equal(g, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// rule is a single nftables rule with the comment used to verify it
+type rule struct {
+	comment string
+	exprs   []expr.Any
+}
+
+// buildRules expands Rules into the validation rule, then accept rules for
+// allowed sources followed by a drop rule for each port. Order matters: the
+// accepts must come before their port's drop.
+func buildRules(rules Rules) []rule {
+	ret := []rule{{
+		comment: fmt.Sprintf("reject tcp/%d to %s", ValidationAddr.Port(), ValidationAddr.Addr()),
+		exprs:   rejectValidation(),
+	}}
+	sources := slices.Concat(loopbackPrefixes, rules.Allowed)
+	for _, port := range rules.Ports {
+		for _, prefix := range sources {
+			ret = append(ret, rule{
+				comment: fmt.Sprintf("accept tcp/%d from %s", port, prefix),
+				exprs:   acceptFromPrefix(port, prefix),
+			})
+		}
+		ret = append(ret, rule{
+			comment: fmt.Sprintf("drop tcp/%d", port),
+			exprs:   append(matchTCPPort(port), &expr.Verdict{Kind: expr.VerdictDrop}),
+		})
+	}
+	return ret
+}
+
+// matchTCPPort returns expressions matching TCP packets to the given destination port
+func matchTCPPort(port uint16) []expr.Any {
+	dport := make([]byte, 2)
+	binary.BigEndian.PutUint16(dport, port)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: dport},
+	}
+}
+
+// rejectValidation returns expressions answering TCP connections to
+// ValidationAddr with a reset
+func rejectValidation() []expr.Any {
+	ret := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+	}
+	ret = append(ret, matchTCPPort(ValidationAddr.Port())...)
+	return append(ret,
+		// IPv4 destination address
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ValidationAddr.Addr().AsSlice()},
+		&expr.Reject{Type: unix.NFT_REJECT_TCP_RST},
+	)
+}
+
+// acceptFromPrefix returns expressions accepting TCP traffic to port from the prefix
+func acceptFromPrefix(port uint16, prefix netip.Prefix) []expr.Any {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+
+	nfproto := byte(unix.NFPROTO_IPV4)
+	offset := uint32(12) // IPv4 source address
+	if addr.Is6() {
+		nfproto = unix.NFPROTO_IPV6
+		offset = 8 // IPv6 source address
+	}
+	addrBytes := addr.AsSlice()
+	length := uint32(len(addrBytes))
+
+	ret := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+	}
+	ret = append(ret, matchTCPPort(port)...)
+	ret = append(ret, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length})
+	if prefix.Bits() < addr.BitLen() {
+		ret = append(ret, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            length,
+			Mask:           prefixMask(prefix.Bits(), int(length)),
+			Xor:            make([]byte, length),
+		})
+	}
+	ret = append(ret,
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addrBytes},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+	return ret
+}
+
+// prefixMask returns a network mask of the given prefix length
+func prefixMask(bits, length int) []byte {
+	mask := make([]byte, length)
+	for i := 0; i < bits; i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+	return mask
+}
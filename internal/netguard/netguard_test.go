@@ -0,0 +1,238 @@
+package netguard
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// TestParsePorts tests port list parsing and validation
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   string
+		want    []uint16
+		wantErr string
+	}{
+		{name: "single", ports: "8080", want: []uint16{8080}},
+		{name: "several with spaces", ports: " 8080, 9090 ,", want: []uint16{8080, 9090}},
+		{name: "empty", ports: "", wantErr: "no ports"},
+		{name: "zero", ports: "0", wantErr: `invalid port "0"`},
+		{name: "out of range", ports: "65536", wantErr: `invalid port "65536"`},
+		{name: "not a number", ports: "http", wantErr: `invalid port "http"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePorts(tt.ports)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParsePorts() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePorts() error = %v", err)
+			}
+			if !slices.Equal(got.Ports, tt.want) {
+				t.Errorf("ParsePorts() = %v, want %v", got.Ports, tt.want)
+			}
+		})
+	}
+}
+
+// TestParsePrefixes tests CIDR and bare address parsing
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes string
+		want     []string
+		wantErr  string
+	}{
+		{name: "empty", prefixes: "", want: nil},
+		{name: "bare ipv4", prefixes: "10.0.0.5", want: []string{"10.0.0.5/32"}},
+		{name: "bare ipv6", prefixes: "fd00::1", want: []string{"fd00::1/128"}},
+		{name: "cidrs masked", prefixes: "10.42.1.7/16, fd00::5/64", want: []string{"10.42.0.0/16", "fd00::/64"}},
+		{name: "bad address", prefixes: "10.0.0", wantErr: `invalid address "10.0.0"`},
+		{name: "bad prefix", prefixes: "10.0.0.0/33", wantErr: `invalid prefix "10.0.0.0/33"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePrefixes(tt.prefixes)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParsePrefixes() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePrefixes() error = %v", err)
+			}
+			var strs []string
+			for _, p := range got {
+				strs = append(strs, p.String())
+			}
+			if !slices.Equal(strs, tt.want) {
+				t.Errorf("ParsePrefixes() = %v, want %v", strs, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildRules tests that accepts precede each port's drop and that
+// prefixes get a mask only when they aren't single hosts
+func TestBuildRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        Rules
+		wantComments []string
+		wantBitwise  []bool
+	}{
+		{
+			name:  "loopback only",
+			rules: Rules{Ports: []uint16{8080}},
+			wantComments: []string{
+				"reject tcp/4179 to 127.0.0.254",
+				"accept tcp/8080 from 127.0.0.1/32",
+				"accept tcp/8080 from ::1/128",
+				"drop tcp/8080",
+			},
+			wantBitwise: []bool{false, false, false, false},
+		},
+		{
+			name: "allowed sources and two ports",
+			rules: Rules{
+				Ports:   []uint16{8080, 9090},
+				Allowed: []netip.Prefix{netip.MustParsePrefix("10.0.0.5/32"), netip.MustParsePrefix("10.42.0.0/16")},
+			},
+			wantComments: []string{
+				"reject tcp/4179 to 127.0.0.254",
+				"accept tcp/8080 from 127.0.0.1/32",
+				"accept tcp/8080 from ::1/128",
+				"accept tcp/8080 from 10.0.0.5/32",
+				"accept tcp/8080 from 10.42.0.0/16",
+				"drop tcp/8080",
+				"accept tcp/9090 from 127.0.0.1/32",
+				"accept tcp/9090 from ::1/128",
+				"accept tcp/9090 from 10.0.0.5/32",
+				"accept tcp/9090 from 10.42.0.0/16",
+				"drop tcp/9090",
+			},
+			wantBitwise: []bool{false, false, false, false, true, false, false, false, false, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildRules(tt.rules)
+			var comments []string
+			for _, r := range got {
+				comments = append(comments, r.comment)
+			}
+			if !slices.Equal(comments, tt.wantComments) {
+				t.Fatalf("buildRules() = %v, want %v", comments, tt.wantComments)
+			}
+			for i, r := range got {
+				last := r.exprs[len(r.exprs)-1]
+				if strings.HasPrefix(r.comment, "reject") {
+					if reject, ok := last.(*expr.Reject); !ok || reject.Type != unix.NFT_REJECT_TCP_RST {
+						t.Errorf("rule %q ends in %+v, want tcp reset", r.comment, last)
+					}
+				} else {
+					verdict, ok := last.(*expr.Verdict)
+					wantKind := expr.VerdictAccept
+					if strings.HasPrefix(r.comment, "drop") {
+						wantKind = expr.VerdictDrop
+					}
+					if !ok || verdict.Kind != wantKind {
+						t.Errorf("rule %q ends in %+v, want verdict %v", r.comment, last, wantKind)
+					}
+				}
+				hasBitwise := slices.ContainsFunc(r.exprs, func(e expr.Any) bool {
+					_, ok := e.(*expr.Bitwise)
+					return ok
+				})
+				if hasBitwise != tt.wantBitwise[i] {
+					t.Errorf("rule %q bitwise = %v, want %v", r.comment, hasBitwise, tt.wantBitwise[i])
+				}
+			}
+		})
+	}
+}
+
+// installedRules renders rules the way GetRules returns them
+func installedRules(rules Rules) []*nftables.Rule {
+	var ret []*nftables.Rule
+	for _, r := range buildRules(rules) {
+		ret = append(ret, &nftables.Rule{
+			Exprs:    r.exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, r.comment),
+		})
+	}
+	return ret
+}
+
+// TestCompare tests that Verify catches chain and rule changes that keep the comments intact
+func TestCompare(t *testing.T) {
+	table := &nftables.Table{Name: TableName, Family: nftables.TableFamilyINet}
+	rules := Rules{Ports: []uint16{8080}, Allowed: []netip.Prefix{netip.MustParsePrefix("10.42.0.0/16")}}
+
+	drop := nftables.ChainPolicyDrop
+	output := nftables.ChainHookOutput
+	priority := nftables.ChainPriorityMangle
+
+	tests := []struct {
+		name    string
+		chain   func(c *nftables.Chain)
+		rules   func(r []*nftables.Rule) []*nftables.Rule
+		wantErr string
+	}{
+		{name: "match"},
+		{name: "policy", chain: func(c *nftables.Chain) { c.Policy = &drop }, wantErr: "accept policy"},
+		{name: "hook", chain: func(c *nftables.Chain) { c.Hooknum = output }, wantErr: "hooked into input"},
+		{name: "priority", chain: func(c *nftables.Chain) { c.Priority = priority }, wantErr: "filter priority"},
+		{name: "missing rule", rules: func(r []*nftables.Rule) []*nftables.Rule { return r[1:] }, wantErr: "4 rules installed"},
+		{
+			name: "reordered",
+			rules: func(r []*nftables.Rule) []*nftables.Rule {
+				r[0], r[len(r)-1] = r[len(r)-1], r[0]
+				return r
+			},
+			wantErr: "rule 0",
+		},
+		{
+			name: "exprs changed under the same comment",
+			rules: func(r []*nftables.Rule) []*nftables.Rule {
+				r[3].Exprs = acceptFromPrefix(8080, netip.MustParsePrefix("0.0.0.0/0"))
+				return r
+			},
+			wantErr: "rule 3 (accept tcp/8080 from 10.42.0.0/16)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := baseChain(table)
+			if tt.chain != nil {
+				tt.chain(chain)
+			}
+			installed := installedRules(rules)
+			if tt.rules != nil {
+				installed = tt.rules(installed)
+			}
+			err := compare(chain, installed, rules)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("compare() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("compare() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package nsdefaults
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// Lister returns the oauth2-proxy annotations set on a Namespace
+//
+// They apply to every pod in the namespace beneath the pod's own, e.g.
+// enabled, config or allowed-groups as namespace-wide defaults.
+type Lister interface {
+	// Annotations returns the namespace's prefixed annotations with its spec
+	// expanded, nil if it has none
+	Annotations(namespace string) (map[string]string, error)
+}
+
+// InformerLister implements Lister from a Namespace informer
+//
+// Every admission reads its namespace, so they are watched rather than
+// fetched. A namespace the informer hasn't seen yet has no defaults.
+type InformerLister struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.NamespaceLister
+	synced  cache.InformerSynced
+}
+
+// NewInformerLister creates a Lister; call Start before using it
+func NewInformerLister(client kubernetes.Interface, resync time.Duration) *InformerLister {
+	factory := informers.NewSharedInformerFactory(client, resync)
+	namespaces := factory.Core().V1().Namespaces()
+	return &InformerLister{
+		factory: factory,
+		lister:  namespaces.Lister(),
+		synced:  namespaces.Informer().HasSynced,
+	}
+}
+
+// Start runs the informer until ctx is done and waits up to timeout for its
+// initial list, e.g. failing fast when list or watch on namespaces is denied
+func (l *InformerLister) Start(ctx context.Context, timeout time.Duration) error {
+	l.factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), l.synced) {
+		return fmt.Errorf("namespace cache did not sync within %s", timeout)
+	}
+	return nil
+}
+
+// Namespaces returns the informer's lister, e.g. to read namespace labels
+// for Pod Security checks without a Get per admission
+func (l *InformerLister) Namespaces() corelisters.NamespaceLister {
+	return l.lister
+}
+
+// Annotations implements Lister
+func (l *InformerLister) Annotations(namespace string) (map[string]string, error) {
+	ns, err := l.lister.Get(namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+
+	ret, err := annotation.ExpandSpec(annotation.Inherit(ns.Annotations, nil))
+	if err != nil {
+		return nil, fmt.Errorf("namespace %s: %w", namespace, err)
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return ret, nil
+}
@@ -0,0 +1,64 @@
+package nsdefaults
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// TestAnnotations tests that only prefixed annotations are returned
+func TestAnnotations(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: map[string]string{
+			annotation.KeyEnabled: "true",
+			"owner":               "team",
+		}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain", Annotations: map[string]string{"owner": "plain"}}},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lister := NewInformerLister(client, 0)
+	if err := lister.Start(ctx, time.Minute); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	tests := []struct {
+		namespace string
+		want      map[string]string
+	}{
+		{namespace: "team", want: map[string]string{annotation.KeyEnabled: "true"}},
+		{namespace: "plain", want: nil},
+		{namespace: "missing", want: nil},
+	}
+	for _, tt := range tests {
+		got, err := lister.Annotations(tt.namespace)
+		if err != nil {
+			t.Fatalf("Annotations(%s) error = %v", tt.namespace, err)
+		}
+		if len(got) != len(tt.want) || got[annotation.KeyEnabled] != tt.want[annotation.KeyEnabled] {
+			t.Errorf("Annotations(%s) = %v, want %v", tt.namespace, got, tt.want)
+		}
+	}
+}
+
+// TestStart_Timeout tests that Start fails when namespaces can't be listed
+func TestStart_Timeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("namespaces is forbidden")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := NewInformerLister(client, 0).Start(ctx, 100*time.Millisecond); err == nil {
+		t.Error("Start() error = nil, want timeout")
+	}
+}
@@ -0,0 +1,233 @@
+package owner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/metadata"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// Ref identifies the top-level workload that owns a pod
+type Ref struct {
+	// APIVersion is the owner's API version, e.g. "apps/v1"
+	APIVersion string
+
+	// Kind is the owner kind, e.g. "Deployment", "StatefulSet"
+	// Empty for bare pods
+	Kind string
+
+	// Name is the owner name, or the pod name for bare pods
+	Name string
+
+	// Namespace is the pod's namespace
+	Namespace string
+
+	// UID is the owner's UID, empty for bare pods
+	UID types.UID
+}
+
+// String returns Kind/Namespace/Name, used as a map key and in logs
+func (r Ref) String() string {
+	return fmt.Sprintf("%s/%s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// WorkloadName returns a name for per-workload objects like generated Secrets
+// Bare pods created with generateName have no name yet, so the prefix is used.
+func WorkloadName(ref Ref, pod *corev1.Pod) string {
+	if ref.Name != "" {
+		return ref.Name
+	}
+	return strings.TrimSuffix(pod.GenerateName, "-")
+}
+
+// Resolver finds the workload that owns a pod
+type Resolver interface {
+	// Resolve walks the pod's controller references up to the top-level workload
+	// Pods without a controller resolve to themselves with an empty Kind
+	Resolve(ctx context.Context, pod *corev1.Pod) (Ref, error)
+
+	// Annotations returns the annotations of every controller above the pod,
+	// merged so that owners nearer the pod win over those further up
+	// Pods without a controller return nil
+	Annotations(ctx context.Context, pod *corev1.Pod) (map[string]string, error)
+}
+
+// ownerResources maps the controller kinds that are followed to their resources
+// Any other kind ends the walk.
+var ownerResources = map[schema.GroupKind]schema.GroupVersionResource{
+	{Group: "apps", Kind: "ReplicaSet"}:                   {Group: "apps", Version: "v1", Resource: "replicasets"},
+	{Group: "apps", Kind: "Deployment"}:                   {Group: "apps", Version: "v1", Resource: "deployments"},
+	{Group: "apps", Kind: "StatefulSet"}:                  {Group: "apps", Version: "v1", Resource: "statefulsets"},
+	{Group: "apps", Kind: "DaemonSet"}:                    {Group: "apps", Version: "v1", Resource: "daemonsets"},
+	{Group: "batch", Kind: "Job"}:                         {Group: "batch", Version: "v1", Resource: "jobs"},
+	{Group: "serving.knative.dev", Kind: "Revision"}:      {Group: "serving.knative.dev", Version: "v1", Resource: "revisions"},
+	{Group: "serving.knative.dev", Kind: "Configuration"}: {Group: "serving.knative.dev", Version: "v1", Resource: "configurations"},
+	{Group: "serving.knative.dev", Kind: "Service"}:       {Group: "serving.knative.dev", Version: "v1", Resource: "services"},
+}
+
+// maxOwnerDepth bounds the walk; Knative's Pod -> ReplicaSet -> Deployment ->
+// Revision -> Configuration -> Service is the longest chain followed
+const maxOwnerDepth = 8
+
+// maxCacheEntries is the cache size above which expired entries are swept
+const maxCacheEntries = 1024
+
+// cachedOwner is what is kept of an owner object between lookups
+type cachedOwner struct {
+	// found is false when the owner no longer exists
+	found       bool
+	annotations map[string]string
+	controller  *metav1.OwnerReference
+	expires     time.Time
+}
+
+// ClientResolver implements Resolver using the Kubernetes metadata API
+//
+// Owners are cached by UID for ttl, so a burst of pods from one rollout costs
+// one lookup per owner. Annotation changes on an owner are seen after at most ttl.
+type ClientResolver struct {
+	client metadata.Interface
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[types.UID]cachedOwner
+}
+
+// NewResolver creates a Resolver backed by the given metadata client
+// ttl of 0 disables caching
+func NewResolver(client metadata.Interface, ttl time.Duration) *ClientResolver {
+	return &ClientResolver{
+		client: client,
+		ttl:    ttl,
+		cache:  make(map[types.UID]cachedOwner),
+	}
+}
+
+// Resolve follows Pod -> ReplicaSet -> Deployment, stopping at any other kind
+func (r *ClientResolver) Resolve(ctx context.Context, pod *corev1.Pod) (Ref, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return Ref{Name: pod.Name, Namespace: pod.Namespace}, nil
+	}
+
+	if ref.Kind != "ReplicaSet" {
+		return refFrom(ref, pod.Namespace), nil
+	}
+
+	rs, err := r.get(ctx, ref, pod.Namespace)
+	if err != nil {
+		return Ref{}, err
+	}
+	if !rs.found {
+		return Ref{}, fmt.Errorf("ReplicaSet %s/%s not found", pod.Namespace, ref.Name)
+	}
+
+	if rs.controller != nil {
+		return refFrom(rs.controller, pod.Namespace), nil
+	}
+	return refFrom(ref, pod.Namespace), nil
+}
+
+// Annotations follows controller references through ownerResources
+// Each owner's spec annotation is expanded before layering, so a nearer owner
+// overrides single fields of a further owner's spec rather than all of it.
+func (r *ClientResolver) Annotations(ctx context.Context, pod *corev1.Pod) (map[string]string, error) {
+	var chain []map[string]string
+	ref := metav1.GetControllerOf(pod)
+	for depth := 0; ref != nil && depth < maxOwnerDepth; depth++ {
+		owner, err := r.get(ctx, ref, pod.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !owner.found {
+			break
+		}
+		annotations, err := annotation.ExpandSpec(owner.annotations)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s/%s: %w", ref.Kind, pod.Namespace, ref.Name, err)
+		}
+		chain = append(chain, annotations)
+		ref = owner.controller
+	}
+
+	var ret map[string]string
+	for i := len(chain) - 1; i >= 0; i-- {
+		for k, v := range chain[i] {
+			if ret == nil {
+				ret = make(map[string]string)
+			}
+			ret[k] = v
+		}
+	}
+	return ret, nil
+}
+
+// get returns the owner ref points at, from the cache if fresh
+// Kinds outside ownerResources and deleted owners come back not found.
+func (r *ClientResolver) get(ctx context.Context, ref *metav1.OwnerReference, namespace string) (cachedOwner, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return cachedOwner{}, nil
+	}
+	gvr, ok := ownerResources[schema.GroupKind{Group: gv.Group, Kind: ref.Kind}]
+	if !ok {
+		return cachedOwner{}, nil
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	cached, ok := r.cache[ref.UID]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	obj, err := r.client.Resource(gvr).Namespace(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		cached = cachedOwner{}
+	case err != nil:
+		return cachedOwner{}, fmt.Errorf("failed to get %s %s/%s: %w", ref.Kind, namespace, ref.Name, err)
+	case obj.UID != ref.UID:
+		// Deleted and recreated under the same name, not our owner any more
+		cached = cachedOwner{}
+	default:
+		cached = cachedOwner{found: true, annotations: obj.Annotations, controller: metav1.GetControllerOf(obj)}
+	}
+
+	if r.ttl > 0 && ref.UID != "" {
+		cached.expires = now.Add(r.ttl)
+		r.mu.Lock()
+		if len(r.cache) >= maxCacheEntries {
+			for uid, e := range r.cache {
+				if !now.Before(e.expires) {
+					delete(r.cache, uid)
+				}
+			}
+		}
+		r.cache[ref.UID] = cached
+		r.mu.Unlock()
+	}
+	return cached, nil
+}
+
+// refFrom converts an OwnerReference into a Ref
+func refFrom(ref *metav1.OwnerReference, namespace string) Ref {
+	return Ref{
+		APIVersion: ref.APIVersion,
+		Kind:       ref.Kind,
+		Name:       ref.Name,
+		Namespace:  namespace,
+		UID:        ref.UID,
+	}
+}
@@ -0,0 +1,86 @@
+package owner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// object builds owner metadata controlled by the next object up the chain
+func object(apiVersion, kind, name string, annotations map[string]string, controller *metav1.PartialObjectMetadata) *metav1.PartialObjectMetadata {
+	obj := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: kind},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "apps",
+			UID:         types.UID(kind + "-" + name),
+			Annotations: annotations,
+		},
+	}
+	if controller != nil {
+		obj.OwnerReferences = []metav1.OwnerReference{controllerRef(controller)}
+	}
+	return obj
+}
+
+func controllerRef(obj *metav1.PartialObjectMetadata) metav1.OwnerReference {
+	isController := true
+	return metav1.OwnerReference{APIVersion: obj.APIVersion, Kind: obj.Kind, Name: obj.Name, UID: obj.UID, Controller: &isController}
+}
+
+// TestAnnotations tests layering along a Knative chain and caching by UID
+func TestAnnotations(t *testing.T) {
+	service := object("serving.knative.dev/v1", "Service", "web", map[string]string{"a": "service", "b": "service"}, nil)
+	configuration := object("serving.knative.dev/v1", "Configuration", "web", nil, service)
+	revision := object("serving.knative.dev/v1", "Revision", "web-00001", map[string]string{"b": "revision"}, configuration)
+	deployment := object("apps/v1", "Deployment", "web-00001-deployment", nil, revision)
+	replicaSet := object("apps/v1", "ReplicaSet", "web-00001-deployment-abc", nil, deployment)
+
+	scheme := metadatafake.NewTestScheme()
+	metav1.AddMetaToScheme(scheme)
+	client := metadatafake.NewSimpleMetadataClient(scheme, service, configuration, revision, deployment, replicaSet)
+	gets := 0
+	client.PrependReactor("get", "*", func(clienttesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "apps",
+		OwnerReferences: []metav1.OwnerReference{controllerRef(replicaSet)},
+	}}
+
+	resolver := NewResolver(client, time.Minute)
+	for i := 0; i < 2; i++ {
+		got, err := resolver.Annotations(context.Background(), pod)
+		if err != nil {
+			t.Fatalf("Annotations() error = %v", err)
+		}
+		if got["a"] != "service" || got["b"] != "revision" {
+			t.Errorf("Annotations() = %v, want a from the Service and b from the nearer Revision", got)
+		}
+	}
+	if gets != 5 {
+		t.Errorf("gets = %d, want 5 (one per owner, second walk cached)", gets)
+	}
+
+	ref, err := resolver.Resolve(context.Background(), pod)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if ref.Kind != "Deployment" || gets != 5 {
+		t.Errorf("Resolve() = %v after %d gets, want the cached Deployment", ref, gets)
+	}
+
+	bare := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "bare"}}
+	if got, err := resolver.Annotations(context.Background(), bare); err != nil || got != nil {
+		t.Errorf("Annotations(bare pod) = %v, %v, want nil, nil", got, err)
+	}
+}
@@ -0,0 +1,168 @@
+package registration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is the RFC 7591 client metadata sent to the registration endpoint
+type Request struct {
+	ClientName              string   `json:"client_name,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+// Response is the RFC 7591 client information response
+// Only the fields the injector stores are decoded.
+type Response struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
+// Client registers OAuth clients at an OIDC issuer's registration endpoint
+type Client struct {
+	httpClient *http.Client
+
+	// initialAccessToken is sent as a bearer token if set
+	// Keycloak requires one unless anonymous registration is allowed
+	initialAccessToken string
+
+	// endpoints caches registration endpoints by issuer URL
+	mu        sync.Mutex
+	endpoints map[string]string
+}
+
+// NewClient creates a registration Client
+// httpClient may be nil to use a client with a 10 second timeout.
+func NewClient(httpClient *http.Client, initialAccessToken string) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		httpClient:         httpClient,
+		initialAccessToken: initialAccessToken,
+		endpoints:          make(map[string]string),
+	}
+}
+
+// Register creates a client at the issuer's registration endpoint
+func (c *Client) Register(ctx context.Context, issuer string, req Request) (*Response, error) {
+	endpoint, err := c.registrationEndpoint(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	if c.initialAccessToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.initialAccessToken)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("registration request to %s failed: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	// RFC 7591 3.2.1: success is 201 Created
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registration at %s failed: %s: %s", endpoint, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var ret Response
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("invalid registration response from %s: %w", endpoint, err)
+	}
+	if ret.ClientID == "" {
+		return nil, fmt.Errorf("registration response from %s has no client_id", endpoint)
+	}
+	return &ret, nil
+}
+
+// Deregister deletes a registered client (RFC 7592 section 2.3) using the
+// registration_client_uri and registration_access_token it was registered with
+func (c *Client) Deregister(ctx context.Context, resp *Response) error {
+	if resp.RegistrationClientURI == "" || resp.RegistrationAccessToken == "" {
+		return fmt.Errorf("issuer returned no registration_client_uri or registration_access_token for client %s", resp.ClientID)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodDelete, resp.RegistrationClientURI, nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+resp.RegistrationAccessToken)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("deregistration request to %s failed: %w", resp.RegistrationClientURI, err)
+	}
+	defer httpResp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	// RFC 7592 2.3: success is 204 No Content
+	if httpResp.StatusCode != http.StatusNoContent && httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deregistration at %s failed: %s: %s", resp.RegistrationClientURI, httpResp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// registrationEndpoint reads registration_endpoint from the issuer's discovery document
+func (c *Client) registrationEndpoint(ctx context.Context, issuer string) (string, error) {
+	c.mu.Lock()
+	endpoint, ok := c.endpoints[issuer]
+	c.mu.Unlock()
+	if ok {
+		return endpoint, nil
+	}
+
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("discovery request to %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discovery at %s failed: %s", url, resp.Status)
+	}
+
+	var doc struct {
+		RegistrationEndpoint string `json:"registration_endpoint"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return "", fmt.Errorf("invalid discovery document at %s: %w", url, err)
+	}
+	if doc.RegistrationEndpoint == "" {
+		return "", fmt.Errorf("issuer %s does not advertise a registration_endpoint", issuer)
+	}
+
+	c.mu.Lock()
+	c.endpoints[issuer] = doc.RegistrationEndpoint
+	c.mu.Unlock()
+	return doc.RegistrationEndpoint, nil
+}
@@ -0,0 +1,234 @@
+package registration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+)
+
+// fakeIssuer is a stand-in OIDC issuer with a registration endpoint
+type fakeIssuer struct {
+	server *httptest.Server
+	// token is the initial access token the endpoint requires, if set
+	token string
+	// received is the last registration request
+	received *Request
+	// registrations counts successful registrations
+	registrations int
+	// deletions counts clients deleted through their registration_client_uri
+	deletions int
+}
+
+func newFakeIssuer(t *testing.T, token string) *fakeIssuer {
+	f := &fakeIssuer{token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                f.server.URL,
+			"registration_endpoint": f.server.URL + "/register",
+		})
+	})
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid_client_metadata"}`, http.StatusBadRequest)
+			return
+		}
+		f.received = &req
+		f.registrations++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Response{
+			ClientID:                "generated-client",
+			ClientSecret:            "generated-secret",
+			RegistrationAccessToken: "rat",
+			RegistrationClientURI:   f.server.URL + "/register/generated-client",
+		})
+	})
+	mux.HandleFunc("/register/generated-client", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.Header.Get("Authorization") != "Bearer rat" {
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+		f.deletions++
+		w.WriteHeader(http.StatusNoContent)
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// TestRegister_Success tests discovery, the bearer token and the request body
+func TestRegister_Success(t *testing.T) {
+	issuer := newFakeIssuer(t, "initial-token")
+	client := NewClient(issuer.server.Client(), "initial-token")
+
+	resp, err := client.Register(context.Background(), issuer.server.URL, Request{
+		ClientName:   "ns/app",
+		RedirectURIs: []string{"https://app.example.com/oauth2/callback"},
+		Scope:        "openid email",
+	})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if resp.ClientID != "generated-client" || resp.ClientSecret != "generated-secret" {
+		t.Errorf("Register() = %+v, want generated-client/generated-secret", resp)
+	}
+	if issuer.received == nil || issuer.received.RedirectURIs[0] != "https://app.example.com/oauth2/callback" {
+		t.Errorf("registration request = %+v, want redirect URI passed through", issuer.received)
+	}
+	if issuer.received.Scope != "openid email" {
+		t.Errorf("registration scope = %q, want %q", issuer.received.Scope, "openid email")
+	}
+}
+
+// TestRegister_Rejected tests that a non-2xx response is returned as an error
+func TestRegister_Rejected(t *testing.T) {
+	issuer := newFakeIssuer(t, "initial-token")
+	client := NewClient(issuer.server.Client(), "wrong-token")
+
+	if _, err := client.Register(context.Background(), issuer.server.URL, Request{RedirectURIs: []string{"https://x"}}); err == nil {
+		t.Fatal("Register() with wrong token succeeded, want error")
+	}
+}
+
+// TestRegister_NoRegistrationEndpoint tests issuers without dynamic registration
+func TestRegister_NoRegistrationEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": "x"})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "")
+	if _, err := client.Register(context.Background(), server.URL, Request{RedirectURIs: []string{"https://x"}}); err == nil {
+		t.Fatal("Register() without registration_endpoint succeeded, want error")
+	}
+}
+
+// stubResolver returns a fixed EffectiveConfig
+type stubResolver struct {
+	cfg *config.EffectiveConfig
+}
+
+func (s *stubResolver) ResolveConfig(ctx context.Context, pod *corev1.Pod) (*config.EffectiveConfig, error) {
+	return s.cfg, nil
+}
+
+// dynamicResolver resolves every pod to a dynamically registered client at issuer
+func dynamicResolver(issuer *fakeIssuer) *stubResolver {
+	return &stubResolver{cfg: &config.EffectiveConfig{
+		DynamicClientRegistration: true,
+		OIDCIssuerURL:             config.SourcedValue{Value: issuer.server.URL, Source: annotation.ValueSourceLiteral},
+		RedirectURL:               config.SourcedValue{Value: "https://app.example.com/oauth2/callback", Source: annotation.ValueSourceLiteral},
+		Scope:                     config.SourcedValue{Value: "openid", Source: annotation.ValueSourceLiteral},
+	}}
+}
+
+// TestControllerSync_CreatesSecretOnce tests the controller end to end
+// against the stand-in issuer: one registration, stored once, never repeated
+func TestControllerSync_CreatesSecretOnce(t *testing.T) {
+	issuer := newFakeIssuer(t, "")
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team", UID: "uid-1"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+					annotation.KeyEnabled:            "true",
+					annotation.KeyClientRegistration: "dynamic",
+				}},
+			},
+		},
+	}
+	client := fake.NewSimpleClientset(deployment)
+	controller := NewController(client, dynamicResolver(issuer), NewClient(issuer.server.Client(), ""))
+
+	for i := 0; i < 2; i++ {
+		if err := controller.Sync(context.Background()); err != nil {
+			t.Fatalf("Sync() error = %v", err)
+		}
+	}
+
+	if issuer.registrations != 1 {
+		t.Errorf("registrations = %d, want 1", issuer.registrations)
+	}
+	secret, err := client.CoreV1().Secrets("team").Get(context.Background(), "app-oauth2-proxy-client", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("registration secret not created: %v", err)
+	}
+	if secret.StringData[SecretKeyClientID] != "generated-client" || secret.StringData[SecretKeyClientSecret] != "generated-secret" {
+		t.Errorf("secret data = %v, want generated client credentials", secret.StringData)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != "uid-1" {
+		t.Errorf("secret owner = %v, want the Deployment", secret.OwnerReferences)
+	}
+}
+
+// TestControllerSync_ResolvedConfig tests that the effective config, not the
+// template annotation, decides whether a client is registered, e.g. when a
+// rule or the namespace sets client-registration
+func TestControllerSync_ResolvedConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		dynamic     bool
+		want        int
+	}{
+		{name: "set by rule or namespace", annotations: nil, dynamic: true, want: 1},
+		{name: "annotation but not enabled", annotations: map[string]string{annotation.KeyClientRegistration: "dynamic"}, dynamic: false, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newFakeIssuer(t, "")
+			client := fake.NewSimpleClientset(&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team"},
+				Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				}},
+			})
+			resolver := dynamicResolver(issuer)
+			if !tt.dynamic {
+				resolver.cfg = nil
+			}
+			if err := NewController(client, resolver, NewClient(issuer.server.Client(), "")).Sync(context.Background()); err != nil {
+				t.Fatalf("Sync() error = %v", err)
+			}
+			if issuer.registrations != tt.want {
+				t.Errorf("registrations = %d, want %d", issuer.registrations, tt.want)
+			}
+		})
+	}
+}
+
+// TestControllerSync_DeregistersUnstoredClient tests that a client whose
+// Secret can't be created is deleted at the issuer instead of leaked
+func TestControllerSync_DeregistersUnstoredClient(t *testing.T) {
+	issuer := newFakeIssuer(t, "")
+	client := fake.NewSimpleClientset(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team"}})
+	client.PrependReactor("create", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("secrets is forbidden")
+	})
+	controller := NewController(client, dynamicResolver(issuer), NewClient(issuer.server.Client(), ""))
+
+	if err := controller.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if issuer.registrations != 1 || issuer.deletions != 1 {
+		t.Errorf("registrations = %d, deletions = %d, want 1 and 1", issuer.registrations, issuer.deletions)
+	}
+}
@@ -0,0 +1,237 @@
+package registration
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
+	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+)
+
+// Keys in the registration Secret
+// client-id and client-secret match the env-secret keys the sidecar reads.
+const (
+	SecretKeyClientID                = "client-id"
+	SecretKeyClientSecret            = "client-secret"
+	SecretKeyRegistrationAccessToken = "registration-access-token"
+	SecretKeyRegistrationClientURI   = "registration-client-uri"
+)
+
+// ConfigResolver computes the config that would be injected into a pod
+// Implemented by mutation.PodMutator
+type ConfigResolver interface {
+	ResolveConfig(ctx context.Context, pod *corev1.Pod) (*config.EffectiveConfig, error)
+}
+
+// Registrar registers an OAuth client at an issuer
+// Implemented by Client
+type Registrar interface {
+	Register(ctx context.Context, issuer string, req Request) (*Response, error)
+
+	// Deregister deletes a client returned by Register, e.g. when it couldn't be stored
+	Deregister(ctx context.Context, resp *Response) error
+}
+
+// Controller registers a client for every workload whose pods would be
+// injected with client-registration: dynamic and stores it in
+// <workload>-oauth2-proxy-client
+type Controller struct {
+	client    kubernetes.Interface
+	resolver  ConfigResolver
+	registrar Registrar
+}
+
+// NewController creates a client registration controller
+func NewController(client kubernetes.Interface, resolver ConfigResolver, registrar Registrar) *Controller {
+	return &Controller{
+		client:    client,
+		resolver:  resolver,
+		registrar: registrar,
+	}
+}
+
+// workload is the subset of a Deployment or StatefulSet the controller needs
+type workload struct {
+	meta     metav1.ObjectMeta
+	kind     string
+	template corev1.PodTemplateSpec
+}
+
+// Run calls Sync every interval until ctx is cancelled
+func (c *Controller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Sync(ctx); err != nil {
+			registrationErrors.Inc()
+			klog.ErrorS(err, "client registration sync failed")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync registers clients for workloads that don't have a registration Secret yet
+//
+// Registration is create-only: an existing Secret is never overwritten, so
+// deleting it is how a client is re-registered.
+func (c *Controller) Sync(ctx context.Context) error {
+	deployments, err := c.client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+	statefulSets, err := c.client.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list statefulsets: %w", err)
+	}
+
+	var workloads []workload
+	for _, d := range deployments.Items {
+		workloads = append(workloads, workload{meta: d.ObjectMeta, kind: "Deployment", template: d.Spec.Template})
+	}
+	for _, s := range statefulSets.Items {
+		workloads = append(workloads, workload{meta: s.ObjectMeta, kind: "StatefulSet", template: s.Spec.Template})
+	}
+
+	for _, w := range workloads {
+		cfg, err := c.resolve(ctx, w)
+		if err != nil {
+			registrationErrors.Inc()
+			klog.ErrorS(err, "failed to resolve config", "workload", klog.KRef(w.meta.Namespace, w.meta.Name), "kind", w.kind)
+			continue
+		}
+		if cfg == nil || !cfg.DynamicClientRegistration {
+			continue
+		}
+		if err := c.ensure(ctx, w, cfg); err != nil {
+			registrationErrors.Inc()
+			klog.ErrorS(err, "failed to register client", "workload", klog.KRef(w.meta.Namespace, w.meta.Name), "kind", w.kind)
+		}
+	}
+
+	return nil
+}
+
+// resolve returns exactly what the webhook would inject into a pod from w's
+// template, nil if it wouldn't inject, so client-registration set by a rule,
+// the namespace or the ConfigMap is honoured as at admission
+func (c *Controller) resolve(ctx context.Context, w workload) (*config.EffectiveConfig, error) {
+	// Pods inherit the workload's own oauth2-proxy annotations, so the template
+	// does too; the template pod has no owner reference for the resolver to follow
+	inherited, err := annotation.ExpandSpec(w.meta.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := annotation.ExpandSpec(w.template.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: *w.template.ObjectMeta.DeepCopy(),
+		Spec:       *w.template.Spec.DeepCopy(),
+	}
+	pod.Namespace = w.meta.Namespace
+	pod.Annotations = annotation.Inherit(inherited, annotations)
+	return c.resolver.ResolveConfig(ctx, pod)
+}
+
+// ensure registers a client for w unless its Secret already exists
+//
+// A client whose Secret can't be created is deleted again at the issuer, so
+// failed syncs don't leave clients behind that nothing references.
+func (c *Controller) ensure(ctx context.Context, w workload, cfg *config.EffectiveConfig) error {
+	secretName := w.meta.Name + mutation.RegisteredClientSecretSuffix
+	_, err := c.client.CoreV1().Secrets(w.meta.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	req, issuer, err := buildRequest(w, cfg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.registrar.Register(ctx, issuer, req)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: w.meta.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "oauth2-proxy-injector",
+			},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: appsv1.SchemeGroupVersion.String(),
+				Kind:       w.kind,
+				Name:       w.meta.Name,
+				UID:        w.meta.UID,
+			}},
+		},
+		Type: corev1.SecretTypeOpaque,
+		StringData: map[string]string{
+			SecretKeyClientID:     resp.ClientID,
+			SecretKeyClientSecret: resp.ClientSecret,
+		},
+	}
+	if resp.RegistrationAccessToken != "" {
+		secret.StringData[SecretKeyRegistrationAccessToken] = resp.RegistrationAccessToken
+	}
+	if resp.RegistrationClientURI != "" {
+		secret.StringData[SecretKeyRegistrationClientURI] = resp.RegistrationClientURI
+	}
+
+	if _, err := c.client.CoreV1().Secrets(w.meta.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		if derr := c.registrar.Deregister(ctx, resp); derr != nil {
+			return fmt.Errorf("registered client %s but failed to store it: %w; failed to delete it, remove it at the issuer: %v", resp.ClientID, err, derr)
+		}
+		return fmt.Errorf("registered client %s but failed to store it, deleted it again: %w", resp.ClientID, err)
+	}
+
+	registrations.Inc()
+	klog.InfoS("registered client", "workload", klog.KRef(w.meta.Namespace, w.meta.Name), "clientID", resp.ClientID)
+	return nil
+}
+
+// buildRequest builds RFC 7591 client metadata from the workload's effective config
+// Returns the request and the issuer to register at.
+func buildRequest(w workload, cfg *config.EffectiveConfig) (Request, string, error) {
+	if !cfg.OIDCIssuerURL.IsLiteral() || cfg.OIDCIssuerURL.Value == "" {
+		return Request{}, "", fmt.Errorf("client-registration: dynamic requires a literal oidc-issuer-url")
+	}
+	if !cfg.RedirectURL.IsLiteral() || cfg.RedirectURL.Value == "" {
+		return Request{}, "", fmt.Errorf("client-registration: dynamic requires a literal redirect-url")
+	}
+
+	req := Request{
+		ClientName:              w.meta.Namespace + "/" + w.meta.Name,
+		RedirectURIs:            []string{cfg.RedirectURL.Value},
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+		TokenEndpointAuthMethod: "client_secret_basic",
+	}
+	if cfg.Scope.IsLiteral() {
+		req.Scope = cfg.Scope.Value
+	}
+	return req, cfg.OIDCIssuerURL.Value, nil
+}
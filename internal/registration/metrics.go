@@ -0,0 +1,27 @@
+package registration
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "oauth2_proxy_injector"
+
+var (
+	// registrations counts clients registered and stored
+	registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_registrations_total",
+		Help:      "Number of OAuth clients registered via dynamic client registration.",
+	})
+
+	// registrationErrors counts failed syncs and failed registrations
+	registrationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_registration_errors_total",
+		Help:      "Number of errors encountered while registering OAuth clients.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(registrations, registrationErrors)
+}
@@ -0,0 +1,27 @@
+package rules
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "oauth2_proxy_injector"
+
+var (
+	// rulesMatched counts pods matched by each injection rule
+	rulesMatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "injection_rule_matches_total",
+		Help:      "Number of pod admissions matched by each injection rule.",
+	}, []string{"rule"})
+
+	// rulesLoadErrors counts failed reads or parses of the rules ConfigMap
+	rulesLoadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "injection_rules_load_errors_total",
+		Help:      "Number of times the injection rules ConfigMap could not be read or parsed.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(rulesMatched, rulesLoadErrors)
+}
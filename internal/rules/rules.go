@@ -0,0 +1,289 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+)
+
+// DataKey is the key of the rules ConfigMap holding the YAML list of rules
+const DataKey = "rules"
+
+// Rule injects oauth2-proxy into matching pods without annotating them
+type Rule struct {
+	// Name identifies the rule in provenance and logs
+	Name string `json:"name"`
+
+	// PodSelector matches pod labels. nil matches every pod
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// NamespaceSelector matches the labels of the pod's namespace. nil matches every namespace
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Profile is a ConfigMap in the webhook's namespace to inject with
+	// Empty uses the default ConfigMap
+	Profile string `json:"profile,omitempty"`
+
+	// Annotations are applied as if set on the pod, keys without the
+	// spacemule.net/oauth2-proxy. prefix. enabled defaults to "true"
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	podSelector       labels.Selector
+	namespaceSelector labels.Selector
+}
+
+// PodAnnotations returns the rule's settings as full annotation keys
+func (r *Rule) PodAnnotations() map[string]string {
+	ret := map[string]string{annotation.KeyEnabled: "true"}
+	for k, v := range r.Annotations {
+		ret[annotation.AnnotationPrefix+k] = v
+	}
+	if r.Profile != "" {
+		ret[annotation.KeyConfig] = r.Profile
+	}
+	return ret
+}
+
+// Parse reads an ordered list of rules
+//
+// Every rule needs a name and at least one selector, and its annotations must
+// parse like pod annotations would, so mistakes surface when the rules are
+// loaded rather than on the next matching pod.
+func Parse(data string) ([]Rule, error) {
+	var ret []Rule
+	if err := yaml.UnmarshalStrict([]byte(data), &ret); err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+
+	parser := annotation.NewParser()
+	seen := make(map[string]bool)
+	for i := range ret {
+		r := &ret[i]
+		if errs := validation.IsDNS1123Label(r.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("rule %d: invalid name %q: %s", i, r.Name, strings.Join(errs, ", "))
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name", r.Name)
+		}
+		seen[r.Name] = true
+
+		if r.PodSelector == nil && r.NamespaceSelector == nil {
+			return nil, fmt.Errorf("rule %q: podSelector or namespaceSelector required", r.Name)
+		}
+		var err error
+		if r.podSelector, err = selector(r.PodSelector); err != nil {
+			return nil, fmt.Errorf("rule %q: invalid podSelector: %w", r.Name, err)
+		}
+		if r.namespaceSelector, err = selector(r.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("rule %q: invalid namespaceSelector: %w", r.Name, err)
+		}
+
+		for k := range r.Annotations {
+			if strings.Contains(k, "/") {
+				return nil, fmt.Errorf("rule %q: annotation %q must omit the %s prefix", r.Name, k, annotation.AnnotationPrefix)
+			}
+		}
+		prefixed := make(map[string]string, len(r.Annotations))
+		for k, v := range r.Annotations {
+			prefixed[annotation.AnnotationPrefix+k] = v
+		}
+		expanded, err := annotation.ExpandSpec(prefixed)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if _, ok := expanded[annotation.KeyConfig]; ok {
+			return nil, fmt.Errorf("rule %q: use profile instead of the config annotation", r.Name)
+		}
+		if _, err := parser.Parse(r.PodAnnotations()); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return ret, nil
+}
+
+// selector converts s, treating nil as matching everything
+func selector(s *metav1.LabelSelector) (labels.Selector, error) {
+	if s == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(s)
+}
+
+// Matcher finds the injection rule for a pod
+type Matcher interface {
+	// Match returns the first rule matching the pod, nil if none does
+	Match(ctx context.Context, pod *corev1.Pod) (*Rule, error)
+}
+
+// ConfigMapMatcher implements Matcher with rules read from a ConfigMap
+//
+// Rules and namespace labels are cached for ttl since every pod admission is
+// matched. A ConfigMap that fails to parse keeps the last good rules.
+type ConfigMapMatcher struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	ttl       time.Duration
+
+	mu         sync.Mutex
+	rules      []Rule
+	loadedAt   time.Time
+	namespaces map[string]cachedLabels
+
+	// loading is closed when the in-flight ConfigMap read finishes, nil when idle
+	loading chan struct{}
+}
+
+// cachedLabels are a namespace's labels and when they were read
+type cachedLabels struct {
+	labels  labels.Set
+	expires time.Time
+}
+
+// NewConfigMapMatcher creates a Matcher for the rules in namespace/name
+func NewConfigMapMatcher(client kubernetes.Interface, namespace, name string, ttl time.Duration) *ConfigMapMatcher {
+	return &ConfigMapMatcher{
+		client:     client,
+		namespace:  namespace,
+		name:       name,
+		ttl:        ttl,
+		namespaces: make(map[string]cachedLabels),
+	}
+}
+
+// Match evaluates the rules in order against the pod and its namespace labels
+func (m *ConfigMapMatcher) Match(ctx context.Context, pod *corev1.Pod) (*Rule, error) {
+	rules, err := m.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	podLabels := labels.Set(pod.Labels)
+
+	var nsLabels labels.Set
+	for i := range rules {
+		r := &rules[i]
+		if !r.podSelector.Matches(podLabels) {
+			continue
+		}
+		if r.NamespaceSelector != nil && nsLabels == nil {
+			var err error
+			if nsLabels, err = m.namespaceLabels(ctx, pod.Namespace); err != nil {
+				return nil, err
+			}
+		}
+		if r.namespaceSelector.Matches(nsLabels) {
+			rulesMatched.WithLabelValues(r.Name).Inc()
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// load returns the cached rules, re-reading the ConfigMap once they are older than ttl
+//
+// Until the ConfigMap has been read once, errors are returned rather than
+// matching no rules, which would admit pods the rules should inject into.
+// Concurrent callers share one read, and the lock isn't held across it so
+// namespace label lookups aren't stalled behind a slow API server.
+func (m *ConfigMapMatcher) load(ctx context.Context) ([]Rule, error) {
+	m.mu.Lock()
+	for m.loadedAt.IsZero() || time.Since(m.loadedAt) >= m.ttl {
+		if m.loading == nil {
+			return m.fetch(ctx)
+		}
+		// Another admission is already reading the ConfigMap, wait for its result
+		loading := m.loading
+		m.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+	defer m.mu.Unlock()
+	return m.rules, nil
+}
+
+// fetch reads the ConfigMap without holding the lock and swaps the rules in
+// Called with m.mu held; returns with it released.
+func (m *ConfigMapMatcher) fetch(ctx context.Context) ([]Rule, error) {
+	loading := make(chan struct{})
+	m.loading = loading
+	m.mu.Unlock()
+
+	cm, err := m.client.CoreV1().ConfigMaps(m.namespace).Get(ctx, m.name, metav1.GetOptions{})
+
+	m.mu.Lock()
+	defer func() {
+		m.loading = nil
+		close(loading)
+		m.mu.Unlock()
+	}()
+	if apierrors.IsNotFound(err) {
+		m.loadedAt = time.Now()
+		m.rules = nil
+		return nil, nil
+	}
+	if err != nil {
+		rulesLoadErrors.Inc()
+		if m.loadedAt.IsZero() {
+			return nil, fmt.Errorf("failed to read injection rules %s/%s: %w", m.namespace, m.name, err)
+		}
+		m.loadedAt = time.Now()
+		klog.ErrorS(err, "failed to read injection rules, keeping previous rules", "configmap", klog.KRef(m.namespace, m.name))
+		return m.rules, nil
+	}
+	m.loadedAt = time.Now()
+	rules, err := Parse(cm.Data[DataKey])
+	if err != nil {
+		rulesLoadErrors.Inc()
+		klog.ErrorS(err, "invalid injection rules, keeping previous rules", "configmap", klog.KRef(m.namespace, m.name))
+		return m.rules, nil
+	}
+	m.rules = rules
+	return rules, nil
+}
+
+// namespaceLabels returns the namespace's labels, cached for ttl
+func (m *ConfigMapMatcher) namespaceLabels(ctx context.Context, namespace string) (labels.Set, error) {
+	now := time.Now()
+	m.mu.Lock()
+	cached, ok := m.namespaces[namespace]
+	m.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.labels, nil
+	}
+
+	ns, err := m.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+	cached = cachedLabels{labels: labels.Set(ns.Labels), expires: now.Add(m.ttl)}
+	if cached.labels == nil {
+		cached.labels = labels.Set{}
+	}
+
+	m.mu.Lock()
+	for name, e := range m.namespaces {
+		if !now.Before(e.expires) {
+			delete(m.namespaces, name)
+		}
+	}
+	m.namespaces[namespace] = cached
+	m.mu.Unlock()
+	return cached.labels, nil
+}
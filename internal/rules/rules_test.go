@@ -0,0 +1,230 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// TestParse tests rule validation
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			data: `
+- name: grafana
+  podSelector: {matchLabels: {app: grafana}}
+  profile: sso
+  annotations: {protected-port: http}`,
+		},
+		{
+			name:    "no selector",
+			data:    `[{name: all, annotations: {protected-port: http}}]`,
+			wantErr: "podSelector or namespaceSelector required",
+		},
+		{
+			name: "duplicate name",
+			data: `
+- {name: a, podSelector: {matchLabels: {app: a}}}
+- {name: a, podSelector: {matchLabels: {app: b}}}`,
+			wantErr: "duplicate name",
+		},
+		{
+			name:    "prefixed annotation",
+			data:    `[{name: a, podSelector: {}, annotations: {spacemule.net/oauth2-proxy.protected-port: http}}]`,
+			wantErr: "must omit",
+		},
+		{
+			name:    "config annotation",
+			data:    `[{name: a, podSelector: {}, annotations: {config: sso}}]`,
+			wantErr: "use profile",
+		},
+		{
+			name:    "config in spec",
+			data:    `[{name: a, podSelector: {}, annotations: {spec: "{config: sso}"}}]`,
+			wantErr: "use profile",
+		},
+		{
+			name:    "invalid annotation value",
+			data:    `[{name: a, podSelector: {}, annotations: {upstream-tls: maybe}}]`,
+			wantErr: `rule "a"`,
+		},
+		{
+			name:    "unknown field",
+			data:    `[{name: a, podSelector: {}, selector: {}}]`,
+			wantErr: "invalid rules",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Parse() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestMatch tests first-match ordering and namespace selectors
+func TestMatch(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "rules", Namespace: "system"},
+		Data: map[string]string{DataKey: `
+- name: team-x-grafana
+  podSelector: {matchLabels: {app: grafana}}
+  namespaceSelector: {matchLabels: {team: x}}
+- name: grafana
+  podSelector: {matchLabels: {app: grafana}}
+`},
+	}
+	client := fake.NewSimpleClientset(cm,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "x", Labels: map[string]string{"team": "x"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "y"}},
+	)
+	matcher := NewConfigMapMatcher(client, "system", "rules", time.Minute)
+
+	tests := []struct {
+		namespace string
+		labels    map[string]string
+		want      string
+	}{
+		{namespace: "x", labels: map[string]string{"app": "grafana"}, want: "team-x-grafana"},
+		{namespace: "y", labels: map[string]string{"app": "grafana"}, want: "grafana"},
+		{namespace: "x", labels: map[string]string{"app": "loki"}, want: ""},
+	}
+	for _, tt := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Labels: tt.labels}}
+		rule, err := matcher.Match(context.Background(), pod)
+		if err != nil {
+			t.Fatalf("Match() error = %v", err)
+		}
+		got := ""
+		if rule != nil {
+			got = rule.Name
+		}
+		if got != tt.want {
+			t.Errorf("Match(%s %v) = %q, want %q", tt.namespace, tt.labels, got, tt.want)
+		}
+	}
+}
+
+// TestMatch_LoadError tests that a failed first read is an error while a
+// failed re-read keeps the previous rules
+func TestMatch_LoadError(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "rules", Namespace: "system"},
+		Data:       map[string]string{DataKey: `[{name: grafana, podSelector: {matchLabels: {app: grafana}}}]`},
+	}
+	client := fake.NewSimpleClientset(cm)
+	failing := true
+	client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+	matcher := NewConfigMapMatcher(client, "system", "rules", 0)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "x", Labels: map[string]string{"app": "grafana"}}}
+
+	if _, err := matcher.Match(context.Background(), pod); err == nil {
+		t.Fatal("Match() before the rules were read: want error")
+	}
+	failing = false
+	if rule, err := matcher.Match(context.Background(), pod); err != nil || rule == nil {
+		t.Fatalf("Match() = %v, %v, want grafana", rule, err)
+	}
+	failing = true
+	if rule, err := matcher.Match(context.Background(), pod); err != nil || rule == nil {
+		t.Errorf("Match() after a failed re-read = %v, %v, want the previous rule", rule, err)
+	}
+}
+
+// TestLoad_Concurrent tests that concurrent loads share one ConfigMap read and
+// that namespace lookups aren't blocked while it is in flight
+func TestLoad_Concurrent(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "rules", Namespace: "system"},
+		Data:       map[string]string{DataKey: `[{name: grafana, podSelector: {matchLabels: {app: grafana}}}]`},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "x", Labels: map[string]string{"team": "a"}}}
+	client := fake.NewSimpleClientset(cm, ns)
+
+	var mu sync.Mutex
+	reads := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		reads++
+		first := reads == 1
+		mu.Unlock()
+		if first {
+			close(started)
+		}
+		<-release
+		return false, nil, nil
+	})
+	matcher := NewConfigMapMatcher(client, "system", "rules", time.Minute)
+	// The fake clientset serialises reactors, so only the cached path can run
+	// while the ConfigMap read is blocked; it still takes the matcher's lock
+	if _, err := matcher.namespaceLabels(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 5
+	results := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			rules, err := matcher.load(context.Background())
+			if err == nil && len(rules) != 1 {
+				err = errors.New("rules not loaded")
+			}
+			results <- err
+		}()
+	}
+
+	<-started
+	lookup := make(chan error, 1)
+	go func() {
+		_, err := matcher.namespaceLabels(context.Background(), "x")
+		lookup <- err
+	}()
+	select {
+	case err := <-lookup:
+		if err != nil {
+			t.Fatalf("namespaceLabels() during a rules read: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("namespaceLabels() blocked behind the rules read")
+	}
+	close(release)
+	for i := 0; i < callers; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("load() error = %v", err)
+		}
+	}
+	if reads != 1 {
+		t.Errorf("ConfigMap read %d times, want once", reads)
+	}
+}
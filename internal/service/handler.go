@@ -12,6 +12,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
 )
 
 // Handler handles admission requests for Service resources
@@ -81,18 +83,24 @@ func (h *Handler) handleAdmissionRequest(ctx context.Context, request *admission
 		return allowed(string(request.UID))
 	}
 
+	// Namespace may be unset on CREATE, it comes from the request
+	if svc.Namespace == "" {
+		svc.Namespace = request.Namespace
+	}
+
 	klog.InfoS("processing admission request",
 		"service", svc.Name,
 		"namespace", request.Namespace,
 		"operation", request.Operation,
 	)
 
-	patches, err := h.mutator.Mutate(ctx, svc)
+	review := &mutation.Review{DryRun: request.DryRun != nil && *request.DryRun}
+	patches, err := h.mutator.Mutate(mutation.WithReview(ctx, review), svc)
 	if err != nil {
 		return denied(string(request.UID), err.Error())
 	}
 	if len(patches) == 0 {
-		return allowed(string(request.UID))
+		return withWarnings(allowed(string(request.UID)), review.Warnings)
 	}
 
 	jsonPatches, err := json.Marshal(patches)
@@ -100,7 +108,7 @@ func (h *Handler) handleAdmissionRequest(ctx context.Context, request *admission
 		return denied(string(request.UID), err.Error())
 	}
 
-	return patchResponse(string(request.UID), jsonPatches)
+	return withWarnings(patchResponse(string(request.UID), jsonPatches), review.Warnings)
 
 }
 
@@ -135,6 +143,12 @@ func patchResponse(uid string, patch []byte) *admissionv1.AdmissionResponse {
 	}
 }
 
+// withWarnings attaches warnings to be shown to the API client (e.g. kubectl)
+func withWarnings(resp *admissionv1.AdmissionResponse, warnings []string) *admissionv1.AdmissionResponse {
+	resp.Warnings = warnings
+	return resp
+}
+
 // writeAdmissionReview writes an AdmissionReview response
 // Note: Must write the full AdmissionReview, not just AdmissionResponse
 func writeAdmissionReview(w http.ResponseWriter, review *admissionv1.AdmissionReview) {
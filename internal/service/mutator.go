@@ -7,9 +7,13 @@ import (
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/spacemule/oauth2-proxy-injector/internal/annotation"
+	"github.com/spacemule/oauth2-proxy-injector/internal/config"
 	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
 )
 
@@ -24,9 +28,9 @@ const (
 	KeyRewritePorts = AnnotationPrefix + "rewrite-ports"
 
 	// KeyProxyPort specifies the port oauth2-proxy listens on in the pod
-	// Value: port number (default: "4180")
+	// Value: port number (default: the selected pods' proxy-port, then "4180")
 	// This is what targetPort gets rewritten to
-	KeyProxyPort = AnnotationPrefix + "proxy-port"
+	KeyProxyPort = annotation.KeyProxyPort
 
 	// KeyInjected is set by the webhook after mutation to prevent double-mutation
 	// Value: "true"
@@ -38,7 +42,7 @@ const (
 )
 
 // DefaultProxyPort is the default port oauth2-proxy listens on
-const DefaultProxyPort = 4180
+const DefaultProxyPort = config.DefaultProxyPort
 
 // Mutator defines the contract for Service mutation operations
 type Mutator interface {
@@ -47,7 +51,11 @@ type Mutator interface {
 }
 
 // ServiceMutator implements Mutator for oauth2-proxy port rewriting
-type ServiceMutator struct{}
+type ServiceMutator struct {
+	// client lists the Service's pods to find their proxy-port
+	// Optional - nil always uses DefaultProxyPort unless the Service sets one
+	client kubernetes.Interface
+}
 
 // ServicePatchBuilder builds JSON patches for Service mutations
 // Simpler than the full PatchBuilder since Services only need:
@@ -110,8 +118,9 @@ func escapeJSONPointer(s string) string {
 }
 
 // NewServiceMutator creates a new ServiceMutator
-func NewServiceMutator() *ServiceMutator {
-	return &ServiceMutator{}
+// client may be nil to skip looking up the proxy port on selected pods
+func NewServiceMutator(client kubernetes.Interface) *ServiceMutator {
+	return &ServiceMutator{client: client}
 }
 
 // Mutate inspects Service annotations and rewrites targetPort for specified ports
@@ -120,7 +129,7 @@ func NewServiceMutator() *ServiceMutator {
 //  1. Check if KeyInjected annotation exists - if so, return empty patch (already mutated)
 //  2. Check if KeyRewritePorts annotation exists - if not, return empty patch (not opted in)
 //  3. Parse KeyRewritePorts into a list of port identifiers (names or numbers)
-//  4. Parse KeyProxyPort if set, otherwise use DefaultProxyPort
+//  4. Parse KeyProxyPort if set, otherwise use the selected pods' proxy port
 //  5. For each port in the Service spec:
 //     a. Check if it matches any identifier in the rewrite list
 //     b. If yes:
@@ -140,10 +149,81 @@ func (m *ServiceMutator) Mutate(ctx context.Context, svc *corev1.Service) ([]mut
 	if cfg == nil {
 		return nil, nil
 	}
+	if _, ok := svc.Annotations[KeyProxyPort]; !ok {
+		if cfg.ProxyPort, err = m.podProxyPort(ctx, svc); err != nil {
+			return nil, err
+		}
+	}
 
 	return buildServicePatches(svc, cfg)
 }
 
+// podProxyPort returns the proxy port of the pods the Service selects
+//
+// Injected pods record the port oauth2-proxy listens on, which includes
+// ConfigMap and namespace defaults; pods not injected yet fall back to their
+// proxy-port annotation. Pods usually don't exist yet when their Service is
+// created, in which case DefaultProxyPort is used with a warning. Pods that
+// disagree are an error since a Service has a single targetPort.
+func (m *ServiceMutator) podProxyPort(ctx context.Context, svc *corev1.Service) (int32, error) {
+	if m.client == nil || len(svc.Spec.Selector) == 0 {
+		warnDefaultProxyPort(ctx, svc)
+		return DefaultProxyPort, nil
+	}
+	pods, err := m.client.CoreV1().Pods(svc.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list pods selected by service %s: %w", svc.Name, err)
+	}
+
+	var ret int32
+	var from string
+	for _, pod := range pods.Items {
+		port, ok, err := declaredProxyPort(&pod)
+		if err != nil {
+			return 0, fmt.Errorf("pod %s: %w", pod.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		if ret != 0 && port != ret {
+			return 0, fmt.Errorf("selected pods %s and %s use different proxy ports (%d and %d), set %s on the service", from, pod.Name, ret, port, KeyProxyPort)
+		}
+		ret, from = port, pod.Name
+	}
+	if ret == 0 {
+		warnDefaultProxyPort(ctx, svc)
+		return DefaultProxyPort, nil
+	}
+	return ret, nil
+}
+
+// warnDefaultProxyPort tells the client the targetPort was guessed, since a
+// pod created later with another proxy-port would be unreachable
+func warnDefaultProxyPort(ctx context.Context, svc *corev1.Service) {
+	mutation.ReviewFrom(ctx).AddWarning("service %s: no selected pod declares a proxy port, targeting the default %d; set %s on the service if its pods use another port",
+		svc.Name, DefaultProxyPort, KeyProxyPort)
+}
+
+// declaredProxyPort reads a pod's proxy port from its injected stamp or annotation
+func declaredProxyPort(pod *corev1.Pod) (int32, bool, error) {
+	key := mutation.InjectedProxyPortAnnotation
+	v, ok := pod.Annotations[key]
+	if !ok {
+		key = KeyProxyPort
+		v, ok = pod.Annotations[key]
+	}
+	if !ok {
+		return 0, false, nil
+	}
+	port, err := annotation.ParsePort(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s value: %w", key, err)
+	}
+	return port, true, nil
+}
+
 // ServiceConfig holds parsed annotation values for a Service
 type ServiceConfig struct {
 	// RewritePorts is the list of port names or numbers to rewrite
@@ -163,16 +243,13 @@ func ParseServiceAnnotations(annotations map[string]string) (*ServiceConfig, err
 		RewritePorts: strings.Split(strings.TrimSpace(v), ","),
 	}
 	if p, ok := annotations[KeyProxyPort]; ok {
-		intPort, err := strconv.ParseInt(p, 10, 32)
+		port, err := annotation.ParsePort(p)
 		if err != nil {
-			return nil, err
-		}
-		if intPort < 1 || intPort > 65535 {
-			return nil, fmt.Errorf("%s value: %d not in valid port range", KeyProxyPort, intPort)
+			return nil, fmt.Errorf("invalid %s value: %w", KeyProxyPort, err)
 		}
-		ret.ProxyPort = int32(intPort)
+		ret.ProxyPort = port
 	} else {
-		ret.ProxyPort = 4180
+		ret.ProxyPort = DefaultProxyPort
 	}
 
 	return ret, nil
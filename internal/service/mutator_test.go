@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spacemule/oauth2-proxy-injector/internal/mutation"
+)
+
+func pod(name string, labels, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "apps", Labels: labels, Annotations: annotations}}
+}
+
+// TestMutateProxyPort tests the Service, pod and default proxy port precedence
+func TestMutateProxyPort(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	tests := []struct {
+		name        string
+		pods        []*corev1.Pod
+		svcPort     string
+		want        int32
+		wantWarning bool
+		wantErr     string
+	}{
+		{name: "no pods", want: DefaultProxyPort, wantWarning: true},
+		{
+			name: "injected pod",
+			pods: []*corev1.Pod{pod("a", web, map[string]string{
+				mutation.InjectedProxyPortAnnotation: "4190",
+				KeyProxyPort:                         "4191",
+			})},
+			want: 4190,
+		},
+		{
+			name:    "invalid injected port",
+			pods:    []*corev1.Pod{pod("a", web, map[string]string{mutation.InjectedProxyPortAnnotation: "http"})},
+			wantErr: "invalid " + mutation.InjectedProxyPortAnnotation,
+		},
+		{
+			name: "pending pod annotation",
+			pods: []*corev1.Pod{pod("a", web, map[string]string{KeyProxyPort: "4191"})},
+			want: 4191,
+		},
+		{
+			name:    "service annotation wins",
+			pods:    []*corev1.Pod{pod("a", web, map[string]string{KeyProxyPort: "4191"})},
+			svcPort: "4192",
+			want:    4192,
+		},
+		{
+			name:        "unselected pod",
+			pods:        []*corev1.Pod{pod("a", map[string]string{"app": "db"}, map[string]string{KeyProxyPort: "4191"})},
+			want:        DefaultProxyPort,
+			wantWarning: true,
+		},
+		{
+			name: "pods disagree",
+			pods: []*corev1.Pod{
+				pod("a", web, map[string]string{KeyProxyPort: "4191"}),
+				pod("b", web, map[string]string{KeyProxyPort: "4192"}),
+			},
+			wantErr: "different proxy ports",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			for _, p := range tt.pods {
+				if err := client.Tracker().Add(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "apps", Annotations: map[string]string{KeyRewritePorts: "http"}},
+				Spec: corev1.ServiceSpec{
+					Selector: web,
+					Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+				},
+			}
+			if tt.svcPort != "" {
+				svc.Annotations[KeyProxyPort] = tt.svcPort
+			}
+
+			review := &mutation.Review{}
+			patches, err := NewServiceMutator(client).Mutate(mutation.WithReview(context.Background(), review), svc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Mutate() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			for _, p := range patches {
+				if p.Path == "/spec/ports/0/targetPort" && p.Value != tt.want {
+					t.Errorf("targetPort = %v, want %d", p.Value, tt.want)
+				}
+			}
+			if warned := len(review.Warnings) > 0; warned != tt.wantWarning {
+				t.Errorf("warnings = %v, want warning %v", review.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestSetup tests that the exporter and resource can be created without a collector
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Options{Endpoint: "localhost:4318", Insecure: true, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+}
+
+// TestStartPropagated tests that spans join the trace in the request headers
+func TestStartPropagated(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := Start(Extract(context.Background(), header), "HandleAdmission")
+	_, child := Start(ctx, "ConfigMapLoader.Load")
+	End(child, errors.New("not found"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(spans))
+	}
+	load, handle := spans[0], spans[1]
+	if got := handle.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the propagated one", got)
+	}
+	if handle.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("HandleAdmission parent = %s, want the propagated span", handle.Parent().SpanID())
+	}
+	if load.Parent().SpanID() != handle.SpanContext().SpanID() {
+		t.Error("ConfigMapLoader.Load is not a child of HandleAdmission")
+	}
+	if load.Status().Code != codes.Error || len(load.Events()) != 1 {
+		t.Errorf("ConfigMapLoader.Load status = %v, events = %d, want error recorded", load.Status(), len(load.Events()))
+	}
+}